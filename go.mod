@@ -5,7 +5,9 @@ go 1.24.0
 require (
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
 	github.com/gonutz/framebuffer v1.0.0
+	github.com/klauspost/compress v1.18.0
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/ulikunitz/xz v0.5.17
 	golang.org/x/image v0.34.0
 	golang.org/x/sys v0.39.0
 )
@@ -11,10 +11,14 @@ import (
 	"github.com/rook-computer/keymaker/internal/app/screens"
 	"github.com/rook-computer/keymaker/internal/buttons"
 	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/library"
+	"github.com/rook-computer/keymaker/internal/provision"
 	"github.com/rook-computer/keymaker/internal/render"
 	"github.com/rook-computer/keymaker/internal/state"
 	"github.com/rook-computer/keymaker/internal/system"
 	"github.com/rook-computer/keymaker/internal/web"
+	"github.com/rook-computer/keymaker/internal/wipe"
 )
 
 type App struct {
@@ -28,6 +32,22 @@ type App struct {
 	Debug   bool
 	baseCtx context.Context
 
+	// Images is the on-device image library used by duplication mode.
+	Images *library.Library
+	// History logs the flashes of duplication mode; nil disables logging.
+	History *history.Store
+	// Provision is the cartridge that flashes are provisioned on; nil when
+	// flashes go elsewhere (an image file), which rejects provisioning.
+	Provision provision.Target
+
+	duplicationMu sync.Mutex
+	duplication   *screens.DuplicationScreen
+
+	// provisioning reports the post-flash provisioning of the last flash.
+	provisioning provision.Report
+	// wiping reports the layout step of the last wipe.
+	wiping wipe.Report
+
 	netRefreshCh chan struct{}
 
 	currentScreen render.Screen
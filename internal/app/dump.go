@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/cartridge"
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/partition"
+	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/system"
+)
+
+// OpenDump is used by the web API to read the whole cartridge as a raw image.
+// The cartridge is unmounted and stays busy until the returned reader is
+// closed; closing it mounts the cartridge again if it was mounted before.
+func (app *App) OpenDump(ctx context.Context) (io.ReadCloser, int64, error) {
+	if app.Flash == nil {
+		return nil, 0, errors.New("flasher not configured")
+	}
+	imageReader, ok := app.Flash.(flash.ImageReader)
+	if !ok {
+		return nil, 0, flash.ErrReadUnsupported
+	}
+
+	state.GetCartridgeInfo().SetBusy(true)
+	runner := system.ShellRunner{Logger: app.Logger}
+	wasMounted := state.GetCartridgeInfo().Snapshot().Mounted
+	release := func() {
+		// The dump request may already be gone; remount on the app context.
+		// DetectAndUpdate leaves an unmounted cartridge unmounted, so the
+		// mount it had before the dump is restored first.
+		ctx := app.detachedContext()
+		if wasMounted {
+			if err := system.MountCartridge(ctx, runner); err != nil {
+				app.Logger.Errorf("system", "mount after dump failed: %v", err)
+			}
+		}
+		_ = cartridge.DetectAndUpdate(ctx, runner, app.Logger, cartridge.DetectOptions{
+			ManageBusy: false,
+			Retries:    3,
+			RetryDelay: 1 * time.Second,
+		})
+		state.GetCartridgeInfo().SetBusy(false)
+	}
+
+	// Unmount so the filesystems are consistent on the card while reading.
+	if wasMounted {
+		if err := system.UnmountCartridge(ctx, runner); err != nil {
+			state.GetCartridgeInfo().SetBusy(false)
+			return nil, 0, err
+		}
+		state.GetCartridgeInfo().SetMounted(false)
+	}
+
+	reader, size, err := imageReader.OpenRead(ctx)
+	if err != nil {
+		release()
+		return nil, 0, err
+	}
+	return &dumpReader{ReadCloser: reader, release: release}, size, nil
+}
+
+// OpenHeader is used by the web API to read the partition table for
+// /image/manifest. Only the first partition.HeaderSize bytes are read, which
+// is safe while the cartridge is mounted, so unlike OpenDump it neither
+// unmounts the cartridge nor marks it busy.
+func (app *App) OpenHeader(ctx context.Context) (io.ReadCloser, int64, error) {
+	if app.Flash == nil {
+		return nil, 0, errors.New("flasher not configured")
+	}
+	imageReader, ok := app.Flash.(flash.ImageReader)
+	if !ok {
+		return nil, 0, flash.ErrReadUnsupported
+	}
+	reader, size, err := imageReader.OpenRead(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(reader, partition.HeaderSize), reader}, size, nil
+}
+
+// dumpReader releases the cartridge once the dump is closed.
+type dumpReader struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (dump *dumpReader) Close() error {
+	err := dump.ReadCloser.Close()
+	dump.once.Do(dump.release)
+	return err
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/rook-computer/keymaker/internal/app/screens"
+	"github.com/rook-computer/keymaker/internal/duplication"
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/system"
+	"github.com/rook-computer/keymaker/internal/web"
+)
+
+// StartDuplication is used by the web API to flash the library image imageID
+// onto every cartridge that is inserted until StopDuplication is called.
+// The cartridge currently inserted (if any) is ejected first.
+func (app *App) StartDuplication(_ context.Context, imageID string) error {
+	if app.Images == nil {
+		return errors.New("image library not configured")
+	}
+	if app.Flash == nil {
+		return errors.New("flasher not configured")
+	}
+	image, err := app.Images.Get(imageID)
+	if err != nil {
+		return err
+	}
+	if err := state.GetDuplication().Begin(image.ID, image.Name); err != nil {
+		return err
+	}
+
+	flashImage := func(ctx context.Context, reader io.Reader, opts flash.Options) error {
+		return app.flashImage(ctx, reader, web.FlashRequest{Options: opts})
+	}
+	flashCartridge := duplication.ImageFlash(app.Images, imageID, app.checkFlashOptions, flashImage, app.FlashStatus, app.History)
+	runner := system.ShellRunner{Logger: app.Logger}
+	screen := screens.NewDuplicationScreen(runner, app.Logger, app, flashCartridge, app.FlashStatus)
+
+	app.duplicationMu.Lock()
+	app.duplication = screen
+	app.duplicationMu.Unlock()
+	if err := app.SetScreen(screen); err != nil {
+		state.GetDuplication().End(err.Error())
+		return err
+	}
+	return nil
+}
+
+// StopDuplication is used by the web API to end the running batch. A flash in
+// progress is cancelled; that cartridge is not counted. The app then returns
+// to its regular eject/insert flow.
+func (app *App) StopDuplication(ctx context.Context) error {
+	app.duplicationMu.Lock()
+	screen := app.duplication
+	app.duplication = nil
+	app.duplicationMu.Unlock()
+	if screen == nil || !state.GetDuplication().Snapshot().Active {
+		return state.ErrDuplicationNotRunning
+	}
+
+	_ = screen.Stop()
+	select {
+	case <-screen.Done():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if app.currentScreen == screen {
+		runner := system.ShellRunner{Logger: app.Logger}
+		return app.SetScreen(screens.NewRemoveCartridgeScreen(runner, app.Logger, app))
+	}
+	return nil
+}
+
+// DuplicationReport is used by the web API to report the running (or last)
+// duplication batch.
+func (app *App) DuplicationReport() state.DuplicationSnapshot {
+	return state.GetDuplication().Snapshot()
+}
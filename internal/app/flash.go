@@ -6,56 +6,180 @@ import (
 	"io"
 	"time"
 
+	"github.com/rook-computer/keymaker/internal/app/screens"
 	"github.com/rook-computer/keymaker/internal/cartridge"
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/provision"
 	"github.com/rook-computer/keymaker/internal/state"
 	"github.com/rook-computer/keymaker/internal/system"
+	"github.com/rook-computer/keymaker/internal/web"
 )
 
-// HandleFlash is used by the web API to overwrite the cartridge with a gzipped disk image.
+// HandleFlash is used by the web API to overwrite the cartridge with a (possibly compressed) disk image.
 // It must not buffer the input; it streams into the flashing pipeline.
-func (app *App) HandleFlash(ctx context.Context, reader io.Reader) error {
+func (app *App) HandleFlash(ctx context.Context, reader io.Reader, req web.FlashRequest) error {
+	err := app.flashImage(ctx, reader, req)
+	if errors.Is(err, context.Canceled) && app.Render != nil {
+		if screenErr := app.SetScreen(screens.NewFlashCancelledScreen(app.Logger, app)); screenErr != nil {
+			app.Logger.Errorf("app", "failed to switch to flash cancelled screen: %v", screenErr)
+		}
+	}
+	return err
+}
+
+// flashImage runs a flash, followed by the requested provisioning, and keeps
+// the cartridge and store state in sync, without touching the screen.
+func (app *App) flashImage(ctx context.Context, reader io.Reader, req web.FlashRequest) error {
 	if app.Flash == nil {
 		return errors.New("flasher not configured")
 	}
+	if !req.Provision.Empty() && app.Provision == nil {
+		return provision.ErrNoTarget
+	}
+	// A second run must not take over the state of the one in progress.
+	if err := flash.CheckIdle(app.Flash); err != nil {
+		return err
+	}
 
 	state.GetCartridgeInfo().SetBusy(true)
 	defer state.GetCartridgeInfo().SetBusy(false)
 
-	// Ensure unmounted before dd.
 	runner := system.ShellRunner{Logger: app.Logger}
 	snap := state.GetCartridgeInfo().Snapshot()
-	if snap.Mounted {
-		if err := system.UnmountCartridge(ctx, runner); err != nil {
-			return err
-		}
-		state.GetCartridgeInfo().SetMounted(false)
+	if err := prepareOverwrite(ctx, runner, snap); err != nil {
+		return err
 	}
 
-	// Cartridge content will change; clear cached type/systems.
-	state.GetCartridgeInfo().SetRetroPie(false, nil, nil)
-
 	if app.Store != nil {
 		app.Store.SetPhase(state.FLASHING)
 		app.Store.UpdateFlash(state.FlashInfo{Status: "flashing"})
 	}
 
-	err := app.Flash.Start(ctx, reader)
+	app.provisioning.Reset()
+	app.wiping.Reset()
+	err := app.Flash.Start(ctx, reader, req.Options)
+	cancelled := errors.Is(err, context.Canceled)
+	// A run rejected before writing (e.g. an image too large for the
+	// cartridge) left the previous contents alone.
+	untouched := err != nil && !cancelled && !app.Flash.Status().Touched
 	if err == nil {
+		state.GetCartridgeInfo().SetIncompleteImage(false)
+	}
+	// Provisioning runs before re-detection so the cartridge is mounted with
+	// its final layout and contents.
+	var provisionErr error
+	if err == nil && !req.Provision.Empty() {
+		if app.Store != nil {
+			app.Store.UpdateFlash(app.FlashStatus())
+		}
+		provisionErr = provision.Run(ctx, app.Provision, req.Provision, &app.provisioning)
+	}
+	if untouched {
+		state.GetCartridgeInfo().SetIncompleteImage(snap.IncompleteImage)
+	}
+	if err == nil || cancelled || untouched {
 		// Re-detect cartridge contents after flashing (partitions may take a moment to settle).
-		_ = cartridge.DetectAndUpdate(ctx, runner, app.Logger, cartridge.DetectOptions{
+		// A cancelled flash may still have left a readable partition table behind.
+		detectCtx := ctx
+		if cancelled || untouched {
+			detectCtx = app.detachedContext()
+		}
+		_ = cartridge.DetectAndUpdate(detectCtx, runner, app.Logger, cartridge.DetectOptions{
 			ManageBusy: false,
 			Retries:    6,
 			RetryDelay: 1 * time.Second,
 		})
 	}
 	if app.Store != nil {
-		if err != nil {
+		switch {
+		case cancelled:
+			app.Store.SetPhase(state.CANCELLED)
+			app.Store.UpdateFlash(app.Flash.Status())
+		case err != nil:
+			// Keep the flasher's view (e.g. "verify_failed" with both digests)
+			// when it has one.
+			info := app.Flash.Status()
+			if info.Err == "" {
+				info = state.FlashInfo{Status: "error", Err: err.Error()}
+			}
 			app.Store.SetPhase(state.ERROR)
-			app.Store.UpdateFlash(state.FlashInfo{Status: "error", Err: err.Error()})
-		} else {
+			app.Store.UpdateFlash(info)
+		case provisionErr != nil:
+			// The image is complete; the steps tell what is missing.
+			info := app.FlashStatus()
+			info.Err = provisionErr.Error()
+			app.Store.SetPhase(state.ERROR)
+			app.Store.UpdateFlash(info)
+		default:
 			app.Store.SetPhase(state.DONE)
-			app.Store.UpdateFlash(state.FlashInfo{Status: "done"})
+			app.Store.UpdateFlash(app.FlashStatus())
 		}
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	return provisionErr
+}
+
+// prepareOverwrite unmounts the (busy) cartridge before its contents (all of
+// them, or a partition) are replaced and marks it as holding a partial image
+// until the caller finishes.
+func prepareOverwrite(ctx context.Context, runner system.ShellRunner, snap state.CartridgeInfoSnapshot) error {
+	// Ensure unmounted before dd.
+	if snap.Mounted {
+		if err := system.UnmountCartridge(ctx, runner); err != nil {
+			return err
+		}
+		state.GetCartridgeInfo().SetMounted(false)
+	}
+
+	// Cartridge content will change; clear cached type/systems.
+	state.GetCartridgeInfo().SetRetroPie(false, nil, nil)
+	state.GetCartridgeInfo().SetIncompleteImage(true)
+	return nil
+}
+
+// CancelFlash is used by the web API to abort a running flash.
+// HandleFlash takes care of the resulting state and screen.
+func (app *App) CancelFlash(ctx context.Context) error {
+	_ = ctx
+	if app.Flash == nil {
+		return flash.ErrNotRunning
+	}
+	return app.Flash.Cancel()
+}
+
+// CheckFlash is used by the web API to reject options the configured
+// flasher cannot honour, and provisioning without a target, before a flash
+// starts.
+func (app *App) CheckFlash(req web.FlashRequest) error {
+	if !req.Provision.Empty() && app.Provision == nil {
+		return provision.ErrNoTarget
+	}
+	return app.checkFlashOptions(req.Options)
+}
+
+func (app *App) checkFlashOptions(opts flash.Options) error {
+	if app.Flash == nil {
+		return nil
+	}
+	return flash.CheckOptions(app.Flash, opts)
+}
+
+// detachedContext returns the app lifecycle context for follow-up work that
+// must not be aborted together with the operation that triggered it.
+func (app *App) detachedContext() context.Context {
+	if app.baseCtx != nil {
+		return app.baseCtx
+	}
+	return context.Background()
+}
+
+// FlashStatus is used by the web API to report the progress of the current
+// (or last) flash run, including its provisioning steps.
+func (app *App) FlashStatus() state.FlashInfo {
+	if app.Flash == nil {
+		return state.FlashInfo{Status: "idle"}
+	}
+	return app.wiping.Apply(app.provisioning.Apply(app.Flash.Status()))
 }
@@ -0,0 +1,207 @@
+package screens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/cartridge"
+	"github.com/rook-computer/keymaker/internal/duplication"
+	"github.com/rook-computer/keymaker/internal/render"
+	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/system"
+)
+
+// DuplicationScreen runs the production-line loop (see duplication.Run):
+// eject the cartridge, wait for the next one, flash and verify it, and start
+// over. The batch only ends when the screen is stopped.
+type DuplicationScreen struct {
+	Runner system.Runner
+	Logger Logger
+	App    AppController
+
+	// Flash writes and verifies the batch image onto the inserted cartridge.
+	Flash func(ctx context.Context) error
+	// Progress reports the running flash for the counter display.
+	Progress func() state.FlashInfo
+
+	TimeoutSeconds int
+	RetryDelay     time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.RWMutex
+	message string
+}
+
+func NewDuplicationScreen(runner system.Runner, logger Logger, app AppController, flash func(ctx context.Context) error, progress func() state.FlashInfo) *DuplicationScreen {
+	return &DuplicationScreen{
+		Runner:         runner,
+		Logger:         logger,
+		App:            app,
+		Flash:          flash,
+		Progress:       progress,
+		TimeoutSeconds: 60,
+		RetryDelay:     500 * time.Millisecond,
+		done:           make(chan struct{}),
+		message:        "preparing duplication...",
+	}
+}
+
+func (screen *DuplicationScreen) Start(ctx context.Context) error {
+	if screen.Runner == nil {
+		return errors.New("no system runner configured")
+	}
+	if screen.App == nil {
+		return errors.New("no app controller configured")
+	}
+	if screen.Flash == nil {
+		return errors.New("no flash function configured")
+	}
+
+	screenCtx, cancel := context.WithCancel(ctx)
+	screen.cancel = cancel
+
+	go func() {
+		defer close(screen.done)
+		duplication.Run(screenCtx, duplicationSlot{screen: screen}, screen.Flash, screen.Progress, screen.Logger)
+	}()
+
+	return nil
+}
+
+func (screen *DuplicationScreen) Stop() error {
+	if screen.cancel != nil {
+		screen.cancel()
+	}
+	return nil
+}
+
+// Done is closed once the loop has ended after Stop.
+func (screen *DuplicationScreen) Done() <-chan struct{} { return screen.done }
+
+// duplicationSlot ejects and awaits cartridges through the scripts.
+type duplicationSlot struct {
+	screen *DuplicationScreen
+}
+
+func (slot duplicationSlot) Remove(ctx context.Context) bool {
+	return slot.screen.waitForRemoval(ctx)
+}
+
+func (slot duplicationSlot) Insert(ctx context.Context) bool {
+	slot.screen.setMessage("please insert the next cartridge")
+	if !slot.screen.waitForInsert(ctx) {
+		return false
+	}
+	_ = cartridge.DetectAndUpdate(ctx, slot.screen.Runner, slot.screen.Logger, cartridge.DetectOptions{
+		ManageBusy: true,
+		Retries:    3,
+		RetryDelay: 750 * time.Millisecond,
+	})
+	return true
+}
+
+// waitForRemoval ejects the cartridge (if any) and waits until it is gone.
+func (screen *DuplicationScreen) waitForRemoval(ctx context.Context) bool {
+	present, _ := system.IsCartridgePresent(ctx, screen.Runner)
+	if !present {
+		return ctx.Err() == nil
+	}
+
+	if err := system.LifelineOn(ctx, screen.Runner); err != nil && screen.Logger != nil {
+		screen.Logger.Errorf("system", "lifeline on failed: %v", err)
+	}
+	if err := system.StartEject(ctx, screen.Runner); err != nil && screen.Logger != nil {
+		screen.Logger.Errorf("system", "start eject failed: %v", err)
+	}
+	screen.setMessage("please remove cartridge")
+
+	for {
+		if err := system.WaitForEject(ctx, screen.Runner, screen.TimeoutSeconds); err == nil {
+			state.GetCartridgeInfo().Reset()
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(screen.RetryDelay):
+		}
+	}
+}
+
+// waitForInsert waits until the next cartridge shows up.
+func (screen *DuplicationScreen) waitForInsert(ctx context.Context) bool {
+	for {
+		if err := system.WaitForInsert(ctx, screen.Runner, screen.TimeoutSeconds); err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+}
+
+func (screen *DuplicationScreen) setMessage(message string) {
+	screen.mu.Lock()
+	screen.message = message
+	screen.mu.Unlock()
+}
+
+func (screen *DuplicationScreen) getMessage() string {
+	screen.mu.RLock()
+	defer screen.mu.RUnlock()
+	return screen.message
+}
+
+func (screen *DuplicationScreen) Draw(drawer render.Drawer, currentState state.State) {
+	snapshot := state.GetDuplication().Snapshot()
+
+	lines := []string{
+		"duplicating " + snapshot.ImageName,
+		fmt.Sprintf("cartridges: %d   passed: %d   failed: %d", len(snapshot.Results), snapshot.Passed, snapshot.Failed),
+		"",
+	}
+	if snapshot.Stage == state.DuplicationStageFlashing && screen.Progress != nil {
+		lines = append(lines, flashProgressText(screen.Progress()))
+	} else {
+		lines = append(lines, screen.getMessage())
+	}
+	if count := len(snapshot.Results); count > 0 {
+		last := snapshot.Results[count-1]
+		if last.Passed {
+			lines = append(lines, fmt.Sprintf("#%d passed", last.Number))
+		} else {
+			reason := last.ErrCode
+			if reason == "" {
+				reason = "error"
+			}
+			lines = append(lines, fmt.Sprintf("#%d FAILED (%s)", last.Number, reason))
+		}
+	}
+
+	drawer.FillBackground()
+	drawer.DrawLogoCenteredTop()
+	drawer.DrawTextCentered(strings.Join(lines, "\n"))
+}
+
+// flashProgressText describes the running write or read-back.
+func flashProgressText(info state.FlashInfo) string {
+	if info.Status == "verifying" {
+		if written := info.BytesWritten + info.BytesInPlace; written > 0 {
+			return fmt.Sprintf("verifying %d%%", min(info.BytesVerified*100/written, 100))
+		}
+		return "verifying"
+	}
+	if info.BytesMapped > 0 {
+		return fmt.Sprintf("flashing %d%%", min((info.BytesWritten+info.BytesInPlace)*100/info.BytesMapped, 100))
+	}
+	if info.BytesTotal > 0 {
+		return fmt.Sprintf("flashing %d%%", min(info.BytesRead*100/info.BytesTotal, 100))
+	}
+	return "flashing"
+}
@@ -0,0 +1,67 @@
+package screens
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/render"
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// FlashCancelledScreen tells the user that a flash was aborted and the
+// cartridge now holds an incomplete image. After DisplayDuration it returns
+// to the main screen so the web UI address is visible again.
+type FlashCancelledScreen struct {
+	Logger Logger
+	App    AppController
+
+	DisplayDuration time.Duration
+
+	cancel context.CancelFunc
+}
+
+func NewFlashCancelledScreen(logger Logger, app AppController) *FlashCancelledScreen {
+	return &FlashCancelledScreen{
+		Logger:          logger,
+		App:             app,
+		DisplayDuration: 30 * time.Second,
+	}
+}
+
+func (screen *FlashCancelledScreen) Start(ctx context.Context) error {
+	if screen.App == nil {
+		return errors.New("no app controller configured")
+	}
+
+	screenCtx, cancel := context.WithCancel(ctx)
+	screen.cancel = cancel
+
+	go func() {
+		select {
+		case <-screenCtx.Done():
+			return
+		case <-time.After(screen.DisplayDuration):
+		}
+		if err := screen.App.SetScreen(&MainScreen{}); err != nil {
+			if screen.Logger != nil {
+				screen.Logger.Errorf("app", "failed to switch to main screen: %v", err)
+			}
+			screen.App.Exit(err)
+		}
+	}()
+	return nil
+}
+
+func (screen *FlashCancelledScreen) Stop() error {
+	if screen.cancel != nil {
+		screen.cancel()
+	}
+	return nil
+}
+
+func (screen *FlashCancelledScreen) Draw(drawer render.Drawer, currentState state.State) {
+	drawer.FillBackground()
+	drawer.DrawLogoCenteredTop()
+	drawer.DrawTextCentered("flash cancelled\nthe cartridge image is incomplete\nflash again before using it")
+}
@@ -356,6 +356,11 @@ func (screen *MainScreen) drawCartridge(drawer render.Drawer, rect image.Rectang
 		retropieText = "RetroPie: yes"
 	}
 	drawer.DrawText(retropieText, rect.Min.X, y, bodyStyle)
+	y += drawer.MeasureText(retropieText, bodyStyle).LineHeight + 6
+
+	if snapshot.IncompleteImage && !snapshot.Busy {
+		drawer.DrawText("Image: incomplete", rect.Min.X, y, bodyStyle)
+	}
 }
 
 func buildOpenWiFiQRPayload(ssid string) string {
@@ -0,0 +1,124 @@
+package screens
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/render"
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// WipingScreen shows a running cartridge wipe and then its outcome. After
+// Finish it stays up for DisplayDuration and returns to the main screen.
+type WipingScreen struct {
+	Logger Logger
+	App    AppController
+
+	// Progress reports the running wipe.
+	Progress func() state.FlashInfo
+
+	DisplayDuration time.Duration
+
+	cancel   context.CancelFunc
+	finished chan struct{}
+	once     sync.Once
+
+	mu     sync.RWMutex
+	result string
+}
+
+func NewWipingScreen(logger Logger, app AppController, progress func() state.FlashInfo) *WipingScreen {
+	return &WipingScreen{
+		Logger:          logger,
+		App:             app,
+		Progress:        progress,
+		DisplayDuration: 30 * time.Second,
+		finished:        make(chan struct{}),
+	}
+}
+
+func (screen *WipingScreen) Start(ctx context.Context) error {
+	if screen.App == nil {
+		return errors.New("no app controller configured")
+	}
+
+	screenCtx, cancel := context.WithCancel(ctx)
+	screen.cancel = cancel
+
+	go func() {
+		select {
+		case <-screenCtx.Done():
+			return
+		case <-screen.finished:
+		}
+		select {
+		case <-screenCtx.Done():
+			return
+		case <-time.After(screen.DisplayDuration):
+		}
+		if err := screen.App.SetScreen(&MainScreen{}); err != nil {
+			if screen.Logger != nil {
+				screen.Logger.Errorf("app", "failed to switch to main screen: %v", err)
+			}
+			screen.App.Exit(err)
+		}
+	}()
+	return nil
+}
+
+func (screen *WipingScreen) Stop() error {
+	if screen.cancel != nil {
+		screen.cancel()
+	}
+	return nil
+}
+
+// Finish shows the outcome of the wipe.
+func (screen *WipingScreen) Finish(err error) {
+	result := "cartridge wiped"
+	switch {
+	case errors.Is(err, context.Canceled):
+		result = "wipe cancelled\nthe cartridge is partially erased"
+	case err != nil:
+		reason := "error"
+		var coded interface{ ErrorCode() string }
+		if errors.As(err, &coded) {
+			reason = coded.ErrorCode()
+		}
+		result = fmt.Sprintf("wipe FAILED (%s)", reason)
+	}
+	screen.mu.Lock()
+	screen.result = result
+	screen.mu.Unlock()
+	screen.once.Do(func() { close(screen.finished) })
+}
+
+func (screen *WipingScreen) Draw(drawer render.Drawer, currentState state.State) {
+	screen.mu.RLock()
+	text := screen.result
+	screen.mu.RUnlock()
+	if text == "" {
+		text = "wiping cartridge"
+		if screen.Progress != nil {
+			text += "\n" + wipeProgressText(screen.Progress())
+		}
+	}
+
+	drawer.FillBackground()
+	drawer.DrawLogoCenteredTop()
+	drawer.DrawTextCentered(text)
+}
+
+// wipeProgressText describes the running erase or format.
+func wipeProgressText(info state.FlashInfo) string {
+	if info.Status == "formatting" {
+		return "formatting"
+	}
+	if info.BytesTotal > 0 {
+		return fmt.Sprintf("erasing %d%%", min(info.BytesWritten*100/info.BytesTotal, 100))
+	}
+	return "erasing"
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/app/screens"
+	"github.com/rook-computer/keymaker/internal/cartridge"
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/system"
+	"github.com/rook-computer/keymaker/internal/wipe"
+)
+
+// HandleWipe is used by the web API to blank the cartridge: it is discarded
+// or zero-filled and optionally given a fresh partition table with a single
+// formatted partition. The wiping screen is shown while it runs.
+func (app *App) HandleWipe(ctx context.Context, opts wipe.Options) error {
+	wiper, ok := app.Flash.(flash.Wiper)
+	if !ok {
+		return errors.New("flasher cannot wipe")
+	}
+
+	state.GetCartridgeInfo().SetBusy(true)
+	defer state.GetCartridgeInfo().SetBusy(false)
+
+	runner := system.ShellRunner{Logger: app.Logger}
+	snap := state.GetCartridgeInfo().Snapshot()
+	if err := prepareOverwrite(ctx, runner, snap); err != nil {
+		return err
+	}
+
+	if app.Store != nil {
+		app.Store.SetPhase(state.WIPING)
+		app.Store.UpdateFlash(state.FlashInfo{Status: "wiping"})
+	}
+	var screen *screens.WipingScreen
+	if app.Render != nil {
+		screen = screens.NewWipingScreen(app.Logger, app, app.FlashStatus)
+		if err := app.SetScreen(screen); err != nil {
+			app.Logger.Errorf("app", "failed to switch to wiping screen: %v", err)
+			screen = nil
+		}
+	}
+
+	app.provisioning.Reset()
+	detail, err := wipe.Run(ctx, wiper, wipe.ScriptTarget{Runner: runner}, opts, &app.wiping)
+	cancelled := errors.Is(err, context.Canceled)
+	if err == nil {
+		// A blank card is complete as it is.
+		state.GetCartridgeInfo().SetIncompleteImage(false)
+	}
+	if detail != "" {
+		app.Logger.Infof("app", "wipe: %s", detail)
+	}
+
+	detectCtx := ctx
+	if err != nil {
+		detectCtx = app.detachedContext()
+	}
+	_ = cartridge.DetectAndUpdate(detectCtx, runner, app.Logger, cartridge.DetectOptions{
+		ManageBusy: false,
+		Retries:    6,
+		RetryDelay: 1 * time.Second,
+	})
+
+	if app.Store != nil {
+		switch {
+		case cancelled:
+			app.Store.SetPhase(state.CANCELLED)
+		case err != nil:
+			app.Store.SetPhase(state.ERROR)
+		default:
+			app.Store.SetPhase(state.DONE)
+		}
+		info := app.FlashStatus()
+		if err != nil && info.Err == "" {
+			info = state.FlashInfo{Status: "error", Err: err.Error()}
+		}
+		app.Store.UpdateFlash(info)
+	}
+	if screen != nil {
+		screen.Finish(err)
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+// Package bios knows the BIOS files RetroPie's emulators need and checks a
+// BIOS directory against them: file names, digests and which systems still
+// miss a required file.
+package bios
+
+import (
+	"strings"
+	"time"
+)
+
+// Known is a BIOS file an emulator looks for.
+type Known struct {
+	// Name is the path below the BIOS directory. Emulators look it up with
+	// this exact case.
+	Name    string
+	Systems []string
+	// MD5 lists the digests of the good dumps; empty accepts any content.
+	MD5 []string
+	// Group joins alternatives: one file of a group is enough for its
+	// systems, e.g. one PlayStation BIOS of any region.
+	Group string
+	// Regional files of a group only run the games of their region, so
+	// once one is there the missing others are recommended.
+	Regional bool
+	// Optional files improve compatibility but no system needs them.
+	Optional    bool
+	Description string
+}
+
+// Status is the verdict on a file in the BIOS directory.
+type Status string
+
+const (
+	// StatusOK is a known file with a known good digest.
+	StatusOK Status = "ok"
+	// StatusUnverified is a known file without digests to check against.
+	StatusUnverified Status = "unverified"
+	// StatusBadChecksum is a known name with unknown content: a bad or
+	// wrong dump that the emulator will likely reject.
+	StatusBadChecksum Status = "bad_checksum"
+	// StatusMisnamed is a known BIOS under the wrong name, e.g. in the wrong
+	// case; the emulator will not find it.
+	StatusMisnamed Status = "misnamed"
+	// StatusUnknown is a file the table does not know.
+	StatusUnknown Status = "unknown"
+)
+
+// File describes a file in the BIOS directory.
+type File struct {
+	// Name is the slash-separated path below the BIOS directory.
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	MD5     string    `json:"md5"`
+	Status  Status    `json:"status"`
+	// Expected is the name the file should have when it is misnamed.
+	Expected    string   `json:"expected,omitempty"`
+	Systems     []string `json:"systems,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// Identify sets the status of a file from its name and MD5 digest.
+func (file *File) Identify() {
+	file.Status, file.Expected, file.Systems, file.Description = StatusUnknown, "", nil, ""
+	known, found := Lookup(file.Name)
+	switch {
+	case found && known.Name == file.Name:
+		file.Status = StatusBadChecksum
+		if len(known.MD5) == 0 {
+			file.Status = StatusUnverified
+		} else if known.matches(file.MD5) {
+			file.Status = StatusOK
+		}
+	case found:
+		file.Status, file.Expected = StatusMisnamed, known.Name
+	default:
+		// A good dump under a made-up name, e.g. "PSX BIOS (USA).bin".
+		if known, found = lookupMD5(file.MD5); found {
+			file.Status, file.Expected = StatusMisnamed, known.Name
+		}
+	}
+	if found {
+		file.Systems, file.Description = known.Systems, known.Description
+	}
+}
+
+// Lookup finds the known file of name, ignoring case.
+func Lookup(name string) (Known, bool) {
+	for _, known := range Table {
+		if known.Name == name {
+			return known, true
+		}
+	}
+	for _, known := range Table {
+		if strings.EqualFold(known.Name, name) {
+			return known, true
+		}
+	}
+	return Known{}, false
+}
+
+func lookupMD5(digest string) (Known, bool) {
+	for _, known := range Table {
+		if known.matches(digest) {
+			return known, true
+		}
+	}
+	return Known{}, false
+}
+
+func (known Known) matches(digest string) bool {
+	for _, md5 := range known.MD5 {
+		if strings.EqualFold(md5, digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// Requirement is a need of a system: any one of Files.
+type Requirement struct {
+	Files       []string `json:"files"`
+	Description string   `json:"description"`
+}
+
+// SystemStatus tells whether a system has its BIOS.
+type SystemStatus struct {
+	System string `json:"system"`
+	// OK is set when no required file is missing.
+	OK      bool          `json:"ok"`
+	Missing []Requirement `json:"missing"`
+	// Recommended lists the missing optional files.
+	Recommended []Requirement `json:"recommended"`
+}
+
+// Check reports, for each of systems that needs a BIOS, what is missing
+// from files. Only usable files (ok or unverified) count.
+func Check(files []File, systems []string) []SystemStatus {
+	usable := map[string]bool{}
+	for _, file := range files {
+		if file.Status == StatusOK || file.Status == StatusUnverified {
+			usable[file.Name] = true
+		}
+	}
+
+	statuses := []SystemStatus{}
+	for _, system := range systems {
+		requirements, optional := requirementsOf(system)
+		if len(requirements) == 0 {
+			continue
+		}
+		status := SystemStatus{System: system, OK: true, Missing: []Requirement{}, Recommended: []Requirement{}}
+		for i, requirement := range requirements {
+			if satisfied(requirement, usable) {
+				status.Recommended = append(status.Recommended, missingRegions(requirement, usable)...)
+				continue
+			}
+			if optional[i] {
+				status.Recommended = append(status.Recommended, requirement)
+			} else {
+				status.Missing = append(status.Missing, requirement)
+				status.OK = false
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// requirementsOf groups the known files of system into requirements, in
+// table order. optional tells which requirements are optional.
+func requirementsOf(system string) (requirements []Requirement, optional []bool) {
+	groups := map[string]int{}
+	for _, known := range Table {
+		if !hasSystem(known, system) {
+			continue
+		}
+		if i, ok := groups[known.Group]; ok && known.Group != "" {
+			requirements[i].Files = append(requirements[i].Files, known.Name)
+			optional[i] = optional[i] && known.Optional
+			continue
+		}
+		description := known.Description
+		if known.Group != "" {
+			description = GroupDescriptions[known.Group]
+			groups[known.Group] = len(requirements)
+		}
+		requirements = append(requirements, Requirement{Files: []string{known.Name}, Description: description})
+		optional = append(optional, known.Optional)
+	}
+	return requirements, optional
+}
+
+func hasSystem(known Known, system string) bool {
+	for _, candidate := range known.Systems {
+		if candidate == system {
+			return true
+		}
+	}
+	return false
+}
+
+// missingRegions returns a requirement per missing regional file of a
+// group.
+func missingRegions(requirement Requirement, usable map[string]bool) []Requirement {
+	var missing []Requirement
+	for _, name := range requirement.Files {
+		if known, _ := Lookup(name); known.Regional && !usable[name] {
+			missing = append(missing, Requirement{Files: []string{name}, Description: known.Description})
+		}
+	}
+	return missing
+}
+
+func satisfied(requirement Requirement, usable map[string]bool) bool {
+	for _, name := range requirement.Files {
+		if usable[name] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package bios
+
+// Table lists the BIOS files the RetroPie emulators look for in
+// ~/RetroPie/BIOS, with the digests of the dumps known to work (from the
+// RetroPie and libretro documentation).
+var Table = []Known{
+	// PlayStation: lr-pcsx-rearmed and lr-beetle-psx take any region.
+	{Name: "SCPH1001.BIN", Systems: []string{"psx"}, Group: "psx", MD5: []string{"924e392ed05558ffdb115408c263dccf"}, Description: "PlayStation BIOS (US)"},
+	{Name: "scph5500.bin", Systems: []string{"psx"}, Group: "psx", MD5: []string{"8dd7d5296a650fac7319bce665a6a53c"}, Description: "PlayStation BIOS (JP)"},
+	{Name: "scph5501.bin", Systems: []string{"psx"}, Group: "psx", MD5: []string{"490f666e1afb15b7362b406ed1cea246"}, Description: "PlayStation BIOS (US)"},
+	{Name: "scph5502.bin", Systems: []string{"psx"}, Group: "psx", MD5: []string{"32736f17079d0b2b7024407c39bd3050"}, Description: "PlayStation BIOS (EU)"},
+
+	// Sega CD / Mega CD: lr-genesis-plus-gx and lr-picodrive need the
+	// region of the game; the other regions are recommended.
+	{Name: "bios_CD_U.bin", Systems: []string{"segacd"}, Group: "segacd", Regional: true, MD5: []string{"2efd74e3232ff260e371b99f84024f7f"}, Description: "Sega CD BIOS (US)"},
+	{Name: "bios_CD_E.bin", Systems: []string{"segacd"}, Group: "segacd", Regional: true, MD5: []string{"e66fa1dc5820d254611fdcdba0662372"}, Description: "Mega CD BIOS (EU)"},
+	{Name: "bios_CD_J.bin", Systems: []string{"segacd"}, Group: "segacd", Regional: true, MD5: []string{"278a9397d192149e84e820ac621a8edd"}, Description: "Mega CD BIOS (JP)"},
+	{Name: "saturn_bios.bin", Systems: []string{"saturn"}, MD5: []string{"af5828fdff51384f99b3c4926be27762"}, Description: "Saturn BIOS"},
+	{Name: "dc/dc_boot.bin", Systems: []string{"dreamcast"}, MD5: []string{"e10c53c2f8b90bab96ead2d368858623"}, Description: "Dreamcast boot ROM"},
+	{Name: "dc/dc_flash.bin", Systems: []string{"dreamcast"}, MD5: []string{"0a93f7940c455905bea6e392dfde92a4"}, Description: "Dreamcast flash ROM"},
+
+	// Nintendo.
+	{Name: "gba_bios.bin", Systems: []string{"gba"}, MD5: []string{"a860e8c0b6d573d191e4ec7db1b1e4f6"}, Description: "Game Boy Advance BIOS"},
+	{Name: "gb_bios.bin", Systems: []string{"gb"}, MD5: []string{"32fbbd84168d3482956eb3c5051637f5"}, Optional: true, Description: "Game Boy boot ROM"},
+	{Name: "gbc_bios.bin", Systems: []string{"gbc"}, MD5: []string{"dbfce9db9deaa2567f6a84fde55f9680"}, Optional: true, Description: "Game Boy Color boot ROM"},
+	{Name: "disksys.rom", Systems: []string{"fds"}, MD5: []string{"ca30b50f880eb660a320674ed365ef7a"}, Description: "Famicom Disk System BIOS"},
+	{Name: "bios7.bin", Systems: []string{"nds"}, MD5: []string{"df692a80a5b1bc90728bc3dfc76cd948"}, Optional: true, Description: "Nintendo DS ARM7 BIOS"},
+	{Name: "bios9.bin", Systems: []string{"nds"}, MD5: []string{"a392174eb3e572fed6447e956bde4b25"}, Optional: true, Description: "Nintendo DS ARM9 BIOS"},
+	{Name: "bios.min", Systems: []string{"pokemini"}, MD5: []string{"1e4fb124a3a886865acb574f388c803d"}, Optional: true, Description: "Pokémon Mini BIOS"},
+
+	// Atari.
+	{Name: "lynxboot.img", Systems: []string{"atarilynx"}, MD5: []string{"fcd403db69f54290b51035d82f835e7b"}, Description: "Lynx boot ROM"},
+	{Name: "5200.rom", Systems: []string{"atari5200"}, MD5: []string{"281f20ea4320404ec820fb7ec0693b38"}, Description: "Atari 5200 BIOS"},
+	{Name: "7800 BIOS (U).rom", Systems: []string{"atari7800"}, MD5: []string{"0763f1ffb006ddbe32e52d497ee848ae"}, Optional: true, Description: "Atari 7800 BIOS (US)"},
+	{Name: "ATARIXL.ROM", Systems: []string{"atari800"}, MD5: []string{"06daac977823773a3eea3422fd26a703"}, Description: "Atari XL/XE OS"},
+	{Name: "ATARIBAS.ROM", Systems: []string{"atari800"}, MD5: []string{"0bac0c6a50104045d902df4503a4c30b"}, Optional: true, Description: "Atari BASIC"},
+
+	// Others.
+	{Name: "syscard3.pce", Systems: []string{"pcengine"}, MD5: []string{"38179df8f4ac870017db21ebcbf53114", "0754f903b52e3b3342202bdafb13efa5"}, Optional: true, Description: "PC Engine CD System Card 3, needed by CD games"},
+	{Name: "colecovision.rom", Systems: []string{"coleco"}, MD5: []string{"2c66f5911e5b42b8ebe113403548eee7"}, Description: "ColecoVision BIOS"},
+	{Name: "exec.bin", Systems: []string{"intellivision"}, MD5: []string{"62e761035cb657903761800f4437b8af"}, Description: "Intellivision Executive ROM"},
+	{Name: "grom.bin", Systems: []string{"intellivision"}, MD5: []string{"0cd5946c6473e42e8e4c2137785e427f"}, Description: "Intellivision Graphics ROM"},
+	{Name: "o2rom.bin", Systems: []string{"videopac"}, MD5: []string{"562d5ebf9e030a40d6fabfc2f33139fd"}, Description: "Odyssey 2 / Videopac BIOS"},
+	{Name: "panafz10.bin", Systems: []string{"3do"}, MD5: []string{"51f2f43ae2f3508a14d9f56597e2d3ce"}, Description: "3DO Panasonic FZ-10 BIOS"},
+	// The Neo Geo BIOS set is a zip whose content differs between MAME
+	// versions, so any copy is accepted.
+	{Name: "neogeo.zip", Systems: []string{"neogeo"}, Description: "Neo Geo BIOS set"},
+}
+
+// GroupDescriptions describes the groups of Table.
+var GroupDescriptions = map[string]string{
+	"psx":    "PlayStation BIOS of any region",
+	"segacd": "Sega CD / Mega CD BIOS of any region",
+}
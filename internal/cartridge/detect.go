@@ -61,6 +61,18 @@ func DetectAndUpdate(ctx context.Context, runner system.Runner, logger Logger, o
 
 	cartridgeInfo.SetPresent(true)
 
+	capacity, err := system.CartridgeCapacity(ctx, runner)
+	if err != nil && logger != nil {
+		logger.Errorf("system", "%v", err)
+	}
+	cartridgeInfo.SetCapacity(capacity)
+
+	identity, err := system.CartridgeIdentity(ctx, runner)
+	if err != nil && logger != nil {
+		logger.Errorf("system", "%v", err)
+	}
+	cartridgeInfo.SetIdentity(state.CartridgeIdentity(identity))
+
 	mountedBefore, err := system.IsCartridgeMounted(ctx, runner)
 	if err != nil {
 		if logger != nil {
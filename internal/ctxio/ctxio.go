@@ -0,0 +1,26 @@
+// Package ctxio ties long streams to a context, so a cancelled flash, upload
+// or download stops within one read.
+package ctxio
+
+import (
+	"context"
+	"io"
+)
+
+// Reader fails reads with the context's error once ctx is done.
+type Reader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+// NewReader returns a Reader of reader that stops once ctx is done.
+func NewReader(ctx context.Context, reader io.Reader) *Reader {
+	return &Reader{ctx: ctx, reader: reader}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
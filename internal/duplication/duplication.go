@@ -0,0 +1,116 @@
+// Package duplication runs the production-line mode: every cartridge that is
+// inserted gets the same library image until the batch is stopped. The
+// device and the simulator share the loop and only differ in how a
+// cartridge is ejected and waited for (see Slot).
+package duplication
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/library"
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// Slot is the cartridge slot a batch works on.
+type Slot interface {
+	// Remove ejects the cartridge, if any, and returns once the slot is
+	// empty, or false when ctx ended first.
+	Remove(ctx context.Context) bool
+	// Insert returns once the next cartridge is in and detected, or false
+	// when ctx ended first.
+	Insert(ctx context.Context) bool
+}
+
+type Logger interface {
+	Infof(component string, format string, args ...interface{})
+	Errorf(component string, format string, args ...interface{})
+}
+
+// Run ejects, awaits and flashes cartridges until ctx ends, recording each
+// one in state.GetDuplication(), and ends the batch there. A failed cartridge
+// is recorded and ejected like a good one; one whose flash was cut short by
+// ctx is neither. progress reports the flash status of a cartridge once its
+// flash returned; logger may be nil.
+func Run(ctx context.Context, slot Slot, flashCartridge func(ctx context.Context) error, progress func() state.FlashInfo, logger Logger) {
+	duplication := state.GetDuplication()
+	defer duplication.End("")
+	for ctx.Err() == nil {
+		duplication.SetStage(state.DuplicationStageRemove)
+		if !slot.Remove(ctx) {
+			return
+		}
+		duplication.SetStage(state.DuplicationStageInsert)
+		if !slot.Insert(ctx) {
+			return
+		}
+
+		duplication.SetStage(state.DuplicationStageFlashing)
+		result := state.DuplicationResult{StartedAt: time.Now()}
+		err := flashCartridge(ctx)
+		if ctx.Err() != nil {
+			// Stopped half way; the cartridge is neither good nor bad.
+			return
+		}
+		result.FinishedAt = time.Now()
+		result.Passed = err == nil
+		if progress != nil {
+			info := progress()
+			result.BytesWritten = info.BytesWritten
+			result.ImageSHA256 = info.ImageSHA256
+			result.DeviceSHA256 = info.DeviceSHA256
+		}
+		if err != nil {
+			result.Err = err.Error()
+			var coded interface{ ErrorCode() string }
+			if errors.As(err, &coded) {
+				result.ErrCode = coded.ErrorCode()
+			}
+		}
+		result = duplication.Record(result)
+		if logger != nil {
+			if result.Passed {
+				logger.Infof("app", "duplication: cartridge #%d passed", result.Number)
+			} else {
+				logger.Errorf("app", "duplication: cartridge #%d failed: %s", result.Number, result.Err)
+			}
+		}
+	}
+}
+
+// ImageFlash returns the flash of one cartridge of a batch: the library image
+// imageID is written with flashImage and verified, and the run is logged to
+// log (nil disables logging). The image is reopened per cartridge so every
+// run re-checks the stored digest. The stored bmap is used unless check
+// (optional) rejects it. status reports the finished run.
+func ImageFlash(images *library.Library, imageID string, check func(opts flash.Options) error, flashImage func(ctx context.Context, reader io.Reader, opts flash.Options) error, status func() state.FlashInfo, log *history.Store) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		file, image, err := images.Open(imageID)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = file.Close() }()
+		bmap, err := images.ParsedBmap(imageID)
+		if err != nil {
+			return err
+		}
+		if bmap != nil && check != nil && check(flash.Options{Bmap: bmap}) != nil {
+			bmap = nil
+		}
+		opts := flash.Options{Size: image.Size, ImageSize: image.ImageSize, Verify: true, UploadSHA256: image.SHA256, Bmap: bmap}
+		if bmap != nil {
+			opts.ImageSize = max(opts.ImageSize, bmap.ImageSize)
+		}
+		started := time.Now()
+		cartridge := history.CartridgeOf(state.GetCartridgeInfo().Snapshot())
+		err = flashImage(ctx, file, opts)
+		if log != nil {
+			_ = log.Append(history.Flash(started, image.Name, "duplication", cartridge, status(), err))
+		}
+		return err
+	}
+}
@@ -0,0 +1,271 @@
+// Package fetch downloads remote images as a stream. Transient failures in
+// the middle of a download are resumed with HTTP Range requests, so the
+// consumer sees one uninterrupted body.
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRetries is how often a broken download is resumed before giving up.
+	DefaultRetries = 5
+	// DefaultStallTimeout aborts (and resumes) a connection that delivers no
+	// data for this long.
+	DefaultStallTimeout = 60 * time.Second
+)
+
+// ErrInvalidURL is returned for URLs that are not absolute http(s) URLs.
+var ErrInvalidURL = errors.New("url must be an absolute http or https URL")
+
+// StatusError is returned when the server answers with an unexpected status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string { return "remote server answered " + e.Status }
+
+// NewClient returns a client suitable for long downloads: connection setup
+// and response headers are bounded, the body is not.
+func NewClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	return &http.Client{Transport: transport}
+}
+
+// Reader is a remote file opened with Open.
+type Reader struct {
+	client *http.Client
+	url    string
+
+	// Retries (per interruption) and StallTimeout may be adjusted before
+	// the first Read.
+	Retries      int
+	StallTimeout time.Duration
+
+	// backoff is the wait before the first resume; later attempts wait
+	// multiples of it.
+	backoff time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	body      io.ReadCloser
+	reqCancel context.CancelFunc
+	stall     *time.Timer
+
+	size      int64
+	offset    int64
+	validator string
+	attempts  int
+}
+
+// Open requests rawURL and returns its body once the server answered with
+// 200. Redirects are followed. The reader stays usable after ctx ends only
+// until Close; pass a context that outlives the consumer.
+func Open(ctx context.Context, client *http.Client, rawURL string) (*Reader, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, ErrInvalidURL
+	}
+	if client == nil {
+		client = NewClient()
+	}
+
+	readerCtx, cancel := context.WithCancel(ctx)
+	reader := &Reader{
+		client:       client,
+		url:          parsed.String(),
+		Retries:      DefaultRetries,
+		StallTimeout: DefaultStallTimeout,
+		backoff:      time.Second,
+		ctx:          readerCtx,
+		cancel:       cancel,
+		size:         -1,
+	}
+	resp, err := reader.request(-1)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	reader.size = resp.ContentLength
+	// Only strong validators may guard a resumed range.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		reader.validator = etag
+	} else {
+		reader.validator = resp.Header.Get("Last-Modified")
+	}
+	reader.body = resp.Body
+	return reader, nil
+}
+
+// Size returns the Content-Length of the remote file, -1 if unknown.
+func (reader *Reader) Size() int64 { return reader.size }
+
+func (reader *Reader) Read(buffer []byte) (int, error) {
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+
+	for {
+		if reader.body == nil {
+			return 0, errors.New("read from closed download")
+		}
+		reader.armStall()
+		readCount, err := reader.body.Read(buffer)
+		reader.offset += int64(readCount)
+		if err == io.EOF && reader.size >= 0 && reader.offset < reader.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if readCount > 0 {
+			// Data is flowing again; a later break gets a fresh set of retries.
+			reader.attempts = 0
+		}
+		if err == nil || err == io.EOF || readCount > 0 {
+			// A sticky body error shows up again on the next call.
+			if err != nil && err != io.EOF {
+				err = nil
+			}
+			return readCount, err
+		}
+
+		if ctxErr := reader.ctx.Err(); ctxErr != nil {
+			return 0, ctxErr
+		}
+		if reader.attempts >= reader.Retries {
+			return 0, fmt.Errorf("download interrupted at byte %d: %w", reader.offset, err)
+		}
+		if resumeErr := reader.resume(); resumeErr != nil {
+			return 0, fmt.Errorf("download interrupted at byte %d: %v; resume failed: %w", reader.offset, err, resumeErr)
+		}
+	}
+}
+
+// Close aborts the download. It is safe to call concurrently with Read.
+func (reader *Reader) Close() error {
+	reader.cancel()
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+	return reader.closeBody()
+}
+
+// resume re-requests the rest of the file after a backoff. The caller holds mu.
+func (reader *Reader) resume() error {
+	_ = reader.closeBody()
+	var err error
+	for reader.attempts < reader.Retries {
+		reader.attempts++
+		select {
+		case <-reader.ctx.Done():
+			return reader.ctx.Err()
+		case <-time.After(time.Duration(reader.attempts) * reader.backoff):
+		}
+
+		var resp *http.Response
+		resp, err = reader.request(reader.offset)
+		if err == nil {
+			reader.body = resp.Body
+			return nil
+		}
+		var statusErr *StatusError
+		if (errors.As(err, &statusErr) && statusErr.StatusCode < 500) || reader.ctx.Err() != nil {
+			// The server refused the range; retrying won't change that.
+			return err
+		}
+	}
+	return err
+}
+
+// request sends a GET, for the bytes from offset on when offset >= 0.
+// The caller holds mu (or owns the reader exclusively).
+func (reader *Reader) request(offset int64) (*http.Response, error) {
+	reqCtx, reqCancel := context.WithCancel(reader.ctx)
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, reader.url, nil)
+	if err != nil {
+		reqCancel()
+		return nil, err
+	}
+	if offset >= 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		if reader.validator != "" {
+			req.Header.Set("If-Range", reader.validator)
+		}
+	}
+	resp, err := reader.client.Do(req)
+	if err != nil {
+		reqCancel()
+		return nil, err
+	}
+
+	wantStatus := http.StatusOK
+	if offset >= 0 {
+		wantStatus = http.StatusPartialContent
+	}
+	if resp.StatusCode != wantStatus || (offset >= 0 && !rangeStartsAt(resp.Header.Get("Content-Range"), offset)) {
+		_ = resp.Body.Close()
+		reqCancel()
+		if offset >= 0 && resp.StatusCode == http.StatusOK {
+			return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status + " instead of a partial response; the file changed or the server does not support resuming"}
+		}
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	reader.reqCancel = reqCancel
+	return resp, nil
+}
+
+// armStall (re)starts the watchdog that aborts a connection without progress.
+// The caller holds mu.
+func (reader *Reader) armStall() {
+	if reader.StallTimeout <= 0 {
+		return
+	}
+	if reader.stall == nil {
+		reader.stall = time.AfterFunc(reader.StallTimeout, reader.reqCancel)
+		return
+	}
+	reader.stall.Reset(reader.StallTimeout)
+}
+
+// closeBody releases the current connection. The caller holds mu.
+func (reader *Reader) closeBody() error {
+	if reader.stall != nil {
+		reader.stall.Stop()
+		reader.stall = nil
+	}
+	if reader.body == nil {
+		return nil
+	}
+	err := reader.body.Close()
+	reader.body = nil
+	if reader.reqCancel != nil {
+		reader.reqCancel()
+		reader.reqCancel = nil
+	}
+	return err
+}
+
+// rangeStartsAt checks a "bytes start-end/size" Content-Range header.
+func rangeStartsAt(contentRange string, offset int64) bool {
+	spec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return false
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return false
+	}
+	value, err := strconv.ParseInt(start, 10, 64)
+	return err == nil && value == offset
+}
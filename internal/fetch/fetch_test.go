@@ -0,0 +1,211 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testFile is served by a testServer. With both fields empty the response
+// carries no validator.
+type testFile struct {
+	etag     string
+	modified time.Time
+}
+
+// testServer serves data like a static file server (ranges, If-Range) and
+// can misbehave: the first response is cut after dropAfter bytes, and the
+// requests after it see the file as resumed, answer resumeStatus, or ignore
+// the Range header.
+type testServer struct {
+	data         []byte
+	file         testFile
+	resumed      *testFile
+	dropAfter    int
+	resumeStatus int
+	ignoreRange  bool
+
+	mu       sync.Mutex
+	requests []http.Header
+}
+
+func (server *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	server.requests = append(server.requests, r.Header.Clone())
+	first := len(server.requests) == 1
+	server.mu.Unlock()
+
+	file := server.file
+	if !first {
+		if server.resumeStatus != 0 {
+			w.WriteHeader(server.resumeStatus)
+			return
+		}
+		if server.resumed != nil {
+			file = *server.resumed
+		}
+		if server.ignoreRange {
+			r.Header.Del("Range")
+		}
+	}
+	if file.etag != "" {
+		w.Header().Set("ETag", file.etag)
+	}
+	if first && server.dropAfter > 0 {
+		w = &droppingWriter{ResponseWriter: w, left: server.dropAfter}
+	}
+	http.ServeContent(w, r, "disk.img", file.modified, bytes.NewReader(server.data))
+}
+
+func (server *testServer) headers() []http.Header {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]http.Header(nil), server.requests...)
+}
+
+// droppingWriter sends left bytes of the body and then drops the connection.
+type droppingWriter struct {
+	http.ResponseWriter
+	left int
+}
+
+func (w *droppingWriter) Write(data []byte) (int, error) {
+	if len(data) > w.left {
+		_, _ = w.ResponseWriter.Write(data[:w.left])
+		_ = http.NewResponseController(w.ResponseWriter).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.left -= len(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+// openTest opens the server's file with fast retries.
+func openTest(t *testing.T, server *testServer) *Reader {
+	t.Helper()
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+	reader, err := Open(context.Background(), httpServer.Client(), httpServer.URL+"/disk.img")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { _ = reader.Close() })
+	reader.backoff = time.Millisecond
+	return reader
+}
+
+func TestResumeAfterDroppedConnection(t *testing.T) {
+	const dropAfter = 100 * 1024
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		file    testFile
+		ifRange string
+	}{
+		{name: "etag", file: testFile{etag: `"v1"`}, ifRange: `"v1"`},
+		{name: "last-modified", file: testFile{modified: modified}, ifRange: modified.Format(http.TimeFormat)},
+		{name: "weak etag", file: testFile{etag: `W/"v1"`, modified: modified}, ifRange: modified.Format(http.TimeFormat)},
+		{name: "no validator"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &testServer{data: testData(256 * 1024), file: test.file, dropAfter: dropAfter}
+			reader := openTest(t, server)
+			if reader.Size() != int64(len(server.data)) {
+				t.Errorf("Size() = %d, want %d", reader.Size(), len(server.data))
+			}
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("ReadAll: %v", err)
+			}
+			if !bytes.Equal(got, server.data) {
+				t.Fatalf("read %d bytes that differ from the %d served", len(got), len(server.data))
+			}
+
+			headers := server.headers()
+			if len(headers) != 2 {
+				t.Fatalf("%d requests, want the first and one resume", len(headers))
+			}
+			if got := headers[0].Get("Range"); got != "" {
+				t.Errorf("first request has Range %q", got)
+			}
+			if got, want := headers[1].Get("Range"), "bytes=102400-"; got != want {
+				t.Errorf("resume has Range %q, want %q", got, want)
+			}
+			if got := headers[1].Get("If-Range"); got != test.ifRange {
+				t.Errorf("resume has If-Range %q, want %q", got, test.ifRange)
+			}
+		})
+	}
+}
+
+func TestResumeRefused(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		file        testFile
+		resumed     *testFile
+		ignoreRange bool
+	}{
+		{name: "server ignores range", file: testFile{etag: `"v1"`}, ignoreRange: true},
+		{name: "etag changed", file: testFile{etag: `"v1"`}, resumed: &testFile{etag: `"v2"`}},
+		{name: "last-modified changed", file: testFile{modified: modified}, resumed: &testFile{modified: modified.Add(time.Hour)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &testServer{data: testData(256 * 1024), file: test.file, resumed: test.resumed, ignoreRange: test.ignoreRange, dropAfter: 64 * 1024}
+			reader := openTest(t, server)
+			got, err := io.ReadAll(reader)
+			// A 200 to a resume carries the whole file from the start;
+			// splicing it in would corrupt the image, so the download fails
+			// and the flash has to start over.
+			var statusErr *StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusOK {
+				t.Fatalf("ReadAll: %v, want a StatusError for 200", err)
+			}
+			if !bytes.Equal(got, server.data[:len(got)]) {
+				t.Error("the bytes before the failure differ from the file")
+			}
+			if count := len(server.headers()); count != 2 {
+				t.Errorf("%d requests, want no retry after the refused resume", count)
+			}
+		})
+	}
+}
+
+func TestRetryLimit(t *testing.T) {
+	server := &testServer{data: testData(128 * 1024), file: testFile{etag: `"v1"`}, dropAfter: 32 * 1024, resumeStatus: http.StatusServiceUnavailable}
+	reader := openTest(t, server)
+	reader.Retries = 3
+	got, err := io.ReadAll(reader)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("ReadAll: %v, want a StatusError for 503", err)
+	}
+	if len(got) != 32*1024 {
+		t.Errorf("read %d bytes, want the %d sent before the drop", len(got), 32*1024)
+	}
+	if count := len(server.headers()); count != 1+reader.Retries {
+		t.Errorf("%d requests, want the first and %d resumes", count, reader.Retries)
+	}
+}
+
+func TestOpenRejectsBadURLs(t *testing.T) {
+	for _, rawURL := range []string{"ftp://example.com/disk.img", "/disk.img", "http://", "::"} {
+		if _, err := Open(context.Background(), nil, rawURL); !errors.Is(err, ErrInvalidURL) {
+			t.Errorf("Open(%q) = %v, want ErrInvalidURL", rawURL, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package flash
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidBmap is returned for block maps that cannot be parsed or do not
+// describe a consistent image.
+var ErrInvalidBmap = errors.New("invalid bmap")
+
+// Bmap is a block map in the format of bmaptool (versions 1.x and 2.x): the
+// ranges of blocks of an image that hold data. Blocks outside the ranges are
+// free space and need not be written.
+type Bmap struct {
+	ImageSize   int64
+	BlockSize   int64
+	BlocksCount int64
+	// ChecksumType is "sha256" or "sha1", or empty when the ranges carry no
+	// checksums.
+	ChecksumType string
+	Ranges       []BmapRange
+}
+
+// BmapRange is an inclusive range of mapped blocks.
+type BmapRange struct {
+	First    int64
+	Last     int64
+	Checksum string
+}
+
+type bmapXML struct {
+	XMLName           xml.Name `xml:"bmap"`
+	Version           string   `xml:"version,attr"`
+	ImageSize         string   `xml:"ImageSize"`
+	BlockSize         string   `xml:"BlockSize"`
+	BlocksCount       string   `xml:"BlocksCount"`
+	MappedBlocksCount string   `xml:"MappedBlocksCount"`
+	ChecksumType      string   `xml:"ChecksumType"`
+	BmapFileChecksum  string   `xml:"BmapFileChecksum"`
+	BmapFileSHA1      string   `xml:"BmapFileSHA1"`
+	Ranges            []struct {
+		Checksum string `xml:"chksum,attr"`
+		SHA1     string `xml:"sha1,attr"`
+		Blocks   string `xml:",chardata"`
+	} `xml:"BlockMap>Range"`
+}
+
+// ParseBmap parses a bmaptool block map. The checksum of the bmap file
+// itself is checked when present.
+func ParseBmap(data []byte) (*Bmap, error) {
+	var raw bmapXML
+	if err := xml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBmap, err)
+	}
+	major, _, _ := strings.Cut(strings.TrimSpace(raw.Version), ".")
+	if major != "1" && major != "2" {
+		return nil, fmt.Errorf("%w: unsupported version %q", ErrInvalidBmap, raw.Version)
+	}
+
+	bmap := &Bmap{ChecksumType: strings.ToLower(strings.TrimSpace(raw.ChecksumType))}
+	var err error
+	if bmap.ImageSize, err = parseBmapNumber("ImageSize", raw.ImageSize); err != nil {
+		return nil, err
+	}
+	if bmap.BlockSize, err = parseBmapNumber("BlockSize", raw.BlockSize); err != nil {
+		return nil, err
+	}
+	if bmap.BlocksCount, err = parseBmapNumber("BlocksCount", raw.BlocksCount); err != nil {
+		return nil, err
+	}
+	if bmap.BlockSize == 0 || (bmap.ImageSize+bmap.BlockSize-1)/bmap.BlockSize != bmap.BlocksCount {
+		return nil, fmt.Errorf("%w: %d blocks of %d bytes do not make an image of %d bytes", ErrInvalidBmap, bmap.BlocksCount, bmap.BlockSize, bmap.ImageSize)
+	}
+	if major == "1" && bmap.ChecksumType == "" {
+		// Version 1 always uses SHA-1 in its "sha1" attributes.
+		bmap.ChecksumType = "sha1"
+	}
+	if bmap.ChecksumType != "" && newBmapHash(bmap.ChecksumType) == nil {
+		return nil, fmt.Errorf("%w: unsupported checksum type %q", ErrInvalidBmap, bmap.ChecksumType)
+	}
+
+	fileChecksum := strings.TrimSpace(raw.BmapFileChecksum)
+	if fileChecksum == "" {
+		fileChecksum = strings.TrimSpace(raw.BmapFileSHA1)
+	}
+	if fileChecksum != "" {
+		if err := checkBmapFileChecksum(data, fileChecksum, bmap.ChecksumType); err != nil {
+			return nil, err
+		}
+	}
+
+	next := int64(0)
+	for _, entry := range raw.Ranges {
+		var mapped BmapRange
+		first, last, isRange := strings.Cut(strings.TrimSpace(entry.Blocks), "-")
+		if mapped.First, err = parseBmapNumber("Range", first); err != nil {
+			return nil, err
+		}
+		mapped.Last = mapped.First
+		if isRange {
+			if mapped.Last, err = parseBmapNumber("Range", last); err != nil {
+				return nil, err
+			}
+		}
+		if mapped.First < next || mapped.Last < mapped.First || mapped.Last >= bmap.BlocksCount {
+			return nil, fmt.Errorf("%w: range %s is out of order or beyond the image", ErrInvalidBmap, strings.TrimSpace(entry.Blocks))
+		}
+		mapped.Checksum = strings.ToLower(strings.TrimSpace(entry.Checksum))
+		if mapped.Checksum == "" {
+			mapped.Checksum = strings.ToLower(strings.TrimSpace(entry.SHA1))
+		}
+		bmap.Ranges = append(bmap.Ranges, mapped)
+		next = mapped.Last + 1
+	}
+	return bmap, nil
+}
+
+// MappedBytes returns the number of image bytes covered by the ranges.
+func (bmap *Bmap) MappedBytes() int64 {
+	var total int64
+	for _, mapped := range bmap.Ranges {
+		start, end := bmap.byteRange(mapped)
+		total += end - start
+	}
+	return total
+}
+
+// byteRange returns the image bytes [start, end) covered by mapped; the last
+// block of the image may be partial.
+func (bmap *Bmap) byteRange(mapped BmapRange) (int64, int64) {
+	return mapped.First * bmap.BlockSize, min((mapped.Last+1)*bmap.BlockSize, bmap.ImageSize)
+}
+
+func parseBmapNumber(field, raw string) (int64, error) {
+	value, err := strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%w: %s %q is not a number", ErrInvalidBmap, field, strings.TrimSpace(raw))
+	}
+	return value, nil
+}
+
+// checkBmapFileChecksum verifies the checksum bmaptool stores in the file:
+// the digest of the file with the checksum itself replaced by zeros.
+func checkBmapFileChecksum(data []byte, want, checksumType string) error {
+	digest := newBmapHash(checksumType)
+	if digest == nil {
+		return fmt.Errorf("%w: unsupported checksum type %q", ErrInvalidBmap, checksumType)
+	}
+	zeroed := bytes.Replace(data, []byte(want), bytes.Repeat([]byte("0"), len(want)), 1)
+	digest.Write(zeroed)
+	if got := hex.EncodeToString(digest.Sum(nil)); !strings.EqualFold(got, want) {
+		return fmt.Errorf("%w: bmap file checksum %s does not match %s", ErrInvalidBmap, got, want)
+	}
+	return nil
+}
+
+func newBmapHash(checksumType string) hash.Hash {
+	switch checksumType {
+	case "sha256":
+		return sha256.New()
+	case "sha1":
+		return sha1.New()
+	}
+	return nil
+}
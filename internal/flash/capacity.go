@@ -0,0 +1,124 @@
+package flash
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/rook-computer/keymaker/internal/partition"
+)
+
+// SizeHint derives the decompressed image size from the first bytes of an
+// upload, where the format allows: a raw image is as large as the upload and
+// a zstd frame may declare its content size. It returns 0 when unknown.
+func SizeHint(header []byte, uploadSize int64) int64 {
+	format, err := DetectFormat(header)
+	if err != nil {
+		// Only accepted as a raw partition image (see DetectImageFormat).
+		format = FormatRaw
+	}
+	switch format {
+	case FormatRaw:
+		return uploadSize
+	case FormatZstd:
+		var frame zstd.Header
+		if frame.Decode(header) == nil && frame.HasFCS {
+			return int64(frame.FrameContentSize)
+		}
+	}
+	return 0
+}
+
+// StoredSizeHint is SizeHint for an upload stored in file, of size bytes:
+// a gzip file also tells its size through its ISIZE trailer.
+func StoredSizeHint(file io.ReaderAt, header []byte, size int64) int64 {
+	if format, err := DetectFormat(header); err == nil && format == FormatGzip {
+		if isize, err := gzipISize(file, size); err == nil {
+			return isize
+		}
+	}
+	return SizeHint(header, size)
+}
+
+// gzipISize reads the ISIZE trailer of a stored gzip file: the decompressed
+// size modulo 4 GiB, and therefore a lower bound of the real size.
+func gzipISize(reader io.ReaderAt, size int64) (int64, error) {
+	if size < 18 {
+		return 0, errors.New("gzip file too short")
+	}
+	var trailer [4]byte
+	if _, err := reader.ReadAt(trailer[:], size-4); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint32(trailer[:])), nil
+}
+
+// checkCapacity rejects an image that cannot fit a device (or, with
+// opts.Partition, a partition) of capacity bytes before anything is written.
+// The image size is taken from opts.ImageSize and, for a whole device, from
+// the end of the last partition in the image's partition table.
+// The returned reader yields the whole image (including the peeked header)
+// and fails as soon as more than capacity bytes come out of it.
+// A capacity of 0 means unknown and disables the checks.
+func checkCapacity(image io.Reader, opts Options, capacity int64, device string) (io.Reader, error) {
+	if capacity <= 0 {
+		return image, nil
+	}
+	holder := "the cartridge"
+	if opts.Partition > 0 {
+		holder = fmt.Sprintf("partition %d", opts.Partition)
+	}
+	if opts.ImageSize > capacity {
+		return nil, newError(CodeImageTooLarge, device, fmt.Errorf("the image is %s but %s holds only %s", formatBytes(opts.ImageSize), holder, formatBytes(capacity)))
+	}
+	// A partition image holds a filesystem, whose boot sector may look like
+	// an MBR.
+	if opts.Partition > 0 {
+		return &capacityReader{reader: image, capacity: capacity, device: device, holder: holder}, nil
+	}
+
+	buffered := bufio.NewReaderSize(image, partition.HeaderSize)
+	header, err := buffered.Peek(partition.HeaderSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, newError(CodeReadFailed, device, err)
+	}
+	if table, err := partition.Parse(header); err == nil && table.End() > capacity {
+		return nil, newError(CodeInsufficientStorage, device, fmt.Errorf("the partitions of the image need %s but the cartridge holds only %s", formatBytes(table.End()), formatBytes(capacity)))
+	}
+	return &capacityReader{reader: buffered, capacity: capacity, device: device, holder: holder}, nil
+}
+
+// capacityReader fails once the image grows beyond the device.
+type capacityReader struct {
+	reader   io.Reader
+	capacity int64
+	read     int64
+	device   string
+	// holder names the target in errors, e.g. "the cartridge".
+	holder string
+}
+
+func (r *capacityReader) Read(buffer []byte) (int, error) {
+	readCount, err := r.reader.Read(buffer)
+	r.read += int64(readCount)
+	if r.read > r.capacity {
+		return 0, newError(CodeImageTooLarge, r.device, fmt.Errorf("the image is larger than %s (%s)", r.holder, formatBytes(r.capacity)))
+	}
+	return readCount, err
+}
+
+// formatBytes renders a size the way SD cards are labelled (decimal units).
+func formatBytes(size int64) string {
+	switch {
+	case size >= 1e9:
+		return fmt.Sprintf("%.1f GB", float64(size)/1e9)
+	case size >= 1e6:
+		return fmt.Sprintf("%.1f MB", float64(size)/1e6)
+	default:
+		return fmt.Sprintf("%d bytes", size)
+	}
+}
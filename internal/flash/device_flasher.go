@@ -0,0 +1,218 @@
+package flash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rook-computer/keymaker/internal/partition"
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// DefaultBufferSize is the write size of DeviceFlasher. It is a multiple of
+// every common logical and erase block size.
+const DefaultBufferSize = 4 * 1024 * 1024
+
+// DeviceFlasher writes images to the cartridge without external tools.
+// The image is decompressed in-process and written in large, block-aligned
+// chunks, then fsynced before the run counts as done. With Options.Verify the
+// written range is read back and compared by SHA-256. With Options.Bmap or
+// Options.SkipZeros only the blocks holding data are written; with
+// Options.Differential only the blocks that changed. With Options.Partition
+// the image goes into that partition, found in the target's partition table.
+//
+// Target may be a block device or any regular file, which makes the write
+// path usable against a file-backed fake device.
+type DeviceFlasher struct {
+	// Target is the device or file to write. When empty the cartridge block
+	// device is discovered on every run.
+	Target string
+	// BufferSize is the write chunk size; 0 means DefaultBufferSize.
+	BufferSize int
+
+	runState
+}
+
+func NewDeviceFlasher(target string) *DeviceFlasher {
+	return &DeviceFlasher{Target: target}
+}
+
+func (f *DeviceFlasher) Start(ctx context.Context, reader io.Reader, opts Options) error {
+	runCtx, progress, err := f.begin(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	target := f.Target
+	if target == "" {
+		target, err = FindCartridgeDevice()
+		if err != nil {
+			return f.finish(ctx, state.FlashInfo{}, err)
+		}
+	}
+	info := state.FlashInfo{Device: target, Partition: opts.Partition}
+	if err := checkTarget(target, opts.Partition); err != nil {
+		return f.finish(ctx, info, err)
+	}
+	var part partition.Partition
+	if opts.Partition > 0 {
+		if part, err = findPartition(target, opts.Partition); err != nil {
+			return f.finish(ctx, info, err)
+		}
+	}
+
+	uploaded := newStreamHash()
+	input := uploaded.Expect(progress.CountInput(reader), opts.UploadSHA256, "upload")
+	image, format, err := openImage(input, opts.Partition)
+	if err != nil {
+		return f.finish(ctx, info, err)
+	}
+	defer func() { _ = image.Close() }()
+	info.Format = string(format)
+	// A missing target (a fake device about to be created) has no capacity.
+	capacity, _ := DeviceCapacity(target)
+	if opts.Partition > 0 {
+		capacity = part.Size
+	}
+	source, err := checkCapacity(image, opts, capacity, target)
+	if err != nil {
+		return f.finish(ctx, info, err)
+	}
+	info.Status = "running"
+	f.update(info)
+
+	// No O_TRUNC: a block device cannot be truncated, and a fake device file
+	// keeps its size like a real card would.
+	mode := os.O_WRONLY
+	if opts.Differential {
+		mode = os.O_RDWR
+	}
+	device, err := os.OpenFile(target, mode|os.O_CREATE, 0o644)
+	if err != nil {
+		return f.finish(ctx, info, newError(CodeOpenFailed, target, err))
+	}
+	output := &offsetFile{File: device, start: part.Start}
+	var sparse *sparseWriter
+	if opts.Bmap != nil || opts.SkipZeros || opts.Differential {
+		sparse = newSparseWriter(output, opts, progress)
+		if opts.Bmap != nil {
+			progress.SetWriteTotal(opts.Bmap.MappedBytes())
+		}
+	}
+	written := newStreamHash()
+	err = f.copy(runCtx, output, written.Expect(source, opts.ImageSHA256, "image"), sparse, progress)
+	if err == nil && sparse != nil {
+		err = sparse.finish()
+	}
+	if err == nil {
+		err = drainUpload(runCtx, input)
+	}
+	if err == nil {
+		if syncErr := device.Sync(); syncErr != nil {
+			err = newError(CodeWriteFailed, target, fmt.Errorf("sync: %w", syncErr))
+		}
+	}
+	if closeErr := device.Close(); err == nil && closeErr != nil {
+		err = newError(CodeWriteFailed, target, closeErr)
+	}
+	progress.WriteDone()
+	if err != nil {
+		return f.finish(ctx, info, err)
+	}
+
+	info.ImageSHA256 = written.Sum()
+	if opts.Verify {
+		info.Status = "verifying"
+		f.update(info)
+		spans := []span{{start: 0, end: written.Size()}}
+		if sparse != nil {
+			spans, written = sparse.spans, sparse.written
+		}
+		info.DeviceSHA256, err = f.verify(runCtx, target, part.Start, spans, written, progress)
+	}
+	return f.finish(ctx, info, err)
+}
+
+// verify re-reads the written spans (image offsets, the image starting start
+// bytes into target), bypassing the page cache where the platform allows it,
+// and compares them with the bytes that were written.
+func (f *DeviceFlasher) verify(ctx context.Context, target string, start int64, spans []span, written *streamHash, progress *Progress) (string, error) {
+	device, err := os.Open(target)
+	if err != nil {
+		return "", newError(CodeOpenFailed, target, err)
+	}
+	defer func() { _ = device.Close() }()
+	dropCache(device)
+	return verifyReadback(ctx, spanReader(&offsetFile{File: device, start: start}, spans), target, written.Size(), written.Sum(), progress)
+}
+
+// OpenRead opens the target for reading.
+func (f *DeviceFlasher) OpenRead(ctx context.Context) (io.ReadCloser, int64, error) {
+	_ = ctx
+	if err := f.CheckIdle(); err != nil {
+		return nil, 0, err
+	}
+	target := f.Target
+	if target == "" {
+		var err error
+		if target, err = FindCartridgeDevice(); err != nil {
+			return nil, 0, err
+		}
+	}
+	size, err := DeviceCapacity(target)
+	if err != nil {
+		return nil, 0, err
+	}
+	device, err := os.Open(target)
+	if err != nil {
+		return nil, 0, newError(CodeOpenFailed, target, err)
+	}
+	return device, size, nil
+}
+
+// copy writes image to device in full buffers; only the final chunk may be
+// shorter. With a sparse writer the buffers are handed to it instead. The
+// context is checked between chunks so Cancel takes effect within one buffer.
+func (f *DeviceFlasher) copy(ctx context.Context, device deviceFile, image io.Reader, sparse *sparseWriter, progress *Progress) error {
+	size := f.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	buffer := make([]byte, size)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		readCount, readErr := io.ReadFull(image, buffer)
+		// A failed read (e.g. a digest mismatch at the end of the image)
+		// discards the chunk instead of writing it.
+		switch {
+		case readErr == nil, errors.Is(readErr, io.EOF), errors.Is(readErr, io.ErrUnexpectedEOF):
+		default:
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			var flashErr *Error
+			if errors.As(readErr, &flashErr) {
+				return readErr
+			}
+			return newError(CodeReadFailed, device.Name(), readErr)
+		}
+		if readCount > 0 && sparse != nil {
+			if err := sparse.write(buffer[:readCount]); err != nil {
+				return err
+			}
+		} else if readCount > 0 {
+			progress.touch()
+			if _, err := device.Write(buffer[:readCount]); err != nil {
+				return newError(CodeWriteFailed, device.Name(), err)
+			}
+			progress.addWritten(int64(readCount))
+		}
+		if readErr != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package flash
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ulikunitz/xz"
+)
+
+// rawImage returns a disk image of size bytes with random contents and an
+// MBR boot signature but no partitions, so it is sniffed as raw.
+func rawImage(t *testing.T, size int) []byte {
+	t.Helper()
+	image := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(image)
+	clear(image[446:510])
+	image[510], image[511] = 0x55, 0xaa
+	return image
+}
+
+func compress(t *testing.T, format Format, image []byte) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	switch format {
+	case FormatRaw:
+		return image
+	case FormatGzip:
+		writer := gzip.NewWriter(&buffer)
+		_, _ = writer.Write(image)
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case FormatXZ:
+		writer, err := xz.NewWriter(&buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = writer.Write(image)
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case FormatZip:
+		archive := zip.NewWriter(&buffer)
+		entry, err := archive.Create("disk.img")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = entry.Write(image)
+		if err := archive.Close(); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("cannot compress %s", format)
+	}
+	return buffer.Bytes()
+}
+
+func flashCode(err error) ErrorCode {
+	var flashErr *Error
+	if errors.As(err, &flashErr) {
+		return flashErr.Code
+	}
+	return ""
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDeviceFlasherFormats(t *testing.T) {
+	image := rawImage(t, 256*1024)
+	for _, format := range []Format{FormatRaw, FormatGzip, FormatXZ, FormatZip} {
+		t.Run(string(format), func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "card.img")
+			flasher := &DeviceFlasher{Target: target, BufferSize: 64 * 1024}
+			err := flasher.Start(context.Background(), bytes.NewReader(compress(t, format, image)), Options{Verify: true})
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			written, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written, image) {
+				t.Fatal("the target does not hold the image")
+			}
+			status := flasher.Status()
+			if status.Status != "done" || status.Format != string(format) {
+				t.Errorf("status %q format %q, want done %s", status.Status, status.Format, format)
+			}
+			if status.ImageSHA256 != sha256Hex(image) || status.DeviceSHA256 != status.ImageSHA256 {
+				t.Errorf("image sha256 %s device sha256 %s, want %s", status.ImageSHA256, status.DeviceSHA256, sha256Hex(image))
+			}
+		})
+	}
+}
+
+func TestDeviceFlasherRejects(t *testing.T) {
+	image := rawImage(t, 128*1024)
+	tests := []struct {
+		name     string
+		capacity int64
+		input    []byte
+		opts     Options
+		code     ErrorCode
+		// touched tells whether the error is only found while writing.
+		touched bool
+	}{
+		{name: "image larger than the card", capacity: 64 * 1024, input: image, code: CodeImageTooLarge, touched: true},
+		{name: "declared size larger than the card", capacity: 256 * 1024, input: image, opts: Options{ImageSize: 512 * 1024}, code: CodeImageTooLarge},
+		{name: "image digest", capacity: 256 * 1024, input: image, opts: Options{ImageSHA256: sha256Hex([]byte("other"))}, code: CodeChecksumMismatch, touched: true},
+		{name: "upload digest", capacity: 256 * 1024, input: compress(t, FormatGzip, image), opts: Options{UploadSHA256: sha256Hex(image)}, code: CodeChecksumMismatch, touched: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := filepath.Join(t.TempDir(), "card.img")
+			if err := os.WriteFile(target, make([]byte, test.capacity), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			flasher := &DeviceFlasher{Target: target, BufferSize: 16 * 1024}
+			err := flasher.Start(context.Background(), bytes.NewReader(test.input), test.opts)
+			if code := flashCode(err); code != test.code {
+				t.Fatalf("Start: %v, want code %s", err, test.code)
+			}
+			status := flasher.Status()
+			if status.Status != "error" {
+				t.Errorf("status %q, want error", status.Status)
+			}
+			if status.Touched != test.touched {
+				t.Errorf("touched %v, want %v", status.Touched, test.touched)
+			}
+		})
+	}
+}
+
+func TestDeviceFlasherDigestMismatchKeepsTail(t *testing.T) {
+	const chunk = 16 * 1024
+	image := rawImage(t, 2*chunk+chunk/2)
+	target := filepath.Join(t.TempDir(), "card.img")
+	if err := os.WriteFile(target, make([]byte, len(image)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	flasher := &DeviceFlasher{Target: target, BufferSize: chunk}
+	err := flasher.Start(context.Background(), bytes.NewReader(image), Options{ImageSHA256: sha256Hex([]byte("other")), Verify: true})
+	if code := flashCode(err); code != CodeChecksumMismatch {
+		t.Fatalf("Start: %v, want code %s", err, CodeChecksumMismatch)
+	}
+	written, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The mismatch is known when the image ends, before its final chunk.
+	if !bytes.Equal(written[:2*chunk], image[:2*chunk]) {
+		t.Error("the chunks before the end were not written")
+	}
+	if !bytes.Equal(written[2*chunk:], make([]byte, chunk/2)) {
+		t.Error("the final chunk was written despite the mismatch")
+	}
+	if status := flasher.Status(); status.DeviceSHA256 != "" {
+		t.Errorf("the device was read back (sha256 %s) despite the mismatch", status.DeviceSHA256)
+	}
+}
+
+func TestDeviceFlasherRejectsPartitionsBeyondCard(t *testing.T) {
+	image := rawImage(t, 64*1024)
+	// One partition of 1 MiB starting at 1 MiB: the card must hold 2 MiB.
+	entry := image[446:462]
+	entry[4] = 0x83
+	binary.LittleEndian.PutUint32(entry[8:12], 2048)
+	binary.LittleEndian.PutUint32(entry[12:16], 2048)
+
+	target := filepath.Join(t.TempDir(), "card.img")
+	if err := os.WriteFile(target, make([]byte, 1024*1024), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	flasher := NewDeviceFlasher(target)
+	err := flasher.Start(context.Background(), bytes.NewReader(image), Options{})
+	if code := flashCode(err); code != CodeInsufficientStorage {
+		t.Fatalf("Start: %v, want code %s", err, CodeInsufficientStorage)
+	}
+	if flasher.Status().Touched {
+		t.Error("the run reports a write to the card")
+	}
+	written, _ := os.ReadFile(target)
+	if !bytes.Equal(written, make([]byte, len(written))) {
+		t.Error("the card was written to")
+	}
+}
+
+func TestVerifyReadbackMismatch(t *testing.T) {
+	image := rawImage(t, 64*1024)
+	tests := []struct {
+		name     string
+		readback []byte
+	}{
+		{name: "changed byte", readback: append(append([]byte{}, image[:1000]...), append([]byte{image[1000] ^ 0xff}, image[1001:]...)...)},
+		{name: "short device", readback: image[:len(image)-1]},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := verifyReadback(context.Background(), bytes.NewReader(test.readback), "card", int64(len(image)), sha256Hex(image), NewProgress(0))
+			if code := flashCode(err); code != CodeVerifyFailed {
+				t.Fatalf("verifyReadback: %v, want code %s", err, CodeVerifyFailed)
+			}
+		})
+	}
+}
+
+func TestDeviceFlasherCancel(t *testing.T) {
+	const chunk = 16 * 1024
+	image := rawImage(t, 4*chunk)
+	target := filepath.Join(t.TempDir(), "card.img")
+	flasher := &DeviceFlasher{Target: target, BufferSize: chunk}
+
+	reader, writer := io.Pipe()
+	defer func() { _ = reader.Close() }()
+	go func() {
+		// The first chunk is written, then the run is cancelled while it waits
+		// for more input.
+		if _, err := writer.Write(image[:chunk]); err != nil {
+			return
+		}
+		for flasher.Status().BytesWritten < chunk {
+			time.Sleep(time.Millisecond)
+		}
+		_ = flasher.Cancel()
+		_, _ = writer.Write(image[chunk:])
+		_ = writer.Close()
+	}()
+
+	err := flasher.Start(context.Background(), reader, Options{})
+	if !errors.Is(err, ErrCancelled) {
+		t.Fatalf("Start: %v, want ErrCancelled", err)
+	}
+	status := flasher.Status()
+	if status.Status != "cancelled" {
+		t.Errorf("status %q, want cancelled", status.Status)
+	}
+	if status.BytesWritten >= int64(len(image)) {
+		t.Errorf("wrote %d bytes, the whole image, despite the cancel", status.BytesWritten)
+	}
+	if err := flasher.Cancel(); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("Cancel after the run: %v, want ErrNotRunning", err)
+	}
+}
+
+func TestDeviceFlasherPartition(t *testing.T) {
+	const (
+		mib       = 1024 * 1024
+		partStart = 1 * mib
+		partSize  = 1 * mib
+	)
+	// A 3 MiB card with partition 1 in its second MiB.
+	card := bytes.Repeat([]byte{0xa5}, 3*mib)
+	clear(card[446:510])
+	entry := card[446:462]
+	entry[4] = 0x83
+	binary.LittleEndian.PutUint32(entry[8:12], partStart/512)
+	binary.LittleEndian.PutUint32(entry[12:16], partSize/512)
+	card[510], card[511] = 0x55, 0xaa
+	target := filepath.Join(t.TempDir(), "card.img")
+	if err := os.WriteFile(target, card, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("fits", func(t *testing.T) {
+		// A filesystem image need not look like a disk.
+		image := bytes.Repeat([]byte("keymaker"), 256*1024/8)
+		err := NewDeviceFlasher(target).Start(context.Background(), bytes.NewReader(image), Options{Partition: 1, Verify: true})
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		written, err := os.ReadFile(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(written[partStart:partStart+len(image)], image) {
+			t.Error("the partition does not hold the image")
+		}
+		if !bytes.Equal(written[:partStart], card[:partStart]) || !bytes.Equal(written[partStart+len(image):], card[partStart+len(image):]) {
+			t.Error("bytes outside the image were changed")
+		}
+	})
+	t.Run("too large", func(t *testing.T) {
+		image := make([]byte, partSize+512)
+		err := NewDeviceFlasher(target).Start(context.Background(), bytes.NewReader(image), Options{Partition: 1})
+		if code := flashCode(err); code != CodeImageTooLarge {
+			t.Fatalf("Start: %v, want code %s", err, CodeImageTooLarge)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		err := NewDeviceFlasher(target).Start(context.Background(), bytes.NewReader(make([]byte, 512)), Options{Partition: 3})
+		if code := flashCode(err); code != CodeInvalidPartition {
+			t.Fatalf("Start: %v, want code %s", err, CodeInvalidPartition)
+		}
+	})
+}
+
+func TestOffsetFile(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "card.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = file.Close() }()
+	output := &offsetFile{File: file, start: 100}
+	if _, err := output.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := output.Write([]byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := output.WriteAt([]byte("X"), 1); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 6)
+	if _, err := file.ReadAt(got, 100); err != nil || string(got) != "aXcdef" {
+		t.Fatalf("device holds %q (%v), want aXcdef at offset 100", got, err)
+	}
+	if _, err := output.ReadAt(got[:3], 3); err != nil || string(got[:3]) != "def" {
+		t.Fatalf("ReadAt(3) = %q (%v), want def", got[:3], err)
+	}
+}
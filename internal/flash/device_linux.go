@@ -0,0 +1,228 @@
+//go:build linux
+
+package flash
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rook-computer/keymaker/internal/system"
+)
+
+var mmcDiskName = regexp.MustCompile(`^mmcblk[0-9]+$`)
+
+// FindCartridgeDevice returns the first mmc disk that does not hold the root
+// filesystem, mirroring the device selection of flash.sh.
+func FindCartridgeDevice() (string, error) {
+	if name := os.Getenv(system.CartridgeDevEnv); name != "" {
+		return "/dev/" + name, nil
+	}
+	entries, err := os.ReadDir("/sys/block")
+	if err != nil {
+		return "", newError(CodeNoDevice, "", err)
+	}
+	rootDisk, _ := rootDiskName()
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if mmcDiskName.MatchString(entry.Name()) && entry.Name() != rootDisk {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return "", newError(CodeNoDevice, "", errors.New("no cartridge device found"))
+	}
+	sort.Strings(names)
+	return "/dev/" + names[0], nil
+}
+
+// checkTarget refuses targets that must not be overwritten: anything that is
+// neither a block device nor a regular file, the disk holding the root
+// filesystem, and disks with mounted partitions. With index > 0 only that
+// partition is to be written and only it must not be mounted. Missing paths
+// outside /dev are allowed and created as plain files.
+func checkTarget(target string, index int) error {
+	var stat unix.Stat_t
+	if err := unix.Stat(target, &stat); err != nil {
+		if errors.Is(err, unix.ENOENT) && !strings.HasPrefix(target, "/dev/") {
+			return nil
+		}
+		if errors.Is(err, unix.ENOENT) {
+			return newError(CodeNoDevice, target, err)
+		}
+		return newError(CodeOpenFailed, target, err)
+	}
+	switch stat.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		return nil
+	case unix.S_IFBLK:
+	default:
+		return newError(CodeNotBlockDevice, target, errors.New("not a block device or regular file"))
+	}
+
+	disk, err := diskName(unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev)))
+	if err != nil {
+		return newError(CodeOpenFailed, target, err)
+	}
+	if rootDisk, err := rootDiskName(); err == nil && rootDisk == disk {
+		return newError(CodeRootDevice, target, errors.New("target holds the root filesystem"))
+	}
+	if mountPoint, ok := mountedPartition(disk, index); ok {
+		return newError(CodeDeviceMounted, target, fmt.Errorf("partition mounted at %s", mountPoint))
+	}
+	return nil
+}
+
+// DeviceCapacity returns the size of a block device (from sysfs, so no
+// special permissions are needed) or of a regular file.
+func DeviceCapacity(target string) (int64, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(target, &stat); err != nil {
+		return 0, newError(CodeNoDevice, target, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return stat.Size, nil
+	}
+	raw, err := os.ReadFile(fmt.Sprintf("/sys/dev/block/%d:%d/size", unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev))))
+	if err != nil {
+		return 0, newError(CodeOpenFailed, target, err)
+	}
+	sectors, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return 0, newError(CodeOpenFailed, target, err)
+	}
+	// sysfs always counts 512-byte sectors, whatever the logical block size.
+	return sectors * 512, nil
+}
+
+// rootDiskName returns the name of the disk the root filesystem lives on.
+func rootDiskName() (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat("/", &stat); err != nil {
+		return "", err
+	}
+	return diskName(unix.Major(uint64(stat.Dev)), unix.Minor(uint64(stat.Dev)))
+}
+
+// diskName resolves a block device number to the name of its whole disk
+// (mmcblk0p2 -> mmcblk0) through sysfs.
+func diskName(major, minor uint32) (string, error) {
+	sysPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/dev/block/%d:%d", major, minor))
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(sysPath, "partition")); err == nil {
+		sysPath = filepath.Dir(sysPath)
+	}
+	return filepath.Base(sysPath), nil
+}
+
+// mountedPartition reports the first mount point backed by disk or, with
+// index > 0, by that partition of disk.
+func mountedPartition(disk string, index int) (string, bool) {
+	mounts, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", false
+	}
+	defer func() { _ = mounts.Close() }()
+
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		var stat unix.Stat_t
+		if err := unix.Stat(fields[0], &stat); err != nil || stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+			continue
+		}
+		major, minor := unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev))
+		name, err := diskName(major, minor)
+		if err != nil || name != disk {
+			continue
+		}
+		if index > 0 && partitionNumber(major, minor) != index {
+			continue
+		}
+		return fields[1], true
+	}
+	return "", false
+}
+
+// partitionNumber returns the partition number of a block device, or 0 for a
+// whole disk.
+func partitionNumber(major, minor uint32) int {
+	raw, err := os.ReadFile(fmt.Sprintf("/sys/dev/block/%d:%d/partition", major, minor))
+	if err != nil {
+		return 0
+	}
+	number, _ := strconv.Atoi(strings.TrimSpace(string(raw)))
+	return number
+}
+
+// PartitionDevice returns the device node of partition index of the disk
+// device (/dev/mmcblk0, 2 -> /dev/mmcblk0p2) as the kernel knows it.
+func PartitionDevice(device string, index int) (string, error) {
+	disk := filepath.Base(device)
+	entries, err := os.ReadDir(filepath.Join("/sys/block", disk))
+	if err != nil {
+		return "", newError(CodeNoDevice, device, err)
+	}
+	for _, entry := range entries {
+		raw, err := os.ReadFile(filepath.Join("/sys/block", disk, entry.Name(), "partition"))
+		if err != nil {
+			continue
+		}
+		if number, err := strconv.Atoi(strings.TrimSpace(string(raw))); err == nil && number == index {
+			return "/dev/" + entry.Name(), nil
+		}
+	}
+	return "", newError(CodeInvalidPartition, device, fmt.Errorf("the cartridge has no partition %d", index))
+}
+
+// discardRange discards length bytes at offset: with BLKDISCARD on a block
+// device, by punching a hole into a regular file.
+func discardRange(file *os.File, offset, length int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return newError(CodeWriteFailed, file.Name(), err)
+	}
+	if info.Mode().IsRegular() {
+		err = unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	} else {
+		span := [2]uint64{uint64(offset), uint64(length)}
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, file.Fd(), unix.BLKDISCARD, uintptr(unsafe.Pointer(&span[0])))
+		if errno != 0 {
+			err = errno
+		}
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.ENOTTY), errors.Is(err, unix.EINVAL):
+		return newError(CodeDiscardUnsupported, file.Name(), err)
+	default:
+		return newError(CodeWriteFailed, file.Name(), err)
+	}
+}
+
+// dropCache discards cached pages of file so the following reads hit the
+// medium. Failures are ignored; the read then may come from the cache.
+func dropCache(file *os.File) {
+	fd := int(file.Fd())
+	info, err := file.Stat()
+	if err == nil && info.Mode()&os.ModeDevice != 0 {
+		_ = unix.IoctlSetInt(fd, unix.BLKFLSBUF, 0)
+		return
+	}
+	_ = unix.Fadvise(fd, 0, 0, unix.FADV_DONTNEED)
+}
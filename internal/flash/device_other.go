@@ -0,0 +1,52 @@
+//go:build !linux
+
+package flash
+
+import (
+	"errors"
+	"os"
+)
+
+// FindCartridgeDevice is only implemented on Linux; elsewhere DeviceFlasher
+// needs an explicit Target.
+func FindCartridgeDevice() (string, error) {
+	return "", newError(CodeNoDevice, "", errors.New("cartridge discovery is only supported on linux"))
+}
+
+// DeviceCapacity returns the size of a regular file.
+func DeviceCapacity(target string) (int64, error) {
+	info, err := os.Stat(target)
+	if err != nil {
+		return 0, newError(CodeNoDevice, target, err)
+	}
+	return info.Size(), nil
+}
+
+// checkTarget only allows regular files outside Linux.
+func checkTarget(target string, index int) error {
+	_ = index
+	info, err := os.Stat(target)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return newError(CodeOpenFailed, target, err)
+	}
+	if !info.Mode().IsRegular() {
+		return newError(CodeNotBlockDevice, target, errors.New("only regular files can be flashed on this platform"))
+	}
+	return nil
+}
+
+// PartitionDevice is only implemented on Linux.
+func PartitionDevice(device string, index int) (string, error) {
+	return "", newError(CodeNoDevice, device, errors.New("partition discovery is only supported on linux"))
+}
+
+// discardRange is only implemented on Linux.
+func discardRange(file *os.File, offset, length int64) error {
+	return newError(CodeDiscardUnsupported, file.Name(), errors.New("discard is only supported on linux"))
+}
+
+// dropCache is a no-op outside Linux.
+func dropCache(file *os.File) {}
@@ -0,0 +1,69 @@
+package flash
+
+import "fmt"
+
+// ErrorCode classifies flash failures so the API can report them precisely.
+type ErrorCode string
+
+const (
+	// CodeNoDevice: no cartridge block device could be found.
+	CodeNoDevice ErrorCode = "no_device"
+	// CodeNotBlockDevice: the target exists but is not a block device.
+	CodeNotBlockDevice ErrorCode = "not_block_device"
+	// CodeRootDevice: the target is the device the host itself runs from.
+	CodeRootDevice ErrorCode = "root_device"
+	// CodeDeviceMounted: a partition of the target is still mounted.
+	CodeDeviceMounted ErrorCode = "device_mounted"
+	// CodeOpenFailed: the target could not be opened for writing.
+	CodeOpenFailed ErrorCode = "open_failed"
+	// CodeWriteFailed: writing to (or syncing) the target failed.
+	CodeWriteFailed ErrorCode = "write_failed"
+	// CodeReadFailed: reading or decompressing the image, or reading it back
+	// from the target, failed.
+	CodeReadFailed ErrorCode = "read_failed"
+	// CodeVerifyFailed: the data read back from the target differs from the
+	// image that was written.
+	CodeVerifyFailed ErrorCode = "verify_failed"
+	// CodeChecksumMismatch: the upload or the image does not match the
+	// SHA-256 supplied by the client.
+	CodeChecksumMismatch ErrorCode = "checksum_mismatch"
+	// CodeImageTooLarge: the image is larger than the target.
+	CodeImageTooLarge ErrorCode = "image_too_large"
+	// CodeInsufficientStorage: the partition table of the image extends
+	// beyond the end of the target.
+	CodeInsufficientStorage ErrorCode = "insufficient_storage"
+	// CodeDiscardUnsupported: the target cannot discard blocks; wipe it with
+	// zeros instead.
+	CodeDiscardUnsupported ErrorCode = "discard_unsupported"
+	// CodeInvalidPartition: the partition to flash does not exist on the
+	// target or cannot hold an image (an extended partition), or flash.sh
+	// was given a bad mode or partition number.
+	CodeInvalidPartition ErrorCode = "invalid_partition"
+	// CodeUnsupportedOption: the configured flasher cannot honour an option
+	// of the request, e.g. a bmap for ScriptFlasher.
+	CodeUnsupportedOption ErrorCode = "unsupported_option"
+)
+
+// Error is a flash failure with a stable code.
+type Error struct {
+	Code   ErrorCode
+	Device string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Device != "" {
+		return fmt.Sprintf("%s (%s): %v", e.Code, e.Device, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Code, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// ErrorCode returns the code as a plain string for callers that do not know
+// this package (e.g. the job manager).
+func (e *Error) ErrorCode() string { return string(e.Code) }
+
+func newError(code ErrorCode, device string, err error) *Error {
+	return &Error{Code: code, Device: device, Err: err}
+}
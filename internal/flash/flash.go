@@ -2,19 +2,114 @@ package flash
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/rook-computer/keymaker/internal/state"
 )
 
+var (
+	// ErrCancelled is returned by Start when the run was stopped via Cancel.
+	// It matches context.Canceled so callers can treat both the same way.
+	ErrCancelled = fmt.Errorf("flash cancelled: %w", context.Canceled)
+
+	// ErrNotRunning is returned when cancelling while no flash is running.
+	ErrNotRunning = errors.New("no flash running")
+
+	// ErrBusy is returned when a run starts while another one (a flash, a
+	// wipe or a dump) is in progress.
+	ErrBusy = errors.New("flash already running")
+
+	// ErrReadUnsupported is returned when the configured flasher cannot read
+	// the cartridge back (it does not implement ImageReader).
+	ErrReadUnsupported = errors.New("reading the cartridge is not supported")
+)
+
 type Flasher interface {
-	Start(ctx context.Context, reader io.Reader) error
+	Start(ctx context.Context, reader io.Reader, opts Options) error
+	// Cancel stops a running flash; Start then returns ErrCancelled.
 	Cancel() error
 	Status() state.FlashInfo
 }
 
+// ImageReader is implemented by flashers that can also read the cartridge
+// back, e.g. to dump it as an image.
+type ImageReader interface {
+	// OpenRead returns the raw contents of the target and its size in bytes.
+	// It fails while a flash is running.
+	OpenRead(ctx context.Context) (io.ReadCloser, int64, error)
+}
+
+// OptionChecker is implemented by flashers that cannot honour every option.
+// Their Start fails with CodeUnsupportedOption instead of silently writing
+// the whole image.
+type OptionChecker interface {
+	CheckOptions(opts Options) error
+}
+
+// CheckOptions tells whether flasher honours opts, so a caller can reject a
+// request before it starts. Flashers that do not implement OptionChecker
+// honour all options.
+func CheckOptions(flasher Flasher, opts Options) error {
+	if checker, ok := flasher.(OptionChecker); ok {
+		return checker.CheckOptions(opts)
+	}
+	return nil
+}
+
+// IdleChecker is implemented by flashers that run one thing at a time.
+type IdleChecker interface {
+	CheckIdle() error
+}
+
+// CheckIdle fails with ErrBusy while flasher is running, so a caller can
+// back off before it touches any state. Flashers that do not implement
+// IdleChecker are always idle.
+func CheckIdle(flasher Flasher) error {
+	if checker, ok := flasher.(IdleChecker); ok {
+		return checker.CheckIdle()
+	}
+	return nil
+}
+
+// Options describes a single flash run.
+type Options struct {
+	// Size is the number of bytes reader will deliver, or 0 when unknown.
+	// It is only used for progress reporting.
+	Size int64
+	// ImageSize is the decompressed image size when known in advance (see
+	// SizeHint and StoredSizeHint), or 0. Images larger than the target are
+	// rejected before anything is written.
+	ImageSize int64
+	// Verify re-reads the written range from the device after the write and
+	// compares its SHA-256 with the hash of the image that was written.
+	Verify bool
+	// UploadSHA256 and ImageSHA256 are optional hex digests the client expects
+	// for the stream as uploaded and for the decompressed image. They are
+	// compared as soon as their stream ends; a mismatch fails the run with
+	// CodeChecksumMismatch before the rest is written and the device synced.
+	UploadSHA256 string
+	ImageSHA256  string
+	// Bmap limits the write to the ranges it maps; their checksums are
+	// checked as they are written. SkipZeros, without a bmap, skips blocks
+	// that are all zeros. Skipped blocks keep their previous contents, and
+	// verification covers the written ranges only. ScriptFlasher
+	// rejects them (see CheckOptions).
+	Bmap      *Bmap
+	SkipZeros bool
+	// Differential reads every block from the device first and only writes
+	// the ones that differ from the image. ScriptFlasher rejects it.
+	Differential bool
+	// Partition, when > 0, writes the image into that partition (numbered
+	// like the kernel does, e.g. 2 for mmcblk0p2) instead of over the whole
+	// target; the rest of the target keeps its contents. The image must fit
+	// the partition, which must not be mounted.
+	Partition int
+}
+
 type NoopFlasher struct{}
 
-func (NoopFlasher) Start(ctx context.Context, reader io.Reader) error { return nil }
-func (NoopFlasher) Cancel() error                                     { return nil }
-func (NoopFlasher) Status() state.FlashInfo                           { return state.FlashInfo{} }
+func (NoopFlasher) Start(ctx context.Context, reader io.Reader, opts Options) error { return nil }
+func (NoopFlasher) Cancel() error                                                   { return nil }
+func (NoopFlasher) Status() state.FlashInfo                                         { return state.FlashInfo{} }
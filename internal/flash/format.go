@@ -0,0 +1,245 @@
+package flash
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Format is the container/compression format of an incoming image.
+type Format string
+
+const (
+	FormatGzip  Format = "gzip"
+	FormatXZ    Format = "xz"
+	FormatZstd  Format = "zstd"
+	FormatBzip2 Format = "bzip2"
+	FormatZip   Format = "zip"
+	FormatRaw   Format = "raw"
+)
+
+// SniffSize is the number of leading bytes DetectFormat needs to recognize
+// every supported format (a raw image is recognized by its MBR signature).
+const SniffSize = 512
+
+// ErrUnsupportedFormat is returned for streams that are neither a supported
+// compressed image nor a raw disk image.
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte{'B', 'Z', 'h'}
+	zipMagic   = []byte{'P', 'K', 0x03, 0x04}
+)
+
+// DetectFormat identifies the image format from its first bytes.
+// header should hold SniffSize bytes, or the whole stream if it is shorter.
+func DetectFormat(header []byte) (Format, error) {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return FormatGzip, nil
+	case bytes.HasPrefix(header, xzMagic):
+		return FormatXZ, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		return FormatZstd, nil
+	case bytes.HasPrefix(header, bzip2Magic):
+		return FormatBzip2, nil
+	case bytes.HasPrefix(header, zipMagic):
+		return FormatZip, nil
+	case len(header) >= SniffSize && header[510] == 0x55 && header[511] == 0xaa:
+		// MBR boot signature; GPT disks carry it in their protective MBR.
+		return FormatRaw, nil
+	}
+	return "", ErrUnsupportedFormat
+}
+
+// DetectImageFormat is DetectFormat for an image written to partition (0 for
+// the whole device). A partition may hold any filesystem, or none, so there
+// every stream that is not compressed counts as a raw image.
+func DetectImageFormat(header []byte, partition int) (Format, error) {
+	format, err := DetectFormat(header)
+	if err != nil && partition > 0 {
+		return FormatRaw, nil
+	}
+	return format, err
+}
+
+// OpenImage sniffs the format of reader and returns a reader yielding the raw
+// disk image. Nothing beyond the sniffed header is consumed before the caller
+// starts reading, so an unsupported stream is rejected before any write.
+func OpenImage(reader io.Reader) (io.ReadCloser, Format, error) {
+	return openImage(reader, 0)
+}
+
+// openImage is OpenImage for an image written to partition (see
+// DetectImageFormat).
+func openImage(reader io.Reader, partition int) (io.ReadCloser, Format, error) {
+	buffered := bufio.NewReaderSize(reader, 64*1024)
+	header, err := buffered.Peek(SniffSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, "", err
+	}
+	format, err := DetectImageFormat(header, partition)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch format {
+	case FormatGzip:
+		image, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, format, fmt.Errorf("invalid gzip image: %w", err)
+		}
+		return image, format, nil
+	case FormatXZ:
+		image, err := xz.NewReader(buffered)
+		if err != nil {
+			return nil, format, fmt.Errorf("invalid xz image: %w", err)
+		}
+		return io.NopCloser(image), format, nil
+	case FormatZstd:
+		image, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, format, fmt.Errorf("invalid zstd image: %w", err)
+		}
+		return image.IOReadCloser(), format, nil
+	case FormatBzip2:
+		return io.NopCloser(bzip2.NewReader(buffered)), format, nil
+	case FormatZip:
+		image, err := openZipEntry(buffered)
+		if err != nil {
+			return nil, format, fmt.Errorf("invalid zip image: %w", err)
+		}
+		return image, format, nil
+	default:
+		return io.NopCloser(buffered), format, nil
+	}
+}
+
+const (
+	zipLocalHeaderSignature    = 0x04034b50
+	zipDataDescriptorSignature = 0x08074b50
+	zipFlagDataDescriptor      = 0x0008
+	zipMethodStore             = 0
+	zipMethodDeflate           = 8
+)
+
+// zipEntryReader streams the single file of a zip archive without the random
+// access archive/zip needs. Directory entries before the file are skipped;
+// a second file entry is reported as an error once the first one ended.
+type zipEntryReader struct {
+	source *bufio.Reader
+	data   io.Reader
+	closer io.Closer
+	flags  uint16
+	done   bool
+}
+
+func openZipEntry(source *bufio.Reader) (io.ReadCloser, error) {
+	for {
+		header, name, err := readZipLocalHeader(source)
+		if err != nil {
+			return nil, err
+		}
+		flags := binary.LittleEndian.Uint16(header[6:8])
+		method := binary.LittleEndian.Uint16(header[8:10])
+		compressedSize := int64(binary.LittleEndian.Uint32(header[18:22]))
+
+		isDirectory := len(name) > 0 && name[len(name)-1] == '/'
+		if isDirectory && compressedSize == 0 && flags&zipFlagDataDescriptor == 0 {
+			continue
+		}
+
+		entry := &zipEntryReader{source: source, flags: flags}
+		switch method {
+		case zipMethodStore:
+			if flags&zipFlagDataDescriptor != 0 || compressedSize == 0xffffffff {
+				return nil, errors.New("stored zip entries need a known size")
+			}
+			entry.data = io.LimitReader(source, compressedSize)
+		case zipMethodDeflate:
+			// flate reads byte-by-byte from an io.ByteReader, so it never
+			// consumes data past the end of the entry.
+			inflater := flate.NewReader(source)
+			entry.data = inflater
+			entry.closer = inflater
+		default:
+			return nil, fmt.Errorf("unsupported zip compression method %d", method)
+		}
+		return entry, nil
+	}
+}
+
+func readZipLocalHeader(source *bufio.Reader) ([]byte, string, error) {
+	header := make([]byte, 30)
+	if _, err := io.ReadFull(source, header); err != nil {
+		return nil, "", err
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != zipLocalHeaderSignature {
+		return nil, "", errors.New("zip contains no file")
+	}
+	nameLength := int(binary.LittleEndian.Uint16(header[26:28]))
+	extraLength := int(binary.LittleEndian.Uint16(header[28:30]))
+	name := make([]byte, nameLength)
+	if _, err := io.ReadFull(source, name); err != nil {
+		return nil, "", err
+	}
+	if _, err := source.Discard(extraLength); err != nil {
+		return nil, "", err
+	}
+	return header, string(name), nil
+}
+
+func (entry *zipEntryReader) Read(buffer []byte) (int, error) {
+	if entry.done {
+		return 0, io.EOF
+	}
+	readCount, err := entry.data.Read(buffer)
+	if errors.Is(err, io.EOF) {
+		entry.done = true
+		if trailerErr := entry.checkTrailer(); trailerErr != nil {
+			return readCount, trailerErr
+		}
+	}
+	return readCount, err
+}
+
+// checkTrailer skips an optional data descriptor and makes sure the archive
+// does not continue with another file.
+func (entry *zipEntryReader) checkTrailer() error {
+	if entry.flags&zipFlagDataDescriptor != 0 {
+		signature, err := entry.source.Peek(4)
+		if err == nil && binary.LittleEndian.Uint32(signature) == zipDataDescriptorSignature {
+			_, _ = entry.source.Discard(4)
+		}
+		// crc32 + compressed size + uncompressed size. Zip64 descriptors are
+		// 8 bytes longer; in that rare case a following entry goes unnoticed.
+		_, _ = entry.source.Discard(12)
+	}
+	next, err := entry.source.Peek(4)
+	if err != nil {
+		return nil
+	}
+	if binary.LittleEndian.Uint32(next) == zipLocalHeaderSignature {
+		return errors.New("zip contains more than one file")
+	}
+	return nil
+}
+
+func (entry *zipEntryReader) Close() error {
+	if entry.closer != nil {
+		return entry.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package flash
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rook-computer/keymaker/internal/partition"
+)
+
+// deviceFile is what DeviceFlasher writes the image to: the target itself or
+// an offsetFile for a single partition.
+type deviceFile interface {
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	Name() string
+}
+
+// offsetFile shifts every offset by start, so an image written to it lands
+// in the partition starting there.
+type offsetFile struct {
+	*os.File
+	start    int64
+	position int64
+}
+
+func (file *offsetFile) Write(p []byte) (int, error) {
+	written, err := file.File.WriteAt(p, file.start+file.position)
+	file.position += int64(written)
+	return written, err
+}
+
+func (file *offsetFile) WriteAt(p []byte, offset int64) (int, error) {
+	return file.File.WriteAt(p, file.start+offset)
+}
+
+func (file *offsetFile) ReadAt(p []byte, offset int64) (int, error) {
+	return file.File.ReadAt(p, file.start+offset)
+}
+
+// findPartition looks up partition index in the partition table of target.
+// Extended MBR partitions only hold other partitions and are refused.
+func findPartition(target string, index int) (partition.Partition, error) {
+	device, err := os.Open(target)
+	if err != nil {
+		return partition.Partition{}, newError(CodeOpenFailed, target, err)
+	}
+	defer func() { _ = device.Close() }()
+
+	header := make([]byte, partition.HeaderSize)
+	readCount, err := io.ReadFull(device, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return partition.Partition{}, newError(CodeReadFailed, target, err)
+	}
+	table, err := partition.Parse(header[:readCount])
+	if err != nil {
+		return partition.Partition{}, newError(CodeInvalidPartition, target, fmt.Errorf("reading the partition table: %w", err))
+	}
+	for _, found := range table.Partitions {
+		if found.Index != index {
+			continue
+		}
+		if table.Scheme == partition.SchemeMBR && isExtendedType(found.Type) {
+			return partition.Partition{}, newError(CodeInvalidPartition, target, fmt.Errorf("partition %d is an extended partition", index))
+		}
+		return found, nil
+	}
+	return partition.Partition{}, newError(CodeInvalidPartition, target, fmt.Errorf("the cartridge has no partition %d", index))
+}
+
+func isExtendedType(partType string) bool {
+	return partType == "0x05" || partType == "0x0f" || partType == "0x85"
+}
+
+// partitionCapacity checks that partition index of the cartridge device
+// exists and is not mounted, and returns its size. It only needs sysfs, so
+// it works without the privileges of the scripts.
+func partitionCapacity(device string, index int) (int64, error) {
+	if device == "" {
+		return 0, newError(CodeNoDevice, "", errors.New("no cartridge device found"))
+	}
+	if err := checkTarget(device, index); err != nil {
+		return 0, err
+	}
+	partitionDevice, err := PartitionDevice(device, index)
+	if err != nil {
+		return 0, err
+	}
+	return DeviceCapacity(partitionDevice)
+}
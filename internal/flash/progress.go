@@ -0,0 +1,189 @@
+package flash
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// Progress tracks how many bytes a flash run has consumed and written.
+// It is safe for concurrent use; flashers update it from the copy goroutine
+// while the API reads it through Status().
+type Progress struct {
+	mu sync.Mutex
+
+	startedAt     time.Time
+	writtenAt     time.Time
+	finishedAt    time.Time
+	bytesTotal    int64
+	bytesRead     int64
+	bytesWritten  int64
+	bytesVerified int64
+	bytesSkipped  int64
+	bytesInPlace  int64
+	// writeTotal is the number of image bytes that will reach the device
+	// (written or found in place), when known: the mapped bytes of a bmap.
+	writeTotal int64
+	// touched is set before the first write to the device. bytesWritten
+	// counts bytes handed on (e.g. to a script), which may never arrive.
+	touched bool
+}
+
+// NewProgress starts tracking a run that expects bytesTotal input bytes.
+// Pass 0 when the input size is unknown; no ETA is reported in that case.
+func NewProgress(bytesTotal int64) *Progress {
+	return &Progress{startedAt: time.Now(), bytesTotal: bytesTotal}
+}
+
+// CountInput wraps reader so every byte read from it counts as consumed input
+// (typically the compressed upload).
+func (progress *Progress) CountInput(reader io.Reader) io.Reader {
+	return &countingReader{reader: reader, add: progress.addRead}
+}
+
+// CountOutput wraps reader so every byte read from it counts as written output
+// (typically the decompressed image going to the cartridge).
+func (progress *Progress) CountOutput(reader io.Reader) io.Reader {
+	return &countingReader{reader: reader, add: progress.addWritten}
+}
+
+// CountVerified wraps reader so every byte read from it counts as verified
+// (the image read back from the cartridge).
+func (progress *Progress) CountVerified(reader io.Reader) io.Reader {
+	return &countingReader{reader: reader, add: progress.addVerified}
+}
+
+// setInputTotal declares the input size of a run that only learns it after
+// it started (a wipe, whose input is the size of the target).
+func (progress *Progress) setInputTotal(total int64) {
+	progress.mu.Lock()
+	progress.bytesTotal = total
+	progress.mu.Unlock()
+}
+
+// SetWriteTotal declares how many bytes the run will write, so the ETA can
+// follow the writes instead of the consumed input.
+func (progress *Progress) SetWriteTotal(total int64) {
+	progress.mu.Lock()
+	progress.writeTotal = total
+	progress.mu.Unlock()
+}
+
+// WriteDone marks the end of the write phase, so a following read-back does
+// not dilute the reported write rate.
+func (progress *Progress) WriteDone() {
+	progress.mu.Lock()
+	if progress.writtenAt.IsZero() {
+		progress.writtenAt = time.Now()
+	}
+	progress.mu.Unlock()
+}
+
+// Finish freezes the clock so the reported rate stays meaningful after the run ended.
+func (progress *Progress) Finish() {
+	progress.mu.Lock()
+	if progress.finishedAt.IsZero() {
+		progress.finishedAt = time.Now()
+	}
+	progress.mu.Unlock()
+}
+
+// touch records that the device is about to be changed.
+func (progress *Progress) touch() {
+	progress.mu.Lock()
+	progress.touched = true
+	progress.mu.Unlock()
+}
+
+func (progress *Progress) addRead(count int64) {
+	progress.mu.Lock()
+	progress.bytesRead += count
+	progress.mu.Unlock()
+}
+
+func (progress *Progress) addWritten(count int64) {
+	progress.mu.Lock()
+	progress.bytesWritten += count
+	progress.mu.Unlock()
+}
+
+func (progress *Progress) addSkipped(count int64) {
+	progress.mu.Lock()
+	progress.bytesSkipped += count
+	progress.mu.Unlock()
+}
+
+func (progress *Progress) addInPlace(count int64) {
+	progress.mu.Lock()
+	progress.bytesInPlace += count
+	progress.mu.Unlock()
+}
+
+func (progress *Progress) addVerified(count int64) {
+	progress.mu.Lock()
+	progress.bytesVerified += count
+	progress.mu.Unlock()
+}
+
+// Apply copies the current counters, the average write rate and the estimated
+// remaining time into info.
+func (progress *Progress) Apply(info *state.FlashInfo) {
+	progress.mu.Lock()
+	defer progress.mu.Unlock()
+
+	info.BytesTotal = progress.bytesTotal
+	info.BytesRead = progress.bytesRead
+	info.BytesWritten = progress.bytesWritten
+	info.BytesVerified = progress.bytesVerified
+	info.BytesMapped = progress.writeTotal
+	info.BytesSkipped = progress.bytesSkipped
+	info.BytesInPlace = progress.bytesInPlace
+	info.Touched = progress.touched
+	info.WriteRate = 0
+	info.ETASeconds = 0
+
+	end := progress.writtenAt
+	if end.IsZero() {
+		end = progress.finishedAt
+	}
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(progress.startedAt)
+	if elapsed <= 0 {
+		return
+	}
+	info.WriteRate = int64(float64(progress.bytesWritten) / elapsed.Seconds())
+
+	// With a bmap the bytes to write are known and dominate the run time.
+	if progress.writeTotal > 0 {
+		done := progress.bytesWritten + progress.bytesInPlace
+		if done > 0 && done < progress.writeTotal {
+			remaining := float64(progress.writeTotal-done) / float64(done)
+			info.ETASeconds = int64(elapsed.Seconds() * remaining)
+		}
+		return
+	}
+	// Otherwise the input size is the only total we know up front (the
+	// decompressed size is not), so the ETA is extrapolated from the share of
+	// input consumed.
+	if progress.bytesTotal > 0 && progress.bytesRead > 0 && progress.bytesRead < progress.bytesTotal {
+		remaining := float64(progress.bytesTotal-progress.bytesRead) / float64(progress.bytesRead)
+		info.ETASeconds = int64(elapsed.Seconds() * remaining)
+	}
+}
+
+type countingReader struct {
+	reader io.Reader
+	add    func(count int64)
+}
+
+func (counter *countingReader) Read(buffer []byte) (int, error) {
+	readCount, err := counter.reader.Read(buffer)
+	if readCount > 0 {
+		counter.add(int64(readCount))
+	}
+	return readCount, err
+}
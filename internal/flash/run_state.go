@@ -0,0 +1,109 @@
+package flash
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// runState holds the bookkeeping shared by the Flasher implementations:
+// a single run at a time, cancellation, and the status/progress reported
+// through Status().
+type runState struct {
+	mu        sync.Mutex
+	running   bool
+	cancel    context.CancelFunc
+	cancelled bool
+	status    state.FlashInfo
+	progress  *Progress
+}
+
+// begin marks a run as started. The returned context is cancelled by Cancel;
+// the caller must call finish exactly once.
+func (run *runState) begin(ctx context.Context, opts Options) (context.Context, *Progress, error) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.running {
+		return nil, nil, ErrBusy
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	run.running = true
+	run.cancel = cancel
+	run.cancelled = false
+	run.progress = NewProgress(opts.Size)
+	run.status = state.FlashInfo{Status: "starting"}
+	return runCtx, run.progress, nil
+}
+
+// update replaces the status of the running flash; counters come from the progress.
+func (run *runState) update(info state.FlashInfo) {
+	run.mu.Lock()
+	run.status = info
+	run.mu.Unlock()
+}
+
+// finish records the outcome. A failure caused by Cancel (or by ctx ending)
+// is reported as ErrCancelled; otherwise err is returned unchanged.
+func (run *runState) finish(ctx context.Context, info state.FlashInfo, err error) error {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.progress.Finish()
+	if run.cancel != nil {
+		run.cancel()
+	}
+	run.cancel = nil
+	run.running = false
+
+	switch {
+	case err != nil && (run.cancelled || ctx.Err() != nil):
+		info.Status = "cancelled"
+		info.Err = ErrCancelled.Error()
+		err = ErrCancelled
+	case isVerifyFailure(err):
+		info.Status = "verify_failed"
+		info.Err = err.Error()
+	case err != nil:
+		info.Status = "error"
+		info.Err = err.Error()
+	default:
+		info.Status = "done"
+	}
+	run.status = info
+	return err
+}
+
+// CheckIdle fails with ErrBusy while a run is in progress.
+func (run *runState) CheckIdle() error {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if run.running {
+		return ErrBusy
+	}
+	return nil
+}
+
+func (run *runState) Cancel() error {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if !run.running || run.cancel == nil {
+		return ErrNotRunning
+	}
+	run.cancelled = true
+	run.cancel()
+	return nil
+}
+
+func (run *runState) Status() state.FlashInfo {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	status := run.status
+	if status.Status == "" {
+		status.Status = "idle"
+	}
+	if run.progress != nil {
+		run.progress.Apply(&status)
+	}
+	return status
+}
@@ -2,84 +2,268 @@ package flash
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os/exec"
+	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/rook-computer/keymaker/internal/ctxio"
 	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/system"
 )
 
-// ScriptFlasher streams input into `sudo flash.sh`.
-// The script is expected to read a gzipped disk image from stdin and write it to the cartridge device.
+// ScriptFlasher streams input into `sudo flash.sh raw`, or `sudo flash.sh
+// part <n>` for a single partition.
+// The image is decompressed in-process (see OpenImage for the supported
+// formats) so both the consumed input and the bytes handed to the script can
+// be reported as progress; the script only writes the raw image to the
+// cartridge device.
 type ScriptFlasher struct {
-	mu     sync.Mutex
-	cmd    *exec.Cmd
-	status state.FlashInfo
+	runState
 }
 
 func NewScriptFlasher() *ScriptFlasher {
-	return &ScriptFlasher{status: state.FlashInfo{Status: "idle"}}
+	return &ScriptFlasher{}
 }
 
-func (f *ScriptFlasher) Start(ctx context.Context, reader io.Reader) error {
-	f.mu.Lock()
-	if f.cmd != nil {
-		f.mu.Unlock()
-		return fmt.Errorf("flash already running")
+func (f *ScriptFlasher) Start(ctx context.Context, reader io.Reader, opts Options) error {
+	if err := f.CheckOptions(opts); err != nil {
+		return err
+	}
+	runCtx, progress, err := f.begin(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	// The format is sniffed before the script starts, so an unsupported
+	// upload fails here before anything is written to the cartridge.
+	uploaded := newStreamHash()
+	input := uploaded.Expect(progress.CountInput(reader), opts.UploadSHA256, "upload")
+	image, format, err := openImage(input, opts.Partition)
+	if err != nil {
+		return f.finish(ctx, state.FlashInfo{}, err)
 	}
-	f.status = state.FlashInfo{Status: "starting"}
-	cmd := exec.CommandContext(ctx, "sudo", "flash.sh")
-	cmd.Stdin = reader
+	defer func() { _ = image.Close() }()
+	info := state.FlashInfo{Format: string(format), Partition: opts.Partition}
+	// flash.sh picks the same device; without one the script reports it.
+	var capacity int64
+	if device, err := FindCartridgeDevice(); err == nil {
+		info.Device = device
+		capacity, _ = DeviceCapacity(device)
+	}
+	args := []string{"flash.sh", "raw"}
+	if opts.Partition > 0 {
+		if capacity, err = partitionCapacity(info.Device, opts.Partition); err != nil {
+			return f.finish(ctx, info, err)
+		}
+		args = []string{"flash.sh", "part", strconv.Itoa(opts.Partition)}
+	}
+	source, err := checkCapacity(image, opts, capacity, info.Device)
+	if err != nil {
+		return f.finish(ctx, info, err)
+	}
+	info.Status = "running"
+	f.update(info)
+
+	cmd := system.SudoCommand(runCtx, args[0], args[1:]...)
+	// SIGKILL would only hit sudo and leave dd running; sudo relays SIGTERM.
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = 10 * time.Second
+	written := newStreamHash()
+	// Stop feeding the script as soon as the run is cancelled, so dd sees EOF
+	// even if the signal does not reach it.
+	cmd.Stdin = ctxio.NewReader(runCtx, written.Expect(progress.CountOutput(source), opts.ImageSHA256, "image"))
 	cmd.Stdout = io.Discard
 	stderr := &ringBuffer{max: 4096}
 	cmd.Stderr = stderr
-	f.cmd = cmd
-	f.mu.Unlock()
 
+	err = cmd.Run()
+	// dd only runs once the checks of the script passed.
+	if written.Size() > 0 && !scriptRefused(err) {
+		progress.touch()
+	}
+	if err == nil {
+		err = drainUpload(runCtx, input)
+	} else {
+		err = scriptError("flash.sh", err, stderr.String())
+	}
+	progress.WriteDone()
+	if err != nil {
+		return f.finish(ctx, info, err)
+	}
+
+	info.ImageSHA256 = written.Sum()
+	if opts.Verify {
+		info.Status = "verifying"
+		f.update(info)
+		info.DeviceSHA256, err = f.verify(runCtx, opts.Partition, written, progress)
+	}
+	return f.finish(ctx, info, err)
+}
+
+// CheckOptions rejects a bmap, SkipZeros and Differential: flash.sh writes
+// every byte it is handed, so skipping blocks is left to DeviceFlasher.
+func (f *ScriptFlasher) CheckOptions(opts Options) error {
+	switch {
+	case opts.Bmap != nil:
+		return newError(CodeUnsupportedOption, "", errors.New("the script flasher cannot flash with a bmap"))
+	case opts.SkipZeros:
+		return newError(CodeUnsupportedOption, "", errors.New("the script flasher cannot skip zero blocks (sparse)"))
+	case opts.Differential:
+		return newError(CodeUnsupportedOption, "", errors.New("the script flasher cannot skip blocks the cartridge already holds (differential)"))
+	}
+	return nil
+}
+
+// verify reads the written range back through `sudo read_sd.sh <bytes>
+// [partition]`.
+func (f *ScriptFlasher) verify(ctx context.Context, partition int, written *streamHash, progress *Progress) (string, error) {
+	args := []string{"read_sd.sh", strconv.FormatInt(written.Size(), 10)}
+	if partition > 0 {
+		args = append(args, strconv.Itoa(partition))
+	}
+	cmd := system.SudoCommand(ctx, args[0], args[1:]...)
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = 10 * time.Second
+	stderr := &ringBuffer{max: 4096}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", newError(CodeReadFailed, "", err)
+	}
 	if err := cmd.Start(); err != nil {
-		f.mu.Lock()
-		f.cmd = nil
-		f.status = state.FlashInfo{Status: "error", Err: err.Error()}
-		f.mu.Unlock()
-		return err
+		return "", newError(CodeReadFailed, "", err)
 	}
 
-	f.mu.Lock()
-	f.status = state.FlashInfo{Status: "running"}
-	f.mu.Unlock()
+	digest, verifyErr := verifyReadback(ctx, stdout, "", written.Size(), written.Sum(), progress)
+	// Drain so read_sd.sh is not left blocked on a full pipe.
+	_, _ = io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", newError(CodeReadFailed, "", fmt.Errorf("read_sd.sh failed: %v: %s", err, stderr.String()))
+	}
+	return digest, verifyErr
+}
 
-	err := cmd.Wait()
+// OpenRead streams the cartridge through `sudo read_sd.sh`. The size is taken
+// from the device the script will pick as well.
+func (f *ScriptFlasher) OpenRead(ctx context.Context) (io.ReadCloser, int64, error) {
+	if err := f.CheckIdle(); err != nil {
+		return nil, 0, err
+	}
+	device, err := FindCartridgeDevice()
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := DeviceCapacity(device)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	f.mu.Lock()
-	f.cmd = nil
+	readCtx, cancel := context.WithCancel(ctx)
+	cmd := system.SudoCommand(readCtx, "read_sd.sh")
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = 10 * time.Second
+	stderr := &ringBuffer{max: 4096}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		msg := err.Error()
-		if s := stderr.String(); s != "" {
-			msg = msg + ": " + s
+		cancel()
+		return nil, 0, newError(CodeReadFailed, device, err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, 0, newError(CodeReadFailed, device, err)
+	}
+	return &scriptReader{ReadCloser: stdout, cmd: cmd, cancel: cancel, stderr: stderr, device: device}, size, nil
+}
+
+// scriptReader is the stdout of a running read_sd.sh. Closing it stops the
+// script if it is still running.
+type scriptReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stderr *ringBuffer
+	device string
+	waited bool
+}
+
+func (r *scriptReader) Read(p []byte) (int, error) {
+	readCount, err := r.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) && !r.waited {
+		// A script that failed half way must not look like a short device.
+		r.waited = true
+		if waitErr := r.cmd.Wait(); waitErr != nil {
+			return readCount, newError(CodeReadFailed, r.device, fmt.Errorf("read_sd.sh failed: %v: %s", waitErr, r.stderr.String()))
 		}
-		f.status = state.FlashInfo{Status: "error", Err: msg}
-		f.mu.Unlock()
-		return fmt.Errorf("flash failed: %s", msg)
 	}
-	f.status = state.FlashInfo{Status: "done"}
-	f.mu.Unlock()
+	return readCount, err
+}
+
+func (r *scriptReader) Close() error {
+	r.cancel()
+	_ = r.ReadCloser.Close()
+	if !r.waited {
+		r.waited = true
+		_ = r.cmd.Wait()
+	}
 	return nil
 }
 
-func (f *ScriptFlasher) Cancel() error {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	if f.cmd == nil || f.cmd.Process == nil {
-		return nil
+// scriptError maps the documented exit codes of flash.sh and wipe_sd.sh to
+// typed errors.
+func scriptError(script string, err error, stderr string) error {
+	// Errors from feeding stdin (e.g. an image larger than the device) are
+	// returned as they are.
+	var flashErr *Error
+	if errors.As(err, &flashErr) {
+		return err
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case 2:
+			return newError(CodeNoDevice, "", errors.New("no cartridge device found"))
+		case 3:
+			return newError(CodeNotBlockDevice, "", errors.New("cartridge device is not a block device"))
+		case 4:
+			return newError(CodeRootDevice, "", errors.New("refusing to flash the root device"))
+		case 5:
+			return newError(CodeInvalidPartition, "", fmt.Errorf("%s rejected its mode or partition argument", script))
+		case 6:
+			return newError(CodeDiscardUnsupported, "", errors.New("the cartridge does not support discard"))
+		case 9:
+			return newError(CodeInvalidPartition, "", errors.New("the partition does not exist"))
+		case 10:
+			return newError(CodeDeviceMounted, "", errors.New("the partition is mounted"))
+		}
 	}
-	return f.cmd.Process.Kill()
+	msg := err.Error()
+	if stderr != "" {
+		msg = msg + ": " + stderr
+	}
+	return newError(CodeWriteFailed, "", fmt.Errorf("%s failed: %s", script, msg))
 }
 
-func (f *ScriptFlasher) Status() state.FlashInfo {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	return f.status
+// scriptRefused tells whether a script failed one of its checks, before it
+// wrote anything to the cartridge.
+func scriptRefused(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	switch exitErr.ExitCode() {
+	case 2, 3, 4, 5, 9, 10:
+		return true
+	}
+	return false
 }
 
 type ringBuffer struct {
@@ -0,0 +1,97 @@
+package flash
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"testing"
+
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+func TestScriptFlasherRejectsSkippingOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "bmap", opts: Options{Bmap: &Bmap{}}},
+		{name: "sparse", opts: Options{SkipZeros: true}},
+		{name: "differential", opts: Options{Differential: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flasher := NewScriptFlasher()
+			if err := CheckOptions(flasher, test.opts); flashCode(err) != CodeUnsupportedOption {
+				t.Errorf("CheckOptions: %v, want %s", err, CodeUnsupportedOption)
+			}
+			// Start fails before the script runs or the input is read.
+			input := bytes.NewReader(make([]byte, 1024))
+			if err := flasher.Start(context.Background(), input, test.opts); flashCode(err) != CodeUnsupportedOption {
+				t.Errorf("Start: %v, want %s", err, CodeUnsupportedOption)
+			}
+			if input.Len() != 1024 {
+				t.Error("Start read the input")
+			}
+			if flasher.Status().Touched {
+				t.Error("Touched is set")
+			}
+		})
+	}
+	if err := CheckOptions(NewDeviceFlasher(""), Options{Bmap: &Bmap{}, SkipZeros: true, Differential: true}); err != nil {
+		t.Errorf("DeviceFlasher CheckOptions: %v", err)
+	}
+}
+
+func TestDiscardOutput(t *testing.T) {
+	progress := NewProgress(0)
+	out := &discardOutput{progress: progress}
+	// Lines may arrive split across writes; other output is ignored.
+	for _, chunk := range []string{
+		"/dev/mmcblk1: Discarded 268435456 bytes from the offset 0\n/dev/mmcblk1: Disc",
+		"arded 268435456 bytes from the offset 268435456\n",
+		"blkdiscard: something else\n/dev/mmcblk1: Discarded 1048576 bytes from the offset 536870912",
+	} {
+		if _, err := out.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := out.Total(), int64(2*268435456); got != want {
+		t.Errorf("Total() = %d before the last line ended, want %d", got, want)
+	}
+	_, _ = out.Write([]byte("\n"))
+	if got, want := out.Total(), int64(2*268435456+1048576); got != want {
+		t.Errorf("Total() = %d, want %d", got, want)
+	}
+	var info state.FlashInfo
+	progress.Apply(&info)
+	if info.BytesWritten != out.Total() || !info.Touched {
+		t.Errorf("progress: %d bytes written, touched %v", info.BytesWritten, info.Touched)
+	}
+}
+
+func TestScriptErrorMatchesRefusals(t *testing.T) {
+	tests := []struct {
+		exit    string
+		code    ErrorCode
+		refused bool
+	}{
+		{exit: "2", code: CodeNoDevice, refused: true},
+		{exit: "3", code: CodeNotBlockDevice, refused: true},
+		{exit: "4", code: CodeRootDevice, refused: true},
+		{exit: "5", code: CodeInvalidPartition, refused: true},
+		{exit: "9", code: CodeInvalidPartition, refused: true},
+		{exit: "10", code: CodeDeviceMounted, refused: true},
+		{exit: "1", code: CodeWriteFailed},
+	}
+	for _, test := range tests {
+		t.Run("exit "+test.exit, func(t *testing.T) {
+			err := exec.Command("sh", "-c", "exit "+test.exit).Run()
+			if got := flashCode(scriptError("flash.sh", err, "")); got != test.code {
+				t.Errorf("scriptError: %s, want %s", got, test.code)
+			}
+			if got := scriptRefused(err); got != test.refused {
+				t.Errorf("scriptRefused: %v, want %v", got, test.refused)
+			}
+		})
+	}
+}
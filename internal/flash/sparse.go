@@ -0,0 +1,241 @@
+package flash
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// blockSize is the granularity at which Options.SkipZeros detects zero runs
+// and Options.Differential compares with the device; it matches the usual
+// bmap block size.
+const blockSize = 4096
+
+// span is a range [start, end) of image bytes that the run put on the device.
+type span struct {
+	start int64
+	end   int64
+}
+
+// sparseWriter writes only the parts of an image that need writing: the
+// ranges mapped by a bmap or, with skipZeros, the blocks that are not all
+// zeros. Everything else is skipped and keeps whatever the device held
+// before. With differential, blocks that already hold the right bytes are
+// not rewritten either. Chunks must be passed in image order.
+type sparseWriter struct {
+	device       deviceFile
+	bmap         *Bmap
+	skipZeros    bool
+	differential bool
+	progress     *Progress
+	// current holds the device contents read for a differential comparison.
+	current []byte
+
+	// offset is the image offset of the next chunk.
+	offset int64
+	// next is the index of the first bmap range not yet completely written,
+	// rangeHash the digest of its bytes written so far.
+	next      int
+	rangeHash hash.Hash
+
+	// written hashes the bytes that now make up the device contents, in order
+	// (whether rewritten or found unchanged); spans records where they are.
+	written *streamHash
+	spans   []span
+}
+
+func newSparseWriter(device deviceFile, opts Options, progress *Progress) *sparseWriter {
+	writer := &sparseWriter{device: device, bmap: opts.Bmap, skipZeros: opts.SkipZeros && opts.Bmap == nil, differential: opts.Differential, progress: progress, written: newStreamHash()}
+	if opts.Bmap != nil && opts.Bmap.ChecksumType != "" {
+		writer.rangeHash = newBmapHash(opts.Bmap.ChecksumType)
+	}
+	return writer
+}
+
+// write handles the next chunk of the image.
+func (writer *sparseWriter) write(chunk []byte) error {
+	start := writer.offset
+	end := start + int64(len(chunk))
+	defer func() { writer.offset = end }()
+
+	if writer.skipZeros {
+		return writer.writeNonZero(chunk, start)
+	}
+	if writer.bmap == nil {
+		return writer.writeAt(chunk, start)
+	}
+	for position := start; position < end; {
+		if writer.next >= len(writer.bmap.Ranges) {
+			writer.progress.addSkipped(end - position)
+			return nil
+		}
+		mapped := writer.bmap.Ranges[writer.next]
+		rangeStart, rangeEnd := writer.bmap.byteRange(mapped)
+		if position < rangeStart {
+			skipped := min(end, rangeStart) - position
+			writer.progress.addSkipped(skipped)
+			position += skipped
+			continue
+		}
+		stop := min(end, rangeEnd)
+		data := chunk[position-start : stop-start]
+		if err := writer.writeAt(data, position); err != nil {
+			return err
+		}
+		if writer.rangeHash != nil {
+			writer.rangeHash.Write(data)
+		}
+		position = stop
+		if position == rangeEnd {
+			if err := writer.checkRange(mapped); err != nil {
+				return err
+			}
+			writer.next++
+		}
+	}
+	return nil
+}
+
+// writeNonZero writes the runs of chunk that are not zero blocks.
+func (writer *sparseWriter) writeNonZero(chunk []byte, start int64) error {
+	runStart := -1
+	for blockStart := 0; blockStart < len(chunk); blockStart += blockSize {
+		blockEnd := min(blockStart+blockSize, len(chunk))
+		zero := isZero(chunk[blockStart:blockEnd])
+		if !zero && runStart < 0 {
+			runStart = blockStart
+		}
+		if zero {
+			writer.progress.addSkipped(int64(blockEnd - blockStart))
+			if runStart >= 0 {
+				if err := writer.writeAt(chunk[runStart:blockStart], start+int64(runStart)); err != nil {
+					return err
+				}
+				runStart = -1
+			}
+		}
+	}
+	if runStart >= 0 {
+		return writer.writeAt(chunk[runStart:], start+int64(runStart))
+	}
+	return nil
+}
+
+// writeAt puts data at offset of the device (only its changed blocks in
+// differential mode) and records it for verification.
+func (writer *sparseWriter) writeAt(data []byte, offset int64) error {
+	if writer.differential {
+		if err := writer.writeChanged(data, offset); err != nil {
+			return err
+		}
+	} else {
+		writer.progress.touch()
+		if _, err := writer.device.WriteAt(data, offset); err != nil {
+			return newError(CodeWriteFailed, writer.device.Name(), err)
+		}
+		writer.progress.addWritten(int64(len(data)))
+	}
+	_, _ = writer.written.hash.Write(data)
+	writer.written.size += int64(len(data))
+	if count := len(writer.spans); count > 0 && writer.spans[count-1].end == offset {
+		writer.spans[count-1].end += int64(len(data))
+	} else {
+		writer.spans = append(writer.spans, span{start: offset, end: offset + int64(len(data))})
+	}
+	return nil
+}
+
+// writeChanged reads the device range data is meant for and writes only the
+// blocks that differ. Bytes beyond the end of the device count as changed.
+func (writer *sparseWriter) writeChanged(data []byte, offset int64) error {
+	if cap(writer.current) < len(data) {
+		writer.current = make([]byte, len(data))
+	}
+	current := writer.current[:len(data)]
+	readCount, err := writer.device.ReadAt(current, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return newError(CodeReadFailed, writer.device.Name(), fmt.Errorf("read for comparison: %w", err))
+	}
+
+	runStart := -1
+	flush := func(end int) error {
+		if runStart < 0 {
+			return nil
+		}
+		writer.progress.touch()
+		if _, err := writer.device.WriteAt(data[runStart:end], offset+int64(runStart)); err != nil {
+			return newError(CodeWriteFailed, writer.device.Name(), err)
+		}
+		writer.progress.addWritten(int64(end - runStart))
+		runStart = -1
+		return nil
+	}
+	for blockStart := 0; blockStart < len(data); blockStart += blockSize {
+		blockEnd := min(blockStart+blockSize, len(data))
+		if blockEnd <= readCount && bytes.Equal(data[blockStart:blockEnd], current[blockStart:blockEnd]) {
+			writer.progress.addInPlace(int64(blockEnd - blockStart))
+			if err := flush(blockStart); err != nil {
+				return err
+			}
+			continue
+		}
+		if runStart < 0 {
+			runStart = blockStart
+		}
+	}
+	return flush(len(data))
+}
+
+// checkRange compares a completely written bmap range with its checksum.
+func (writer *sparseWriter) checkRange(mapped BmapRange) error {
+	if writer.rangeHash == nil {
+		return nil
+	}
+	got := hex.EncodeToString(writer.rangeHash.Sum(nil))
+	writer.rangeHash.Reset()
+	if mapped.Checksum != "" && !strings.EqualFold(got, mapped.Checksum) {
+		return newError(CodeChecksumMismatch, writer.device.Name(), fmt.Errorf("blocks %d-%d have %s %s, the bmap expects %s", mapped.First, mapped.Last, writer.bmap.ChecksumType, got, mapped.Checksum))
+	}
+	return nil
+}
+
+// finish checks that the image matched the bmap once the stream ended.
+func (writer *sparseWriter) finish() error {
+	if writer.bmap == nil {
+		return nil
+	}
+	if writer.offset != writer.bmap.ImageSize {
+		return newError(CodeChecksumMismatch, writer.device.Name(), fmt.Errorf("the image is %d bytes but the bmap describes %d bytes", writer.offset, writer.bmap.ImageSize))
+	}
+	return nil
+}
+
+// spanReader reads the given spans of device back to back.
+func spanReader(device io.ReaderAt, spans []span) io.Reader {
+	readers := make([]io.Reader, 0, len(spans))
+	for _, written := range spans {
+		readers = append(readers, io.NewSectionReader(device, written.start, written.end-written.start))
+	}
+	return io.MultiReader(readers...)
+}
+
+func isZero(data []byte) bool {
+	for len(data) >= len(zeroBlock) {
+		if !bytes.Equal(data[:len(zeroBlock)], zeroBlock[:]) {
+			return false
+		}
+		data = data[len(zeroBlock):]
+	}
+	for _, value := range data {
+		if value != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+var zeroBlock [blockSize]byte
@@ -0,0 +1,103 @@
+package flash
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/rook-computer/keymaker/internal/ctxio"
+)
+
+// streamHash computes the SHA-256 and length of a stream (the upload or the
+// image on its way to the device) while it is read.
+type streamHash struct {
+	hash hash.Hash
+	size int64
+}
+
+func newStreamHash() *streamHash {
+	return &streamHash{hash: sha256.New()}
+}
+
+// Reader returns a reader that hashes everything read through it.
+func (stream *streamHash) Reader(reader io.Reader) io.Reader {
+	return &countingReader{reader: io.TeeReader(reader, stream.hash), add: func(count int64) { stream.size += count }}
+}
+
+func (stream *streamHash) Size() int64 { return stream.size }
+
+func (stream *streamHash) Sum() string { return hex.EncodeToString(stream.hash.Sum(nil)) }
+
+// verifyReadback hashes the first size bytes of source (the device) and
+// compares them with want. It returns the digest of what was read back.
+func verifyReadback(ctx context.Context, source io.Reader, device string, size int64, want string, progress *Progress) (string, error) {
+	readback := sha256.New()
+	copied, err := io.Copy(readback, ctxio.NewReader(ctx, progress.CountVerified(io.LimitReader(source, size))))
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		}
+		return "", newError(CodeReadFailed, device, fmt.Errorf("read back: %w", err))
+	}
+	got := hex.EncodeToString(readback.Sum(nil))
+	if copied < size {
+		return got, newError(CodeVerifyFailed, device, fmt.Errorf("read back %d of %d bytes", copied, size))
+	}
+	if got != want {
+		return got, newError(CodeVerifyFailed, device, fmt.Errorf("read back sha256 %s does not match image sha256 %s", got, want))
+	}
+	return got, nil
+}
+
+// Expect returns a reader like Reader that compares the digest with want as
+// soon as the stream ends. On a mismatch the final read fails with
+// CodeChecksumMismatch instead of io.EOF and returns no data, so the run
+// stops before the tail is written, the device synced or read back. An
+// empty want checks nothing; what names the stream in the error.
+func (stream *streamHash) Expect(reader io.Reader, want, what string) io.Reader {
+	reader = stream.Reader(reader)
+	if want == "" {
+		return reader
+	}
+	return &expectReader{reader: reader, stream: stream, want: want, what: what}
+}
+
+type expectReader struct {
+	reader     io.Reader
+	stream     *streamHash
+	want, what string
+}
+
+func (r *expectReader) Read(p []byte) (int, error) {
+	readCount, err := r.reader.Read(p)
+	if errors.Is(err, io.EOF) && !strings.EqualFold(r.want, r.stream.Sum()) {
+		return 0, newError(CodeChecksumMismatch, "", fmt.Errorf("%s sha256 %s does not match expected %s", r.what, r.stream.Sum(), r.want))
+	}
+	return readCount, err
+}
+
+// drainUpload consumes what is left of the upload after the image ended
+// (e.g. a zip central directory), so the upload digest covers all of it.
+func drainUpload(ctx context.Context, upload io.Reader) error {
+	if _, err := io.Copy(io.Discard, ctxio.NewReader(ctx, upload)); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		var flashErr *Error
+		if errors.As(err, &flashErr) {
+			return err
+		}
+		return newError(CodeReadFailed, "", err)
+	}
+	return nil
+}
+
+func isVerifyFailure(err error) bool {
+	var flashErr *Error
+	return errors.As(err, &flashErr) && flashErr.Code == CodeVerifyFailed
+}
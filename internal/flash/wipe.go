@@ -0,0 +1,234 @@
+package flash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/ctxio"
+	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/system"
+)
+
+// WipeMode selects how Wipe blanks the target.
+type WipeMode string
+
+const (
+	// WipeDiscard tells the card that every block is unused (like
+	// blkdiscard). It is fast and spares the card; whether discarded blocks
+	// read back as zeros depends on the card.
+	WipeDiscard WipeMode = "discard"
+	// WipeZero writes zeros over the whole target.
+	WipeZero WipeMode = "zero"
+)
+
+// ErrInvalidWipeMode is returned for a mode other than WipeDiscard and
+// WipeZero.
+var ErrInvalidWipeMode = errors.New("wipe mode must be discard or zero")
+
+// Wiper is implemented by flashers that can blank the whole target. A wipe
+// is a run like a flash: Cancel stops it and Status reports it with status
+// "wiping", bytesTotal being the size of the target and bytesRead and
+// bytesWritten the bytes erased so far.
+type Wiper interface {
+	Wipe(ctx context.Context, mode WipeMode) error
+}
+
+// discardChunk is the size of a single discard request, so progress and
+// cancellation are noticed while a large card is discarded.
+const discardChunk = 256 * 1024 * 1024
+
+func checkWipeMode(mode WipeMode) error {
+	if mode != WipeDiscard && mode != WipeZero {
+		return ErrInvalidWipeMode
+	}
+	return nil
+}
+
+// Wipe blanks the target in place.
+func (f *DeviceFlasher) Wipe(ctx context.Context, mode WipeMode) error {
+	if err := checkWipeMode(mode); err != nil {
+		return err
+	}
+	runCtx, progress, err := f.begin(ctx, Options{})
+	if err != nil {
+		return err
+	}
+
+	target := f.Target
+	if target == "" {
+		target, err = FindCartridgeDevice()
+		if err != nil {
+			return f.finish(ctx, state.FlashInfo{}, err)
+		}
+	}
+	info := state.FlashInfo{Device: target}
+	if err := checkTarget(target, 0); err != nil {
+		return f.finish(ctx, info, err)
+	}
+	capacity, err := DeviceCapacity(target)
+	if err != nil {
+		return f.finish(ctx, info, err)
+	}
+	progress.setInputTotal(capacity)
+	info.Status = "wiping"
+	f.update(info)
+
+	device, err := os.OpenFile(target, os.O_WRONLY, 0)
+	if err != nil {
+		return f.finish(ctx, info, newError(CodeOpenFailed, target, err))
+	}
+	if mode == WipeDiscard {
+		err = discardAll(runCtx, device, capacity, progress)
+	} else {
+		err = f.copy(runCtx, device, progress.CountInput(io.LimitReader(zeros{}, capacity)), nil, progress)
+	}
+	if err == nil {
+		if syncErr := device.Sync(); syncErr != nil {
+			err = newError(CodeWriteFailed, target, fmt.Errorf("sync: %w", syncErr))
+		}
+	}
+	if closeErr := device.Close(); err == nil && closeErr != nil {
+		err = newError(CodeWriteFailed, target, closeErr)
+	}
+	progress.WriteDone()
+	return f.finish(ctx, info, err)
+}
+
+// discardAll discards the whole device in chunks.
+func discardAll(ctx context.Context, device *os.File, size int64, progress *Progress) error {
+	for offset := int64(0); offset < size; offset += discardChunk {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		length := min(discardChunk, size-offset)
+		progress.touch()
+		if err := discardRange(device, offset, length); err != nil {
+			return err
+		}
+		progress.addRead(length)
+		progress.addWritten(length)
+	}
+	return nil
+}
+
+// Wipe blanks the cartridge through the scripts: zeros are streamed into
+// `sudo flash.sh raw`, a discard runs `sudo wipe_sd.sh discard`.
+func (f *ScriptFlasher) Wipe(ctx context.Context, mode WipeMode) error {
+	if err := checkWipeMode(mode); err != nil {
+		return err
+	}
+	runCtx, progress, err := f.begin(ctx, Options{})
+	if err != nil {
+		return err
+	}
+
+	// The scripts pick the same device.
+	device, err := FindCartridgeDevice()
+	if err != nil {
+		return f.finish(ctx, state.FlashInfo{}, err)
+	}
+	info := state.FlashInfo{Device: device}
+	capacity, err := DeviceCapacity(device)
+	if err != nil {
+		return f.finish(ctx, info, err)
+	}
+	progress.setInputTotal(capacity)
+	info.Status = "wiping"
+	f.update(info)
+
+	script := "flash.sh"
+	cmd := system.SudoCommand(runCtx, "flash.sh", "raw")
+	cmd.Stdout = io.Discard
+	discarded := &discardOutput{progress: progress}
+	if mode == WipeDiscard {
+		script = "wipe_sd.sh"
+		cmd = system.SudoCommand(runCtx, "wipe_sd.sh", "discard")
+		cmd.Stdout = discarded
+	} else {
+		zeroFill := progress.CountOutput(progress.CountInput(io.LimitReader(zeros{}, capacity)))
+		cmd.Stdin = ctxio.NewReader(runCtx, zeroFill)
+	}
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = 10 * time.Second
+	stderr := &ringBuffer{max: 4096}
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if !scriptRefused(err) {
+		progress.touch()
+	}
+	if err != nil {
+		err = scriptError(script, err, stderr.String())
+	} else if mode == WipeDiscard {
+		// An old blkdiscard without per-step output reports nothing.
+		if rest := capacity - discarded.Total(); rest > 0 {
+			progress.addRead(rest)
+			progress.addWritten(rest)
+		}
+	}
+	progress.WriteDone()
+	return f.finish(ctx, info, err)
+}
+
+// discardedLine is a progress line of `blkdiscard -v -s`.
+var discardedLine = regexp.MustCompile(`: Discarded ([0-9]+) bytes from the offset [0-9]+$`)
+
+// discardOutput counts the bytes wipe_sd.sh reports as discarded while it
+// runs.
+type discardOutput struct {
+	progress *Progress
+
+	mu      sync.Mutex
+	partial []byte
+	total   int64
+}
+
+func (out *discardOutput) Write(p []byte) (int, error) {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	out.partial = append(out.partial, p...)
+	for {
+		end := bytes.IndexByte(out.partial, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		line := bytes.TrimSpace(out.partial[:end])
+		out.partial = out.partial[end+1:]
+		match := discardedLine.FindSubmatch(line)
+		if match == nil {
+			continue
+		}
+		count, err := strconv.ParseInt(string(match[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		out.total += count
+		out.progress.touch()
+		out.progress.addRead(count)
+		out.progress.addWritten(count)
+	}
+}
+
+// Total returns the bytes reported so far.
+func (out *discardOutput) Total() int64 {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	return out.total
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
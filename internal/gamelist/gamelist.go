@@ -0,0 +1,286 @@
+// Package gamelist reads and writes EmulationStation's gamelist.xml, the
+// per-system file holding the display name, description, rating, media and
+// other metadata of each game. Elements the package does not know about
+// (release dates, play counts, ...) are kept as they are.
+package gamelist
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidMetadata is returned by Patch.Validate.
+var ErrInvalidMetadata = errors.New("invalid game metadata")
+
+// List is a parsed gamelist.xml.
+type List struct {
+	XMLName xml.Name `xml:"gameList"`
+	// Other keeps the elements besides games and folders, e.g. <provider>.
+	Other   []Element `xml:",any"`
+	Games   []Entry   `xml:"game"`
+	Folders []Entry   `xml:"folder"`
+}
+
+// Entry is a <game> or <folder> element.
+type Entry struct {
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Path     string     `xml:"path"`
+	Name     string     `xml:"name,omitempty"`
+	Desc     string     `xml:"desc,omitempty"`
+	Rating   string     `xml:"rating,omitempty"`
+	Players  string     `xml:"players,omitempty"`
+	Favorite string     `xml:"favorite,omitempty"`
+	Hidden   string     `xml:"hidden,omitempty"`
+	// Image, Thumbnail, Marquee and Video link the game's media files.
+	Image     string    `xml:"image,omitempty"`
+	Thumbnail string    `xml:"thumbnail,omitempty"`
+	Marquee   string    `xml:"marquee,omitempty"`
+	Video     string    `xml:"video,omitempty"`
+	Other     []Element `xml:",any"`
+}
+
+// Element is an element kept verbatim.
+type Element struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// Parse reads a gamelist.xml.
+func Parse(reader io.Reader) (*List, error) {
+	var list List
+	if err := xml.NewDecoder(reader).Decode(&list); err != nil {
+		return nil, fmt.Errorf("parse gamelist: %w", err)
+	}
+	return &list, nil
+}
+
+// Encode writes the list the way EmulationStation does: an XML declaration
+// followed by the indented <gameList>.
+func (list *List) Encode(writer io.Writer) error {
+	var buffer bytes.Buffer
+	buffer.WriteString("<?xml version=\"1.0\"?>\n")
+	encoder := xml.NewEncoder(&buffer)
+	encoder.Indent("", "\t")
+	if err := encoder.Encode(list); err != nil {
+		return err
+	}
+	buffer.WriteByte('\n')
+	_, err := writer.Write(buffer.Bytes())
+	return err
+}
+
+// Find returns the entry of game, a slash-separated path relative to the
+// system directory, or nil. systemDir is the system directory as
+// EmulationStation sees it (e.g. /home/pi/RetroPie/roms/nes), which absolute
+// entry paths are matched against.
+func (list *List) Find(systemDir, game string) *Entry {
+	for i := range list.Games {
+		if entryGame(systemDir, list.Games[i].Path) == game {
+			return &list.Games[i]
+		}
+	}
+	for i := range list.Folders {
+		if entryGame(systemDir, list.Folders[i].Path) == game {
+			return &list.Folders[i]
+		}
+	}
+	return nil
+}
+
+// Add appends an entry for game and returns it. A folder becomes a <folder>
+// element.
+func (list *List) Add(game string, folder bool) *Entry {
+	entry := Entry{Path: "./" + game}
+	if folder {
+		list.Folders = append(list.Folders, entry)
+		return &list.Folders[len(list.Folders)-1]
+	}
+	list.Games = append(list.Games, entry)
+	return &list.Games[len(list.Games)-1]
+}
+
+// Remove drops the entries of game and, if it is a directory, of everything
+// below it, and returns them.
+func (list *List) Remove(systemDir, game string) []Entry {
+	var removed []Entry
+	keep := func(entries []Entry) []Entry {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if within(entryGame(systemDir, entry.Path), game) {
+				removed = append(removed, entry)
+			} else {
+				kept = append(kept, entry)
+			}
+		}
+		return kept
+	}
+	list.Games = keep(list.Games)
+	list.Folders = keep(list.Folders)
+	return removed
+}
+
+// Rename points the entries of game, and of everything below it, to
+// newGame. It reports whether any entry changed.
+func (list *List) Rename(systemDir, game, newGame string) bool {
+	changed := false
+	rename := func(entries []Entry) {
+		for i := range entries {
+			current := entryGame(systemDir, entries[i].Path)
+			if within(current, game) {
+				entries[i].Path = "./" + newGame + strings.TrimPrefix(current, game)
+				changed = true
+			}
+		}
+	}
+	rename(list.Games)
+	rename(list.Folders)
+	return changed
+}
+
+// entryGame turns the <path> of an entry into a path relative to the system
+// directory. Paths outside it are returned unchanged, so they never match.
+func entryGame(systemDir, entryPath string) string {
+	entryPath = strings.TrimSpace(entryPath)
+	if strings.HasPrefix(entryPath, "/") {
+		rel, ok := strings.CutPrefix(path.Clean(entryPath), systemDir+"/")
+		if !ok {
+			return entryPath
+		}
+		return rel
+	}
+	return path.Clean(entryPath)
+}
+
+func within(game, dir string) bool {
+	return game == dir || strings.HasPrefix(game, dir+"/")
+}
+
+// Metadata is the editable metadata of a game.
+type Metadata struct {
+	// Path is the game relative to the system directory.
+	Path string `json:"path"`
+	// Listed tells whether the gamelist has an entry for the game. The other
+	// fields of an unlisted game are EmulationStation's defaults.
+	Listed  bool    `json:"listed"`
+	Name    string  `json:"name"`
+	Desc    string  `json:"desc"`
+	Rating  float64 `json:"rating"`
+	Players string  `json:"players"`
+	// Favorite and Hidden are the flags set from EmulationStation's menus.
+	Favorite bool `json:"favorite"`
+	Hidden   bool `json:"hidden"`
+	// Media lists the linked media files.
+	Media []MediaFile `json:"media"`
+}
+
+// Metadata describes the entry of game.
+func (entry *Entry) Metadata(game string) Metadata {
+	meta := Metadata{
+		Path:     game,
+		Listed:   true,
+		Name:     entry.Name,
+		Desc:     entry.Desc,
+		Players:  entry.Players,
+		Favorite: entry.Favorite == "true",
+		Hidden:   entry.Hidden == "true",
+	}
+	if meta.Name == "" {
+		meta.Name = DefaultName(game)
+	}
+	if rating, err := strconv.ParseFloat(strings.TrimSpace(entry.Rating), 64); err == nil {
+		meta.Rating = rating
+	}
+	return meta
+}
+
+// DefaultName is the name EmulationStation shows for a game without one: its
+// file name without the extension.
+func DefaultName(game string) string {
+	name := path.Base(game)
+	if ext := path.Ext(name); ext != "" && ext != name {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// Patch changes the metadata of a game; nil fields are left alone.
+type Patch struct {
+	Name     *string  `json:"name"`
+	Desc     *string  `json:"desc"`
+	Rating   *float64 `json:"rating"`
+	Players  *string  `json:"players"`
+	Favorite *bool    `json:"favorite"`
+	Hidden   *bool    `json:"hidden"`
+}
+
+// Validate checks the patch before a gamelist is touched.
+func (patch Patch) Validate() error {
+	if patch.Rating != nil && (*patch.Rating < 0 || *patch.Rating > 1) {
+		return fmt.Errorf("%w: rating must be between 0 and 1", ErrInvalidMetadata)
+	}
+	if patch.Players != nil && !validPlayers(*patch.Players) {
+		return fmt.Errorf("%w: players must be a number or a range like 1-4", ErrInvalidMetadata)
+	}
+	return nil
+}
+
+// Empty reports whether the patch changes nothing.
+func (patch Patch) Empty() bool {
+	return patch == Patch{}
+}
+
+func validPlayers(players string) bool {
+	if players == "" {
+		return true
+	}
+	low, high, isRange := strings.Cut(players, "-")
+	if _, err := strconv.ParseUint(low, 10, 16); err != nil {
+		return false
+	}
+	if !isRange {
+		return true
+	}
+	_, err := strconv.ParseUint(high, 10, 16)
+	return err == nil
+}
+
+// Apply writes the patch into the entry. Cleared fields (empty text, a zero
+// rating, false flags) are dropped from the element, as EmulationStation
+// does for default values.
+func (entry *Entry) Apply(patch Patch) {
+	if patch.Name != nil {
+		entry.Name = *patch.Name
+	}
+	if patch.Desc != nil {
+		entry.Desc = *patch.Desc
+	}
+	if patch.Rating != nil {
+		entry.Rating = ""
+		if *patch.Rating > 0 {
+			entry.Rating = strconv.FormatFloat(*patch.Rating, 'f', -1, 64)
+		}
+	}
+	if patch.Players != nil {
+		entry.Players = *patch.Players
+	}
+	if patch.Favorite != nil {
+		entry.Favorite = flag(*patch.Favorite)
+	}
+	if patch.Hidden != nil {
+		entry.Hidden = flag(*patch.Hidden)
+	}
+}
+
+func flag(value bool) string {
+	if value {
+		return "true"
+	}
+	return ""
+}
@@ -0,0 +1,236 @@
+package gamelist
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/ownership"
+)
+
+// MediaKind is a kind of game media shown by EmulationStation.
+type MediaKind string
+
+const (
+	// MediaImage is the main picture: box art or a screenshot.
+	MediaImage     MediaKind = "image"
+	MediaThumbnail MediaKind = "thumbnail"
+	MediaMarquee   MediaKind = "marquee"
+	MediaVideo     MediaKind = "video"
+)
+
+// MediaKinds lists every kind in gamelist order.
+var MediaKinds = []MediaKind{MediaImage, MediaThumbnail, MediaMarquee, MediaVideo}
+
+// ErrInvalidMedia is returned for an unknown media kind or a file that does
+// not suit the kind.
+var ErrInvalidMedia = errors.New("invalid media")
+
+// ErrNoMedia is returned when a game has no media of a kind. It matches
+// fs.ErrNotExist.
+var ErrNoMedia = fmt.Errorf("no such media: %w", fs.ErrNotExist)
+
+// imageTypes and videoTypes map the accepted content types to file
+// extensions.
+var (
+	imageTypes = map[string]string{"image/png": ".png", "image/jpeg": ".jpg", "image/gif": ".gif", "image/webp": ".webp"}
+	videoTypes = map[string]string{"video/mp4": ".mp4", "video/webm": ".webm"}
+)
+
+// ParseMediaKind validates a media kind.
+func ParseMediaKind(value string) (MediaKind, error) {
+	for _, kind := range MediaKinds {
+		if string(kind) == value {
+			return kind, nil
+		}
+	}
+	return "", fmt.Errorf("%w: kind must be image, thumbnail, marquee or video", ErrInvalidMedia)
+}
+
+// IsVideo reports whether the kind holds a video rather than a picture.
+func (kind MediaKind) IsVideo() bool { return kind == MediaVideo }
+
+// Extension returns the file extension of media of this kind with
+// contentType, or ErrInvalidMedia if the kind does not accept it.
+func (kind MediaKind) Extension(contentType string) (string, error) {
+	types := imageTypes
+	if kind.IsVideo() {
+		types = videoTypes
+	}
+	if ext, ok := types[contentType]; ok {
+		return ext, nil
+	}
+	return "", fmt.Errorf("%w: a %s cannot be %s", ErrInvalidMedia, kind, contentType)
+}
+
+// MediaFile describes a media file linked from a game's entry.
+type MediaFile struct {
+	Kind MediaKind `json:"kind"`
+	// Link is the path written in gamelist.xml.
+	Link    string    `json:"link"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Missing tells that the linked file does not exist.
+	Missing bool `json:"missing,omitempty"`
+}
+
+func (entry *Entry) media(kind MediaKind) *string {
+	switch kind {
+	case MediaThumbnail:
+		return &entry.Thumbnail
+	case MediaMarquee:
+		return &entry.Marquee
+	case MediaVideo:
+		return &entry.Video
+	default:
+		return &entry.Image
+	}
+}
+
+// MediaPath returns the file of game's media of kind, or ErrNoMedia.
+func (store *Store) MediaPath(system, game string, kind MediaKind) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	entry, err := store.find(system, game)
+	if err != nil {
+		return "", err
+	}
+	if entry == nil || *entry.media(kind) == "" {
+		return "", ErrNoMedia
+	}
+	return store.linkPath(system, *entry.media(kind))
+}
+
+// SetMedia stores media of kind for game and links it from the gamelists,
+// adding the entry (and creating a gamelist) like SetMetadata. The file goes
+// to ~/.emulationstation/downloaded_media/{system}/{kind}s, named after the
+// game's file name with ext added (so "Mario.nes" and "Mario.zip" keep apart);
+// media it replaces there is deleted.
+func (store *Store) SetMedia(system, game string, folder bool, kind MediaKind, ext string, body io.Reader) (Metadata, error) {
+	link := path.Join("~/.emulationstation/downloaded_media", system, string(kind)+"s", game+ext)
+	file, err := store.linkPath(system, link)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if err := ownership.MkdirAll(filepath.Dir(file)); err != nil {
+		return Metadata{}, err
+	}
+	err = writeAtomic(file, func(f *os.File) error {
+		_, err := io.Copy(f, body)
+		return err
+	})
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	var meta Metadata
+	var replaced []string
+	err = store.update(system, true, func(list *List) bool {
+		entry := list.Find(store.systemDir(system), game)
+		if entry == nil {
+			entry = list.Add(game, folder)
+		}
+		if old := *entry.media(kind); old != "" && old != link {
+			replaced = append(replaced, old)
+		}
+		*entry.media(kind) = link
+		meta = store.describe(system, game, entry)
+		return true
+	})
+	if err != nil {
+		return Metadata{}, err
+	}
+	for _, old := range replaced {
+		if oldFile, err := store.linkPath(system, old); err == nil && oldFile != file {
+			store.deleteManagedMedia(system, old)
+		}
+	}
+	return meta, nil
+}
+
+// DeleteMedia unlinks game's media of kind from the gamelists. The file is
+// deleted if it is in downloaded_media; media kept elsewhere (e.g. by a
+// scraper, possibly shared) stays. Without such media it returns ErrNoMedia.
+func (store *Store) DeleteMedia(system, game string, kind MediaKind) error {
+	var links []string
+	err := store.update(system, false, func(list *List) bool {
+		entry := list.Find(store.systemDir(system), game)
+		if entry == nil || *entry.media(kind) == "" {
+			return false
+		}
+		links = append(links, *entry.media(kind))
+		*entry.media(kind) = ""
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(links) == 0 {
+		return ErrNoMedia
+	}
+	for _, link := range links {
+		store.deleteManagedMedia(system, link)
+	}
+	return nil
+}
+
+// deleteManagedMedia deletes the file a media link points to if it is one
+// of ours in downloaded_media and no entry of the system links it any more.
+func (store *Store) deleteManagedMedia(system, link string) {
+	if link == "" {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	file, err := store.linkPath(system, link)
+	if err != nil {
+		return
+	}
+	managed, err := store.linkPath(system, path.Join("~/.emulationstation/downloaded_media", system))
+	if err != nil {
+		return
+	}
+	if rel, err := filepath.Rel(managed, file); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return
+	}
+	if store.linked(system, file) {
+		return
+	}
+	_ = os.Remove(file)
+}
+
+// linked reports whether an entry in a gamelist of system links file. An
+// unreadable gamelist counts as linking it.
+func (store *Store) linked(system, file string) bool {
+	paths, err := store.paths(system)
+	if err != nil {
+		return true
+	}
+	for _, gamelist := range paths {
+		list, err := load(gamelist)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return true
+		}
+		for _, entries := range [][]Entry{list.Games, list.Folders} {
+			for i := range entries {
+				for _, kind := range MediaKinds {
+					if link := *entries[i].media(kind); link != "" {
+						if other, err := store.linkPath(system, link); err == nil && other == file {
+							return true
+						}
+					}
+				}
+			}
+		}
+	}
+	return false
+}
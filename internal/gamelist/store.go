@@ -0,0 +1,350 @@
+package gamelist
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/rook-computer/keymaker/internal/ownership"
+)
+
+// FileName is the name of a gamelist file.
+const FileName = "gamelist.xml"
+
+// maxLinks bounds the symbolic links followed when a path is resolved.
+const maxLinks = 40
+
+// Store edits the gamelists of the RetroPie install below Root, e.g. a
+// mounted cartridge.
+//
+// A system's gamelist lives in its roms directory or in
+// ~/.emulationstation/gamelists/{system}. EmulationStation reads the first
+// one that exists; the Store reads that one too, keeps every existing copy in
+// sync and creates the second location when a game without gamelist gets
+// metadata. Files are replaced atomically, so a power loss leaves either the
+// old or the new gamelist.
+type Store struct {
+	// Root is the filesystem root of the install. Absolute paths seen by
+	// EmulationStation (entries, links) are resolved below it.
+	Root string
+	// RomsRoot holds a directory per system.
+	RomsRoot string
+	// Home is the home directory of the user running EmulationStation.
+	Home string
+
+	mu sync.Mutex
+}
+
+// Metadata describes game, a slash-separated path relative to the system
+// directory. A game without entry gets EmulationStation's defaults.
+func (store *Store) Metadata(system, game string) (Metadata, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	entry, err := store.find(system, game)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return store.describe(system, game, entry), nil
+}
+
+// SetMetadata applies patch to the entry of game, adding the entry where it
+// is missing. folder tells whether game is a directory. Without any gamelist
+// one is created in ~/.emulationstation/gamelists.
+func (store *Store) SetMetadata(system, game string, folder bool, patch Patch) (Metadata, error) {
+	if err := patch.Validate(); err != nil {
+		return Metadata{}, err
+	}
+	var meta Metadata
+	err := store.update(system, true, func(list *List) bool {
+		entry := list.Find(store.systemDir(system), game)
+		if entry == nil {
+			entry = list.Add(game, folder)
+		}
+		entry.Apply(patch)
+		meta = store.describe(system, game, entry)
+		return true
+	})
+	return meta, err
+}
+
+// Add lists a new game in the existing gamelists of system, named after its
+// file. Games already listed keep their metadata.
+func (store *Store) Add(system, game string, folder bool) error {
+	return store.update(system, false, func(list *List) bool {
+		if list.Find(store.systemDir(system), game) != nil {
+			return false
+		}
+		list.Add(game, folder).Name = DefaultName(game)
+		return true
+	})
+}
+
+// Remove drops game, and everything below it, from the gamelists of system.
+// Their media in downloaded_media is deleted as well.
+func (store *Store) Remove(system, game string) error {
+	var removed []Entry
+	err := store.update(system, false, func(list *List) bool {
+		entries := list.Remove(store.systemDir(system), game)
+		removed = append(removed, entries...)
+		return len(entries) > 0
+	})
+	for i := range removed {
+		for _, kind := range MediaKinds {
+			store.deleteManagedMedia(system, *removed[i].media(kind))
+		}
+	}
+	return err
+}
+
+// Rename moves the entries of game, and of everything below it, to newGame.
+func (store *Store) Rename(system, game, newGame string) error {
+	return store.update(system, false, func(list *List) bool {
+		systemDir := store.systemDir(system)
+		// A stale entry of the new path would otherwise shadow the moved one.
+		changed := len(list.Remove(systemDir, newGame)) > 0
+		return list.Rename(systemDir, game, newGame) || changed
+	})
+}
+
+// find returns the entry of game in the gamelist EmulationStation reads, or
+// nil.
+func (store *Store) find(system, game string) (*Entry, error) {
+	paths, err := store.paths(system)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range paths {
+		list, err := load(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return list.Find(store.systemDir(system), game), nil
+	}
+	return nil, nil
+}
+
+// describe returns the metadata of game, whose entry may be nil.
+func (store *Store) describe(system, game string, entry *Entry) Metadata {
+	if entry == nil {
+		return Metadata{Path: game, Name: DefaultName(game), Media: []MediaFile{}}
+	}
+	meta := entry.Metadata(game)
+	meta.Media = []MediaFile{}
+	for _, kind := range MediaKinds {
+		link := *entry.media(kind)
+		if link == "" {
+			continue
+		}
+		file := MediaFile{Kind: kind, Link: link, Missing: true}
+		if hostPath, err := store.linkPath(system, link); err == nil {
+			if info, err := os.Stat(hostPath); err == nil && info.Mode().IsRegular() {
+				file.Missing = false
+				file.Size = info.Size()
+				file.ModTime = info.ModTime()
+			}
+		}
+		meta.Media = append(meta.Media, file)
+	}
+	return meta
+}
+
+// update runs change on every existing gamelist of system and writes the
+// ones it changed. With create, a missing gamelist is created in the home
+// directory first.
+func (store *Store) update(system string, create bool, change func(*List) bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	paths, err := store.paths(system)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, file := range paths {
+		list, err := load(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+		if change(list) {
+			if err := save(file, list); err != nil {
+				return err
+			}
+		}
+	}
+	if found || !create {
+		return nil
+	}
+	list := &List{}
+	change(list)
+	file := paths[len(paths)-1]
+	if err := ownership.MkdirAll(filepath.Dir(file)); err != nil {
+		return err
+	}
+	return save(file, list)
+}
+
+// paths lists the gamelist locations of system in the order EmulationStation
+// reads them.
+func (store *Store) paths(system string) ([]string, error) {
+	if system == "" || strings.ContainsAny(system, `/\`) || system == "." || system == ".." {
+		return nil, fmt.Errorf("invalid system %q", system)
+	}
+	home, err := store.hostPath(path.Join(store.esPath(store.Home), ".emulationstation/gamelists", system, FileName))
+	if err != nil {
+		return nil, err
+	}
+	return []string{filepath.Join(store.RomsRoot, system, FileName), home}, nil
+}
+
+// systemDir is the system directory as EmulationStation sees it.
+func (store *Store) systemDir(system string) string {
+	return store.esPath(filepath.Join(store.RomsRoot, system))
+}
+
+// esPath turns a path below Root into the absolute path EmulationStation
+// sees.
+func (store *Store) esPath(hostPath string) string {
+	rel, err := filepath.Rel(store.Root, hostPath)
+	if err != nil {
+		return "/"
+	}
+	return path.Join("/", filepath.ToSlash(rel))
+}
+
+// linkPath resolves a path written in a gamelist of system: relative to the
+// system directory, to the home directory (~/) or absolute.
+func (store *Store) linkPath(system, link string) (string, error) {
+	switch {
+	case strings.HasPrefix(link, "/"):
+	case strings.HasPrefix(link, "~/"):
+		link = path.Join(store.esPath(store.Home), link[2:])
+	default:
+		link = path.Join(store.systemDir(system), link)
+	}
+	return store.hostPath(link)
+}
+
+// hostPath maps an absolute path as EmulationStation sees it below Root,
+// following symbolic links the same way: an absolute link target (RetroPie
+// links ~/.emulationstation to /opt/retropie/configs/all/emulationstation)
+// starts over at Root. The result never leaves Root. Missing components are
+// taken as they are.
+func (store *Store) hostPath(esPath string) (string, error) {
+	current := "/"
+	rest := splitPath(esPath)
+	for links := 0; len(rest) > 0; {
+		name := rest[0]
+		rest = rest[1:]
+		if name == ".." {
+			current = path.Dir(current)
+			continue
+		}
+		next := path.Join(current, name)
+		info, err := os.Lstat(filepath.Join(store.Root, filepath.FromSlash(next)))
+		if errors.Is(err, fs.ErrNotExist) {
+			current = path.Join(next, path.Join(rest...))
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if links++; links > maxLinks {
+			return "", fmt.Errorf("%s: too many links", esPath)
+		}
+		target, err := os.Readlink(filepath.Join(store.Root, filepath.FromSlash(next)))
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			current = "/"
+		}
+		rest = append(splitPath(target), rest...)
+	}
+	return filepath.Join(store.Root, filepath.FromSlash(current)), nil
+}
+
+func splitPath(p string) []string {
+	var parts []string
+	for _, part := range strings.Split(p, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func load(file string) (*List, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	list, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return list, nil
+}
+
+// save replaces file atomically (see writeAtomic).
+func save(file string, list *List) error {
+	return writeAtomic(file, func(f *os.File) error { return list.Encode(f) })
+}
+
+// writeAtomic replaces file with what write produces: the data is written
+// and synced to a temporary file next to it, which is then renamed over the
+// old one. The file keeps its owner (or gets the one of its directory).
+func writeAtomic(file string, write func(*os.File) error) error {
+	dir := filepath.Dir(file)
+	temp, err := os.CreateTemp(dir, "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(temp.Name()) }()
+	if _, err := os.Stat(file); err == nil {
+		ownership.ChownLike(temp.Name(), file)
+	} else {
+		ownership.ChownLike(temp.Name(), dir)
+	}
+	err = write(temp)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), file)
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", file, err)
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return f.Sync()
+}
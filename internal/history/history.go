@@ -0,0 +1,298 @@
+// Package history keeps a persistent log of what was written to and read
+// from cartridges and the host: flashes, dumps, uploads, renames and
+// deletes. Entries are appended to a JSON Lines file, so the log survives
+// restarts and can be read with standard tools.
+package history
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// Kinds of operations.
+const (
+	KindFlash  = "flash"
+	KindDump   = "dump"
+	KindUpload = "upload"
+	KindDelete = "delete"
+	KindRename = "rename"
+	KindWipe   = "wipe"
+)
+
+// Targets of operations.
+const (
+	// TargetCartridge is the whole cartridge (flash, dump).
+	TargetCartridge = "cartridge"
+	// TargetGame is a game on the cartridge's RetroPie install.
+	TargetGame = "game"
+	// TargetImage is an image of the host library.
+	TargetImage = "image"
+	// TargetBIOS is a file in the BIOS directory of the RetroPie install.
+	TargetBIOS = "bios"
+)
+
+// Results of operations.
+const (
+	ResultOK        = "ok"
+	ResultError     = "error"
+	ResultCancelled = "cancelled"
+)
+
+// DefaultMaxSize is the size at which the log is rotated. One rotated
+// generation (<file>.1) is kept and still queried.
+const DefaultMaxSize = 16 * 1024 * 1024
+
+// Cartridge identifies the cartridge an operation acted on.
+type Cartridge struct {
+	CID      string `json:"cid,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Capacity int64  `json:"capacity,omitempty"`
+}
+
+// Entry is one logged operation.
+type Entry struct {
+	// Time is when the operation started.
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Target string    `json:"target"`
+	// Name is the image (file name, library name or URL), the game
+	// ("{system}/{game}", "{system}/{game} -> {new game}" for a rename) or,
+	// for a wipe, the mode and new layout.
+	Name string `json:"name,omitempty"`
+	// Source tells where a flashed image came from: upload, url, library or
+	// resumable.
+	Source string `json:"source,omitempty"`
+	// Partition is the partition written by a single-partition flash.
+	Partition int `json:"partition,omitempty"`
+	// SHA256 is the digest of the (decompressed) image flashed or dumped, or
+	// of the stored library image.
+	SHA256     string     `json:"sha256,omitempty"`
+	Cartridge  *Cartridge `json:"cartridge,omitempty"`
+	DurationMS int64      `json:"durationMs"`
+	// BytesRead and BytesWritten count the bytes consumed and produced, e.g.
+	// the compressed upload and the image written for a flash.
+	BytesRead    int64  `json:"bytesRead"`
+	BytesWritten int64  `json:"bytesWritten"`
+	Result       string `json:"result"`
+	Error        string `json:"error,omitempty"`
+	ErrorCode    string `json:"errorCode,omitempty"`
+}
+
+// codedError is implemented by errors that carry a stable code (e.g.
+// *flash.Error).
+type codedError interface {
+	error
+	ErrorCode() string
+}
+
+// Finish completes an entry started at entry.Time with the outcome err.
+func (entry Entry) Finish(err error) Entry {
+	entry.DurationMS = time.Since(entry.Time).Milliseconds()
+	switch {
+	case err == nil:
+		entry.Result = ResultOK
+	case errors.Is(err, context.Canceled):
+		entry.Result = ResultCancelled
+		entry.Error = err.Error()
+	default:
+		entry.Result = ResultError
+		entry.Error = err.Error()
+	}
+	var coded codedError
+	if errors.As(err, &coded) {
+		entry.ErrorCode = coded.ErrorCode()
+	}
+	return entry
+}
+
+// CartridgeOf returns the identity of the inserted cartridge, or nil.
+func CartridgeOf(snapshot state.CartridgeInfoSnapshot) *Cartridge {
+	if !snapshot.Present {
+		return nil
+	}
+	return &Cartridge{
+		CID:      snapshot.Identity.CID,
+		Serial:   snapshot.Identity.Serial,
+		Name:     snapshot.Identity.Name,
+		Capacity: snapshot.Capacity,
+	}
+}
+
+// Flash builds the entry of a flash from the flasher's final status.
+func Flash(started time.Time, name, source string, cartridge *Cartridge, info state.FlashInfo, err error) Entry {
+	entry := Entry{
+		Time:         started,
+		Kind:         KindFlash,
+		Target:       TargetCartridge,
+		Name:         name,
+		Source:       source,
+		SHA256:       info.ImageSHA256,
+		Cartridge:    cartridge,
+		Partition:    info.Partition,
+		BytesRead:    info.BytesRead,
+		BytesWritten: info.BytesWritten,
+	}
+	return entry.Finish(err)
+}
+
+// Filter selects entries. Empty fields match everything; Name matches
+// case-insensitive substrings.
+type Filter struct {
+	Kind   string
+	Target string
+	Result string
+	CID    string
+	Name   string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (filter Filter) match(entry Entry) bool {
+	switch {
+	case filter.Kind != "" && entry.Kind != filter.Kind,
+		filter.Target != "" && entry.Target != filter.Target,
+		filter.Result != "" && entry.Result != filter.Result,
+		filter.Name != "" && !strings.Contains(strings.ToLower(entry.Name), strings.ToLower(filter.Name)),
+		!filter.Since.IsZero() && entry.Time.Before(filter.Since),
+		!filter.Until.IsZero() && !entry.Time.Before(filter.Until):
+		return false
+	}
+	if filter.CID != "" && (entry.Cartridge == nil || !strings.EqualFold(entry.Cartridge.CID, filter.CID)) {
+		return false
+	}
+	return true
+}
+
+// Store is the history log. It is safe for concurrent use.
+type Store struct {
+	path    string
+	maxSize int64
+
+	mu sync.Mutex
+}
+
+// New opens the log at path; the file is created with the first entry.
+func New(path string) *Store {
+	return &Store{path: filepath.Clean(path), maxSize: DefaultMaxSize}
+}
+
+// Append adds an entry to the log.
+func (store *Store) Append(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(store.path), 0o755); err != nil {
+		return err
+	}
+	if info, err := os.Stat(store.path); err == nil && info.Size()+int64(len(line)) > store.maxSize {
+		if err := os.Rename(store.path, store.path+".1"); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(store.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	// A crash during an earlier append can leave a torn last line; end it
+	// so that this entry starts a line of its own.
+	torn, err := tornTail(file)
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if torn {
+		line = append([]byte{'\n'}, line...)
+	}
+	if _, err := file.Write(line); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// tornTail reports whether file does not end with a newline.
+func tornTail(file *os.File) (bool, error) {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return false, err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return false, err
+	}
+	return last[0] != '\n', nil
+}
+
+// Query returns the entries matching filter, newest first, skipping offset
+// entries and returning at most limit (all if limit <= 0), together with the
+// number of matching entries.
+func (store *Store) Query(filter Filter, offset, limit int) ([]Entry, int, error) {
+	store.mu.Lock()
+	var matches []Entry
+	var err error
+	for _, path := range []string{store.path + ".1", store.path} {
+		if matches, err = readEntries(path, filter, matches); err != nil {
+			break
+		}
+	}
+	store.mu.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(matches)
+	for left, right := 0, total-1; left < right; left, right = left+1, right-1 {
+		matches[left], matches[right] = matches[right], matches[left]
+	}
+	offset = min(max(offset, 0), total)
+	end := total
+	if limit > 0 {
+		end = min(offset+limit, total)
+	}
+	return matches[offset:end], total, nil
+}
+
+// readEntries appends the matching entries of a log file in file order. A
+// line that cannot be parsed (e.g. cut short by a power loss) is skipped.
+func readEntries(path string, filter Filter, matches []Entry) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return matches, nil
+		}
+		return matches, err
+	}
+	defer func() { _ = file.Close() }()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if filter.match(entry) {
+			matches = append(matches, entry)
+		}
+	}
+	return matches, scanner.Err()
+}
@@ -0,0 +1,229 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+type Phase string
+
+const (
+	PhaseRunning   Phase = "running"
+	PhaseDone      Phase = "done"
+	PhaseError     Phase = "error"
+	PhaseCancelled Phase = "cancelled"
+)
+
+// maxFinishedJobs bounds how many finished jobs are kept for polling.
+const maxFinishedJobs = 20
+
+// Snapshot is a point-in-time copy of a job.
+type Snapshot struct {
+	ID         string
+	Kind       string
+	Phase      Phase
+	Progress   state.FlashInfo
+	CreatedAt  time.Time
+	FinishedAt time.Time
+	Err        string
+	// ErrCode is the stable code of Err when the error provides one.
+	ErrCode string
+}
+
+// codedError is implemented by errors that carry a stable, machine-readable
+// code (e.g. *flash.Error).
+type codedError interface {
+	error
+	ErrorCode() string
+}
+
+// Job is a long-running operation (e.g. a flash) that outlives the HTTP request
+// which started it. Clients poll it by ID.
+type Job struct {
+	id        string
+	kind      string
+	createdAt time.Time
+	progress  func() state.FlashInfo
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	mu         sync.RWMutex
+	phase      Phase
+	finalInfo  state.FlashInfo
+	finishedAt time.Time
+	err        error
+}
+
+// Manager owns all jobs of the process.
+type Manager struct {
+	baseCtx context.Context
+
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []*Job
+}
+
+// NewManager creates a manager whose jobs are cancelled when ctx ends.
+// Jobs are deliberately not tied to any request context.
+func NewManager(ctx context.Context) *Manager {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &Manager{baseCtx: ctx, jobs: make(map[string]*Job)}
+}
+
+// Start runs run in the background as a new job of the given kind.
+// progress is optional; when set it is polled for live progress while the job
+// runs and sampled once more when it finishes.
+func (manager *Manager) Start(kind string, progress func() state.FlashInfo, run func(ctx context.Context) error) *Job {
+	jobCtx, cancel := context.WithCancel(manager.baseCtx)
+	job := &Job{
+		id:        newJobID(),
+		kind:      kind,
+		createdAt: time.Now(),
+		progress:  progress,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		phase:     PhaseRunning,
+	}
+
+	manager.mu.Lock()
+	manager.jobs[job.id] = job
+	manager.order = append(manager.order, job)
+	manager.pruneLocked()
+	manager.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		err := run(jobCtx)
+		job.finish(err)
+	}()
+	return job
+}
+
+// Get returns the job with the given ID.
+func (manager *Manager) Get(id string) (*Job, bool) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	job, ok := manager.jobs[id]
+	return job, ok
+}
+
+// List returns snapshots of all known jobs, oldest first.
+func (manager *Manager) List() []Snapshot {
+	manager.mu.Lock()
+	jobs := make([]*Job, len(manager.order))
+	copy(jobs, manager.order)
+	manager.mu.Unlock()
+
+	snapshots := make([]Snapshot, 0, len(jobs))
+	for _, job := range jobs {
+		snapshots = append(snapshots, job.Snapshot())
+	}
+	return snapshots
+}
+
+func (manager *Manager) pruneLocked() {
+	finished := 0
+	for _, job := range manager.order {
+		if job.finished() {
+			finished++
+		}
+	}
+	if finished <= maxFinishedJobs {
+		return
+	}
+
+	kept := manager.order[:0]
+	for _, job := range manager.order {
+		if finished > maxFinishedJobs && job.finished() {
+			delete(manager.jobs, job.id)
+			finished--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	manager.order = kept
+}
+
+func (job *Job) ID() string { return job.id }
+
+// Done is closed once the job has finished.
+func (job *Job) Done() <-chan struct{} { return job.done }
+
+// Err returns the final error of a finished job.
+func (job *Job) Err() error {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.err
+}
+
+// Cancel cancels the job's context.
+func (job *Job) Cancel() { job.cancel() }
+
+func (job *Job) Snapshot() Snapshot {
+	job.mu.RLock()
+	snapshot := Snapshot{
+		ID:         job.id,
+		Kind:       job.kind,
+		Phase:      job.phase,
+		Progress:   job.finalInfo,
+		CreatedAt:  job.createdAt,
+		FinishedAt: job.finishedAt,
+	}
+	if job.err != nil {
+		snapshot.Err = job.err.Error()
+		var coded codedError
+		if errors.As(job.err, &coded) {
+			snapshot.ErrCode = coded.ErrorCode()
+		}
+	}
+	job.mu.RUnlock()
+
+	if snapshot.Phase == PhaseRunning && job.progress != nil {
+		snapshot.Progress = job.progress()
+	}
+	return snapshot
+}
+
+func (job *Job) finished() bool {
+	job.mu.RLock()
+	defer job.mu.RUnlock()
+	return job.phase != PhaseRunning
+}
+
+func (job *Job) finish(err error) {
+	var finalInfo state.FlashInfo
+	if job.progress != nil {
+		finalInfo = job.progress()
+	}
+
+	job.mu.Lock()
+	job.finalInfo = finalInfo
+	job.finishedAt = time.Now()
+	job.err = err
+	switch {
+	case err == nil:
+		job.phase = PhaseDone
+	case errors.Is(err, context.Canceled):
+		job.phase = PhaseCancelled
+	default:
+		job.phase = PhaseError
+	}
+	job.mu.Unlock()
+	close(job.done)
+}
+
+func newJobID() string {
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(raw[:])
+}
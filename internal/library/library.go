@@ -0,0 +1,443 @@
+// Package library keeps disk images on the host's own storage so they can be
+// uploaded once and flashed onto many cartridges.
+//
+// Every image is stored as <id>.img next to a <id>.json metadata sidecar and,
+// optionally, a <id>.bmap block map used for sparse flashing.
+package library
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/rook-computer/keymaker/internal/ctxio"
+	"github.com/rook-computer/keymaker/internal/flash"
+)
+
+var (
+	// ErrNotFound is returned for unknown image IDs.
+	ErrNotFound = errors.New("image not found")
+	// ErrInvalidName is returned for empty or unsafe display names.
+	ErrInvalidName = errors.New("invalid image name")
+	// ErrNoBmap is returned when an image has no block map attached.
+	ErrNoBmap = errors.New("image has no bmap")
+)
+
+const (
+	imageSuffix    = ".img"
+	metadataSuffix = ".json"
+	bmapSuffix     = ".bmap"
+	// tempPrefix marks uploads in progress; leftovers of a crash are removed
+	// when the library is opened.
+	tempPrefix = ".upload-"
+
+	maxNameLength = 255
+)
+
+var idPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// Image describes a stored image.
+type Image struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Size is the size of the stored (possibly compressed) file in bytes.
+	Size   int64        `json:"size"`
+	Format flash.Format `json:"format"`
+	// SHA256 is the hex digest of the stored file.
+	SHA256 string `json:"sha256"`
+	// ImageSize is the decompressed size where the format reveals it, 0 if
+	// unknown. For gzip it is a lower bound (see ImageSizeApproximate).
+	ImageSize int64     `json:"imageSize"`
+	CreatedAt time.Time `json:"createdAt"`
+	// HasBmap reports whether a block map is attached (see SetBmap).
+	HasBmap bool `json:"-"`
+}
+
+// ImageSizeApproximate tells whether ImageSize may be short of the real size:
+// gzip stores the size modulo 4 GiB, so a larger image looks smaller by a
+// multiple of 4 GiB and nothing in the file tells it apart.
+func (image Image) ImageSizeApproximate() bool {
+	return image.Format == flash.FormatGzip && image.ImageSize > 0
+}
+
+// Library is a directory of stored images. It is safe for concurrent use.
+type Library struct {
+	dir string
+
+	mu sync.Mutex
+}
+
+// New opens the library in dir. The directory is created on first upload.
+func New(dir string) *Library {
+	lib := &Library{dir: filepath.Clean(dir)}
+	lib.removeStaleUploads()
+	return lib
+}
+
+// Check creates the directory if needed and makes sure images can be stored
+// in it, so a bad directory is reported at startup rather than on the first
+// upload.
+func (lib *Library) Check() error {
+	if err := os.MkdirAll(lib.dir, 0o755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(lib.dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	_ = probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Dir returns the directory the images are stored in.
+func (lib *Library) Dir() string { return lib.dir }
+
+// List returns all stored images, newest first.
+func (lib *Library) List() ([]Image, error) {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+
+	entries, err := os.ReadDir(lib.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Image{}, nil
+		}
+		return nil, err
+	}
+	images := []Image{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), metadataSuffix)
+		if !ok || !idPattern.MatchString(id) {
+			continue
+		}
+		image, err := lib.readMetadata(id)
+		if err != nil {
+			// A sidecar without its image (or vice versa) is not listed.
+			continue
+		}
+		images = append(images, image)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if !images[i].CreatedAt.Equal(images[j].CreatedAt) {
+			return images[i].CreatedAt.After(images[j].CreatedAt)
+		}
+		return images[i].ID < images[j].ID
+	})
+	return images, nil
+}
+
+// Get returns the metadata of one image.
+func (lib *Library) Get(id string) (Image, error) {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	return lib.readMetadata(id)
+}
+
+// Add stores body as a new image called name. The format is sniffed from the
+// first bytes and must be one the flasher understands.
+func (lib *Library) Add(ctx context.Context, name string, body io.Reader) (Image, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return Image{}, err
+	}
+	if err := os.MkdirAll(lib.dir, 0o755); err != nil {
+		return Image{}, err
+	}
+
+	buffered := bufio.NewReaderSize(body, flash.SniffSize)
+	header, err := buffered.Peek(flash.SniffSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return Image{}, err
+	}
+	format, err := flash.DetectFormat(header)
+	if err != nil {
+		return Image{}, err
+	}
+
+	temp, err := os.CreateTemp(lib.dir, tempPrefix+"*")
+	if err != nil {
+		return Image{}, err
+	}
+	tempPath := temp.Name()
+	stored := false
+	defer func() {
+		if !stored {
+			_ = temp.Close()
+			_ = os.Remove(tempPath)
+		}
+	}()
+
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(temp, digest), ctxio.NewReader(ctx, buffered))
+	if err != nil {
+		return Image{}, err
+	}
+	if err := temp.Sync(); err != nil {
+		return Image{}, err
+	}
+
+	imageSize := flash.StoredSizeHint(temp, header, size)
+	if err := temp.Close(); err != nil {
+		return Image{}, err
+	}
+
+	image := Image{
+		ID:        newID(),
+		Name:      name,
+		Size:      size,
+		Format:    format,
+		SHA256:    hex.EncodeToString(digest.Sum(nil)),
+		ImageSize: imageSize,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	if err := os.Rename(tempPath, lib.imagePath(image.ID)); err != nil {
+		return Image{}, err
+	}
+	stored = true
+	if err := lib.writeMetadata(image); err != nil {
+		_ = os.Remove(lib.imagePath(image.ID))
+		return Image{}, err
+	}
+	return image, nil
+}
+
+// Rename changes the display name of an image.
+func (lib *Library) Rename(id, name string) (Image, error) {
+	name, err := cleanName(name)
+	if err != nil {
+		return Image{}, err
+	}
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+
+	image, err := lib.readMetadata(id)
+	if err != nil {
+		return Image{}, err
+	}
+	image.Name = name
+	if err := lib.writeMetadata(image); err != nil {
+		return Image{}, err
+	}
+	return image, nil
+}
+
+// Delete removes an image. A flash already reading it keeps its open file.
+func (lib *Library) Delete(id string) error {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+
+	if _, err := lib.readMetadata(id); err != nil {
+		return err
+	}
+	if err := os.Remove(lib.metadataPath(id)); err != nil {
+		return err
+	}
+	if err := os.Remove(lib.imagePath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(lib.bmapPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SetBmap attaches a bmaptool block map to an image, replacing any previous
+// one. Flashes of the image then only write the mapped blocks.
+func (lib *Library) SetBmap(id string, data []byte) (Image, error) {
+	if _, err := flash.ParseBmap(data); err != nil {
+		return Image{}, err
+	}
+
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	image, err := lib.readMetadata(id)
+	if err != nil {
+		return Image{}, err
+	}
+	if err := lib.writeFile(lib.bmapPath(id), data); err != nil {
+		return Image{}, err
+	}
+	image.HasBmap = true
+	return image, nil
+}
+
+// Bmap returns the block map attached to an image.
+func (lib *Library) Bmap(id string) ([]byte, error) {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+
+	if _, err := lib.readMetadata(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(lib.bmapPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoBmap
+	}
+	return data, err
+}
+
+// ParsedBmap returns the block map attached to an image, or nil if it has none.
+func (lib *Library) ParsedBmap(id string) (*flash.Bmap, error) {
+	data, err := lib.Bmap(id)
+	if errors.Is(err, ErrNoBmap) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return flash.ParseBmap(data)
+}
+
+// DeleteBmap detaches the block map of an image.
+func (lib *Library) DeleteBmap(id string) error {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+
+	if _, err := lib.readMetadata(id); err != nil {
+		return err
+	}
+	err := os.Remove(lib.bmapPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoBmap
+	}
+	return err
+}
+
+// Open opens the stored file of an image for reading.
+func (lib *Library) Open(id string) (*os.File, Image, error) {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+
+	image, err := lib.readMetadata(id)
+	if err != nil {
+		return nil, Image{}, err
+	}
+	file, err := os.Open(lib.imagePath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, Image{}, ErrNotFound
+		}
+		return nil, Image{}, err
+	}
+	return file, image, nil
+}
+
+func (lib *Library) imagePath(id string) string {
+	return filepath.Join(lib.dir, id+imageSuffix)
+}
+
+func (lib *Library) metadataPath(id string) string {
+	return filepath.Join(lib.dir, id+metadataSuffix)
+}
+
+func (lib *Library) bmapPath(id string) string {
+	return filepath.Join(lib.dir, id+bmapSuffix)
+}
+
+// readMetadata loads the sidecar of id. The caller holds lib.mu.
+func (lib *Library) readMetadata(id string) (Image, error) {
+	if !idPattern.MatchString(id) {
+		return Image{}, ErrNotFound
+	}
+	raw, err := os.ReadFile(lib.metadataPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, err
+	}
+	if _, err := os.Stat(lib.imagePath(id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Image{}, ErrNotFound
+		}
+		return Image{}, err
+	}
+	var image Image
+	if err := json.Unmarshal(raw, &image); err != nil {
+		return Image{}, fmt.Errorf("read metadata of image %s: %w", id, err)
+	}
+	image.ID = id
+	_, err = os.Stat(lib.bmapPath(id))
+	image.HasBmap = err == nil
+	return image, nil
+}
+
+// writeMetadata replaces the sidecar of image atomically. The caller holds lib.mu.
+func (lib *Library) writeMetadata(image Image) error {
+	raw, err := json.MarshalIndent(image, "", "  ")
+	if err != nil {
+		return err
+	}
+	return lib.writeFile(lib.metadataPath(image.ID), append(raw, '\n'))
+}
+
+// writeFile replaces path atomically. The caller holds lib.mu.
+func (lib *Library) writeFile(path string, data []byte) error {
+	temp, err := os.CreateTemp(lib.dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	tempPath := temp.Name()
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		_ = os.Remove(tempPath)
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+func (lib *Library) removeStaleUploads() {
+	stale, _ := filepath.Glob(filepath.Join(lib.dir, tempPrefix+"*"))
+	for _, path := range stale {
+		_ = os.Remove(path)
+	}
+}
+
+// cleanName trims a display name and rejects names that are empty, too long
+// or contain path separators or control characters.
+func cleanName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxNameLength || name == "." || name == ".." {
+		return "", ErrInvalidName
+	}
+	for _, char := range name {
+		if char == '/' || char == '\\' || unicode.IsControl(char) {
+			return "", ErrInvalidName
+		}
+	}
+	return name, nil
+}
+
+func newID() string {
+	var raw [8]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		// Fall back to the clock; collisions within a nanosecond are not a concern here.
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(raw[:])
+}
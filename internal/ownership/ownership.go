@@ -0,0 +1,29 @@
+// Package ownership keeps files that keymaker (running as root) creates on a
+// cartridge owned by the user of the install.
+package ownership
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// MkdirAll creates dir and its missing parents with the owner of the
+// closest existing ancestor (see ChownLike).
+func MkdirAll(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := MkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	ChownLike(dir, parent)
+	return nil
+}
@@ -0,0 +1,21 @@
+package ownership
+
+import (
+	"os"
+	"syscall"
+)
+
+// ChownLike gives path the owner of reference, so EmulationStation (running
+// as the user owning the install, not as root) can still rewrite the file.
+// It is best effort: without the right to chown, files stay ours.
+func ChownLike(path, reference string) {
+	info, err := os.Stat(reference)
+	if err != nil {
+		return
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	_ = os.Lchown(path, int(stat.Uid), int(stat.Gid))
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package ownership
+
+// ChownLike only matters on the device, which runs Linux.
+func ChownLike(path, reference string) {}
@@ -0,0 +1,180 @@
+// Package partition parses MBR and GPT partition tables from the start of a
+// disk image and derives which regions of the disk hold data.
+package partition
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// SectorSize is the logical sector size assumed for all tables. SD cards
+// always use 512-byte sectors.
+const SectorSize = 512
+
+// HeaderSize is the number of leading disk bytes Parse needs: the MBR, the
+// GPT header and a standard GPT entry array (128 entries of 128 bytes).
+const HeaderSize = 34 * SectorSize
+
+type Scheme string
+
+const (
+	SchemeMBR Scheme = "mbr"
+	SchemeGPT Scheme = "gpt"
+)
+
+// ErrNoTable is returned when the header carries no partition table.
+var ErrNoTable = errors.New("no partition table found")
+
+// Partition is one entry of a partition table. Offsets are in bytes.
+type Partition struct {
+	Index int
+	// Type is the MBR type byte (e.g. "0x0c") or the GPT type GUID.
+	Type  string
+	Name  string
+	Start int64
+	Size  int64
+}
+
+func (p Partition) End() int64 { return p.Start + p.Size }
+
+// Table is a parsed partition table.
+type Table struct {
+	Scheme     Scheme
+	Partitions []Partition
+}
+
+// End returns the offset just past the last partition, i.e. the number of
+// bytes a disk needs to hold every partition. A GPT's backup header at the
+// very end of the disk is not included.
+func (table *Table) End() int64 {
+	var end int64
+	for _, p := range table.Partitions {
+		if p.End() > end {
+			end = p.End()
+		}
+	}
+	if end == 0 && table.Scheme == SchemeGPT {
+		end = HeaderSize
+	}
+	if end == 0 {
+		end = SectorSize
+	}
+	return end
+}
+
+// Parse reads the partition table from header, which should hold the first
+// HeaderSize bytes of the disk.
+func Parse(header []byte) (*Table, error) {
+	if len(header) < SectorSize || header[510] != 0x55 || header[511] != 0xaa {
+		return nil, ErrNoTable
+	}
+	if isProtectiveMBR(header) {
+		return parseGPT(header)
+	}
+	return parseMBR(header)
+}
+
+const (
+	mbrEntriesOffset = 446
+	mbrEntrySize     = 16
+	mbrTypeGPT       = 0xee
+)
+
+func isProtectiveMBR(header []byte) bool {
+	for i := 0; i < 4; i++ {
+		if header[mbrEntriesOffset+i*mbrEntrySize+4] == mbrTypeGPT {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMBR returns the primary partitions. Logical partitions live inside the
+// extended partition, which is reported as a whole.
+func parseMBR(header []byte) (*Table, error) {
+	table := &Table{Scheme: SchemeMBR}
+	for i := 0; i < 4; i++ {
+		entry := header[mbrEntriesOffset+i*mbrEntrySize : mbrEntriesOffset+(i+1)*mbrEntrySize]
+		partType := entry[4]
+		startLBA := int64(binary.LittleEndian.Uint32(entry[8:12]))
+		sectors := int64(binary.LittleEndian.Uint32(entry[12:16]))
+		if partType == 0 || sectors == 0 {
+			continue
+		}
+		table.Partitions = append(table.Partitions, Partition{
+			Index: i + 1,
+			Type:  fmt.Sprintf("0x%02x", partType),
+			Start: startLBA * SectorSize,
+			Size:  sectors * SectorSize,
+		})
+	}
+	return table, nil
+}
+
+var gptSignature = []byte("EFI PART")
+
+func parseGPT(header []byte) (*Table, error) {
+	if len(header) < 2*SectorSize || !bytes.Equal(header[SectorSize:SectorSize+8], gptSignature) {
+		return nil, errors.New("protective MBR without GPT header")
+	}
+	gpt := header[SectorSize : 2*SectorSize]
+	entriesLBA := int64(binary.LittleEndian.Uint64(gpt[72:80]))
+	entryCount := int64(binary.LittleEndian.Uint32(gpt[80:84]))
+	entrySize := int64(binary.LittleEndian.Uint32(gpt[84:88]))
+	if entrySize < 128 || entrySize > SectorSize {
+		return nil, fmt.Errorf("invalid GPT entry size %d", entrySize)
+	}
+	// Checked piecewise: the fields are large enough to overflow a product.
+	entriesStart := entriesLBA * SectorSize
+	if entriesLBA < 2 || entriesLBA >= int64(len(header))/SectorSize || entryCount > (int64(len(header))-entriesStart)/entrySize {
+		return nil, fmt.Errorf("GPT entries outside the first %d bytes", len(header))
+	}
+
+	table := &Table{Scheme: SchemeGPT}
+	for i := int64(0); i < entryCount; i++ {
+		entry := header[entriesStart+i*entrySize : entriesStart+(i+1)*entrySize]
+		typeGUID := entry[0:16]
+		if bytes.Equal(typeGUID, make([]byte, 16)) {
+			continue
+		}
+		firstLBA := int64(binary.LittleEndian.Uint64(entry[32:40]))
+		lastLBA := int64(binary.LittleEndian.Uint64(entry[40:48]))
+		if lastLBA < firstLBA {
+			continue
+		}
+		table.Partitions = append(table.Partitions, Partition{
+			Index: int(i) + 1,
+			Type:  formatGUID(typeGUID),
+			Name:  decodeUTF16Name(entry[56:128]),
+			Start: firstLBA * SectorSize,
+			Size:  (lastLBA - firstLBA + 1) * SectorSize,
+		})
+	}
+	return table, nil
+}
+
+// formatGUID renders a mixed-endian GPT GUID in its canonical form.
+func formatGUID(raw []byte) string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(raw[0:4]),
+		binary.LittleEndian.Uint16(raw[4:6]),
+		binary.LittleEndian.Uint16(raw[6:8]),
+		raw[8:10],
+		raw[10:16])
+}
+
+func decodeUTF16Name(raw []byte) string {
+	units := make([]uint16, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		unit := binary.LittleEndian.Uint16(raw[i : i+2])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return strings.TrimSpace(string(utf16.Decode(units)))
+}
@@ -0,0 +1,105 @@
+package partition
+
+import (
+	"io"
+	"sort"
+)
+
+// Region is a byte range of a disk.
+type Region struct {
+	Offset int64
+	Length int64
+}
+
+func (r Region) End() int64 { return r.Offset + r.Length }
+
+// AllocatedRegions returns the parts of a disk of the given size that hold
+// data: everything before the first partition (the tables and any boot
+// loader stored there) and every partition. Free space between and after the
+// partitions is left out. Regions are sorted, merged and clipped to size.
+func (table *Table) AllocatedRegions(size int64) []Region {
+	partitions := append([]Partition(nil), table.Partitions...)
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].Start < partitions[j].Start })
+
+	head := table.End()
+	if len(partitions) > 0 {
+		head = partitions[0].Start
+	}
+	regions := []Region{{Offset: 0, Length: head}}
+	for _, p := range partitions {
+		regions = append(regions, Region{Offset: p.Start, Length: p.Size})
+	}
+
+	merged := make([]Region, 0, len(regions))
+	for _, region := range regions {
+		if region.End() > size {
+			region.Length = size - region.Offset
+		}
+		if region.Length <= 0 {
+			continue
+		}
+		if last := len(merged) - 1; last >= 0 && region.Offset <= merged[last].End() {
+			if region.End() > merged[last].End() {
+				merged[last].Length = region.End() - merged[last].Offset
+			}
+			continue
+		}
+		merged = append(merged, region)
+	}
+	return merged
+}
+
+// ZeroFill returns a reader over the first size bytes of source in which all
+// bytes outside regions read as zero. regions must be sorted and must not
+// overlap, as returned by AllocatedRegions.
+func ZeroFill(source io.Reader, regions []Region, size int64) io.Reader {
+	return &zeroFillReader{source: source, regions: regions, size: size}
+}
+
+type zeroFillReader struct {
+	source  io.Reader
+	regions []Region
+	size    int64
+	offset  int64
+}
+
+func (r *zeroFillReader) Read(buffer []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	for len(r.regions) > 0 && r.regions[0].End() <= r.offset {
+		r.regions = r.regions[1:]
+	}
+	if remaining := r.size - r.offset; int64(len(buffer)) > remaining {
+		buffer = buffer[:remaining]
+	}
+
+	// Inside an allocated region: pass the source data through.
+	if len(r.regions) > 0 && r.regions[0].Offset <= r.offset {
+		if limit := r.regions[0].End() - r.offset; int64(len(buffer)) > limit {
+			buffer = buffer[:limit]
+		}
+		readCount, err := r.source.Read(buffer)
+		r.offset += int64(readCount)
+		if err == io.EOF && r.offset < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+		return readCount, err
+	}
+
+	// Free space up to the next region: skip the source data, emit zeros.
+	gap := r.size - r.offset
+	if len(r.regions) > 0 {
+		gap = r.regions[0].Offset - r.offset
+	}
+	if int64(len(buffer)) > gap {
+		buffer = buffer[:gap]
+	}
+	skipped, err := io.CopyN(io.Discard, r.source, int64(len(buffer)))
+	clear(buffer[:skipped])
+	r.offset += skipped
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return int(skipped), err
+}
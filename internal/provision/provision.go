@@ -0,0 +1,392 @@
+// Package provision prepares a freshly flashed cartridge for its first boot:
+// it grows the root filesystem to fill the card and writes the hostname,
+// WiFi credentials and an SSH key into the image.
+package provision
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// ErrInvalidOptions is returned by Options.Validate.
+var ErrInvalidOptions = errors.New("invalid provisioning options")
+
+// ErrNoTarget is returned when provisioning is requested for a flash that
+// does not go to the cartridge, e.g. into an image file.
+var ErrNoTarget = errors.New("provisioning needs a flash to the cartridge device")
+
+// DefaultSSHUser receives the authorized key when Options.SSHUser is empty.
+const DefaultSSHUser = "pi"
+
+// Options selects the provisioning steps of a flash. The zero value
+// provisions nothing.
+type Options struct {
+	// Expand grows the last partition and its filesystem to the end of the
+	// cartridge.
+	Expand bool `json:"expand"`
+	// Hostname is written to /etc/hostname and /etc/hosts.
+	Hostname string `json:"hostname"`
+	// WiFi is written to wpa_supplicant.conf on the boot partition.
+	WiFi *WiFi `json:"wifi"`
+	// SSHAuthorizedKey is added to ~/.ssh/authorized_keys of SSHUser, and
+	// the SSH server is enabled via the "ssh" file on the boot partition.
+	SSHAuthorizedKey string `json:"sshAuthorizedKey"`
+	SSHUser          string `json:"sshUser"`
+}
+
+// WiFi is a network the cartridge joins on boot. An empty PSK means an open
+// network.
+type WiFi struct {
+	SSID string `json:"ssid"`
+	PSK  string `json:"psk"`
+	// Country is the ISO 3166 code for the regulatory domain (e.g. "DE").
+	Country string `json:"country"`
+}
+
+var (
+	hostnameLabel = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+	userPattern   = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+	countryCode   = regexp.MustCompile(`^[A-Z]{2}$`)
+	hexPSK        = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+	keyTypes      = []string{"ssh-", "ecdsa-", "sk-"}
+)
+
+// Empty reports whether no step is requested.
+func (opts Options) Empty() bool {
+	return !opts.Expand && opts.Hostname == "" && opts.WiFi == nil && opts.SSHAuthorizedKey == ""
+}
+
+// Validate checks the options before anything is flashed.
+func (opts Options) Validate() error {
+	if opts.Hostname != "" {
+		if len(opts.Hostname) > 253 {
+			return fmt.Errorf("%w: hostname is longer than 253 characters", ErrInvalidOptions)
+		}
+		for _, label := range strings.Split(opts.Hostname, ".") {
+			if !hostnameLabel.MatchString(label) {
+				return fmt.Errorf("%w: %q is not a valid hostname", ErrInvalidOptions, opts.Hostname)
+			}
+		}
+	}
+	if wifi := opts.WiFi; wifi != nil {
+		if len(wifi.SSID) == 0 || len(wifi.SSID) > 32 {
+			return fmt.Errorf("%w: the WiFi SSID must be 1 to 32 bytes", ErrInvalidOptions)
+		}
+		if wifi.PSK != "" && !hexPSK.MatchString(wifi.PSK) {
+			if len(wifi.PSK) < 8 || len(wifi.PSK) > 63 || !printableASCII(wifi.PSK) {
+				return fmt.Errorf("%w: the WiFi passphrase must be 8 to 63 printable ASCII characters", ErrInvalidOptions)
+			}
+		}
+		if wifi.Country != "" && !countryCode.MatchString(wifi.Country) {
+			return fmt.Errorf("%w: the WiFi country must be a two-letter ISO 3166 code", ErrInvalidOptions)
+		}
+	}
+	if opts.SSHAuthorizedKey != "" {
+		key := strings.TrimSpace(opts.SSHAuthorizedKey)
+		if strings.ContainsAny(key, "\r\n") || len(strings.Fields(key)) < 2 || !hasKeyType(key) {
+			return fmt.Errorf("%w: the SSH key must be a single authorized_keys line", ErrInvalidOptions)
+		}
+	}
+	if opts.SSHUser != "" && !userPattern.MatchString(opts.SSHUser) {
+		return fmt.Errorf("%w: %q is not a valid user name", ErrInvalidOptions, opts.SSHUser)
+	}
+	return nil
+}
+
+// Volume is a filesystem of the flashed image.
+type Volume string
+
+const (
+	// Boot is the FAT boot partition.
+	Boot Volume = "boot"
+	// Root is the root filesystem.
+	Root Volume = "root"
+)
+
+// Target is the flashed cartridge being provisioned.
+type Target interface {
+	// Expand grows the last partition and its filesystem to the end of the
+	// cartridge and describes what it did.
+	Expand(ctx context.Context) (string, error)
+	// ReadFile returns a file of volume; a missing file reads as empty.
+	ReadFile(ctx context.Context, volume Volume, path string) ([]byte, error)
+	// WriteFile replaces a file of volume, creating its directory. owner,
+	// when set, is a user of the image that gets the file.
+	WriteFile(ctx context.Context, volume Volume, path string, data []byte, mode os.FileMode, owner string) error
+}
+
+// Error is returned by Run when steps failed. The image itself was flashed
+// completely.
+type Error struct {
+	Failed []state.ProvisionStep
+}
+
+func (err *Error) Error() string {
+	parts := make([]string, 0, len(err.Failed))
+	for _, step := range err.Failed {
+		parts = append(parts, step.Name+": "+step.Detail)
+	}
+	return "provisioning failed: " + strings.Join(parts, "; ")
+}
+
+// ErrorCode is the stable code reported for failed provisioning.
+func (err *Error) ErrorCode() string { return "provision_failed" }
+
+type step struct {
+	name string
+	run  func(ctx context.Context, target Target) (string, error)
+}
+
+// steps returns the requested steps in the order they run. The partition is
+// grown first, while nothing of the card is mounted.
+func (opts Options) steps() []step {
+	var steps []step
+	if opts.Expand {
+		steps = append(steps, step{"expand", func(ctx context.Context, target Target) (string, error) {
+			return target.Expand(ctx)
+		}})
+	}
+	if opts.Hostname != "" {
+		steps = append(steps, step{"hostname", opts.writeHostname})
+	}
+	if opts.WiFi != nil {
+		steps = append(steps, step{"wifi", opts.writeWiFi})
+	}
+	if opts.SSHAuthorizedKey != "" {
+		steps = append(steps, step{"ssh", opts.writeSSHKey})
+	}
+	return steps
+}
+
+// Run applies opts to target, recording every step in report. All steps
+// run even if an earlier one failed; the failures are returned as *Error.
+func Run(ctx context.Context, target Target, opts Options, report *Report) error {
+	steps := opts.steps()
+	names := make([]string, 0, len(steps))
+	for _, step := range steps {
+		names = append(names, step.name)
+	}
+	report.begin(names)
+	defer report.end()
+
+	var failed []state.ProvisionStep
+	for index, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.set(index, "running", "")
+		detail, err := step.run(ctx, target)
+		if err != nil {
+			report.set(index, "failed", err.Error())
+			failed = append(failed, state.ProvisionStep{Name: step.name, Status: "failed", Detail: err.Error()})
+			continue
+		}
+		report.set(index, "ok", detail)
+	}
+	if len(failed) > 0 {
+		return &Error{Failed: failed}
+	}
+	return nil
+}
+
+func (opts Options) writeHostname(ctx context.Context, target Target) (string, error) {
+	if err := target.WriteFile(ctx, Root, "/etc/hostname", []byte(opts.Hostname+"\n"), 0o644, ""); err != nil {
+		return "", err
+	}
+	hosts, err := target.ReadFile(ctx, Root, "/etc/hosts")
+	if err != nil {
+		return "", err
+	}
+	if err := target.WriteFile(ctx, Root, "/etc/hosts", setHostsEntry(hosts, opts.Hostname), 0o644, ""); err != nil {
+		return "", err
+	}
+	return "hostname set to " + opts.Hostname, nil
+}
+
+// setHostsEntry points the 127.0.1.1 line of an /etc/hosts file at hostname,
+// the way Debian maps the local hostname.
+func setHostsEntry(hosts []byte, hostname string) []byte {
+	entry := "127.0.1.1\t" + hostname
+	var lines []string
+	if trimmed := strings.TrimRight(string(hosts), "\n"); trimmed != "" {
+		lines = strings.Split(trimmed, "\n")
+	} else {
+		lines = []string{"127.0.0.1\tlocalhost"}
+	}
+	replaced := false
+	kept := lines[:0]
+	for _, line := range lines {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "127.0.1.1" {
+			if replaced {
+				continue
+			}
+			line = entry
+			replaced = true
+		}
+		kept = append(kept, line)
+	}
+	if !replaced {
+		kept = append(kept, entry)
+	}
+	return []byte(strings.Join(kept, "\n") + "\n")
+}
+
+// writeWiFi drops a wpa_supplicant.conf on the boot partition, which
+// Raspberry Pi OS moves into place on the next boot. Passphrases are stored
+// as the derived key only.
+func (opts Options) writeWiFi(ctx context.Context, target Target) (string, error) {
+	wifi := opts.WiFi
+	var config strings.Builder
+	config.WriteString("ctrl_interface=DIR=/var/run/wpa_supplicant GROUP=netdev\nupdate_config=1\n")
+	if wifi.Country != "" {
+		config.WriteString("country=" + wifi.Country + "\n")
+	}
+	config.WriteString("\nnetwork={\n")
+	if printableASCII(wifi.SSID) && !strings.Contains(wifi.SSID, `"`) {
+		config.WriteString("\tssid=\"" + wifi.SSID + "\"\n")
+	} else {
+		config.WriteString("\tssid=" + hex.EncodeToString([]byte(wifi.SSID)) + "\n")
+	}
+	switch {
+	case wifi.PSK == "":
+		config.WriteString("\tkey_mgmt=NONE\n")
+	case hexPSK.MatchString(wifi.PSK):
+		config.WriteString("\tpsk=" + strings.ToLower(wifi.PSK) + "\n\tkey_mgmt=WPA-PSK\n")
+	default:
+		key, err := pbkdf2.Key(sha1.New, wifi.PSK, []byte(wifi.SSID), 4096, 32)
+		if err != nil {
+			return "", err
+		}
+		config.WriteString("\tpsk=" + hex.EncodeToString(key) + "\n\tkey_mgmt=WPA-PSK\n")
+	}
+	config.WriteString("}\n")
+
+	if err := target.WriteFile(ctx, Boot, "/wpa_supplicant.conf", []byte(config.String()), 0o600, ""); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("WiFi network %q configured", wifi.SSID), nil
+}
+
+func (opts Options) writeSSHKey(ctx context.Context, target Target) (string, error) {
+	user := opts.SSHUser
+	if user == "" {
+		user = DefaultSSHUser
+	}
+	home := "/home/" + user
+	if user == "root" {
+		home = "/root"
+	}
+	path := home + "/.ssh/authorized_keys"
+	key := strings.TrimSpace(opts.SSHAuthorizedKey)
+
+	existing, err := target.ReadFile(ctx, Root, path)
+	if err != nil {
+		return "", err
+	}
+	detail := "key added for " + user
+	if containsLine(string(existing), key) {
+		detail = "key already authorized for " + user
+	} else {
+		keys := strings.TrimRight(string(existing), "\n")
+		if keys != "" {
+			keys += "\n"
+		}
+		if err := target.WriteFile(ctx, Root, path, []byte(keys+key+"\n"), 0o600, user); err != nil {
+			return "", err
+		}
+	}
+	if err := target.WriteFile(ctx, Boot, "/ssh", nil, 0o644, ""); err != nil {
+		return "", err
+	}
+	return detail + "; SSH server enabled", nil
+}
+
+func containsLine(text, line string) bool {
+	for _, existing := range strings.Split(text, "\n") {
+		if strings.TrimSpace(existing) == line {
+			return true
+		}
+	}
+	return false
+}
+
+func hasKeyType(key string) bool {
+	for _, prefix := range keyTypes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func printableASCII(value string) bool {
+	for _, char := range value {
+		if char < 0x20 || char > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// Report tracks the steps of the current (or last) provisioning run for
+// status reporting. The zero value is ready to use.
+type Report struct {
+	mu      sync.Mutex
+	running bool
+	steps   []state.ProvisionStep
+}
+
+// Reset forgets the previous run, e.g. when a new flash starts.
+func (report *Report) Reset() {
+	report.mu.Lock()
+	report.running = false
+	report.steps = nil
+	report.mu.Unlock()
+}
+
+// Apply adds the steps to a flash status. While provisioning runs, the
+// status is "provisioning".
+func (report *Report) Apply(info state.FlashInfo) state.FlashInfo {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	if len(report.steps) > 0 {
+		info.Provisioning = append([]state.ProvisionStep(nil), report.steps...)
+	}
+	if report.running {
+		info.Status = "provisioning"
+	}
+	return info
+}
+
+func (report *Report) begin(names []string) {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	report.running = true
+	report.steps = make([]state.ProvisionStep, 0, len(names))
+	for _, name := range names {
+		report.steps = append(report.steps, state.ProvisionStep{Name: name, Status: "pending"})
+	}
+}
+
+func (report *Report) set(index int, status, detail string) {
+	report.mu.Lock()
+	report.steps[index].Status = status
+	report.steps[index].Detail = detail
+	report.mu.Unlock()
+}
+
+func (report *Report) end() {
+	report.mu.Lock()
+	report.running = false
+	report.mu.Unlock()
+}
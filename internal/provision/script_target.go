@@ -0,0 +1,40 @@
+package provision
+
+import (
+	"context"
+	"os"
+
+	"github.com/rook-computer/keymaker/internal/system"
+)
+
+// ScriptTarget provisions the cartridge SD card through the device scripts,
+// which mount its partitions as needed.
+type ScriptTarget struct {
+	Runner system.Runner
+}
+
+func (target ScriptTarget) Expand(ctx context.Context) (string, error) {
+	return system.ExpandCartridge(ctx, target.Runner)
+}
+
+func (target ScriptTarget) ReadFile(ctx context.Context, volume Volume, path string) ([]byte, error) {
+	contents, err := system.ReadCartridgeFile(ctx, target.Runner, string(volume), path)
+	return []byte(contents), err
+}
+
+// WriteFile hands data to the script through a private temporary file.
+func (target ScriptTarget) WriteFile(ctx context.Context, volume Volume, path string, data []byte, mode os.FileMode, owner string) error {
+	temp, err := os.CreateTemp("", "keymaker-provision-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(temp.Name()) }()
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return system.WriteCartridgeFile(ctx, target.Runner, string(volume), path, temp.Name(), mode, owner)
+}
@@ -7,6 +7,16 @@ type CartridgeSystemInfo struct {
 	FileCount int    `json:"filecount"`
 }
 
+// CartridgeIdentity identifies the SD card of a cartridge by its card
+// registers. Fields are empty when unknown.
+type CartridgeIdentity struct {
+	CID            string // card identification register (hex), unique per card
+	Serial         string
+	Name           string // product name, e.g. "SD32G"
+	ManufacturerID string
+	Date           string // manufacturing date, e.g. "05/2023"
+}
+
 type CartridgeInfoSnapshot struct {
 	Present      bool
 	Mounted      bool
@@ -14,6 +24,14 @@ type CartridgeInfoSnapshot struct {
 	Systems      []CartridgeSystemInfo
 	EmptySystems []string
 	Busy         bool
+	// IncompleteImage is set while (and after) a flash did not finish writing
+	// the image, e.g. because it was cancelled. It is cleared by a successful
+	// flash or when a different cartridge is inserted.
+	IncompleteImage bool
+	// Capacity is the size of the cartridge device in bytes, 0 if unknown.
+	Capacity int64
+	// Identity identifies the inserted card.
+	Identity CartridgeIdentity
 }
 
 type CartridgeInfo struct {
@@ -25,6 +43,10 @@ type CartridgeInfo struct {
 	systems      []CartridgeSystemInfo
 	emptySystems []string
 	busy         bool
+
+	incompleteImage bool
+	capacity        int64
+	identity        CartridgeIdentity
 }
 
 var (
@@ -50,6 +72,10 @@ func (info *CartridgeInfo) Snapshot() CartridgeInfoSnapshot {
 		Systems:      cloneSystemInfos(info.systems),
 		EmptySystems: cloneStrings(info.emptySystems),
 		Busy:         info.busy,
+
+		IncompleteImage: info.incompleteImage,
+		Capacity:        info.capacity,
+		Identity:        info.identity,
 	}
 }
 
@@ -61,6 +87,9 @@ func (info *CartridgeInfo) Reset() {
 	info.systems = nil
 	info.emptySystems = nil
 	info.busy = false
+	info.incompleteImage = false
+	info.capacity = 0
+	info.identity = CartridgeIdentity{}
 	info.mu.Unlock()
 }
 
@@ -82,6 +111,36 @@ func (info *CartridgeInfo) SetBusy(busy bool) {
 	info.mu.Unlock()
 }
 
+// TryBegin marks the cartridge busy unless it already is and reports
+// whether it did, so two operations cannot both pass a busy check.
+func (info *CartridgeInfo) TryBegin() bool {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if info.busy {
+		return false
+	}
+	info.busy = true
+	return true
+}
+
+func (info *CartridgeInfo) SetIncompleteImage(incomplete bool) {
+	info.mu.Lock()
+	info.incompleteImage = incomplete
+	info.mu.Unlock()
+}
+
+func (info *CartridgeInfo) SetCapacity(capacity int64) {
+	info.mu.Lock()
+	info.capacity = capacity
+	info.mu.Unlock()
+}
+
+func (info *CartridgeInfo) SetIdentity(identity CartridgeIdentity) {
+	info.mu.Lock()
+	info.identity = identity
+	info.mu.Unlock()
+}
+
 func (info *CartridgeInfo) SetRetroPie(isRetroPie bool, systems []CartridgeSystemInfo, emptySystems []string) {
 	info.mu.Lock()
 	info.isRetroPie = isRetroPie
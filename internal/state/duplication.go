@@ -0,0 +1,149 @@
+package state
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDuplicationActive is returned when a batch is started while one runs.
+	ErrDuplicationActive = errors.New("duplication already running")
+	// ErrDuplicationNotRunning is returned when stopping without a running batch.
+	ErrDuplicationNotRunning = errors.New("duplication not running")
+)
+
+// Duplication stages.
+const (
+	DuplicationStageRemove   = "waiting_for_removal"
+	DuplicationStageInsert   = "waiting_for_cartridge"
+	DuplicationStageFlashing = "flashing"
+	DuplicationStageStopped  = "stopped"
+)
+
+// DuplicationResult is the outcome of one cartridge of a duplication batch.
+type DuplicationResult struct {
+	Number       int
+	Passed       bool
+	BytesWritten int64
+	ImageSHA256  string
+	DeviceSHA256 string
+	ErrCode      string
+	Err          string
+	StartedAt    time.Time
+	FinishedAt   time.Time
+}
+
+type DuplicationSnapshot struct {
+	Active    bool
+	ImageID   string
+	ImageName string
+	Stage     string
+	Passed    int
+	Failed    int
+	Results   []DuplicationResult
+	StartedAt time.Time
+	StoppedAt time.Time
+	// Err is set when the batch itself ended because of an error.
+	Err string
+}
+
+// Duplication tracks the production-line mode that flashes the same image
+// onto every inserted cartridge. The report of the last batch is kept until
+// the next one starts.
+type Duplication struct {
+	mu sync.RWMutex
+
+	active    bool
+	imageID   string
+	imageName string
+	stage     string
+	results   []DuplicationResult
+	startedAt time.Time
+	stoppedAt time.Time
+	err       string
+}
+
+var (
+	duplicationOnce sync.Once
+	duplication     *Duplication
+)
+
+func GetDuplication() *Duplication {
+	duplicationOnce.Do(func() {
+		duplication = &Duplication{stage: DuplicationStageStopped}
+	})
+	return duplication
+}
+
+func (dup *Duplication) Snapshot() DuplicationSnapshot {
+	dup.mu.RLock()
+	defer dup.mu.RUnlock()
+
+	snap := DuplicationSnapshot{
+		Active:    dup.active,
+		ImageID:   dup.imageID,
+		ImageName: dup.imageName,
+		Stage:     dup.stage,
+		Results:   make([]DuplicationResult, len(dup.results)),
+		StartedAt: dup.startedAt,
+		StoppedAt: dup.stoppedAt,
+		Err:       dup.err,
+	}
+	copy(snap.Results, dup.results)
+	for _, result := range dup.results {
+		if result.Passed {
+			snap.Passed++
+		} else {
+			snap.Failed++
+		}
+	}
+	return snap
+}
+
+// Begin starts a new batch and discards the report of the previous one.
+func (dup *Duplication) Begin(imageID, imageName string) error {
+	dup.mu.Lock()
+	defer dup.mu.Unlock()
+	if dup.active {
+		return ErrDuplicationActive
+	}
+	dup.active = true
+	dup.imageID = imageID
+	dup.imageName = imageName
+	dup.stage = DuplicationStageRemove
+	dup.results = nil
+	dup.startedAt = time.Now()
+	dup.stoppedAt = time.Time{}
+	dup.err = ""
+	return nil
+}
+
+func (dup *Duplication) SetStage(stage string) {
+	dup.mu.Lock()
+	if dup.active {
+		dup.stage = stage
+	}
+	dup.mu.Unlock()
+}
+
+// Record appends the result of a cartridge and numbers it.
+func (dup *Duplication) Record(result DuplicationResult) DuplicationResult {
+	dup.mu.Lock()
+	defer dup.mu.Unlock()
+	result.Number = len(dup.results) + 1
+	dup.results = append(dup.results, result)
+	return result
+}
+
+// End marks the batch as stopped. err is empty for a regular stop.
+func (dup *Duplication) End(err string) {
+	dup.mu.Lock()
+	if dup.active {
+		dup.active = false
+		dup.stage = DuplicationStageStopped
+		dup.stoppedAt = time.Now()
+		dup.err = err
+	}
+	dup.mu.Unlock()
+}
@@ -11,6 +11,7 @@ const (
 	DONE
 	ERROR
 	CANCELLED
+	WIPING
 )
 
 type WiFiInfo struct {
@@ -26,11 +27,34 @@ type NetworkInfo struct {
 }
 
 type FlashInfo struct {
-	Device       string
-	BytesWritten int64
-	WriteRate    int64 // bytes/sec, optional
-	Status       string
-	Err          string
+	Device        string
+	Partition     int    // partition written by a single-partition flash, 0 for the whole device
+	Format        string // detected image format (gzip, xz, zstd, bzip2, zip, raw)
+	BytesTotal    int64  // expected input bytes, 0 if unknown
+	BytesRead     int64  // input bytes consumed (compressed)
+	BytesWritten  int64  // image bytes written (decompressed)
+	BytesMapped   int64  // image bytes a bmap marks as data, 0 without a bmap
+	BytesSkipped  int64  // image bytes not written (unmapped or zero blocks of a sparse flash)
+	BytesInPlace  int64  // image bytes a differential flash found already on the device (not rewritten)
+	WriteRate     int64  // bytes/sec, optional
+	ETASeconds    int64  // estimated remaining time, 0 if unknown
+	BytesVerified int64  // image bytes read back from the device for verification
+	Touched       bool   // the run wrote to the device; false when it failed before changing anything
+	ImageSHA256   string // hex SHA-256 of the decompressed image as written
+	DeviceSHA256  string // hex SHA-256 of the written range(s) read back from the device
+	Status        string
+	Err           string
+	// Provisioning lists the post-flash provisioning steps requested for
+	// the run, in order.
+	Provisioning []ProvisionStep
+}
+
+// ProvisionStep is the outcome of one post-flash provisioning step (e.g.
+// "expand" or "hostname").
+type ProvisionStep struct {
+	Name   string
+	Status string // "pending", "running", "ok" or "failed"
+	Detail string // what was done, or why it failed
 }
 
 type State struct {
@@ -3,6 +3,8 @@ package system
 import (
 	"context"
 	"fmt"
+	"os"
+	"strconv"
 	"strings"
 )
 
@@ -16,6 +18,10 @@ const (
 	isMountedScript        = "is_sd_mounted.sh"
 	isRetroPieScript       = "is_sd_retropie.sh"
 	retroPieSystemsScript  = "sd_retropie_systems.sh"
+	capacityScript         = "sd_capacity.sh"
+	provisionScript        = "provision_sd.sh"
+	wipeScript             = "wipe_sd.sh"
+	identityScript         = "sd_identity.sh"
 )
 
 // StartEject calls the eject script via sudo to initiate ejection.
@@ -87,6 +93,57 @@ func IsCartridgePresent(ctx context.Context, r Runner) (bool, error) {
 	return true, nil
 }
 
+// CartridgeCapacity returns the size of the cartridge block device in bytes.
+func CartridgeCapacity(ctx context.Context, r Runner) (int64, error) {
+	stdout, stderr, err := r.Run(ctx, capacityScript)
+	if err != nil {
+		return 0, fmt.Errorf("capacity detection failed: %v: %s", err, stderr)
+	}
+	capacity, err := strconv.ParseInt(strings.TrimSpace(stdout), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("capacity detection failed: unexpected output %q", stdout)
+	}
+	return capacity, nil
+}
+
+// CardIdentity holds the card registers of the cartridge SD card.
+type CardIdentity struct {
+	CID            string
+	Serial         string
+	Name           string
+	ManufacturerID string
+	Date           string
+}
+
+// CartridgeIdentity reads the card registers of the cartridge. Registers the
+// card reader does not expose are left empty.
+func CartridgeIdentity(ctx context.Context, r Runner) (CardIdentity, error) {
+	stdout, stderr, err := r.Run(ctx, identityScript)
+	if err != nil {
+		return CardIdentity{}, fmt.Errorf("identity detection failed: %v: %s", err, stderr)
+	}
+	var identity CardIdentity
+	for _, line := range strings.Split(stdout, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "cid":
+			identity.CID = value
+		case "serial":
+			identity.Serial = value
+		case "name":
+			identity.Name = value
+		case "manfid":
+			identity.ManufacturerID = value
+		case "date":
+			identity.Date = value
+		}
+	}
+	return identity, nil
+}
+
 // IsRetroPieCartridge checks whether the mounted cartridge looks like a RetroPie install.
 // Any non-zero exit code is treated as "not RetroPie".
 func IsRetroPieCartridge(ctx context.Context, r Runner) (bool, error) {
@@ -115,3 +172,53 @@ func RetroPieSystems(ctx context.Context, r Runner) ([]string, error) {
 	}
 	return systems, nil
 }
+
+// ExpandCartridge grows the last partition of the cartridge and its
+// filesystem to the end of the card and returns the script's summary.
+func ExpandCartridge(ctx context.Context, r Runner) (string, error) {
+	stdout, stderr, err := r.Run(ctx, provisionScript, "expand")
+	if err != nil {
+		return "", fmt.Errorf("expand failed: %v: %s", err, stderr)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+// ReadCartridgeFile returns a file of the cartridge's "boot" or "root"
+// partition. A missing file reads as empty.
+func ReadCartridgeFile(ctx context.Context, r Runner, volume, path string) (string, error) {
+	stdout, stderr, err := r.Run(ctx, provisionScript, "read", volume, path)
+	if err != nil {
+		return "", fmt.Errorf("read %s:%s failed: %v: %s", volume, path, err, stderr)
+	}
+	return stdout, nil
+}
+
+// WriteCartridgeFile installs the local file source as path on the
+// cartridge's "boot" or "root" partition. owner, when set, is a user of the
+// image that gets the file.
+func WriteCartridgeFile(ctx context.Context, r Runner, volume, path, source string, mode os.FileMode, owner string) error {
+	args := []string{"write", volume, path, source, fmt.Sprintf("%04o", mode.Perm())}
+	if owner != "" {
+		args = append(args, owner)
+	}
+	_, stderr, err := r.Run(ctx, provisionScript, args...)
+	if err != nil {
+		return fmt.Errorf("write %s:%s failed: %v: %s", volume, path, err, stderr)
+	}
+	return nil
+}
+
+// LayoutCartridge writes a new partition table ("mbr" or "gpt") with a single
+// partition spanning the cartridge and formats it ("fat32", "exfat" or
+// "ext4"), returning a summary.
+func LayoutCartridge(ctx context.Context, r Runner, table, filesystem, label string) (string, error) {
+	args := []string{"layout", table, filesystem}
+	if label != "" {
+		args = append(args, label)
+	}
+	stdout, stderr, err := r.Run(ctx, wipeScript, args...)
+	if err != nil {
+		return "", fmt.Errorf("layout failed: %v: %s", err, stderr)
+	}
+	return strings.TrimSpace(stdout), nil
+}
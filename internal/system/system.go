@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
 )
 
@@ -50,9 +51,7 @@ type sysLogger interface {
 type ShellRunner struct{ Logger sysLogger }
 
 func (sr ShellRunner) Run(ctx context.Context, cmd string, args ...string) (string, string, error) {
-	// Prepend cmd to args, execute through sudo
-	fullArgs := append([]string{cmd}, args...)
-	command := exec.CommandContext(ctx, "sudo", fullArgs...)
+	command := SudoCommand(ctx, cmd, args...)
 	var outBuf, errBuf bytes.Buffer
 	command.Stdout = &outBuf
 	command.Stderr = &errBuf
@@ -77,6 +76,23 @@ func (sr ShellRunner) Run(ctx context.Context, cmd string, args ...string) (stri
 	return outBuf.String(), errBuf.String(), nil
 }
 
+// CartridgeDevEnv names the cartridge disk (e.g. mmcblk1) for the device
+// scripts and flash.FindCartridgeDevice; unset, they pick the first mmc disk
+// that does not hold the root filesystem.
+const CartridgeDevEnv = "CARTRIDGE_DEV"
+
+// SudoCommand returns the command running the script name with args through
+// sudo. sudo resets the environment, so CartridgeDevEnv is passed on
+// explicitly when it is set.
+func SudoCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	sudoArgs := []string{}
+	if os.Getenv(CartridgeDevEnv) != "" {
+		sudoArgs = append(sudoArgs, "--preserve-env="+CartridgeDevEnv)
+	}
+	sudoArgs = append(sudoArgs, name)
+	return exec.CommandContext(ctx, "sudo", append(sudoArgs, args...)...)
+}
+
 func truncate(s string, n int) string {
 	if len(s) <= n {
 		return s
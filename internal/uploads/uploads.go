@@ -0,0 +1,361 @@
+// Package uploads stores resumable (tus-style) uploads on disk. An upload is
+// created with its final length, filled with chunks at increasing offsets
+// (possibly across many requests) and, once complete, handed to a consumer
+// such as the flash pipeline. Idle uploads expire.
+//
+// Every upload is stored as <id>.part next to a <id>.json sidecar; the size
+// of the .part file is the current offset.
+package uploads
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/ctxio"
+)
+
+// DefaultTTL is how long an upload is kept after its last chunk.
+const DefaultTTL = 24 * time.Hour
+
+var (
+	// ErrNotFound is returned for unknown or expired uploads.
+	ErrNotFound = errors.New("upload not found")
+	// ErrOffsetMismatch is returned when a chunk does not start at the
+	// current offset of the upload.
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+	// ErrTooLarge is returned when a chunk extends beyond the declared length.
+	ErrTooLarge = errors.New("chunk exceeds upload length")
+	// ErrLocked is returned while another request writes to the same upload.
+	ErrLocked = errors.New("upload is being written by another request")
+	// ErrIncomplete is returned when an unfinished upload is opened for use.
+	ErrIncomplete = errors.New("upload is incomplete")
+)
+
+const (
+	dataSuffix     = ".part"
+	metadataSuffix = ".json"
+)
+
+var idPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Upload describes a stored upload.
+type Upload struct {
+	ID     string `json:"id"`
+	Length int64  `json:"length"`
+	// Offset is the number of bytes received so far.
+	Offset int64 `json:"-"`
+	// Metadata holds the client's Upload-Metadata pairs (e.g. filename).
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// Complete reports whether all bytes have been received.
+func (upload Upload) Complete() bool { return upload.Offset == upload.Length }
+
+// Store is a directory of uploads. It is safe for concurrent use.
+type Store struct {
+	dir string
+	ttl time.Duration
+
+	mu      sync.Mutex
+	writing map[string]bool
+}
+
+// New opens the store in dir. Uploads expire ttl after their last chunk.
+func New(dir string, ttl time.Duration) *Store {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Store{dir: filepath.Clean(dir), ttl: ttl, writing: make(map[string]bool)}
+}
+
+// TTL returns how long idle uploads are kept.
+func (store *Store) TTL() time.Duration { return store.ttl }
+
+// Create starts an upload of length bytes.
+func (store *Store) Create(length int64, metadata map[string]string) (Upload, error) {
+	if length < 0 {
+		return Upload{}, fmt.Errorf("invalid upload length %d", length)
+	}
+	if err := os.MkdirAll(store.dir, 0o755); err != nil {
+		return Upload{}, err
+	}
+	now := time.Now().UTC()
+	upload := Upload{ID: newID(), Length: length, Metadata: metadata, CreatedAt: now, ExpiresAt: now.Add(store.ttl)}
+	if upload.Metadata == nil {
+		upload.Metadata = map[string]string{}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	file, err := os.OpenFile(store.dataPath(upload.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return Upload{}, err
+	}
+	if err := file.Close(); err != nil {
+		return Upload{}, err
+	}
+	if err := store.writeMetadata(upload); err != nil {
+		_ = os.Remove(store.dataPath(upload.ID))
+		return Upload{}, err
+	}
+	return upload, nil
+}
+
+// Get returns an upload with its current offset.
+func (store *Store) Get(id string) (Upload, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.load(id)
+}
+
+// List returns all live uploads, oldest first.
+func (store *Store) List() ([]Upload, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Upload{}, nil
+		}
+		return nil, err
+	}
+	list := []Upload{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), metadataSuffix)
+		if !ok || !idPattern.MatchString(id) {
+			continue
+		}
+		upload, err := store.load(id)
+		if err != nil {
+			continue
+		}
+		list = append(list, upload)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+// Append writes a chunk that must start at offset. Whatever arrived before
+// body failed is kept, so the client can resume from the new offset, which
+// is returned together with the error.
+func (store *Store) Append(ctx context.Context, id string, offset int64, body io.Reader) (Upload, error) {
+	store.mu.Lock()
+	upload, err := store.load(id)
+	if err != nil {
+		store.mu.Unlock()
+		return Upload{}, err
+	}
+	if store.writing[id] {
+		store.mu.Unlock()
+		return upload, ErrLocked
+	}
+	if offset != upload.Offset {
+		store.mu.Unlock()
+		return upload, ErrOffsetMismatch
+	}
+	store.writing[id] = true
+	store.mu.Unlock()
+
+	written, writeErr := store.appendData(ctx, id, upload.Length-upload.Offset, body)
+	upload.Offset += written
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.writing, id)
+	upload.ExpiresAt = time.Now().UTC().Add(store.ttl)
+	if err := store.writeMetadata(upload); err != nil && writeErr == nil {
+		writeErr = err
+	}
+	return upload, writeErr
+}
+
+func (store *Store) appendData(ctx context.Context, id string, remaining int64, body io.Reader) (int64, error) {
+	file, err := os.OpenFile(store.dataPath(id), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(file, ctxio.NewReader(ctx, io.LimitReader(body, remaining)))
+	if err == nil && written == remaining {
+		// Anything beyond the declared length is an error, not silently dropped.
+		var probe [1]byte
+		if extra, _ := body.Read(probe[:]); extra > 0 {
+			err = ErrTooLarge
+		}
+	}
+	if syncErr := file.Sync(); syncErr != nil && err == nil {
+		err = syncErr
+	}
+	if closeErr := file.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return written, err
+}
+
+// Open opens a complete upload for reading.
+func (store *Store) Open(id string) (*os.File, Upload, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	upload, err := store.load(id)
+	if err != nil {
+		return nil, Upload{}, err
+	}
+	if store.writing[id] || !upload.Complete() {
+		return nil, upload, ErrIncomplete
+	}
+	file, err := os.Open(store.dataPath(id))
+	if err != nil {
+		return nil, Upload{}, err
+	}
+	return file, upload, nil
+}
+
+// Delete cancels an upload and removes its data. A consumer that already
+// opened it keeps its file.
+func (store *Store) Delete(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, err := store.load(id); err != nil {
+		return err
+	}
+	if store.writing[id] {
+		return ErrLocked
+	}
+	return store.remove(id)
+}
+
+// Sweep removes expired uploads.
+func (store *Store) Sweep() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	sidecars, _ := filepath.Glob(filepath.Join(store.dir, "*"+metadataSuffix))
+	now := time.Now()
+	for _, path := range sidecars {
+		id := strings.TrimSuffix(filepath.Base(path), metadataSuffix)
+		if !idPattern.MatchString(id) || store.writing[id] {
+			continue
+		}
+		upload, err := store.readMetadata(id)
+		if err != nil || now.After(upload.ExpiresAt) {
+			_ = store.remove(id)
+		}
+	}
+}
+
+// Run sweeps expired uploads periodically until ctx ends.
+func (store *Store) Run(ctx context.Context) {
+	store.Sweep()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			store.Sweep()
+		}
+	}
+}
+
+func (store *Store) dataPath(id string) string {
+	return filepath.Join(store.dir, id+dataSuffix)
+}
+
+func (store *Store) metadataPath(id string) string {
+	return filepath.Join(store.dir, id+metadataSuffix)
+}
+
+// load reads an upload and its offset; expired uploads are not found.
+// The caller holds mu.
+func (store *Store) load(id string) (Upload, error) {
+	upload, err := store.readMetadata(id)
+	if err != nil {
+		return Upload{}, err
+	}
+	if time.Now().After(upload.ExpiresAt) && !store.writing[id] {
+		return Upload{}, ErrNotFound
+	}
+	info, err := os.Stat(store.dataPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Upload{}, ErrNotFound
+		}
+		return Upload{}, err
+	}
+	upload.Offset = info.Size()
+	return upload, nil
+}
+
+// readMetadata loads the sidecar of id. The caller holds mu.
+func (store *Store) readMetadata(id string) (Upload, error) {
+	if !idPattern.MatchString(id) {
+		return Upload{}, ErrNotFound
+	}
+	raw, err := os.ReadFile(store.metadataPath(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Upload{}, ErrNotFound
+		}
+		return Upload{}, err
+	}
+	var upload Upload
+	if err := json.Unmarshal(raw, &upload); err != nil {
+		return Upload{}, fmt.Errorf("read metadata of upload %s: %w", id, err)
+	}
+	upload.ID = id
+	return upload, nil
+}
+
+// writeMetadata replaces the sidecar of upload atomically. The caller holds mu.
+func (store *Store) writeMetadata(upload Upload) error {
+	raw, err := json.MarshalIndent(upload, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := store.metadataPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(temp, append(raw, '\n'), 0o644); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	if err := os.Rename(temp, store.metadataPath(upload.ID)); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// remove deletes the files of an upload. The caller holds mu.
+func (store *Store) remove(id string) error {
+	if err := os.Remove(store.dataPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(store.metadataPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func newID() string {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(raw[:])
+}
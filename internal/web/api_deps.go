@@ -6,7 +6,14 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/rook-computer/keymaker/internal/bios"
+	"github.com/rook-computer/keymaker/internal/fetch"
+	"github.com/rook-computer/keymaker/internal/gamelist"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/jobs"
+	"github.com/rook-computer/keymaker/internal/library"
 	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/uploads"
 )
 
 // CartridgeInfoStore abstracts the cartridge state used by the API.
@@ -15,6 +22,10 @@ import (
 type CartridgeInfoStore interface {
 	Snapshot() state.CartridgeInfoSnapshot
 	SetMounted(mounted bool)
+	// TryBegin and SetBusy(false) claim and release the cartridge for an
+	// operation that runs as a job.
+	TryBegin() bool
+	SetBusy(busy bool)
 }
 
 // sysLogger matches the logging shape used by system.ShellRunner.
@@ -32,17 +43,53 @@ type CartridgeMounter interface {
 }
 
 // RetroPieStorage abstracts file operations for the RetroPie roms tree.
+//
+// gameName is a slash-separated path below the system directory; an
+// implementation must refuse paths that leave the roms tree.
 type RetroPieStorage interface {
-	ListGames(ctx context.Context, systemName string) ([]string, error)
+	ListGames(ctx context.Context, systemName string, opts GameListOptions) (GameList, error)
 	DownloadGame(ctx context.Context, w http.ResponseWriter, r *http.Request, systemName, gameName string) error
 	UploadGame(ctx context.Context, systemName, gameName string, body io.Reader, contentLength int64) error
 	DeleteGame(ctx context.Context, systemName, gameName string) error
+	// RenameGame moves a game within its system directory.
+	RenameGame(ctx context.Context, systemName, gameName, newName string) error
+	// GameMetadata and SetGameMetadata read and edit the game's entry in
+	// EmulationStation's gamelist.xml.
+	GameMetadata(ctx context.Context, systemName, gameName string) (gamelist.Metadata, error)
+	SetGameMetadata(ctx context.Context, systemName, gameName string, patch gamelist.Patch) (gamelist.Metadata, error)
+	// DownloadGameMedia serves the game's media of kind; a size above zero
+	// asks for a picture scaled to fit in size x size pixels.
+	DownloadGameMedia(ctx context.Context, w http.ResponseWriter, r *http.Request, systemName, gameName string, kind gamelist.MediaKind, size int) error
+	// SetGameMedia stores media of kind for the game and links it from the
+	// gamelist; DeleteGameMedia unlinks it again.
+	SetGameMedia(ctx context.Context, systemName, gameName string, kind gamelist.MediaKind, body io.Reader, contentLength int64) (gamelist.Metadata, error)
+	DeleteGameMedia(ctx context.Context, systemName, gameName string, kind gamelist.MediaKind) error
+	// ListBIOS, DownloadBIOS, UploadBIOS and DeleteBIOS work on the BIOS
+	// directory next to the roms tree; name is a slash-separated path below
+	// it.
+	ListBIOS(ctx context.Context) ([]bios.File, error)
+	DownloadBIOS(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) error
+	UploadBIOS(ctx context.Context, name string, body io.Reader, contentLength int64) (bios.File, error)
+	DeleteBIOS(ctx context.Context, name string) error
 }
 
 type APIV1Deps struct {
 	Cartridge CartridgeInfoStore
 	Mounter   CartridgeMounter
 	RetroPie  RetroPieStorage
+	// Jobs runs long operations (flash) detached from the request that started them.
+	Jobs *jobs.Manager
+	// Images is the on-device image library; nil disables /images and
+	// POST /flash?image={id}.
+	Images *library.Library
+	// Uploads holds resumable uploads; nil disables /uploads and the
+	// ?upload={id} hand-off of POST /flash and POST /retropie/{system}/{game}.
+	Uploads *uploads.Store
+	// HTTPClient downloads images for POST /flash/url.
+	HTTPClient *http.Client
+	// History logs flashes, dumps, uploads and deletes; nil disables
+	// logging and GET /history.
+	History *history.Store
 }
 
 func (d APIV1Deps) withDefaults() APIV1Deps {
@@ -56,6 +103,12 @@ func (d APIV1Deps) withDefaults() APIV1Deps {
 	if out.RetroPie == nil {
 		out.RetroPie = NoopRetroPieStorage{Err: errors.New("retropie storage not configured")}
 	}
+	if out.Jobs == nil {
+		out.Jobs = jobs.NewManager(context.Background())
+	}
+	if out.HTTPClient == nil {
+		out.HTTPClient = fetch.NewClient()
+	}
 	return out
 }
 
@@ -70,8 +123,8 @@ func (m NoopCartridgeMounter) EnsureMounted(context.Context) error {
 
 type NoopRetroPieStorage struct{ Err error }
 
-func (s NoopRetroPieStorage) ListGames(context.Context, string) ([]string, error) {
-	return nil, s.err()
+func (s NoopRetroPieStorage) ListGames(context.Context, string, GameListOptions) (GameList, error) {
+	return GameList{}, s.err()
 }
 
 func (s NoopRetroPieStorage) DownloadGame(context.Context, http.ResponseWriter, *http.Request, string, string) error {
@@ -86,6 +139,46 @@ func (s NoopRetroPieStorage) DeleteGame(context.Context, string, string) error {
 	return s.err()
 }
 
+func (s NoopRetroPieStorage) RenameGame(context.Context, string, string, string) error {
+	return s.err()
+}
+
+func (s NoopRetroPieStorage) GameMetadata(context.Context, string, string) (gamelist.Metadata, error) {
+	return gamelist.Metadata{}, s.err()
+}
+
+func (s NoopRetroPieStorage) SetGameMetadata(context.Context, string, string, gamelist.Patch) (gamelist.Metadata, error) {
+	return gamelist.Metadata{}, s.err()
+}
+
+func (s NoopRetroPieStorage) DownloadGameMedia(context.Context, http.ResponseWriter, *http.Request, string, string, gamelist.MediaKind, int) error {
+	return s.err()
+}
+
+func (s NoopRetroPieStorage) SetGameMedia(context.Context, string, string, gamelist.MediaKind, io.Reader, int64) (gamelist.Metadata, error) {
+	return gamelist.Metadata{}, s.err()
+}
+
+func (s NoopRetroPieStorage) DeleteGameMedia(context.Context, string, string, gamelist.MediaKind) error {
+	return s.err()
+}
+
+func (s NoopRetroPieStorage) ListBIOS(context.Context) ([]bios.File, error) {
+	return nil, s.err()
+}
+
+func (s NoopRetroPieStorage) DownloadBIOS(context.Context, http.ResponseWriter, *http.Request, string) error {
+	return s.err()
+}
+
+func (s NoopRetroPieStorage) UploadBIOS(context.Context, string, io.Reader, int64) (bios.File, error) {
+	return bios.File{}, s.err()
+}
+
+func (s NoopRetroPieStorage) DeleteBIOS(context.Context, string) error {
+	return s.err()
+}
+
 func (s NoopRetroPieStorage) err() error {
 	if s.Err != nil {
 		return s.Err
@@ -0,0 +1,158 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/library"
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+type duplicationRequest struct {
+	ImageID string `json:"imageId"`
+}
+
+type duplicationResponse struct {
+	Active    bool                        `json:"active"`
+	ImageID   string                      `json:"imageId"`
+	ImageName string                      `json:"imageName"`
+	Stage     string                      `json:"stage"`
+	Total     int                         `json:"total"`
+	Passed    int                         `json:"passed"`
+	Failed    int                         `json:"failed"`
+	Results   []duplicationResultResponse `json:"results"`
+	StartedAt *time.Time                  `json:"startedAt"`
+	StoppedAt *time.Time                  `json:"stoppedAt"`
+	Error     string                      `json:"error"`
+}
+
+type duplicationResultResponse struct {
+	Number       int       `json:"number"`
+	Passed       bool      `json:"passed"`
+	BytesWritten int64     `json:"bytesWritten"`
+	ImageSHA256  string    `json:"imageSha256"`
+	DeviceSHA256 string    `json:"deviceSha256"`
+	Error        string    `json:"error"`
+	ErrorCode    string    `json:"errorCode,omitempty"`
+	StartedAt    time.Time `json:"startedAt"`
+	FinishedAt   time.Time `json:"finishedAt"`
+}
+
+func handleDuplication(w http.ResponseWriter, r *http.Request, deps APIV1Deps, handlers APIV1Handlers) {
+	// GET /duplication -> report of the running (or last) batch
+	// POST /duplication -> start a batch with a library image
+	// DELETE /duplication -> stop the batch
+	if handlers.StartDuplicationFunc == nil || handlers.StopDuplicationFunc == nil || handlers.DuplicationFunc == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "duplication not configured")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, newDuplicationResponse(handlers.DuplicationFunc()))
+	case http.MethodPost:
+		var req duplicationRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "invalid json")
+			return
+		}
+		if req.ImageID == "" {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "imageId is required")
+			return
+		}
+		if deps.Cartridge.Snapshot().Busy && !handlers.DuplicationFunc().Active {
+			writeAPIError(w, http.StatusConflict, "cartridge_busy", "cartridge is busy")
+			return
+		}
+		if err := handlers.StartDuplicationFunc(r.Context(), req.ImageID); err != nil {
+			switch {
+			case errors.Is(err, state.ErrDuplicationActive):
+				writeAPIError(w, http.StatusConflict, "duplication_active", err.Error())
+			case errors.Is(err, library.ErrNotFound):
+				writeAPIError(w, http.StatusNotFound, "image_not_found", err.Error())
+			default:
+				writeAPIError(w, http.StatusInternalServerError, "duplication_failed", err.Error())
+			}
+			return
+		}
+		writeJSON(w, http.StatusAccepted, newDuplicationResponse(handlers.DuplicationFunc()))
+	case http.MethodDelete:
+		if err := handlers.StopDuplicationFunc(r.Context()); err != nil {
+			if errors.Is(err, state.ErrDuplicationNotRunning) {
+				writeAPIError(w, http.StatusConflict, "not_duplicating", err.Error())
+				return
+			}
+			writeAPIError(w, http.StatusInternalServerError, "duplication_failed", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, newDuplicationResponse(handlers.DuplicationFunc()))
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+// rejectDuringDuplication answers 409 while a duplication batch owns the
+// cartridge slot and reports whether it did.
+func rejectDuringDuplication(w http.ResponseWriter, handlers APIV1Handlers) bool {
+	if handlers.DuplicationFunc == nil || !handlers.DuplicationFunc().Active {
+		return false
+	}
+	writeAPIError(w, http.StatusConflict, "duplication_active", "a duplication batch is running")
+	return true
+}
+
+// rejectBatchImageChange answers 409 to a request below /images that would
+// delete the image of the running batch or change its bmap, and reports
+// whether it did.
+func rejectBatchImageChange(w http.ResponseWriter, r *http.Request, handlers APIV1Handlers) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodPatch || handlers.DuplicationFunc == nil {
+		return false
+	}
+	snapshot := handlers.DuplicationFunc()
+	id, _, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/images"), "/"), "/")
+	if !snapshot.Active || id != snapshot.ImageID {
+		return false
+	}
+	writeAPIError(w, http.StatusConflict, "duplication_active", "the image is used by the running duplication batch")
+	return true
+}
+
+func newDuplicationResponse(snapshot state.DuplicationSnapshot) duplicationResponse {
+	resp := duplicationResponse{
+		Active:    snapshot.Active,
+		ImageID:   snapshot.ImageID,
+		ImageName: snapshot.ImageName,
+		Stage:     snapshot.Stage,
+		Total:     len(snapshot.Results),
+		Passed:    snapshot.Passed,
+		Failed:    snapshot.Failed,
+		Results:   make([]duplicationResultResponse, 0, len(snapshot.Results)),
+		Error:     snapshot.Err,
+	}
+	for _, result := range snapshot.Results {
+		resp.Results = append(resp.Results, duplicationResultResponse{
+			Number:       result.Number,
+			Passed:       result.Passed,
+			BytesWritten: result.BytesWritten,
+			ImageSHA256:  result.ImageSHA256,
+			DeviceSHA256: result.DeviceSHA256,
+			Error:        result.Err,
+			ErrorCode:    result.ErrCode,
+			StartedAt:    result.StartedAt,
+			FinishedAt:   result.FinishedAt,
+		})
+	}
+	if !snapshot.StartedAt.IsZero() {
+		startedAt := snapshot.StartedAt
+		resp.StartedAt = &startedAt
+	}
+	if !snapshot.StoppedAt.IsZero() {
+		stoppedAt := snapshot.StoppedAt
+		resp.StoppedAt = &stoppedAt
+	}
+	return resp
+}
@@ -0,0 +1,482 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/jobs"
+	"github.com/rook-computer/keymaker/internal/provision"
+	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/uploads"
+)
+
+type flashStatusResponse struct {
+	Status       string `json:"status"`
+	Device       string `json:"device"`
+	Format       string `json:"format"`
+	BytesTotal   int64  `json:"bytesTotal"`
+	BytesRead    int64  `json:"bytesRead"`
+	BytesWritten int64  `json:"bytesWritten"`
+	// Partition is the partition written by a single-partition flash, 0
+	// for the whole cartridge.
+	Partition int `json:"partition"`
+	// BytesMapped (with a bmap) and BytesSkipped describe a sparse flash,
+	// BytesInPlace a differential one.
+	BytesMapped  int64 `json:"bytesMapped"`
+	BytesSkipped int64 `json:"bytesSkipped"`
+	BytesInPlace int64 `json:"bytesInPlace"`
+	WriteRate    int64 `json:"writeRate"`
+	ETASeconds   int64 `json:"etaSeconds"`
+	// BytesVerified, ImageSHA256 and DeviceSHA256 report the read-back
+	// verification; the digests are empty until known.
+	BytesVerified int64  `json:"bytesVerified"`
+	ImageSHA256   string `json:"imageSha256"`
+	DeviceSHA256  string `json:"deviceSha256"`
+	Error         string `json:"error"`
+	// Provisioning lists the requested post-flash provisioning steps.
+	Provisioning []provisionStepResponse `json:"provisioning"`
+}
+
+type provisionStepResponse struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// maxPartition is the highest partition number a flash can target (the
+// entries of a standard GPT).
+const maxPartition = 128
+
+type jobStartedResponse struct {
+	OK    bool   `json:"ok"`
+	JobID string `json:"jobId"`
+}
+
+func handleFlash(w http.ResponseWriter, r *http.Request, deps APIV1Deps, handlers APIV1Handlers) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	flashFunc := handlers.FlashFunc
+	if flashFunc == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "flash not configured")
+		return
+	}
+	verify, err := parseBoolQuery(r, "verify", true)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	uploadSHA256, err := expectedSHA256(r, "X-Upload-SHA256", "uploadSha256")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_checksum", err.Error())
+		return
+	}
+	imageSHA256, err := expectedSHA256(r, "X-Image-SHA256", "imageSha256")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_checksum", err.Error())
+		return
+	}
+
+	var declaredSize int64
+	if raw := r.Header.Get("X-Image-Size"); raw != "" {
+		declaredSize, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || declaredSize < 0 {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "X-Image-Size must be a byte count")
+			return
+		}
+	}
+	sparse, err := parseBoolQuery(r, "sparse", false)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	differential, err := parseBoolQuery(r, "differential", false)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	provisionOpts, err := parseProvisionQuery(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_provision", err.Error())
+		return
+	}
+	partition, err := parseIntQuery(r, "partition", 0, 1, maxPartition)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	imageID := r.URL.Query().Get("image")
+	uploadID := r.URL.Query().Get("upload")
+	if imageID != "" && uploadID != "" {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "image and upload are mutually exclusive")
+		return
+	}
+	if imageID == "" && uploadID == "" {
+		if err := requireContentLength(r); err != nil {
+			writeAPIError(w, http.StatusLengthRequired, "length_required", err.Error())
+			return
+		}
+	}
+
+	snap := deps.Cartridge.Snapshot()
+	if snap.Busy {
+		writeAPIError(w, http.StatusConflict, "cartridge_busy", "cartridge is busy")
+		return
+	}
+	if !snap.Present {
+		writeAPIError(w, http.StatusConflict, "no_cartridge", "no cartridge present")
+		return
+	}
+
+	opts := FlashRequest{
+		Options:   flash.Options{ImageSize: declaredSize, Verify: verify, UploadSHA256: uploadSHA256, ImageSHA256: imageSHA256, SkipZeros: sparse, Differential: differential, Partition: partition},
+		Provision: provisionOpts,
+	}
+	if bmapID := r.URL.Query().Get("bmap"); bmapID != "" {
+		if opts.Bmap, err = loadUploadedBmap(deps, bmapID); err != nil {
+			if errors.Is(err, flash.ErrInvalidBmap) {
+				writeFlashError(w, err)
+				return
+			}
+			writeUploadError(w, err)
+			return
+		}
+		opts.ImageSize = max(opts.ImageSize, opts.Bmap.ImageSize)
+	}
+	if err := checkFlash(handlers, opts); err != nil {
+		writeFlashError(w, err)
+		return
+	}
+	if imageID != "" {
+		startLibraryFlash(w, deps, handlers, imageID, opts)
+		return
+	}
+	if uploadID != "" {
+		startUploadFlash(w, deps, handlers, uploadID, opts)
+		return
+	}
+
+	// Reject unknown formats before the cartridge is touched. Peeking keeps
+	// the sniffed bytes in the stream handed to the flasher.
+	body := newUploadReader(io.LimitReader(r.Body, r.ContentLength))
+	buffered := bufio.NewReaderSize(body, flash.SniffSize)
+	header, err := buffered.Peek(flash.SniffSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeAPIError(w, http.StatusBadRequest, "upload_failed", err.Error())
+		return
+	}
+	if _, err := flash.DetectImageFormat(header, opts.Partition); err != nil {
+		writeFlashError(w, err)
+		return
+	}
+	opts.Size = r.ContentLength
+	opts.ImageSize = max(opts.ImageSize, flash.SizeHint(header, r.ContentLength))
+
+	// Stream the body directly into the flashing pipeline. The flash runs as a
+	// job so that a dropped connection after the upload completed (while dd is
+	// still flushing) does not cancel it; the handler only stays around until
+	// the body has been consumed.
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "upload"
+	}
+	job, err := startFlashJob(deps, handlers, name, "upload", func(ctx context.Context) error {
+		return flashFunc(ctx, buffered, opts)
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, "cartridge_busy", err.Error())
+		return
+	}
+
+	select {
+	case <-body.Done():
+	case <-job.Done():
+	}
+
+	// Prefer reporting an early failure (e.g. an invalid image) synchronously.
+	select {
+	case <-job.Done():
+		if err := job.Err(); err != nil {
+			writeFlashError(w, err)
+			return
+		}
+	default:
+	}
+	writeJSON(w, http.StatusAccepted, jobStartedResponse{OK: true, JobID: job.ID()})
+}
+
+// checkFlash rejects options the configured flasher would ignore, so a
+// request for a sparse or differential flash fails instead of writing the
+// whole image, and one for provisioning fails when there is no cartridge to
+// provision.
+func checkFlash(handlers APIV1Handlers, req FlashRequest) error {
+	if handlers.CheckFlashFunc == nil {
+		return nil
+	}
+	return handlers.CheckFlashFunc(req)
+}
+
+// errCartridgeBusy is returned by startFlashJob when another operation holds
+// the cartridge.
+var errCartridgeBusy = errors.New("cartridge is busy")
+
+// startFlashJob claims the cartridge, starts a flash job and logs its
+// outcome. name describes the image and source where it came from (upload,
+// url, library, resumable). The cartridge is released when the job ends.
+func startFlashJob(deps APIV1Deps, handlers APIV1Handlers, name, source string, run func(ctx context.Context) error) (*jobs.Job, error) {
+	if !deps.Cartridge.TryBegin() {
+		return nil, errCartridgeBusy
+	}
+	started := time.Now()
+	cartridge := history.CartridgeOf(deps.Cartridge.Snapshot())
+	statusFunc := handlers.FlashStatusFunc
+	return deps.Jobs.Start("flash", statusFunc, func(ctx context.Context) error {
+		err := run(ctx)
+		deps.Cartridge.SetBusy(false)
+		var info state.FlashInfo
+		// A run that never started has no status of its own.
+		if statusFunc != nil && !errors.Is(err, flash.ErrBusy) {
+			info = statusFunc()
+		}
+		recordHistory(deps, history.Flash(started, name, source, cartridge, info, err))
+		return err
+	}), nil
+}
+
+// writeFlashError maps flash pipeline errors to API errors.
+
+func writeFlashError(w http.ResponseWriter, err error) {
+	var flashErr *flash.Error
+	switch {
+	case errors.As(err, &flashErr):
+		status := http.StatusInternalServerError
+		switch flashErr.Code {
+		case flash.CodeNoDevice, flash.CodeRootDevice, flash.CodeDeviceMounted:
+			status = http.StatusConflict
+		case flash.CodeChecksumMismatch, flash.CodeInvalidPartition:
+			status = http.StatusUnprocessableEntity
+		case flash.CodeImageTooLarge:
+			status = http.StatusRequestEntityTooLarge
+		case flash.CodeInsufficientStorage:
+			status = http.StatusInsufficientStorage
+		case flash.CodeUnsupportedOption:
+			status = http.StatusNotImplemented
+		}
+		writeAPIError(w, status, string(flashErr.Code), err.Error())
+	case errors.Is(err, provision.ErrNoTarget):
+		writeAPIError(w, http.StatusNotImplemented, string(flash.CodeUnsupportedOption), err.Error())
+	case errors.Is(err, flash.ErrInvalidBmap):
+		writeAPIError(w, http.StatusBadRequest, "invalid_bmap", err.Error())
+	case errors.Is(err, flash.ErrUnsupportedFormat):
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_format", "unsupported image format: expected a gzip, xz, zstd, bzip2 or single-file zip compressed image, or a raw disk image")
+	case errors.Is(err, context.Canceled):
+		writeAPIError(w, http.StatusConflict, "flash_cancelled", err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "flash_failed", err.Error())
+	}
+}
+
+func handleFlashCancel(w http.ResponseWriter, r *http.Request, cancelFunc func(ctx context.Context) error) {
+	if cancelFunc == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "flash cancel not configured")
+		return
+	}
+	if err := cancelFunc(r.Context()); err != nil {
+		if errors.Is(err, flash.ErrNotRunning) {
+			writeAPIError(w, http.StatusConflict, "not_flashing", err.Error())
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, "cancel_failed", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, okResponse{OK: true})
+}
+
+func handleFlashStatus(w http.ResponseWriter, r *http.Request, statusFunc func() state.FlashInfo) {
+	if statusFunc == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "flash status not configured")
+		return
+	}
+	writeJSON(w, http.StatusOK, newFlashStatusResponse(statusFunc()))
+}
+
+func newFlashStatusResponse(info state.FlashInfo) flashStatusResponse {
+	steps := make([]provisionStepResponse, 0, len(info.Provisioning))
+	for _, step := range info.Provisioning {
+		steps = append(steps, provisionStepResponse{Name: step.Name, Status: step.Status, Detail: step.Detail})
+	}
+	return flashStatusResponse{
+		Status:        info.Status,
+		Device:        info.Device,
+		Partition:     info.Partition,
+		Format:        info.Format,
+		BytesTotal:    info.BytesTotal,
+		BytesRead:     info.BytesRead,
+		BytesWritten:  info.BytesWritten,
+		BytesMapped:   info.BytesMapped,
+		BytesSkipped:  info.BytesSkipped,
+		BytesInPlace:  info.BytesInPlace,
+		WriteRate:     info.WriteRate,
+		ETASeconds:    info.ETASeconds,
+		BytesVerified: info.BytesVerified,
+		ImageSHA256:   info.ImageSHA256,
+		DeviceSHA256:  info.DeviceSHA256,
+		Error:         info.Err,
+		Provisioning:  steps,
+	}
+}
+
+// maxBmapSize bounds block map files; bmaps of even very large images are a
+// few hundred KiB.
+const maxBmapSize = 16 * 1024 * 1024
+
+// readBmapFile reads and parses a bmaptool block map.
+func readBmapFile(reader io.Reader) ([]byte, *flash.Bmap, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, maxBmapSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > maxBmapSize {
+		return nil, nil, fmt.Errorf("%w: larger than %d bytes", flash.ErrInvalidBmap, maxBmapSize)
+	}
+	bmap, err := flash.ParseBmap(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, bmap, nil
+}
+
+// loadUploadedBmap parses the block map stored as a completed resumable
+// upload. The upload is left in place for further flashes until it expires.
+func loadUploadedBmap(deps APIV1Deps, id string) (*flash.Bmap, error) {
+	if deps.Uploads == nil {
+		return nil, uploads.ErrNotFound
+	}
+	file, _, err := deps.Uploads.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	_, bmap, err := readBmapFile(file)
+	return bmap, err
+}
+
+// parseProvisionQuery reads the post-flash provisioning options of a flash
+// request: expand, hostname, wifiSsid/wifiCountry and sshUser from the
+// query, the WiFi passphrase and the SSH key from the X-WiFi-PSK and
+// X-SSH-Key headers.
+func parseProvisionQuery(r *http.Request) (provision.Options, error) {
+	query := r.URL.Query()
+	// Query strings end up in access logs and browser history, so the
+	// secrets travel in headers.
+	for _, secret := range [][2]string{{"wifiPsk", "X-WiFi-PSK"}, {"sshKey", "X-SSH-Key"}} {
+		if query.Has(secret[0]) {
+			return provision.Options{}, fmt.Errorf("%w: pass %s in the %s header", provision.ErrInvalidOptions, secret[0], secret[1])
+		}
+	}
+	expand, err := parseBoolQuery(r, "expand", false)
+	if err != nil {
+		return provision.Options{}, err
+	}
+	psk := r.Header.Get("X-WiFi-PSK")
+	opts := provision.Options{
+		Expand:           expand,
+		Hostname:         query.Get("hostname"),
+		SSHAuthorizedKey: r.Header.Get("X-SSH-Key"),
+		SSHUser:          query.Get("sshUser"),
+	}
+	if ssid := query.Get("wifiSsid"); ssid != "" {
+		opts.WiFi = &provision.WiFi{SSID: ssid, PSK: psk, Country: query.Get("wifiCountry")}
+	} else if psk != "" || query.Get("wifiCountry") != "" {
+		return provision.Options{}, fmt.Errorf("%w: X-WiFi-PSK and wifiCountry need wifiSsid", provision.ErrInvalidOptions)
+	}
+	return opts, opts.Validate()
+}
+
+// parseBoolQuery reads an optional boolean query parameter.
+func parseBoolQuery(r *http.Request, name string, fallback bool) (bool, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s parameter: %q", name, raw)
+	}
+	return value, nil
+}
+
+// uploadReader reports when a request body has been fully consumed (or has
+// failed), so a handler can return while a job keeps processing the data.
+// Once the body reached a terminal state it is never read again, because the
+// server invalidates it as soon as the handler returns.
+type uploadReader struct {
+	reader io.Reader
+
+	once sync.Once
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newUploadReader(reader io.Reader) *uploadReader {
+	return &uploadReader{reader: reader, done: make(chan struct{})}
+}
+
+func (upload *uploadReader) Read(buffer []byte) (int, error) {
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if upload.err != nil {
+		return 0, upload.err
+	}
+	readCount, err := upload.reader.Read(buffer)
+	if err != nil {
+		upload.err = err
+		upload.once.Do(func() { close(upload.done) })
+	}
+	return readCount, err
+}
+
+// Done is closed once the body returned EOF or an error.
+func (upload *uploadReader) Done() <-chan struct{} { return upload.done }
+
+// expectedSHA256 reads an optional hex SHA-256 from a request header or,
+// failing that, a query parameter. Both may be given if they agree.
+func expectedSHA256(r *http.Request, header, query string) (string, error) {
+	fromHeader := strings.ToLower(strings.TrimSpace(r.Header.Get(header)))
+	fromQuery := strings.ToLower(strings.TrimSpace(r.URL.Query().Get(query)))
+	if fromHeader != "" && fromQuery != "" && fromHeader != fromQuery {
+		return "", fmt.Errorf("%s header and %s parameter differ", header, query)
+	}
+	digest := fromHeader
+	if digest == "" {
+		digest = fromQuery
+	}
+	return parseSHA256(digest, query)
+}
+
+// parseSHA256 normalizes an optional hex SHA-256 digest.
+func parseSHA256(digest, name string) (string, error) {
+	digest = strings.ToLower(strings.TrimSpace(digest))
+	if digest == "" {
+		return "", nil
+	}
+	if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("%s must be a hex encoded SHA-256 digest", name)
+	}
+	return digest, nil
+}
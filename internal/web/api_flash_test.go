@@ -0,0 +1,44 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/rook-computer/keymaker/internal/jobs"
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+func TestStartFlashJobClaimsCartridge(t *testing.T) {
+	cartridge := &state.CartridgeInfo{}
+	deps := APIV1Deps{Cartridge: cartridge, Jobs: jobs.NewManager(context.Background())}
+
+	release := make(chan struct{})
+	first, err := startFlashJob(deps, APIV1Handlers{}, "first", "upload", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("first startFlashJob: %v", err)
+	}
+	if !cartridge.Snapshot().Busy {
+		t.Error("the cartridge is not busy while the first flash is queued")
+	}
+
+	ran := false
+	if _, err := startFlashJob(deps, APIV1Handlers{}, "second", "upload", func(ctx context.Context) error {
+		ran = true
+		return nil
+	}); !errors.Is(err, errCartridgeBusy) {
+		t.Errorf("second startFlashJob: %v, want errCartridgeBusy", err)
+	}
+
+	close(release)
+	<-first.Done()
+	if ran {
+		t.Error("the second flash ran")
+	}
+	if cartridge.Snapshot().Busy {
+		t.Error("the cartridge is still busy after the flash")
+	}
+}
@@ -0,0 +1,167 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/rook-computer/keymaker/internal/fetch"
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/provision"
+)
+
+type flashURLRequest struct {
+	URL string `json:"url"`
+	// UploadSHA256 is the expected digest of the remote file as downloaded.
+	UploadSHA256 string `json:"uploadSha256"`
+	ImageSHA256  string `json:"imageSha256"`
+	Verify       *bool  `json:"verify"`
+	// BmapURL points to a bmaptool block map of the image; Sparse skips
+	// zero blocks when there is none. Differential only rewrites changed blocks.
+	BmapURL      string `json:"bmapUrl"`
+	Sparse       bool   `json:"sparse"`
+	Differential bool   `json:"differential"`
+	// Partition writes the image into that partition only (see
+	// flash.Options.Partition); 0 flashes the whole cartridge.
+	Partition int `json:"partition"`
+	// Provision configures the cartridge after a successful flash.
+	Provision *provision.Options `json:"provision"`
+}
+
+// handleFlashURL lets the device download the image itself and stream it
+// straight into the flash pipeline. Broken downloads are resumed with Range
+// requests by fetch.Reader.
+func handleFlashURL(w http.ResponseWriter, r *http.Request, deps APIV1Deps, handlers APIV1Handlers) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	flashFunc := handlers.FlashFunc
+	if flashFunc == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "flash not configured")
+		return
+	}
+
+	var req flashURLRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "invalid json")
+		return
+	}
+	uploadSHA256, err := parseSHA256(req.UploadSHA256, "uploadSha256")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_checksum", err.Error())
+		return
+	}
+	imageSHA256, err := parseSHA256(req.ImageSHA256, "imageSha256")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_checksum", err.Error())
+		return
+	}
+	verify := true
+	if req.Verify != nil {
+		verify = *req.Verify
+	}
+	if req.Partition < 0 || req.Partition > maxPartition {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("partition must be between 1 and %d", maxPartition))
+		return
+	}
+	var provisionOpts provision.Options
+	if req.Provision != nil {
+		provisionOpts = *req.Provision
+		if err := provisionOpts.Validate(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_provision", err.Error())
+			return
+		}
+	}
+
+	snap := deps.Cartridge.Snapshot()
+	if snap.Busy {
+		writeAPIError(w, http.StatusConflict, "cartridge_busy", "cartridge is busy")
+		return
+	}
+	if !snap.Present {
+		writeAPIError(w, http.StatusConflict, "no_cartridge", "no cartridge present")
+		return
+	}
+
+	var bmap *flash.Bmap
+	if req.BmapURL != "" {
+		if bmap, err = fetchBmap(r.Context(), deps, req.BmapURL); err != nil {
+			switch {
+			case errors.Is(err, fetch.ErrInvalidURL):
+				writeAPIError(w, http.StatusBadRequest, "invalid_url", "bmapUrl: "+err.Error())
+			case errors.Is(err, flash.ErrInvalidBmap):
+				writeFlashError(w, err)
+			default:
+				writeAPIError(w, http.StatusBadGateway, "fetch_failed", "bmap: "+err.Error())
+			}
+			return
+		}
+	}
+
+	if err := checkFlash(handlers, FlashRequest{Options: flash.Options{Bmap: bmap, SkipZeros: req.Sparse, Differential: req.Differential}, Provision: provisionOpts}); err != nil {
+		writeFlashError(w, err)
+		return
+	}
+
+	// The download outlives this request; the job closes it.
+	download, err := fetch.Open(context.WithoutCancel(r.Context()), deps.HTTPClient, req.URL)
+	if err != nil {
+		if errors.Is(err, fetch.ErrInvalidURL) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_url", err.Error())
+			return
+		}
+		writeAPIError(w, http.StatusBadGateway, "fetch_failed", err.Error())
+		return
+	}
+
+	// Reject unknown formats before the cartridge is touched.
+	buffered := bufio.NewReaderSize(download, flash.SniffSize)
+	header, err := buffered.Peek(flash.SniffSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		_ = download.Close()
+		writeAPIError(w, http.StatusBadGateway, "fetch_failed", err.Error())
+		return
+	}
+	if _, err := flash.DetectImageFormat(header, req.Partition); err != nil {
+		_ = download.Close()
+		writeFlashError(w, err)
+		return
+	}
+
+	size := max(download.Size(), 0)
+	opts := FlashRequest{
+		Options:   flash.Options{Size: size, ImageSize: flash.SizeHint(header, size), Verify: verify, UploadSHA256: uploadSHA256, ImageSHA256: imageSHA256, Bmap: bmap, SkipZeros: req.Sparse, Differential: req.Differential, Partition: req.Partition},
+		Provision: provisionOpts,
+	}
+	if bmap != nil {
+		opts.ImageSize = max(opts.ImageSize, bmap.ImageSize)
+	}
+	job, err := startFlashJob(deps, handlers, redactURL(req.URL), "url", func(ctx context.Context) error {
+		defer func() { _ = download.Close() }()
+		stop := context.AfterFunc(ctx, func() { _ = download.Close() })
+		defer stop()
+		return flashFunc(ctx, buffered, opts)
+	})
+	if err != nil {
+		_ = download.Close()
+		writeAPIError(w, http.StatusConflict, "cartridge_busy", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, jobStartedResponse{OK: true, JobID: job.ID()})
+}
+
+// fetchBmap downloads and parses a block map.
+func fetchBmap(ctx context.Context, deps APIV1Deps, url string) (*flash.Bmap, error) {
+	download, err := fetch.Open(ctx, deps.HTTPClient, url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = download.Close() }()
+	_, bmap, err := readBmapFile(download)
+	return bmap, err
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/history"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 1000
+)
+
+type historyPageResponse struct {
+	Total   int             `json:"total"`
+	Offset  int             `json:"offset"`
+	Limit   int             `json:"limit"`
+	Entries []history.Entry `json:"entries"`
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request, deps APIV1Deps) {
+	// GET /history?kind=&target=&result=&cartridge={cid}&name=&since=&until=&offset=&limit=
+	//   -> logged operations, newest first
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if deps.History == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "history not configured")
+		return
+	}
+
+	query := r.URL.Query()
+	filter := history.Filter{
+		Kind:   query.Get("kind"),
+		Target: query.Get("target"),
+		Result: query.Get("result"),
+		CID:    query.Get("cartridge"),
+		Name:   query.Get("name"),
+	}
+	var err error
+	if filter.Since, err = parseTimeQuery(r, "since"); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if filter.Until, err = parseTimeQuery(r, "until"); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	offset, err := parseIntQuery(r, "offset", 0, 0, 0)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	limit, err := parseIntQuery(r, "limit", defaultHistoryLimit, 1, maxHistoryLimit)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	entries, total, err := deps.History.Query(filter, offset, limit)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "history_failed", err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []history.Entry{}
+	}
+	writeJSON(w, http.StatusOK, historyPageResponse{Total: total, Offset: offset, Limit: limit, Entries: entries})
+}
+
+// parseTimeQuery reads an optional RFC 3339 timestamp.
+func parseTimeQuery(r *http.Request, name string) (time.Time, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	value, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s parameter: %q (want RFC 3339)", name, raw)
+	}
+	return value, nil
+}
+
+// parseIntQuery reads an optional integer of at least low and, if high > 0,
+// at most high.
+func parseIntQuery(r *http.Request, name string, fallback, low, high int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < low || (high > 0 && value > high) {
+		return 0, fmt.Errorf("invalid %s parameter: %q", name, raw)
+	}
+	return value, nil
+}
+
+// recordHistory appends an entry to the history log, if one is configured.
+// The log is best effort: failing to write it never fails the operation.
+func recordHistory(deps APIV1Deps, entry history.Entry) {
+	if deps.History == nil {
+		return
+	}
+	_ = deps.History.Append(entry)
+}
+
+// gameEntry starts the history entry of an operation on a game.
+func gameEntry(deps APIV1Deps, kind, systemName, gameName string) history.Entry {
+	return history.Entry{
+		Time:      time.Now(),
+		Kind:      kind,
+		Target:    history.TargetGame,
+		Name:      systemName + "/" + gameName,
+		Cartridge: history.CartridgeOf(deps.Cartridge.Snapshot()),
+	}
+}
+
+// biosEntry starts the history entry of an operation on a BIOS file.
+func biosEntry(deps APIV1Deps, kind, name string) history.Entry {
+	return history.Entry{
+		Time:      time.Now(),
+		Kind:      kind,
+		Target:    history.TargetBIOS,
+		Name:      name,
+		Cartridge: history.CartridgeOf(deps.Cartridge.Snapshot()),
+	}
+}
+
+// redactURL drops the query and credentials of an image URL before it is
+// logged.
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+	return parsed.String()
+}
@@ -0,0 +1,264 @@
+package web
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/partition"
+)
+
+type imageManifestResponse struct {
+	// Scheme is mbr, gpt, or empty when the cartridge has no partition table.
+	Scheme     string                   `json:"scheme"`
+	SectorSize int                      `json:"sectorSize"`
+	DeviceSize int64                    `json:"deviceSize"`
+	ImageSize  int64                    `json:"imageSize"`
+	Truncated  bool                     `json:"truncated"`
+	ZeroFilled bool                     `json:"zeroFilled"`
+	Partitions []imagePartitionResponse `json:"partitions"`
+	// Regions are the allocated ranges within the image; everything else
+	// is free space (zero when ZeroFilled).
+	Regions []imageRegionResponse `json:"regions"`
+}
+
+type imagePartitionResponse struct {
+	Index int    `json:"index"`
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Start int64  `json:"start"`
+	Size  int64  `json:"size"`
+}
+
+type imageRegionResponse struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// imageDump is an opened cartridge dump with its layout.
+type imageDump struct {
+	raw      io.ReadCloser
+	reader   io.Reader
+	manifest imageManifestResponse
+}
+
+// handleImageDump streams the whole cartridge as a compressed disk image.
+// The compressed size is unknown up front, so the raw size is sent as a hint
+// in X-Image-Size instead of a Content-Length. The manifest only needs the
+// partition table, which HeaderFunc reads while the cartridge stays mounted.
+func handleImageDump(w http.ResponseWriter, r *http.Request, deps APIV1Deps, handlers APIV1Handlers) {
+	// GET /image -> compressed image
+	// GET /image/manifest -> layout of the image GET /image would produce
+	manifestOnly := false
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/image":
+	case "/image/manifest":
+		manifestOnly = true
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", "not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	dumpFunc := handlers.DumpFunc
+	if manifestOnly && handlers.HeaderFunc != nil {
+		dumpFunc = handlers.HeaderFunc
+	}
+	if dumpFunc == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "image dump not configured")
+		return
+	}
+
+	compression := r.URL.Query().Get("compression")
+	if compression == "" {
+		compression = "gzip"
+	}
+	if compression != "gzip" && compression != "zstd" {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "compression must be gzip or zstd")
+		return
+	}
+	truncate, err := parseBoolQuery(r, "truncate", false)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	zeroFill, err := parseBoolQuery(r, "zeroFill", false)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	snap := deps.Cartridge.Snapshot()
+	if snap.Busy {
+		writeAPIError(w, http.StatusConflict, "cartridge_busy", "cartridge is busy")
+		return
+	}
+	if !snap.Present {
+		writeAPIError(w, http.StatusConflict, "no_cartridge", "no cartridge present")
+		return
+	}
+
+	dump, err := openImageDump(r.Context(), dumpFunc, truncate, zeroFill)
+	if err != nil {
+		switch {
+		case errors.Is(err, flash.ErrReadUnsupported):
+			writeAPIError(w, http.StatusNotImplemented, "not_implemented", err.Error())
+		case errors.Is(err, partition.ErrNoTable):
+			writeAPIError(w, http.StatusUnprocessableEntity, "no_partition_table", "the cartridge has no partition table; download the full image instead")
+		default:
+			writeAPIError(w, http.StatusInternalServerError, "dump_failed", err.Error())
+		}
+		return
+	}
+	defer func() { _ = dump.raw.Close() }()
+
+	if manifestOnly {
+		writeJSON(w, http.StatusOK, dump.manifest)
+		return
+	}
+
+	started := time.Now()
+	filename := "cartridge-" + started.Format("20060102-150405") + ".img"
+	sent := &countingWriter{writer: w}
+	var compressed io.WriteCloser
+	if compression == "zstd" {
+		filename += ".zst"
+		setDownloadHeaders(w, filename, "application/zstd")
+		compressed, err = zstd.NewWriter(sent)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "dump_failed", err.Error())
+			return
+		}
+	} else {
+		filename += ".gz"
+		setDownloadHeaders(w, filename, "application/gzip")
+		compressed, _ = gzip.NewWriterLevel(sent, gzip.BestSpeed)
+	}
+	w.Header().Set("X-Image-Size", strconv.FormatInt(dump.manifest.ImageSize, 10))
+	if manifest, err := json.Marshal(dump.manifest); err == nil {
+		w.Header().Set("X-Image-Manifest", asciiJSON(manifest))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	digest := sha256.New()
+	read, err := io.Copy(compressed, io.TeeReader(dump.reader, digest))
+	if err == nil {
+		err = compressed.Close()
+	}
+	entry := history.Entry{
+		Time:         started,
+		Kind:         history.KindDump,
+		Target:       history.TargetCartridge,
+		Name:         filename,
+		Cartridge:    history.CartridgeOf(snap),
+		BytesRead:    read,
+		BytesWritten: sent.count,
+	}
+	if err == nil {
+		entry.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	}
+	recordHistory(deps, entry.Finish(err))
+	if err != nil {
+		// The status line is already out; abort the connection so the client
+		// cannot mistake a truncated image for a complete one.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// openImageDump opens the cartridge and parses its partition table. With
+// truncate the image ends after the last partition; with zeroFill all free
+// space reads as zeros. Both need a partition table.
+func openImageDump(ctx context.Context, dumpFunc func(ctx context.Context) (io.ReadCloser, int64, error), truncate, zeroFill bool) (*imageDump, error) {
+	raw, size, err := dumpFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReaderSize(raw, partition.HeaderSize)
+	header, err := buffered.Peek(partition.HeaderSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		_ = raw.Close()
+		return nil, err
+	}
+
+	manifest := imageManifestResponse{
+		SectorSize: partition.SectorSize,
+		DeviceSize: size,
+		ImageSize:  size,
+		Partitions: []imagePartitionResponse{},
+		Regions:    []imageRegionResponse{{Offset: 0, Length: size}},
+	}
+	table, err := partition.Parse(header)
+	if err != nil {
+		if truncate || zeroFill {
+			_ = raw.Close()
+			return nil, fmt.Errorf("%w: %v", partition.ErrNoTable, err)
+		}
+		return &imageDump{raw: raw, reader: io.LimitReader(buffered, size), manifest: manifest}, nil
+	}
+
+	manifest.Scheme = string(table.Scheme)
+	for _, p := range table.Partitions {
+		manifest.Partitions = append(manifest.Partitions, imagePartitionResponse{Index: p.Index, Type: p.Type, Name: p.Name, Start: p.Start, Size: p.Size})
+	}
+	if truncate && table.End() < size {
+		manifest.ImageSize = table.End()
+		manifest.Truncated = true
+	}
+	regions := table.AllocatedRegions(manifest.ImageSize)
+	manifest.Regions = make([]imageRegionResponse, 0, len(regions))
+	for _, region := range regions {
+		manifest.Regions = append(manifest.Regions, imageRegionResponse{Offset: region.Offset, Length: region.Length})
+	}
+
+	dump := &imageDump{raw: raw, reader: io.LimitReader(buffered, manifest.ImageSize), manifest: manifest}
+	if zeroFill {
+		dump.manifest.ZeroFilled = true
+		dump.reader = partition.ZeroFill(buffered, regions, manifest.ImageSize)
+	}
+	return dump, nil
+}
+
+// countingWriter counts the bytes sent to the client.
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (counter *countingWriter) Write(data []byte) (int, error) {
+	n, err := counter.writer.Write(data)
+	counter.count += int64(n)
+	return n, err
+}
+
+// asciiJSON escapes non-ASCII characters (e.g. in GPT partition names) so
+// the JSON can be sent in a header.
+func asciiJSON(raw []byte) string {
+	var builder strings.Builder
+	for _, char := range string(raw) {
+		if char < 0x80 {
+			builder.WriteRune(char)
+			continue
+		}
+		for _, unit := range utf16.Encode([]rune{char}) {
+			fmt.Fprintf(&builder, `\u%04x`, unit)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,292 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/library"
+)
+
+type libraryImageResponse struct {
+	ID                   string    `json:"id"`
+	Name                 string    `json:"name"`
+	Size                 int64     `json:"size"`
+	Format               string    `json:"format"`
+	SHA256               string    `json:"sha256"`
+	ImageSize            int64     `json:"imageSize"`
+	ImageSizeApproximate bool      `json:"imageSizeApproximate"`
+	CreatedAt            time.Time `json:"createdAt"`
+	HasBmap              bool      `json:"hasBmap"`
+}
+
+type renameImageRequest struct {
+	Name string `json:"name"`
+}
+
+func handleImages(w http.ResponseWriter, r *http.Request, deps APIV1Deps) {
+	// GET /images -> stored images
+	// POST /images?name={name} -> store the body as a new image
+	// GET /images/{id} -> a single image
+	// PATCH /images/{id} -> rename an image
+	// DELETE /images/{id} -> delete an image
+	// GET, PUT, DELETE /images/{id}/bmap -> block map used for sparse flashing
+	if deps.Images == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "image library not configured")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/images"), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			images, err := deps.Images.List()
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "library_failed", err.Error())
+				return
+			}
+			resp := make([]libraryImageResponse, 0, len(images))
+			for _, image := range images {
+				resp = append(resp, newLibraryImageResponse(image))
+			}
+			writeJSON(w, http.StatusOK, resp)
+		case http.MethodPost:
+			handleImageUpload(w, r, deps)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		}
+		return
+	}
+	if id, sub, ok := strings.Cut(id, "/"); ok {
+		if sub != "bmap" {
+			writeAPIError(w, http.StatusNotFound, "not_found", "not found")
+			return
+		}
+		handleImageBmap(w, r, deps, id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		image, err := deps.Images.Get(id)
+		if err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newLibraryImageResponse(image))
+	case http.MethodPatch:
+		var req renameImageRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "invalid json")
+			return
+		}
+		image, err := deps.Images.Rename(id, req.Name)
+		if err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newLibraryImageResponse(image))
+	case http.MethodDelete:
+		image, err := deps.Images.Get(id)
+		if err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		entry := history.Entry{Time: time.Now(), Kind: history.KindDelete, Target: history.TargetImage, Name: image.Name, SHA256: image.SHA256}
+		err = deps.Images.Delete(id)
+		recordHistory(deps, entry.Finish(err))
+		if err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, okResponse{OK: true})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+func handleImageUpload(w http.ResponseWriter, r *http.Request, deps APIV1Deps) {
+	if err := requireContentLength(r); err != nil {
+		writeAPIError(w, http.StatusLengthRequired, "length_required", err.Error())
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = "image-" + time.Now().Format("20060102-150405")
+	}
+
+	entry := history.Entry{Time: time.Now(), Kind: history.KindUpload, Target: history.TargetImage, Name: name}
+	image, err := deps.Images.Add(r.Context(), name, io.LimitReader(r.Body, r.ContentLength))
+	if err != nil {
+		recordHistory(deps, entry.Finish(err))
+		if r.Context().Err() != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+			writeAPIError(w, http.StatusBadRequest, "upload_failed", err.Error())
+			return
+		}
+		writeLibraryError(w, err)
+		return
+	}
+	entry.BytesRead = image.Size
+	if image.Size < r.ContentLength {
+		// The client went away mid-upload; don't keep a truncated image.
+		_ = deps.Images.Delete(image.ID)
+		err := fmt.Errorf("received %d of %d bytes", image.Size, r.ContentLength)
+		recordHistory(deps, entry.Finish(err))
+		writeAPIError(w, http.StatusBadRequest, "upload_failed", err.Error())
+		return
+	}
+	entry.SHA256, entry.BytesWritten = image.SHA256, image.Size
+	recordHistory(deps, entry.Finish(nil))
+	writeJSON(w, http.StatusCreated, newLibraryImageResponse(image))
+}
+
+func handleImageBmap(w http.ResponseWriter, r *http.Request, deps APIV1Deps, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		data, err := deps.Images.Bmap(id)
+		if err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(data)
+	case http.MethodPut:
+		data, _, err := readBmapFile(r.Body)
+		if err != nil {
+			if errors.Is(err, flash.ErrInvalidBmap) {
+				writeFlashError(w, err)
+				return
+			}
+			writeAPIError(w, http.StatusBadRequest, "upload_failed", err.Error())
+			return
+		}
+		image, err := deps.Images.SetBmap(id, data)
+		if err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newLibraryImageResponse(image))
+	case http.MethodDelete:
+		if err := deps.Images.DeleteBmap(id); err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, okResponse{OK: true})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+// startLibraryFlash flashes a stored image instead of the request body.
+// The stored digest doubles as the expected upload digest, so a file that
+// rotted on the host's storage fails with checksum_mismatch. An attached
+// block map is used unless the request brought its own.
+func startLibraryFlash(w http.ResponseWriter, deps APIV1Deps, handlers APIV1Handlers, id string, opts FlashRequest) {
+	if deps.Images == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "image library not configured")
+		return
+	}
+	file, image, err := deps.Images.Open(id)
+	if err != nil {
+		writeLibraryError(w, err)
+		return
+	}
+	if opts.UploadSHA256 != "" && !strings.EqualFold(opts.UploadSHA256, image.SHA256) {
+		_ = file.Close()
+		writeAPIError(w, http.StatusUnprocessableEntity, string(flash.CodeChecksumMismatch), fmt.Sprintf("stored image sha256 %s does not match expected %s", image.SHA256, opts.UploadSHA256))
+		return
+	}
+	if opts.Bmap == nil {
+		bmap, err := deps.Images.ParsedBmap(id)
+		if err != nil {
+			_ = file.Close()
+			writeLibraryError(w, err)
+			return
+		}
+		// The stored bmap only saves time; a flasher that cannot honour it
+		// writes the whole image.
+		if bmap != nil && checkFlash(handlers, FlashRequest{Options: flash.Options{Bmap: bmap}}) == nil {
+			opts.Bmap = bmap
+		}
+	}
+	if opts.Bmap != nil {
+		opts.ImageSize = max(opts.ImageSize, opts.Bmap.ImageSize)
+	}
+	opts.Size = image.Size
+	opts.ImageSize = max(opts.ImageSize, image.ImageSize)
+	opts.UploadSHA256 = image.SHA256
+	startStoredFlash(w, deps, handlers, file, image.Name, "library", opts, nil)
+}
+
+// startStoredFlash flashes an image file that is already on the host. It
+// owns file and closes it once the job ends; onSuccess (optional) runs after
+// a successful flash. source is logged to the history (library, resumable).
+func startStoredFlash(w http.ResponseWriter, deps APIV1Deps, handlers APIV1Handlers, file *os.File, name, source string, opts FlashRequest, onSuccess func()) {
+	// A partition is checked by the flasher, which knows its size.
+	if capacity := deps.Cartridge.Snapshot().Capacity; capacity > 0 && opts.Partition == 0 && opts.ImageSize > capacity {
+		_ = file.Close()
+		writeAPIError(w, http.StatusRequestEntityTooLarge, string(flash.CodeImageTooLarge), fmt.Sprintf("image %s is %d bytes but the cartridge holds only %d bytes", name, opts.ImageSize, capacity))
+		return
+	}
+
+	flashFunc := handlers.FlashFunc
+	job, err := startFlashJob(deps, handlers, name, source, func(ctx context.Context) error {
+		defer func() { _ = file.Close() }()
+		if err := flashFunc(ctx, file, opts); err != nil {
+			return err
+		}
+		if onSuccess != nil {
+			onSuccess()
+		}
+		return nil
+	})
+	if err != nil {
+		_ = file.Close()
+		writeAPIError(w, http.StatusConflict, "cartridge_busy", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, jobStartedResponse{OK: true, JobID: job.ID()})
+}
+
+// writeLibraryError maps image library errors to API errors.
+func writeLibraryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, library.ErrNotFound):
+		writeAPIError(w, http.StatusNotFound, "image_not_found", err.Error())
+	case errors.Is(err, library.ErrInvalidName):
+		writeAPIError(w, http.StatusBadRequest, "invalid_name", "name must be 1-255 characters without slashes or control characters")
+	case errors.Is(err, library.ErrNoBmap):
+		writeAPIError(w, http.StatusNotFound, "bmap_not_found", err.Error())
+	case errors.Is(err, flash.ErrUnsupportedFormat), errors.Is(err, flash.ErrInvalidBmap):
+		writeFlashError(w, err)
+	case errors.Is(err, syscall.ENOSPC):
+		writeAPIError(w, http.StatusInsufficientStorage, "insufficient_storage", "not enough space for the image on the host")
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "library_failed", err.Error())
+	}
+}
+
+func newLibraryImageResponse(image library.Image) libraryImageResponse {
+	return libraryImageResponse{
+		ID:                   image.ID,
+		Name:                 image.Name,
+		Size:                 image.Size,
+		Format:               string(image.Format),
+		SHA256:               image.SHA256,
+		ImageSize:            image.ImageSize,
+		ImageSizeApproximate: image.ImageSizeApproximate(),
+		CreatedAt:            image.CreatedAt,
+		HasBmap:              image.HasBmap,
+	}
+}
@@ -0,0 +1,68 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/jobs"
+)
+
+type jobResponse struct {
+	ID         string              `json:"id"`
+	Kind       string              `json:"kind"`
+	Phase      string              `json:"phase"`
+	Progress   flashStatusResponse `json:"progress"`
+	CreatedAt  time.Time           `json:"createdAt"`
+	FinishedAt *time.Time          `json:"finishedAt"`
+	Error      string              `json:"error"`
+	ErrorCode  string              `json:"errorCode,omitempty"`
+}
+
+func handleJobs(w http.ResponseWriter, r *http.Request, deps APIV1Deps) {
+	// GET /jobs -> all known jobs
+	// GET /jobs/{id} -> a single job
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if id == "" {
+		snapshots := deps.Jobs.List()
+		resp := make([]jobResponse, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			resp = append(resp, newJobResponse(snapshot))
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	if strings.Contains(id, "/") {
+		writeAPIError(w, http.StatusNotFound, "not_found", "not found")
+		return
+	}
+
+	job, ok := deps.Jobs.Get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "job_not_found", "job not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, newJobResponse(job.Snapshot()))
+}
+
+func newJobResponse(snapshot jobs.Snapshot) jobResponse {
+	resp := jobResponse{
+		ID:        snapshot.ID,
+		Kind:      snapshot.Kind,
+		Phase:     string(snapshot.Phase),
+		Progress:  newFlashStatusResponse(snapshot.Progress),
+		CreatedAt: snapshot.CreatedAt,
+		Error:     snapshot.Err,
+		ErrorCode: snapshot.ErrCode,
+	}
+	if !snapshot.FinishedAt.IsZero() {
+		finishedAt := snapshot.FinishedAt
+		resp.FinishedAt = &finishedAt
+	}
+	return resp
+}
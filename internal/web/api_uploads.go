@@ -0,0 +1,322 @@
+package web
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/uploads"
+)
+
+// tusVersion is the version of the tus resumable upload protocol spoken by
+// /uploads. Only its core plus the creation, expiration and termination
+// extensions are implemented.
+const tusVersion = "1.0.0"
+
+type uploadResponse struct {
+	ID        string            `json:"id"`
+	Length    int64             `json:"length"`
+	Offset    int64             `json:"offset"`
+	Complete  bool              `json:"complete"`
+	Metadata  map[string]string `json:"metadata"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+func handleUploads(w http.ResponseWriter, r *http.Request, deps APIV1Deps) {
+	// OPTIONS /uploads -> tus capabilities
+	// GET /uploads -> partial and completed uploads
+	// POST /uploads -> create an upload (Upload-Length, optional Upload-Metadata)
+	// GET /uploads/{id} -> a single upload
+	// HEAD /uploads/{id} -> current offset (Upload-Offset)
+	// PATCH /uploads/{id} -> append a chunk at Upload-Offset
+	// DELETE /uploads/{id} -> cancel an upload
+	if deps.Uploads == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "uploads not configured")
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if version := r.Header.Get("Tus-Resumable"); version != "" && version != tusVersion && r.Method != http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeAPIError(w, http.StatusPreconditionFailed, "unsupported_version", "only tus "+tusVersion+" is supported")
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodOptions:
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", "creation,expiration,termination")
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			list, err := deps.Uploads.List()
+			if err != nil {
+				writeAPIError(w, http.StatusInternalServerError, "upload_failed", err.Error())
+				return
+			}
+			resp := make([]uploadResponse, 0, len(list))
+			for _, upload := range list {
+				resp = append(resp, newUploadResponse(upload))
+			}
+			writeJSON(w, http.StatusOK, resp)
+		case http.MethodPost:
+			handleUploadCreate(w, r, deps)
+		default:
+			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		}
+		return
+	}
+	if strings.Contains(id, "/") {
+		writeAPIError(w, http.StatusNotFound, "not_found", "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		upload, err := deps.Uploads.Get(id)
+		if err != nil {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(uploadErrorStatus(err))
+				return
+			}
+			writeUploadError(w, err)
+			return
+		}
+		setUploadHeaders(w, upload)
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		writeJSON(w, http.StatusOK, newUploadResponse(upload))
+	case http.MethodPatch:
+		handleUploadChunk(w, r, deps, id)
+	case http.MethodDelete:
+		if err := deps.Uploads.Delete(id); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+func handleUploadCreate(w http.ResponseWriter, r *http.Request, deps APIV1Deps) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "Upload-Length must be a byte count")
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+
+	upload, err := deps.Uploads.Create(length, metadata)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/uploads/"+upload.ID)
+	setUploadHeaders(w, upload)
+	writeJSON(w, http.StatusCreated, newUploadResponse(upload))
+}
+
+// handleUploadChunk appends the request body to an upload. Bytes received
+// before a broken connection are kept; the client asks for the offset with
+// HEAD and continues from there.
+func handleUploadChunk(w http.ResponseWriter, r *http.Request, deps APIV1Deps, id string) {
+	if mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0]); mediaType != "application/offset+octet-stream" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "chunks must be sent as application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "Upload-Offset must be a byte offset")
+		return
+	}
+
+	upload, err := deps.Uploads.Get(id)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if r.ContentLength > 0 && offset+r.ContentLength > upload.Length {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "upload_too_large", fmt.Sprintf("chunk ends at byte %d but the upload is %d bytes", offset+r.ContentLength, upload.Length))
+		return
+	}
+
+	upload, err = deps.Uploads.Append(r.Context(), id, offset, r.Body)
+	if upload.ID != "" {
+		setUploadHeaders(w, upload)
+	}
+	if err != nil {
+		if r.Context().Err() != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+			writeAPIError(w, http.StatusBadRequest, "upload_failed", fmt.Sprintf("chunk interrupted at byte %d: %v", upload.Offset, err))
+			return
+		}
+		writeUploadError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startUploadFlash flashes a completed upload. The upload is removed once the
+// flash succeeded; after a failure it stays until it expires, so the flash
+// can be retried without uploading again.
+func startUploadFlash(w http.ResponseWriter, deps APIV1Deps, handlers APIV1Handlers, id string, opts FlashRequest) {
+	if deps.Uploads == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "uploads not configured")
+		return
+	}
+	file, upload, err := deps.Uploads.Open(id)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	header := make([]byte, flash.SniffSize)
+	headerSize, err := file.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		_ = file.Close()
+		writeUploadError(w, err)
+		return
+	}
+	header = header[:headerSize]
+	if _, err := flash.DetectImageFormat(header, opts.Partition); err != nil {
+		_ = file.Close()
+		writeFlashError(w, err)
+		return
+	}
+	opts.Size = upload.Length
+	opts.ImageSize = max(opts.ImageSize, flash.StoredSizeHint(file, header, upload.Length))
+
+	name := upload.Metadata["filename"]
+	if name == "" {
+		name = "upload " + upload.ID
+	}
+	startStoredFlash(w, deps, handlers, file, name, "resumable", opts, func() { _ = deps.Uploads.Delete(id) })
+}
+
+// uploadGameFromUpload stores a completed upload as a game and removes the
+// upload on success.
+func uploadGameFromUpload(w http.ResponseWriter, r *http.Request, deps APIV1Deps, systemName, gameName, id string) {
+	if deps.Uploads == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "uploads not configured")
+		return
+	}
+	file, upload, err := deps.Uploads.Open(id)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	defer func() { _ = file.Close() }()
+
+	entry := gameEntry(deps, history.KindUpload, systemName, gameName)
+	err = deps.RetroPie.UploadGame(r.Context(), systemName, gameName, file, upload.Length)
+	if err == nil {
+		entry.BytesRead, entry.BytesWritten = upload.Length, upload.Length
+	}
+	recordHistory(deps, entry.Finish(err))
+	if err != nil {
+		if writeGamePathError(w, err) {
+			return
+		}
+		if errorsIsNotExist(err) {
+			writeAPIError(w, http.StatusNotFound, "system_not_found", "system not found")
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, "upload_failed", err.Error())
+		return
+	}
+	_ = deps.Uploads.Delete(id)
+	writeJSON(w, http.StatusOK, okResponse{OK: true})
+}
+
+func setUploadHeaders(w http.ResponseWriter, upload uploads.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma separated
+// "key base64(value)" pairs, where the value may be omitted.
+func parseUploadMetadata(raw string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(raw) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata: empty key")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata: value of %q is not base64", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, uploads.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, uploads.ErrOffsetMismatch), errors.Is(err, uploads.ErrIncomplete):
+		return http.StatusConflict
+	case errors.Is(err, uploads.ErrLocked):
+		return http.StatusLocked
+	case errors.Is(err, uploads.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, syscall.ENOSPC):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeUploadError maps upload store errors to API errors.
+func writeUploadError(w http.ResponseWriter, err error) {
+	status := uploadErrorStatus(err)
+	code := "upload_failed"
+	switch {
+	case errors.Is(err, uploads.ErrNotFound):
+		code = "upload_not_found"
+	case errors.Is(err, uploads.ErrOffsetMismatch):
+		code = "offset_mismatch"
+	case errors.Is(err, uploads.ErrIncomplete):
+		code = "upload_incomplete"
+	case errors.Is(err, uploads.ErrLocked):
+		code = "upload_locked"
+	case errors.Is(err, uploads.ErrTooLarge):
+		code = "upload_too_large"
+	case errors.Is(err, syscall.ENOSPC):
+		code = "insufficient_storage"
+	}
+	writeAPIError(w, status, code, err.Error())
+}
+
+func newUploadResponse(upload uploads.Upload) uploadResponse {
+	return uploadResponse{
+		ID:        upload.ID,
+		Length:    upload.Length,
+		Offset:    upload.Offset,
+		Complete:  upload.Complete(),
+		Metadata:  upload.Metadata,
+		CreatedAt: upload.CreatedAt,
+		ExpiresAt: upload.ExpiresAt,
+	}
+}
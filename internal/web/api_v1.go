@@ -9,11 +9,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/rook-computer/keymaker/internal/history"
 	"github.com/rook-computer/keymaker/internal/state"
 )
 
@@ -33,9 +33,23 @@ type cartridgeInfoResponse struct {
 	Systems      []state.CartridgeSystemInfo `json:"systems"`
 	EmptySystems []string                    `json:"emptySystems"`
 	Busy         bool                        `json:"busy"`
+
+	IncompleteImage bool  `json:"incompleteImage"`
+	Capacity        int64 `json:"capacity"`
+	// Identity is read from the card registers; null when the reader does
+	// not expose them.
+	Identity *cartridgeIdentityResponse `json:"identity"`
+}
+
+type cartridgeIdentityResponse struct {
+	CID            string `json:"cid"`
+	Serial         string `json:"serial"`
+	Name           string `json:"name"`
+	ManufacturerID string `json:"manufacturerId"`
+	Date           string `json:"date"`
 }
 
-func apiV1Router(ejectFunc func(ctx context.Context) error, flashFunc func(ctx context.Context, reader io.Reader) error) http.Handler {
+func apiV1Router(ejectFunc func(ctx context.Context) error, flashFunc func(ctx context.Context, reader io.Reader, req FlashRequest) error) http.Handler {
 	// Backwards-compatible defaults: keep the existing device behavior
 	// (mount via scripts, roms under /cartridge/...) unless an entrypoint
 	// registers routes with explicit deps.
@@ -47,14 +61,80 @@ func apiV1RouterWithDeps(handlers APIV1Handlers, deps APIV1Deps) http.Handler {
 	deps = deps.withDefaults()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/cartridgeinfo", func(w http.ResponseWriter, r *http.Request) { handleCartridgeInfo(w, r, deps) })
-	mux.HandleFunc("/retropie", func(w http.ResponseWriter, r *http.Request) { handleRetroPie(w, r, deps) })
-	mux.HandleFunc("/retropie/", func(w http.ResponseWriter, r *http.Request) { handleRetroPie(w, r, deps) })
+	// A running duplication batch owns the cartridge slot: it ejects, flashes
+	// and verifies cartridges on its own, so the routes that mount, read or
+	// write the cartridge (including the games below /retropie) are refused.
+	mux.HandleFunc("/retropie", func(w http.ResponseWriter, r *http.Request) {
+		if rejectDuringDuplication(w, handlers) {
+			return
+		}
+		handleRetroPie(w, r, deps)
+	})
+	mux.HandleFunc("/retropie/", func(w http.ResponseWriter, r *http.Request) {
+		if rejectDuringDuplication(w, handlers) {
+			return
+		}
+		handleRetroPie(w, r, deps)
+	})
 	mux.HandleFunc("/eject", func(w http.ResponseWriter, r *http.Request) {
+		if rejectDuringDuplication(w, handlers) {
+			return
+		}
 		handleEject(w, r, deps, handlers.EjectFunc)
 	})
 	mux.HandleFunc("/flash", func(w http.ResponseWriter, r *http.Request) {
-		handleFlash(w, r, deps, handlers.FlashFunc)
+		switch r.Method {
+		case http.MethodGet:
+			handleFlashStatus(w, r, handlers.FlashStatusFunc)
+		case http.MethodDelete:
+			handleFlashCancel(w, r, handlers.CancelFlashFunc)
+		default:
+			if rejectDuringDuplication(w, handlers) {
+				return
+			}
+			handleFlash(w, r, deps, handlers)
+		}
 	})
+	mux.HandleFunc("/flash/url", func(w http.ResponseWriter, r *http.Request) {
+		if rejectDuringDuplication(w, handlers) {
+			return
+		}
+		handleFlashURL(w, r, deps, handlers)
+	})
+	mux.HandleFunc("/wipe", func(w http.ResponseWriter, r *http.Request) {
+		if rejectDuringDuplication(w, handlers) {
+			return
+		}
+		handleWipe(w, r, deps, handlers)
+	})
+	mux.HandleFunc("/duplication", func(w http.ResponseWriter, r *http.Request) { handleDuplication(w, r, deps, handlers) })
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		if rejectDuringDuplication(w, handlers) {
+			return
+		}
+		handleImageDump(w, r, deps, handlers)
+	})
+	mux.HandleFunc("/image/", func(w http.ResponseWriter, r *http.Request) {
+		if rejectDuringDuplication(w, handlers) {
+			return
+		}
+		handleImageDump(w, r, deps, handlers)
+	})
+	// The image library and the resumable uploads live on the host's storage
+	// and stay usable during a batch; flashing one of them goes through the
+	// guarded /flash. Only the batch image itself must stay as it is.
+	mux.HandleFunc("/images", func(w http.ResponseWriter, r *http.Request) { handleImages(w, r, deps) })
+	mux.HandleFunc("/images/", func(w http.ResponseWriter, r *http.Request) {
+		if rejectBatchImageChange(w, r, handlers) {
+			return
+		}
+		handleImages(w, r, deps)
+	})
+	mux.HandleFunc("/uploads", func(w http.ResponseWriter, r *http.Request) { handleUploads(w, r, deps) })
+	mux.HandleFunc("/uploads/", func(w http.ResponseWriter, r *http.Request) { handleUploads(w, r, deps) })
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) { handleJobs(w, r, deps) })
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) { handleJobs(w, r, deps) })
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) { handleHistory(w, r, deps) })
 	return mux
 }
 
@@ -85,44 +165,22 @@ func handleEject(w http.ResponseWriter, r *http.Request, deps APIV1Deps, ejectFu
 	writeJSON(w, http.StatusOK, okResponse{OK: true})
 }
 
-func handleFlash(w http.ResponseWriter, r *http.Request, deps APIV1Deps, flashFunc func(ctx context.Context, reader io.Reader) error) {
-	if r.Method != http.MethodPost {
-		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
-		return
-	}
-	if flashFunc == nil {
-		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "flash not configured")
-		return
-	}
-	if err := requireContentLength(r); err != nil {
-		writeAPIError(w, http.StatusLengthRequired, "length_required", err.Error())
-		return
-	}
-
-	snap := deps.Cartridge.Snapshot()
-	if snap.Busy {
-		writeAPIError(w, http.StatusConflict, "cartridge_busy", "cartridge is busy")
-		return
-	}
-	if !snap.Present {
-		writeAPIError(w, http.StatusConflict, "no_cartridge", "no cartridge present")
-		return
-	}
-
-	// Stream the body directly into the flashing pipeline.
-	limitedBody := io.LimitReader(r.Body, r.ContentLength)
-	if err := flashFunc(r.Context(), limitedBody); err != nil {
-		writeAPIError(w, http.StatusInternalServerError, "flash_failed", err.Error())
-		return
-	}
-	writeJSON(w, http.StatusAccepted, okResponse{OK: true})
-}
-
 func handleRetroPie(w http.ResponseWriter, r *http.Request, deps APIV1Deps) {
 	// Step 3: GET /retropie -> systems list (from CartridgeInfo snapshot)
 	// Step 4: GET /retropie/{system} -> game list (requires mounted cartridge)
+	//         (?details=true&sort=&order=&name=&offset=&limit=&hash= lists sizes,
+	//         times and digests)
 	// Step 5: GET /retropie/{system}/{game} -> download game bytes (zip folder if needed)
 	// Step 6: POST /retropie/{system}/{game} -> upload a game (unzip if {game} ends with .zip)
+	//         (?upload={id} takes the bytes from a completed resumable upload)
+	// {game} may be a path of any depth inside the system directory, e.g.
+	// doom/doom.cfg; GET ?list=true on a directory lists it like Step 4.
+	// GET ?metadata=true -> the game's gamelist.xml metadata
+	// PATCH /retropie/{system}/{game} -> rename the game and/or edit its metadata
+	// GET/PUT/DELETE ?media={image|thumbnail|marquee|video} -> the game's media
+	//         (GET &size=N scales a picture for cover grids)
+	// /retropie/bios[/{name}] -> the BIOS directory (see handleBIOS); it
+	// takes the place of a system called bios, which RetroPie does not have.
 	path := r.URL.Path
 	if !strings.HasPrefix(path, "/retropie") {
 		writeAPIError(w, http.StatusNotFound, "not_found", "not found")
@@ -162,6 +220,10 @@ func handleRetroPie(w http.ResponseWriter, r *http.Request, deps APIV1Deps) {
 	}
 
 	parts := strings.Split(rel, "/")
+	if parts[0] == biosPathSegment {
+		handleBIOS(w, r, deps, snap, strings.Join(parts[1:], "/"))
+		return
+	}
 	if len(parts) == 1 {
 		if r.Method != http.MethodGet {
 			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
@@ -178,114 +240,130 @@ func handleRetroPie(w http.ResponseWriter, r *http.Request, deps APIV1Deps) {
 			writeAPIError(w, http.StatusInternalServerError, "mount_failed", err.Error())
 			return
 		}
+		listGameDirectory(w, r, deps, systemName, "")
+		return
+	}
+
+	systemName := parts[0]
+	gameName := strings.Join(parts[1:], "/")
+	if !hasCartridgeSystem(snap, systemName) {
+		writeAPIError(w, http.StatusNotFound, "system_not_found", "system not found")
+		return
+	}
+	if !validGamePath(gameName) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_game", "invalid game")
+		return
+	}
+
+	if err := deps.Mounter.EnsureMounted(r.Context()); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "mount_failed", err.Error())
+		return
+	}
+
+	if kindName := r.URL.Query().Get("media"); kindName != "" {
+		handleGameMedia(w, r, deps, systemName, gameName, kindName)
+		return
+	}
 
-		games, err := deps.RetroPie.ListGames(r.Context(), systemName)
+	switch r.Method {
+	case http.MethodGet:
+		list, err := parseBoolQuery(r, "list", false)
 		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		if list {
+			listGameDirectory(w, r, deps, systemName, gameName)
+			return
+		}
+		metadata, err := parseBoolQuery(r, "metadata", false)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		if metadata {
+			handleGameMetadata(w, r, deps, systemName, gameName)
+			return
+		}
+		if err := deps.RetroPie.DownloadGame(r.Context(), w, r, systemName, gameName); err != nil {
+			if writeGamePathError(w, err) {
+				return
+			}
 			if errorsIsNotExist(err) {
-				writeAPIError(w, http.StatusNotFound, "system_not_found", "system not found")
+				writeAPIError(w, http.StatusNotFound, "game_not_found", "game not found")
 				return
 			}
-			writeAPIError(w, http.StatusInternalServerError, "list_failed", err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "download_failed", err.Error())
 			return
 		}
-		writeJSON(w, http.StatusOK, games)
 		return
-	}
-
-	if len(parts) == 2 {
-		systemName := parts[0]
-		gameName := parts[1]
-		if !hasCartridgeSystem(snap, systemName) {
-			writeAPIError(w, http.StatusNotFound, "system_not_found", "system not found")
+	case http.MethodPost:
+		if uploadID := r.URL.Query().Get("upload"); uploadID != "" {
+			uploadGameFromUpload(w, r, deps, systemName, gameName, uploadID)
 			return
 		}
-		if strings.TrimSpace(gameName) == "" || gameName == "." || gameName == ".." {
-			writeAPIError(w, http.StatusBadRequest, "invalid_game", "invalid game")
+		if err := requireContentLength(r); err != nil {
+			writeAPIError(w, http.StatusLengthRequired, "length_required", err.Error())
 			return
 		}
-
-		if err := deps.Mounter.EnsureMounted(r.Context()); err != nil {
-			writeAPIError(w, http.StatusInternalServerError, "mount_failed", err.Error())
-			return
+		entry := gameEntry(deps, history.KindUpload, systemName, gameName)
+		err := deps.RetroPie.UploadGame(r.Context(), systemName, gameName, r.Body, r.ContentLength)
+		if err == nil {
+			entry.BytesRead, entry.BytesWritten = r.ContentLength, r.ContentLength
 		}
-
-		switch r.Method {
-		case http.MethodGet:
-			if err := deps.RetroPie.DownloadGame(r.Context(), w, r, systemName, gameName); err != nil {
-				if errorsIsNotExist(err) {
-					writeAPIError(w, http.StatusNotFound, "game_not_found", "game not found")
-					return
-				}
-				writeAPIError(w, http.StatusInternalServerError, "download_failed", err.Error())
+		recordHistory(deps, entry.Finish(err))
+		if err != nil {
+			if writeGamePathError(w, err) {
 				return
 			}
-			return
-		case http.MethodPost:
-			if err := requireContentLength(r); err != nil {
-				writeAPIError(w, http.StatusLengthRequired, "length_required", err.Error())
+			if errorsIsNotExist(err) {
+				writeAPIError(w, http.StatusNotFound, "system_not_found", "system not found")
 				return
 			}
-			if err := deps.RetroPie.UploadGame(r.Context(), systemName, gameName, r.Body, r.ContentLength); err != nil {
-				if errorsIsNotExist(err) {
-					writeAPIError(w, http.StatusNotFound, "system_not_found", "system not found")
-					return
-				}
-				writeAPIError(w, http.StatusInternalServerError, "upload_failed", err.Error())
+			writeAPIError(w, http.StatusInternalServerError, "upload_failed", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, okResponse{OK: true})
+		return
+	case http.MethodPatch:
+		handleGameUpdate(w, r, deps, systemName, gameName)
+		return
+	case http.MethodDelete:
+		entry := gameEntry(deps, history.KindDelete, systemName, gameName)
+		err := deps.RetroPie.DeleteGame(r.Context(), systemName, gameName)
+		recordHistory(deps, entry.Finish(err))
+		if err != nil {
+			if writeGamePathError(w, err) {
 				return
 			}
-			writeJSON(w, http.StatusOK, okResponse{OK: true})
-			return
-		case http.MethodDelete:
-			if err := deps.RetroPie.DeleteGame(r.Context(), systemName, gameName); err != nil {
-				if errorsIsNotExist(err) {
-					writeAPIError(w, http.StatusNotFound, "game_not_found", "game not found")
-					return
-				}
-				writeAPIError(w, http.StatusInternalServerError, "delete_failed", err.Error())
+			if errorsIsNotExist(err) {
+				writeAPIError(w, http.StatusNotFound, "game_not_found", "game not found")
 				return
 			}
-			writeJSON(w, http.StatusOK, okResponse{OK: true})
-			return
-		default:
-			writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+			writeAPIError(w, http.StatusInternalServerError, "delete_failed", err.Error())
 			return
 		}
+		writeJSON(w, http.StatusOK, okResponse{OK: true})
+		return
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
 	}
-
-	// Reserved for later steps.
-	writeAPIError(w, http.StatusNotFound, "not_found", "not found")
 }
 
-func listGamesForSystem(romsRoot, systemName string) ([]string, error) {
-	romDir := filepath.Join(romsRoot, systemName)
-	entries, err := os.ReadDir(romDir)
+func downloadGame(romsRoot string, w http.ResponseWriter, r *http.Request, systemName, gameName string) error {
+	gamePath, err := resolveGamePath(romsRoot, systemName, gameName)
 	if err != nil {
-		return nil, err
-	}
-	games := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		name := strings.TrimSpace(entry.Name())
-		if name == "" {
-			continue
-		}
-		if strings.HasPrefix(name, ".") {
-			continue
-		}
-		games = append(games, name)
+		return err
 	}
-	sort.Strings(games)
-	return games, nil
-}
-
-func downloadGame(romsRoot string, w http.ResponseWriter, r *http.Request, systemName, gameName string) error {
-	gamePath := filepath.Join(romsRoot, systemName, gameName)
 	info, err := os.Stat(gamePath)
 	if err != nil {
 		return err
 	}
 
+	fileName := filepath.Base(gamePath)
 	if info.IsDir() {
-		downloadName := gameName
+		downloadName := fileName
 		if !strings.HasSuffix(strings.ToLower(downloadName), ".zip") {
 			downloadName += ".zip"
 		}
@@ -300,8 +378,8 @@ func downloadGame(romsRoot string, w http.ResponseWriter, r *http.Request, syste
 	}
 	defer func() { _ = f.Close() }()
 
-	setDownloadHeaders(w, gameName, "application/octet-stream")
-	http.ServeContent(w, r, gameName, info.ModTime(), f)
+	setDownloadHeaders(w, fileName, "application/octet-stream")
+	http.ServeContent(w, r, fileName, info.ModTime(), f)
 	return nil
 }
 
@@ -380,17 +458,24 @@ type apiSimpleError struct{ Message string }
 
 func (e *apiSimpleError) Error() string { return e.Message }
 
-func uploadGame(romsRoot, systemName, gameName string, body io.Reader, contentLength int64) error {
+// uploadGame stores a game and returns its name in the system directory,
+// which is the folder for an unpacked zip.
+func uploadGame(romsRoot, systemName, gameName string, body io.Reader, contentLength int64) (string, error) {
 	romSystemDir := filepath.Join(romsRoot, systemName)
 	if _, err := os.Stat(romSystemDir); err != nil {
-		return err
+		return "", err
 	}
 
-	isZip := strings.HasSuffix(strings.ToLower(gameName), ".zip")
+	// Only a game uploaded at the top of the system directory is unpacked;
+	// files deeper down are stored as they are.
+	isZip := strings.HasSuffix(strings.ToLower(gameName), ".zip") && !strings.Contains(gameName, "/")
 	if !isZip {
-		targetPath := filepath.Join(romSystemDir, gameName)
+		targetPath, err := resolveGamePath(romsRoot, systemName, gameName)
+		if err != nil {
+			return "", err
+		}
 		_ = os.RemoveAll(targetPath)
-		return writeStreamToFile(targetPath, body, contentLength)
+		return gameName, writeStreamToFile(targetPath, body, contentLength)
 	}
 
 	baseName := gameName[:len(gameName)-4]
@@ -398,26 +483,30 @@ func uploadGame(romsRoot, systemName, gameName string, body io.Reader, contentLe
 	if baseName == "" {
 		baseName = "game"
 	}
+	// "..zip" and "...zip" would unpack over the system or roms directory.
+	destDir, err := resolveGamePath(romsRoot, systemName, baseName)
+	if err != nil {
+		return "", err
+	}
 
 	// Store the uploaded zip temporarily on the cartridge (not in RAM).
 	tmpName := ".upload-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + sanitizeFilename(gameName)
 	tmpZipPath := filepath.Join(romSystemDir, tmpName)
 	if err := writeStreamToFile(tmpZipPath, body, contentLength); err != nil {
 		_ = os.Remove(tmpZipPath)
-		return err
+		return "", err
 	}
 	defer func() { _ = os.Remove(tmpZipPath) }()
 
-	destDir := filepath.Join(romSystemDir, baseName)
 	_ = os.RemoveAll(destDir)
 	if err := os.MkdirAll(destDir, 0o755); err != nil {
-		return err
+		return "", err
 	}
 
 	if err := unzipToDir(tmpZipPath, destDir); err != nil {
-		return err
+		return "", err
 	}
-	return flattenSingleTopLevelDir(destDir)
+	return baseName, flattenSingleTopLevelDir(destDir)
 }
 
 func writeStreamToFile(targetPath string, src io.Reader, expectedBytes int64) error {
@@ -564,7 +653,10 @@ func sanitizeFilename(name string) string {
 }
 
 func deleteGame(romsRoot, systemName, gameName string) error {
-	gamePath := filepath.Join(romsRoot, systemName, gameName)
+	gamePath, err := resolveGamePath(romsRoot, systemName, gameName)
+	if err != nil {
+		return err
+	}
 	info, err := os.Stat(gamePath)
 	if err != nil {
 		return err
@@ -620,6 +712,18 @@ func handleCartridgeInfo(w http.ResponseWriter, r *http.Request, deps APIV1Deps)
 		Systems:      snap.Systems,
 		EmptySystems: snap.EmptySystems,
 		Busy:         snap.Busy,
+
+		IncompleteImage: snap.IncompleteImage,
+		Capacity:        snap.Capacity,
+	}
+	if identity := snap.Identity; identity.CID != "" {
+		resp.Identity = &cartridgeIdentityResponse{
+			CID:            identity.CID,
+			Serial:         identity.Serial,
+			Name:           identity.Name,
+			ManufacturerID: identity.ManufacturerID,
+			Date:           identity.Date,
+		}
 	}
 	writeJSON(w, http.StatusOK, resp)
 }
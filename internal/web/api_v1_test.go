@@ -0,0 +1,66 @@
+package web
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testZip(t *testing.T) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	file, err := archive.Create("game.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("rom")); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestUploadGameZipStaysInSystem(t *testing.T) {
+	for _, name := range []string{"..zip", "...zip", ". .zip"} {
+		t.Run(name, func(t *testing.T) {
+			romsRoot := t.TempDir()
+			kept := []string{filepath.Join(romsRoot, "nes", "mario.nes"), filepath.Join(romsRoot, "snes", "zelda.sfc")}
+			for _, file := range kept {
+				if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(file, []byte("rom"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data := testZip(t)
+			if _, err := uploadGame(romsRoot, "nes", name, bytes.NewReader(data), int64(len(data))); !errors.Is(err, errGamePathEscapes) {
+				t.Errorf("uploadGame: %v, want errGamePathEscapes", err)
+			}
+			for _, file := range kept {
+				if _, err := os.Stat(file); err != nil {
+					t.Errorf("%s is gone: %v", file, err)
+				}
+			}
+		})
+	}
+
+	romsRoot := t.TempDir()
+	if err := os.Mkdir(filepath.Join(romsRoot, "nes"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	data := testZip(t)
+	got, err := uploadGame(romsRoot, "nes", "mario.zip", bytes.NewReader(data), int64(len(data)))
+	if err != nil || got != "mario" {
+		t.Fatalf("uploadGame(mario.zip) = %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(romsRoot, "nes", "mario", "game.bin")); err != nil {
+		t.Errorf("unpacked game: %v", err)
+	}
+}
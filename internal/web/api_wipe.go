@@ -0,0 +1,85 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/wipe"
+)
+
+// handleWipe blanks the cartridge for reuse. Progress is reported by
+// GET /flash and the returned job, like a flash.
+//
+// POST /wipe {"mode":"discard|zero","table":"mbr|gpt","filesystem":"fat32|exfat|ext4","label":""} -> 202 {ok, jobId}
+func handleWipe(w http.ResponseWriter, r *http.Request, deps APIV1Deps, handlers APIV1Handlers) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	wipeFunc := handlers.WipeFunc
+	if wipeFunc == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "wipe not configured")
+		return
+	}
+
+	var opts wipe.Options
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&opts); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "invalid json")
+		return
+	}
+	if err := opts.Validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_wipe", err.Error())
+		return
+	}
+
+	snap := deps.Cartridge.Snapshot()
+	if snap.Busy {
+		writeAPIError(w, http.StatusConflict, "cartridge_busy", "cartridge is busy")
+		return
+	}
+	if !snap.Present {
+		writeAPIError(w, http.StatusConflict, "no_cartridge", "no cartridge present")
+		return
+	}
+
+	started := time.Now()
+	cartridge := history.CartridgeOf(snap)
+	statusFunc := handlers.FlashStatusFunc
+	job := deps.Jobs.Start("wipe", statusFunc, func(ctx context.Context) error {
+		err := wipeFunc(ctx, opts)
+		var info state.FlashInfo
+		if statusFunc != nil {
+			info = statusFunc()
+		}
+		entry := history.Entry{
+			Time:         started,
+			Kind:         history.KindWipe,
+			Target:       history.TargetCartridge,
+			Name:         wipeName(opts),
+			Cartridge:    cartridge,
+			BytesRead:    info.BytesRead,
+			BytesWritten: info.BytesWritten,
+		}
+		recordHistory(deps, entry.Finish(err))
+		return err
+	})
+	writeJSON(w, http.StatusAccepted, jobStartedResponse{OK: true, JobID: job.ID()})
+}
+
+// wipeName describes a wipe in the history, e.g. "zero, mbr fat32".
+func wipeName(opts wipe.Options) string {
+	name := string(opts.Mode)
+	if opts.Table != "" {
+		filesystem := opts.Filesystem
+		if filesystem == "" {
+			filesystem = wipe.DefaultFilesystem
+		}
+		name += ", " + opts.Table + " " + filesystem
+	}
+	return name
+}
@@ -15,9 +15,9 @@ func WithDevCORS(next http.Handler) http.Handler {
 		if origin != "" {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 			w.Header().Add("Vary", "Origin")
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,Range")
-			w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition,Content-Length,Accept-Ranges")
+			w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,Range,X-Upload-SHA256,X-Image-SHA256,X-Image-Size,X-WiFi-PSK,X-SSH-Key,Upload-Length,Upload-Offset,Upload-Metadata,Tus-Resumable")
+			w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition,Content-Length,Accept-Ranges,X-Image-Size,X-Image-Manifest,Location,Upload-Offset,Upload-Length,Upload-Expires,Tus-Resumable,Tus-Version,Tus-Extension")
 		}
 
 		if r.Method == http.MethodOptions {
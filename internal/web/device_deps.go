@@ -1,16 +1,26 @@
 package web
 
 import (
+	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/rook-computer/keymaker/internal/bios"
+	"github.com/rook-computer/keymaker/internal/gamelist"
 	"github.com/rook-computer/keymaker/internal/state"
 	"github.com/rook-computer/keymaker/internal/system"
 )
 
-const deviceRetroPieRomsRoot = "/cartridge/home/pi/RetroPie/roms"
+const (
+	deviceCartridgeRoot    = "/cartridge"
+	deviceRetroPieHome     = deviceCartridgeRoot + "/home/pi"
+	deviceRetroPieRomsRoot = deviceRetroPieHome + "/RetroPie/roms"
+	deviceRetroPieBIOSDir  = deviceRetroPieHome + "/RetroPie/BIOS"
+)
 
 // NewDeviceAPIV1Deps wires the API to the real device behaviors.
 //
@@ -23,7 +33,12 @@ func NewDeviceAPIV1Deps(logger sysLogger) APIV1Deps {
 	return APIV1Deps{
 		Cartridge: cartridge,
 		Mounter:   DeviceCartridgeMounter{Cartridge: cartridge, Logger: logger},
-		RetroPie:  FileSystemRetroPieStorage{RomsRoot: deviceRetroPieRomsRoot},
+		RetroPie: FileSystemRetroPieStorage{
+			RomsRoot:  deviceRetroPieRomsRoot,
+			BIOSDir:   deviceRetroPieBIOSDir,
+			Hashes:    &GameHashCache{},
+			Gamelists: &gamelist.Store{Root: deviceCartridgeRoot, RomsRoot: deviceRetroPieRomsRoot, Home: deviceRetroPieHome},
+		},
 	}
 }
 
@@ -65,11 +80,18 @@ func (m DeviceCartridgeMounter) EnsureMounted(ctx context.Context) error {
 
 type FileSystemRetroPieStorage struct {
 	RomsRoot string
+	// BIOSDir holds the BIOS files; empty disables the BIOS manager.
+	BIOSDir string
+	// Hashes caches the digests of listed games; nil computes them on every
+	// listing that asks for them.
+	Hashes *GameHashCache
+	// Gamelists keeps EmulationStation's gamelist.xml in sync with uploads,
+	// renames and deletes; nil leaves it alone and disables game metadata.
+	Gamelists *gamelist.Store
 }
 
-func (s FileSystemRetroPieStorage) ListGames(ctx context.Context, systemName string) ([]string, error) {
-	_ = ctx
-	return listGamesForSystem(s.RomsRoot, systemName)
+func (s FileSystemRetroPieStorage) ListGames(ctx context.Context, systemName string, opts GameListOptions) (GameList, error) {
+	return listGamesForSystem(ctx, s.RomsRoot, systemName, opts, s.Hashes)
 }
 
 func (s FileSystemRetroPieStorage) DownloadGame(ctx context.Context, w http.ResponseWriter, r *http.Request, systemName, gameName string) error {
@@ -77,12 +99,138 @@ func (s FileSystemRetroPieStorage) DownloadGame(ctx context.Context, w http.Resp
 	return downloadGame(s.RomsRoot, w, r, systemName, gameName)
 }
 
+// UploadGame stores a game; one uploaded at the top of the system directory
+// is added to the existing gamelists.
 func (s FileSystemRetroPieStorage) UploadGame(ctx context.Context, systemName, gameName string, body io.Reader, contentLength int64) error {
 	_ = ctx
-	return uploadGame(s.RomsRoot, systemName, gameName, body, contentLength)
+	stored, err := uploadGame(s.RomsRoot, systemName, gameName, body, contentLength)
+	if err != nil || s.Gamelists == nil || strings.Contains(gameName, "/") {
+		return err
+	}
+	// The gamelist is best effort: the game is stored either way. A zip
+	// was unpacked into a folder of another name.
+	_ = s.Gamelists.Add(systemName, stored, stored != gameName)
+	return nil
 }
 
 func (s FileSystemRetroPieStorage) DeleteGame(ctx context.Context, systemName, gameName string) error {
 	_ = ctx
-	return deleteGame(s.RomsRoot, systemName, gameName)
+	if err := deleteGame(s.RomsRoot, systemName, gameName); err != nil {
+		return err
+	}
+	if s.Gamelists != nil {
+		_ = s.Gamelists.Remove(systemName, gameName)
+	}
+	return nil
+}
+
+func (s FileSystemRetroPieStorage) RenameGame(ctx context.Context, systemName, gameName, newName string) error {
+	_ = ctx
+	if err := renameGame(s.RomsRoot, systemName, gameName, newName); err != nil {
+		return err
+	}
+	if s.Gamelists != nil {
+		_ = s.Gamelists.Rename(systemName, gameName, newName)
+	}
+	return nil
+}
+
+func (s FileSystemRetroPieStorage) GameMetadata(ctx context.Context, systemName, gameName string) (gamelist.Metadata, error) {
+	_ = ctx
+	if s.Gamelists == nil {
+		return gamelist.Metadata{}, errGamelistsNotConfigured
+	}
+	if _, err := gameFileInfo(s.RomsRoot, systemName, gameName); err != nil {
+		return gamelist.Metadata{}, err
+	}
+	return s.Gamelists.Metadata(systemName, gameName)
+}
+
+func (s FileSystemRetroPieStorage) SetGameMetadata(ctx context.Context, systemName, gameName string, patch gamelist.Patch) (gamelist.Metadata, error) {
+	_ = ctx
+	if s.Gamelists == nil {
+		return gamelist.Metadata{}, errGamelistsNotConfigured
+	}
+	info, err := gameFileInfo(s.RomsRoot, systemName, gameName)
+	if err != nil {
+		return gamelist.Metadata{}, err
+	}
+	return s.Gamelists.SetMetadata(systemName, gameName, info.IsDir(), patch)
+}
+
+func (s FileSystemRetroPieStorage) DownloadGameMedia(ctx context.Context, w http.ResponseWriter, r *http.Request, systemName, gameName string, kind gamelist.MediaKind, size int) error {
+	_ = ctx
+	if s.Gamelists == nil {
+		return errGamelistsNotConfigured
+	}
+	if _, err := gameFileInfo(s.RomsRoot, systemName, gameName); err != nil {
+		return err
+	}
+	file, err := s.Gamelists.MediaPath(systemName, gameName, kind)
+	if err != nil {
+		return err
+	}
+	return serveGameMedia(w, r, file, kind, size)
+}
+
+func (s FileSystemRetroPieStorage) SetGameMedia(ctx context.Context, systemName, gameName string, kind gamelist.MediaKind, body io.Reader, contentLength int64) (gamelist.Metadata, error) {
+	_ = ctx
+	if s.Gamelists == nil {
+		return gamelist.Metadata{}, errGamelistsNotConfigured
+	}
+	info, err := gameFileInfo(s.RomsRoot, systemName, gameName)
+	if err != nil {
+		return gamelist.Metadata{}, err
+	}
+	if limit := maxMediaUpload(kind); contentLength > limit {
+		return gamelist.Metadata{}, fmt.Errorf("%w: a %s may be at most %d bytes", errMediaTooLarge, kind, limit)
+	}
+	reader := bufio.NewReaderSize(io.LimitReader(body, contentLength), 512)
+	ext, err := mediaExtension(reader, kind)
+	if err != nil {
+		return gamelist.Metadata{}, err
+	}
+	return s.Gamelists.SetMedia(systemName, gameName, info.IsDir(), kind, ext, reader)
+}
+
+func (s FileSystemRetroPieStorage) DeleteGameMedia(ctx context.Context, systemName, gameName string, kind gamelist.MediaKind) error {
+	_ = ctx
+	if s.Gamelists == nil {
+		return errGamelistsNotConfigured
+	}
+	if _, err := gameFileInfo(s.RomsRoot, systemName, gameName); err != nil {
+		return err
+	}
+	return s.Gamelists.DeleteMedia(systemName, gameName, kind)
+}
+
+func (s FileSystemRetroPieStorage) ListBIOS(ctx context.Context) ([]bios.File, error) {
+	if s.BIOSDir == "" {
+		return nil, errBIOSNotConfigured
+	}
+	return listBIOS(ctx, s.BIOSDir)
+}
+
+func (s FileSystemRetroPieStorage) DownloadBIOS(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) error {
+	_ = ctx
+	if s.BIOSDir == "" {
+		return errBIOSNotConfigured
+	}
+	return downloadGame(s.BIOSDir, w, r, "", name)
+}
+
+func (s FileSystemRetroPieStorage) UploadBIOS(ctx context.Context, name string, body io.Reader, contentLength int64) (bios.File, error) {
+	_ = ctx
+	if s.BIOSDir == "" {
+		return bios.File{}, errBIOSNotConfigured
+	}
+	return uploadBIOS(s.BIOSDir, name, body, contentLength)
+}
+
+func (s FileSystemRetroPieStorage) DeleteBIOS(ctx context.Context, name string) error {
+	_ = ctx
+	if s.BIOSDir == "" {
+		return errBIOSNotConfigured
+	}
+	return deleteGame(s.BIOSDir, "", name)
 }
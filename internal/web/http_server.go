@@ -13,6 +13,8 @@ import (
 	"time"
 
 	"github.com/rook-computer/keymaker/internal/assets"
+	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/wipe"
 )
 
 type HTTPServer struct {
@@ -34,8 +36,34 @@ type HTTPServer struct {
 	EjectFunc func(ctx context.Context) error
 
 	// FlashFunc is called by the API when POST /api/v1/flash is invoked.
-	// The body is expected to be a gzipped disk image and must be streamed.
-	FlashFunc func(ctx context.Context, reader io.Reader) error
+	// The body is a (possibly compressed) disk image and must be streamed.
+	FlashFunc func(ctx context.Context, reader io.Reader, req FlashRequest) error
+
+	// FlashStatusFunc is called by the API when GET /api/v1/flash is invoked.
+	FlashStatusFunc func() state.FlashInfo
+
+	// CancelFlashFunc is called by the API when DELETE /api/v1/flash is invoked.
+	CancelFlashFunc func(ctx context.Context) error
+
+	// CheckFlashFunc is called by the API before a flash starts to reject
+	// options the flasher (or the flash target) cannot honour.
+	CheckFlashFunc func(req FlashRequest) error
+
+	// DumpFunc is called by the API when GET /api/v1/image is invoked.
+	DumpFunc func(ctx context.Context) (io.ReadCloser, int64, error)
+
+	// HeaderFunc is called by the API when GET /api/v1/image/manifest is
+	// invoked.
+	HeaderFunc func(ctx context.Context) (io.ReadCloser, int64, error)
+
+	// WipeFunc is called by the API when POST /api/v1/wipe is invoked.
+	WipeFunc func(ctx context.Context, opts wipe.Options) error
+
+	// StartDuplicationFunc, StopDuplicationFunc and DuplicationFunc are called
+	// by the API for POST, DELETE and GET /api/v1/duplication.
+	StartDuplicationFunc func(ctx context.Context, imageID string) error
+	StopDuplicationFunc  func(ctx context.Context) error
+	DuplicationFunc      func() state.DuplicationSnapshot
 
 	mu     sync.Mutex
 	srv    *http.Server
@@ -65,7 +93,7 @@ func (s *HTTPServer) Start(ctx context.Context) error {
 
 	handler := s.Handler
 	if handler == nil {
-		handler = NewDefaultMux(s.StaticDir, APIV1Config{Handlers: APIV1Handlers{EjectFunc: s.EjectFunc, FlashFunc: s.FlashFunc}, Deps: NewDeviceAPIV1Deps(nil)})
+		handler = NewDefaultMux(s.StaticDir, APIV1Config{Handlers: APIV1Handlers{EjectFunc: s.EjectFunc, FlashFunc: s.FlashFunc, FlashStatusFunc: s.FlashStatusFunc, CancelFlashFunc: s.CancelFlashFunc, CheckFlashFunc: s.CheckFlashFunc, DumpFunc: s.DumpFunc, HeaderFunc: s.HeaderFunc, WipeFunc: s.WipeFunc, StartDuplicationFunc: s.StartDuplicationFunc, StopDuplicationFunc: s.StopDuplicationFunc, DuplicationFunc: s.DuplicationFunc}, Deps: NewDeviceAPIV1Deps(nil)})
 	}
 	if s.DevMode {
 		handler = WithDevCORS(handler)
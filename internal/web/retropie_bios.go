@@ -0,0 +1,213 @@
+package web
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rook-computer/keymaker/internal/bios"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/ownership"
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// biosPathSegment is the part of /retropie/bios that takes the place of a
+// system name.
+const biosPathSegment = "bios"
+
+var errBIOSNotConfigured = errors.New("bios directory not configured")
+
+// biosListResponse is the body of GET /retropie/bios.
+type biosListResponse struct {
+	Files []bios.File `json:"files"`
+	// Systems checks the systems of the cartridge that need a BIOS.
+	Systems []bios.SystemStatus `json:"systems"`
+}
+
+// handleBIOS answers the requests below /retropie/bios:
+//
+//	GET    /retropie/bios        -> files with their status and missing BIOS per system
+//	GET    /retropie/bios/{name} -> download a file
+//	POST   /retropie/bios/{name} -> upload a file and report its status
+//	DELETE /retropie/bios/{name} -> delete a file
+func handleBIOS(w http.ResponseWriter, r *http.Request, deps APIV1Deps, snap state.CartridgeInfoSnapshot, name string) {
+	if name != "" && !validGamePath(name) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_bios", "invalid bios file name")
+		return
+	}
+	if name == "" && r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if err := deps.Mounter.EnsureMounted(r.Context()); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "mount_failed", err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if name == "" {
+			files, err := deps.RetroPie.ListBIOS(r.Context())
+			if err != nil {
+				writeBIOSError(w, err, "list_failed")
+				return
+			}
+			writeJSON(w, http.StatusOK, biosListResponse{
+				Files:   files,
+				Systems: bios.Check(files, cartridgeSystemNames(snap)),
+			})
+			return
+		}
+		if err := deps.RetroPie.DownloadBIOS(r.Context(), w, r, name); err != nil {
+			writeBIOSError(w, err, "download_failed")
+		}
+	case http.MethodPost:
+		if err := requireContentLength(r); err != nil {
+			writeAPIError(w, http.StatusLengthRequired, "length_required", err.Error())
+			return
+		}
+		entry := biosEntry(deps, history.KindUpload, name)
+		file, err := deps.RetroPie.UploadBIOS(r.Context(), name, r.Body, r.ContentLength)
+		if err == nil {
+			entry.BytesRead, entry.BytesWritten = r.ContentLength, r.ContentLength
+		}
+		recordHistory(deps, entry.Finish(err))
+		if err != nil {
+			writeBIOSError(w, err, "upload_failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, file)
+	case http.MethodDelete:
+		entry := biosEntry(deps, history.KindDelete, name)
+		err := deps.RetroPie.DeleteBIOS(r.Context(), name)
+		recordHistory(deps, entry.Finish(err))
+		if err != nil {
+			writeBIOSError(w, err, "delete_failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, okResponse{OK: true})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+func writeBIOSError(w http.ResponseWriter, err error, code string) {
+	switch {
+	case errors.Is(err, errGamePathEscapes):
+		writeAPIError(w, http.StatusBadRequest, "invalid_bios", "path escapes the bios directory")
+	case errorsIsNotExist(err):
+		writeAPIError(w, http.StatusNotFound, "bios_not_found", "bios file not found")
+	case errors.Is(err, errBIOSNotConfigured):
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, code, err.Error())
+	}
+}
+
+// listBIOS describes the files below dir, sorted by name. Hidden files and
+// links leaving dir are skipped; a missing dir holds no files.
+func listBIOS(ctx context.Context, dir string) ([]bios.File, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []bios.File{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := []bios.File{}
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil || !pathWithin(root, resolved) {
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		file, err := describeBIOS(path, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		if file.Name != "" {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// uploadBIOS stores a BIOS file, creating dir and missing directories of
+// name, and describes it. Like the rest of the install they belong to its
+// user rather than to root: new directories get the owner of their closest
+// existing parent and the file that of its directory.
+func uploadBIOS(dir, name string, body io.Reader, contentLength int64) (bios.File, error) {
+	if err := ownership.MkdirAll(dir); err != nil {
+		return bios.File{}, err
+	}
+	target, err := resolveGamePath(dir, "", name)
+	if err != nil {
+		return bios.File{}, err
+	}
+	if err := ownership.MkdirAll(filepath.Dir(target)); err != nil {
+		return bios.File{}, err
+	}
+	if err := writeStreamToFile(target, body, contentLength); err != nil {
+		return bios.File{}, err
+	}
+	ownership.ChownLike(target, filepath.Dir(target))
+	return describeBIOS(target, name)
+}
+
+// describeBIOS digests the file at path and identifies it as name. A path
+// that is not a regular file gets an empty description.
+func describeBIOS(path, name string) (bios.File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return bios.File{}, err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return bios.File{}, err
+	}
+	digest := md5.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return bios.File{}, err
+	}
+	file := bios.File{Name: name, Size: info.Size(), ModTime: info.ModTime(), MD5: hex.EncodeToString(digest.Sum(nil))}
+	file.Identify()
+	return file, nil
+}
@@ -0,0 +1,383 @@
+package web
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GameInfo describes one entry of a system's roms directory.
+type GameInfo struct {
+	Name        string `json:"name"`
+	IsDirectory bool   `json:"isDirectory"`
+	// Size is the size of the file or, for a directory, of all files below it.
+	Size int64 `json:"size"`
+	// ModTime is the modification time of the file or, for a directory, of
+	// the most recently modified entry below it.
+	ModTime time.Time `json:"modTime"`
+	// SHA256 is the digest of a file, when it has been computed (see
+	// GameListOptions.Hash). Directories have none.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Sort orders accepted by GameListOptions.Sort.
+const (
+	GameSortName  = "name"
+	GameSortSize  = "size"
+	GameSortMTime = "mtime"
+)
+
+// GameListOptions selects and orders the games returned by ListGames.
+type GameListOptions struct {
+	// Path lists a directory below the system directory instead of the
+	// system directory itself.
+	Path string
+	// Sort is GameSortName (the default), GameSortSize or GameSortMTime.
+	Sort string
+	// Descending reverses the order.
+	Descending bool
+	// Name keeps the games whose name contains it, ignoring case.
+	Name string
+	// Offset and Limit select a page of the sorted games; Limit 0 returns
+	// all of them.
+	Offset int
+	Limit  int
+	// Hash computes the digests of files that are not cached yet. Without it
+	// only cached digests are reported.
+	Hash bool
+	// Details asks for the Size and ModTime of directories, which means
+	// walking them. Without it, and sorted by name, a directory reports its
+	// own.
+	Details bool
+}
+
+// GameList is a page of games.
+type GameList struct {
+	// Total is the number of games matching the filter.
+	Total int
+	Games []GameInfo
+}
+
+// GameHashCache remembers file digests by path, size and modification time so
+// listings do not read the roms again. It holds up to maxGameHashes digests;
+// when full, those of deleted files and then the least recently used ones
+// are dropped. The zero value is ready to use.
+type GameHashCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedGameHash
+}
+
+// maxGameHashes bounds GameHashCache, well above the roms of a full
+// cartridge.
+const maxGameHashes = 20000
+
+type cachedGameHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+	used    time.Time
+}
+
+func (cache *GameHashCache) get(path string, size int64, modTime time.Time) string {
+	if cache == nil {
+		return ""
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[path]
+	if !ok || entry.size != size || !entry.modTime.Equal(modTime) {
+		return ""
+	}
+	entry.used = time.Now()
+	cache.entries[path] = entry
+	return entry.sum
+}
+
+func (cache *GameHashCache) put(path string, size int64, modTime time.Time, sum string) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.entries == nil {
+		cache.entries = make(map[string]cachedGameHash)
+	}
+	if _, ok := cache.entries[path]; !ok && len(cache.entries) >= maxGameHashes {
+		cache.evict()
+	}
+	cache.entries[path] = cachedGameHash{size: size, modTime: modTime, sum: sum, used: time.Now()}
+}
+
+// evict drops the digests of files that are gone and, if that does not free
+// a quarter of the cache, the least recently used ones, so a full cache is
+// not swept on every put. The caller holds mu.
+func (cache *GameHashCache) evict() {
+	for path := range cache.entries {
+		if _, err := os.Lstat(path); errors.Is(err, fs.ErrNotExist) {
+			delete(cache.entries, path)
+		}
+	}
+	keep := maxGameHashes * 3 / 4
+	if len(cache.entries) <= keep {
+		return
+	}
+	paths := make([]string, 0, len(cache.entries))
+	for path := range cache.entries {
+		paths = append(paths, path)
+	}
+	slices.SortFunc(paths, func(a, b string) int {
+		return cache.entries[a].used.Compare(cache.entries[b].used)
+	})
+	for _, path := range paths[:len(paths)-keep] {
+		delete(cache.entries, path)
+	}
+}
+
+type gameListResponse struct {
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	Games  []GameInfo `json:"games"`
+}
+
+// listGameDirectory answers a listing of the system directory (dir "") or of
+// a directory below it.
+func listGameDirectory(w http.ResponseWriter, r *http.Request, deps APIV1Deps, systemName, dir string) {
+	details, opts, err := parseGameListQuery(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	opts.Path = dir
+
+	list, err := deps.RetroPie.ListGames(r.Context(), systemName, opts)
+	if err != nil {
+		if writeGamePathError(w, err) {
+			return
+		}
+		if errorsIsNotExist(err) && dir == "" {
+			writeAPIError(w, http.StatusNotFound, "system_not_found", "system not found")
+			return
+		}
+		if errorsIsNotExist(err) {
+			writeAPIError(w, http.StatusNotFound, "game_not_found", "game not found")
+			return
+		}
+		writeAPIError(w, http.StatusInternalServerError, "list_failed", err.Error())
+		return
+	}
+	if details {
+		writeJSON(w, http.StatusOK, gameListResponse{Total: list.Total, Offset: opts.Offset, Limit: opts.Limit, Games: list.Games})
+		return
+	}
+	games := make([]string, 0, len(list.Games))
+	for _, game := range list.Games {
+		games = append(games, game.Name)
+	}
+	writeJSON(w, http.StatusOK, games)
+}
+
+// parseGameListQuery reads the listing options of GET /retropie/{system}.
+// They apply to the plain name list as well; details selects the GameInfo
+// page.
+func parseGameListQuery(r *http.Request) (bool, GameListOptions, error) {
+	query := r.URL.Query()
+	details, err := parseBoolQuery(r, "details", false)
+	if err != nil {
+		return false, GameListOptions{}, err
+	}
+	opts := GameListOptions{Sort: query.Get("sort"), Name: query.Get("name")}
+	switch opts.Sort {
+	case "":
+		opts.Sort = GameSortName
+	case GameSortName, GameSortSize, GameSortMTime:
+	default:
+		return false, opts, fmt.Errorf("invalid sort parameter: %q (want name, size or mtime)", opts.Sort)
+	}
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return false, opts, fmt.Errorf("invalid order parameter: %q (want asc or desc)", order)
+	}
+	if opts.Offset, err = parseIntQuery(r, "offset", 0, 0, 0); err != nil {
+		return false, opts, err
+	}
+	if opts.Limit, err = parseIntQuery(r, "limit", 0, 1, 0); err != nil {
+		return false, opts, err
+	}
+	if opts.Hash, err = parseBoolQuery(r, "hash", false); err != nil {
+		return false, opts, err
+	}
+	opts.Details = details
+	return details, opts, nil
+}
+
+func listGamesForSystem(ctx context.Context, romsRoot, systemName string, opts GameListOptions, hashes *GameHashCache) (GameList, error) {
+	romDir := filepath.Join(romsRoot, systemName)
+	if opts.Path != "" {
+		dir, err := resolveGamePath(romsRoot, systemName, opts.Path)
+		if err != nil {
+			return GameList{}, err
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return GameList{}, err
+		}
+		if !info.IsDir() {
+			return GameList{}, errNotGameDirectory
+		}
+		romDir = dir
+	}
+	entries, err := os.ReadDir(romDir)
+	if err != nil {
+		return GameList{}, err
+	}
+	filter := strings.ToLower(opts.Name)
+	// A plain name list needs no directory totals.
+	walk := opts.Details || opts.Sort == GameSortSize || opts.Sort == GameSortMTime
+	games := make([]GameInfo, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSpace(entry.Name())
+		if name == "" {
+			continue
+		}
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if filter != "" && !strings.Contains(strings.ToLower(name), filter) {
+			continue
+		}
+		game, err := gameInfo(filepath.Join(romDir, entry.Name()), walk)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Deleted (or a dangling link) while listing.
+				continue
+			}
+			return GameList{}, err
+		}
+		games = append(games, game)
+	}
+	sortGames(games, opts.Sort, opts.Descending)
+
+	list := GameList{Total: len(games)}
+	start := min(opts.Offset, len(games))
+	end := len(games)
+	if opts.Limit > 0 {
+		end = min(start+opts.Limit, end)
+	}
+	list.Games = games[start:end]
+
+	// Only the returned page is hashed.
+	for i := range list.Games {
+		game := &list.Games[i]
+		if game.IsDirectory {
+			continue
+		}
+		path := filepath.Join(romDir, game.Name)
+		game.SHA256 = hashes.get(path, game.Size, game.ModTime)
+		if game.SHA256 != "" || !opts.Hash {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return GameList{}, err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return GameList{}, err
+		}
+		hashes.put(path, game.Size, game.ModTime, sum)
+		game.SHA256 = sum
+	}
+	return list, nil
+}
+
+// gameInfo describes the file or directory at path. With walk, a directory
+// is walked for its total size and latest modification; otherwise it reports
+// its own. A link to a game is followed; links inside a game directory are
+// not.
+func gameInfo(path string, walk bool) (GameInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return GameInfo{}, err
+	}
+	game := GameInfo{
+		Name:        filepath.Base(path),
+		IsDirectory: info.IsDir(),
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+	}
+	if !info.IsDir() || !walk {
+		return game, nil
+	}
+	game.Size = 0
+	root, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return GameInfo{}, err
+	}
+	err = filepath.WalkDir(root, func(entryPath string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if entryPath == root {
+			return nil
+		}
+		entryInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			game.Size += entryInfo.Size()
+		}
+		if entryInfo.ModTime().After(game.ModTime) {
+			game.ModTime = entryInfo.ModTime()
+		}
+		return nil
+	})
+	return game, err
+}
+
+func sortGames(games []GameInfo, order string, descending bool) {
+	slices.SortStableFunc(games, func(a, b GameInfo) int {
+		var result int
+		switch order {
+		case GameSortSize:
+			result = cmp.Compare(a.Size, b.Size)
+		case GameSortMTime:
+			result = a.ModTime.Compare(b.ModTime)
+		}
+		if result == 0 {
+			result = strings.Compare(a.Name, b.Name)
+		}
+		if descending {
+			return -result
+		}
+		return result
+	})
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
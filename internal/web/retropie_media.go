@@ -0,0 +1,312 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/rook-computer/keymaker/internal/gamelist"
+	"github.com/rook-computer/keymaker/internal/history"
+)
+
+const (
+	// minMediaSize and maxMediaSize bound the size query parameter.
+	minMediaSize = 16
+	maxMediaSize = 1024
+	// maxScaledPixels bounds the pictures decoded for scaling, so a huge
+	// image cannot exhaust the memory of the device.
+	maxScaledPixels = 4096 * 4096
+	// maxScaledCache bounds the bytes of scaled pictures kept for reuse.
+	maxScaledCache = 8 << 20
+	// maxPictureUpload and maxVideoUpload bound stored media; scraped box
+	// art is well below a MiB and preview videos a few MiB.
+	maxPictureUpload = 16 << 20
+	maxVideoUpload   = 256 << 20
+)
+
+// errMediaTooLarge is returned for media uploads above the limit of their
+// kind.
+var errMediaTooLarge = errors.New("media too large")
+
+// maxMediaUpload returns the largest media file of kind that is stored.
+func maxMediaUpload(kind gamelist.MediaKind) int64 {
+	if kind.IsVideo() {
+		return maxVideoUpload
+	}
+	return maxPictureUpload
+}
+
+// handleGameMedia answers the requests on /retropie/{system}/{game} with a
+// ?media={kind} parameter:
+//
+//	GET    -> the media file (?size=N scales a picture to fit in N x N)
+//	PUT    -> store the body as the game's media and link it from gamelist.xml
+//	DELETE -> unlink the media and delete the file we stored
+func handleGameMedia(w http.ResponseWriter, r *http.Request, deps APIV1Deps, systemName, gameName, kindName string) {
+	kind, err := gamelist.ParseMediaKind(kindName)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_media", err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		size, err := parseIntQuery(r, "size", 0, minMediaSize, maxMediaSize)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		if size > 0 && kind.IsVideo() {
+			writeAPIError(w, http.StatusBadRequest, "bad_request", "a video cannot be scaled")
+			return
+		}
+		if err := deps.RetroPie.DownloadGameMedia(r.Context(), w, r, systemName, gameName, kind, size); err != nil {
+			writeGameMediaError(w, err)
+		}
+	case http.MethodPut:
+		if err := requireContentLength(r); err != nil {
+			writeAPIError(w, http.StatusLengthRequired, "length_required", err.Error())
+			return
+		}
+		entry := gameEntry(deps, history.KindUpload, systemName, gameName)
+		entry.Name += " (" + string(kind) + ")"
+		meta, err := deps.RetroPie.SetGameMedia(r.Context(), systemName, gameName, kind, r.Body, r.ContentLength)
+		if err == nil {
+			entry.BytesRead, entry.BytesWritten = r.ContentLength, r.ContentLength
+		}
+		recordHistory(deps, entry.Finish(err))
+		if err != nil {
+			writeGameMediaError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, meta)
+	case http.MethodDelete:
+		entry := gameEntry(deps, history.KindDelete, systemName, gameName)
+		entry.Name += " (" + string(kind) + ")"
+		err := deps.RetroPie.DeleteGameMedia(r.Context(), systemName, gameName, kind)
+		recordHistory(deps, entry.Finish(err))
+		if err != nil {
+			writeGameMediaError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, okResponse{OK: true})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	}
+}
+
+func writeGameMediaError(w http.ResponseWriter, err error) {
+	switch {
+	case writeGamePathError(w, err):
+	case errors.Is(err, gamelist.ErrNoMedia):
+		writeAPIError(w, http.StatusNotFound, "media_not_found", "media not found")
+	case errorsIsNotExist(err):
+		writeAPIError(w, http.StatusNotFound, "game_not_found", "game not found")
+	case errors.Is(err, gamelist.ErrInvalidMedia):
+		writeAPIError(w, http.StatusUnsupportedMediaType, "unsupported_media", err.Error())
+	case errors.Is(err, errMediaTooLarge):
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "media_too_large", err.Error())
+	case errors.Is(err, errGamelistsNotConfigured):
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "media_failed", err.Error())
+	}
+}
+
+// mediaExtension sniffs the content type of an upload and returns the file
+// extension media of kind gets for it.
+func mediaExtension(reader *bufio.Reader, kind gamelist.MediaKind) (string, error) {
+	head, err := reader.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return kind.Extension(http.DetectContentType(head))
+}
+
+// serveGameMedia serves a media file as it is or, with a size above zero,
+// scaled down to fit in size x size pixels.
+func serveGameMedia(w http.ResponseWriter, r *http.Request, file string, kind gamelist.MediaKind, size int) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return gamelist.ErrNoMedia
+	}
+	if size <= 0 {
+		http.ServeContent(w, r, filepath.Base(file), info.ModTime(), f)
+		return nil
+	}
+
+	// Scaling is the expensive part, so a cached copy is confirmed first.
+	if notModifiedSince(r, info.ModTime()) {
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	scaled, name, err := scaledMedia.scale(file, info, f, size)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", gamelist.ErrInvalidMedia, kind, err)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(scaled))
+	return nil
+}
+
+// scaledMedia scales the pictures served with a size.
+var scaledMedia mediaScaler
+
+// mediaScaler scales pictures one at a time, so parallel requests of a
+// cover grid cannot decode many pictures at once, and keeps the results by
+// file, size and modification time until maxScaledCache is reached.
+type mediaScaler struct {
+	scaling sync.Mutex
+
+	mu      sync.Mutex
+	entries map[scaledKey]scaledPicture
+	bytes   int
+}
+
+type scaledKey struct {
+	file string
+	size int
+}
+
+type scaledPicture struct {
+	fileSize int64
+	modTime  time.Time
+	data     []byte
+	name     string
+	used     time.Time
+}
+
+func (scaler *mediaScaler) scale(file string, info os.FileInfo, reader io.ReadSeeker, size int) ([]byte, string, error) {
+	key := scaledKey{file: file, size: size}
+	if picture, ok := scaler.get(key, info); ok {
+		return picture.data, picture.name, nil
+	}
+	scaler.scaling.Lock()
+	defer scaler.scaling.Unlock()
+	// Another request may have scaled it while this one waited.
+	if picture, ok := scaler.get(key, info); ok {
+		return picture.data, picture.name, nil
+	}
+	data, name, err := scaleImage(reader, size)
+	if err != nil {
+		return nil, "", err
+	}
+	scaler.put(key, scaledPicture{fileSize: info.Size(), modTime: info.ModTime(), data: data, name: name})
+	return data, name, nil
+}
+
+func (scaler *mediaScaler) get(key scaledKey, info os.FileInfo) (scaledPicture, bool) {
+	scaler.mu.Lock()
+	defer scaler.mu.Unlock()
+	picture, ok := scaler.entries[key]
+	if !ok || picture.fileSize != info.Size() || !picture.modTime.Equal(info.ModTime()) {
+		return scaledPicture{}, false
+	}
+	picture.used = time.Now()
+	scaler.entries[key] = picture
+	return picture, true
+}
+
+func (scaler *mediaScaler) put(key scaledKey, picture scaledPicture) {
+	if len(picture.data) > maxScaledCache/4 {
+		return
+	}
+	scaler.mu.Lock()
+	defer scaler.mu.Unlock()
+	if scaler.entries == nil {
+		scaler.entries = make(map[scaledKey]scaledPicture)
+	}
+	if old, ok := scaler.entries[key]; ok {
+		scaler.bytes -= len(old.data)
+	}
+	picture.used = time.Now()
+	scaler.entries[key] = picture
+	scaler.bytes += len(picture.data)
+	for scaler.bytes > maxScaledCache {
+		// Drop the least recently used picture.
+		var oldest scaledKey
+		var oldestUsed time.Time
+		for key, entry := range scaler.entries {
+			if oldestUsed.IsZero() || entry.used.Before(oldestUsed) {
+				oldest, oldestUsed = key, entry.used
+			}
+		}
+		scaler.bytes -= len(scaler.entries[oldest].data)
+		delete(scaler.entries, oldest)
+	}
+}
+
+func notModifiedSince(r *http.Request, modTime time.Time) bool {
+	if r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modTime.Truncate(time.Second).After(since)
+}
+
+// scaleImage decodes a picture and scales it down to fit in size x size
+// pixels; smaller pictures keep their size. Opaque pictures are encoded as
+// JPEG, the others as PNG. name carries the matching extension.
+func scaleImage(reader io.ReadSeeker, size int) (data []byte, name string, err error) {
+	config, _, err := image.DecodeConfig(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	if config.Width*config.Height > maxScaledPixels {
+		return nil, "", fmt.Errorf("%dx%d is too large to scale", config.Width, config.Height)
+	}
+	if _, err := reader.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	src, _, err := image.Decode(reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, bounds, xdraw.Src, nil)
+
+	var buffer bytes.Buffer
+	name = "thumbnail.png"
+	if dst.Opaque() {
+		name = "thumbnail.jpg"
+		err = jpeg.Encode(&buffer, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buffer, dst)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buffer.Bytes(), name, nil
+}
@@ -0,0 +1,135 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/rook-computer/keymaker/internal/gamelist"
+	"github.com/rook-computer/keymaker/internal/history"
+)
+
+var (
+	errGamelistsNotConfigured = errors.New("gamelists not configured")
+	// errGameExists is returned when a game is renamed onto an existing one.
+	errGameExists = errors.New("a game with that name already exists")
+	// errRenameIntoItself is returned when a directory is moved below itself.
+	errRenameIntoItself = errors.New("cannot move a game into itself")
+)
+
+// gameUpdateRequest is the body of PATCH /retropie/{system}/{game}: an
+// optional new path and the metadata fields to change.
+type gameUpdateRequest struct {
+	Rename string `json:"rename"`
+	gamelist.Patch
+}
+
+// handleGameMetadata answers GET /retropie/{system}/{game}?metadata=true.
+func handleGameMetadata(w http.ResponseWriter, r *http.Request, deps APIV1Deps, systemName, gameName string) {
+	meta, err := deps.RetroPie.GameMetadata(r.Context(), systemName, gameName)
+	if err != nil {
+		writeGameMetadataError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, meta)
+}
+
+// handleGameUpdate answers PATCH /retropie/{system}/{game}: the game is
+// renamed first, then its gamelist entry is edited.
+func handleGameUpdate(w http.ResponseWriter, r *http.Request, deps APIV1Deps, systemName, gameName string) {
+	var req gameUpdateRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "bad_request", "invalid json")
+		return
+	}
+	if req.Rename != "" && !validGamePath(req.Rename) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_game", "invalid rename target")
+		return
+	}
+	if err := req.Patch.Validate(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+
+	if req.Rename != "" && req.Rename != gameName {
+		entry := gameEntry(deps, history.KindRename, systemName, gameName)
+		entry.Name += " -> " + req.Rename
+		err := deps.RetroPie.RenameGame(r.Context(), systemName, gameName, req.Rename)
+		recordHistory(deps, entry.Finish(err))
+		if err != nil {
+			writeGameMetadataError(w, err)
+			return
+		}
+		gameName = req.Rename
+	}
+
+	var meta gamelist.Metadata
+	var err error
+	if req.Patch.Empty() {
+		meta, err = deps.RetroPie.GameMetadata(r.Context(), systemName, gameName)
+	} else {
+		meta, err = deps.RetroPie.SetGameMetadata(r.Context(), systemName, gameName, req.Patch)
+	}
+	if err != nil {
+		writeGameMetadataError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, meta)
+}
+
+func writeGameMetadataError(w http.ResponseWriter, err error) {
+	switch {
+	case writeGamePathError(w, err):
+	case errorsIsNotExist(err):
+		writeAPIError(w, http.StatusNotFound, "game_not_found", "game not found")
+	case errors.Is(err, errRenameIntoItself):
+		writeAPIError(w, http.StatusBadRequest, "invalid_game", err.Error())
+	case errors.Is(err, errGameExists):
+		writeAPIError(w, http.StatusConflict, "game_exists", err.Error())
+	case errors.Is(err, gamelist.ErrInvalidMetadata):
+		writeAPIError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+	case errors.Is(err, errGamelistsNotConfigured):
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, "gamelist_failed", err.Error())
+	}
+}
+
+// gameFileInfo describes an existing game.
+func gameFileInfo(romsRoot, systemName, gameName string) (fs.FileInfo, error) {
+	gamePath, err := resolveGamePath(romsRoot, systemName, gameName)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(gamePath)
+}
+
+// renameGame moves a game within the system directory, creating missing
+// directories of the new path. An existing game is never replaced.
+func renameGame(romsRoot, systemName, gameName, newName string) error {
+	oldPath, err := resolveGamePath(romsRoot, systemName, gameName)
+	if err != nil {
+		return err
+	}
+	newPath, err := resolveGamePath(romsRoot, systemName, newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(oldPath); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(newPath); err == nil {
+		return errGameExists
+	}
+	if pathWithin(oldPath, newPath) {
+		return errRenameIntoItself
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
@@ -0,0 +1,84 @@
+package web
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// errGamePathEscapes is returned for a game path that leaves the roms
+	// root, directly or through a symbolic link.
+	errGamePathEscapes = errors.New("path escapes the roms directory")
+	// errNotGameDirectory is returned when a file is listed as a directory.
+	errNotGameDirectory = errors.New("not a directory")
+)
+
+// validGamePath reports whether rel is a slash-separated path of plain names
+// (no empty, "." or ".." segments).
+func validGamePath(rel string) bool {
+	if rel == "" {
+		return false
+	}
+	for _, segment := range strings.Split(rel, "/") {
+		if strings.TrimSpace(segment) == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveGamePath joins rel below the system directory and makes sure the
+// result stays inside romsRoot once symbolic links are followed. The path
+// does not need to exist; its deepest existing ancestor is checked instead.
+func resolveGamePath(romsRoot, systemName, rel string) (string, error) {
+	if !validGamePath(rel) {
+		return "", errGamePathEscapes
+	}
+	target := filepath.Join(romsRoot, systemName, filepath.FromSlash(rel))
+	root, err := filepath.EvalSymlinks(romsRoot)
+	if err != nil {
+		return "", err
+	}
+
+	existing, missing := target, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if !pathWithin(root, filepath.Join(resolved, missing)) {
+				return "", errGamePathEscapes
+			}
+			return target, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = parent
+	}
+}
+
+func pathWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// writeGamePathError answers the errors of an unusable game path and reports
+// whether it did.
+func writeGamePathError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errGamePathEscapes):
+		writeAPIError(w, http.StatusBadRequest, "invalid_game", err.Error())
+	case errors.Is(err, errNotGameDirectory):
+		writeAPIError(w, http.StatusBadRequest, "not_a_directory", err.Error())
+	default:
+		return false
+	}
+	return true
+}
@@ -4,11 +4,45 @@ import (
 	"context"
 	"io"
 	"net/http"
+
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/provision"
+	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/wipe"
 )
 
+// FlashRequest is a flash started through the API: the options of the
+// flasher and the provisioning that follows a successful run.
+type FlashRequest struct {
+	flash.Options
+	// Provision is applied to the cartridge after the flash (see
+	// provision.Run).
+	Provision provision.Options
+}
+
 type APIV1Handlers struct {
-	EjectFunc func(ctx context.Context) error
-	FlashFunc func(ctx context.Context, reader io.Reader) error
+	EjectFunc       func(ctx context.Context) error
+	FlashFunc       func(ctx context.Context, reader io.Reader, req FlashRequest) error
+	FlashStatusFunc func() state.FlashInfo
+	CancelFlashFunc func(ctx context.Context) error
+	// CheckFlashFunc rejects options the flasher (or the flash target)
+	// cannot honour; without it every option is passed on.
+	CheckFlashFunc func(req FlashRequest) error
+	// DumpFunc opens the raw cartridge image and reports its size in bytes.
+	DumpFunc func(ctx context.Context) (io.ReadCloser, int64, error)
+	// HeaderFunc opens the start of the cartridge holding its partition
+	// table without taking it offline; /image/manifest falls back to
+	// DumpFunc without it.
+	HeaderFunc func(ctx context.Context) (io.ReadCloser, int64, error)
+	// WipeFunc discards or zero-fills the cartridge and optionally lays it
+	// out anew; it reports progress through FlashStatusFunc.
+	WipeFunc func(ctx context.Context, opts wipe.Options) error
+	// StartDuplicationFunc, StopDuplicationFunc and DuplicationFunc drive the
+	// production-line mode that flashes a library image onto every inserted
+	// cartridge.
+	StartDuplicationFunc func(ctx context.Context, imageID string) error
+	StopDuplicationFunc  func(ctx context.Context) error
+	DuplicationFunc      func() state.DuplicationSnapshot
 }
 
 type APIV1Config struct {
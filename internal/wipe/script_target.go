@@ -0,0 +1,16 @@
+package wipe
+
+import (
+	"context"
+
+	"github.com/rook-computer/keymaker/internal/system"
+)
+
+// ScriptTarget lays out the cartridge SD card through the device scripts.
+type ScriptTarget struct {
+	Runner system.Runner
+}
+
+func (target ScriptTarget) Layout(ctx context.Context, table, filesystem, label string) (string, error) {
+	return system.LayoutCartridge(ctx, target.Runner, table, filesystem, label)
+}
@@ -0,0 +1,169 @@
+// Package wipe blanks a cartridge for reuse: the whole card is discarded or
+// zero-filled and, optionally, given a fresh partition table with a single
+// formatted partition.
+package wipe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/state"
+)
+
+// ErrInvalidOptions is returned by Options.Validate.
+var ErrInvalidOptions = errors.New("invalid wipe options")
+
+// DefaultFilesystem formats the partition when Options.Filesystem is empty.
+const DefaultFilesystem = "fat32"
+
+// Options describes a wipe.
+type Options struct {
+	// Mode is flash.WipeDiscard or flash.WipeZero.
+	Mode flash.WipeMode `json:"mode"`
+	// Table, "mbr" or "gpt", writes a new partition table with a single
+	// partition spanning the card after the wipe. Empty leaves the card
+	// without a partition table.
+	Table string `json:"table"`
+	// Filesystem formats that partition: fat32 (the default), exfat or ext4.
+	Filesystem string `json:"filesystem"`
+	// Label is the optional filesystem label.
+	Label string `json:"label"`
+}
+
+// labelLengths are the longest labels the filesystems store.
+var labelLengths = map[string]int{"fat32": 11, "exfat": 15, "ext4": 16}
+
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// Validate checks the options before the cartridge is touched.
+func (opts Options) Validate() error {
+	if opts.Mode != flash.WipeDiscard && opts.Mode != flash.WipeZero {
+		return fmt.Errorf("%w: mode must be discard or zero", ErrInvalidOptions)
+	}
+	switch opts.Table {
+	case "":
+		if opts.Filesystem != "" || opts.Label != "" {
+			return fmt.Errorf("%w: filesystem and label need a partition table", ErrInvalidOptions)
+		}
+		return nil
+	case "mbr", "gpt":
+	default:
+		return fmt.Errorf("%w: table must be mbr or gpt", ErrInvalidOptions)
+	}
+	maxLabel, ok := labelLengths[opts.filesystem()]
+	if !ok {
+		return fmt.Errorf("%w: filesystem must be fat32, exfat or ext4", ErrInvalidOptions)
+	}
+	if len(opts.Label) > maxLabel || !labelPattern.MatchString(opts.Label) {
+		return fmt.Errorf("%w: the %s label must be up to %d letters, digits, '-' or '_'", ErrInvalidOptions, opts.filesystem(), maxLabel)
+	}
+	return nil
+}
+
+func (opts Options) filesystem() string {
+	if opts.Filesystem == "" {
+		return DefaultFilesystem
+	}
+	return opts.Filesystem
+}
+
+// Target is the wiped cartridge receiving its new layout.
+type Target interface {
+	// Layout writes a partition table ("mbr" or "gpt") with a single
+	// partition spanning the cartridge, formats it and describes what it did.
+	Layout(ctx context.Context, table, filesystem, label string) (string, error)
+}
+
+// Error is returned by Run when the card was wiped but could not be
+// partitioned or formatted.
+type Error struct {
+	Err error
+}
+
+func (err *Error) Error() string { return "formatting failed: " + err.Err.Error() }
+
+func (err *Error) Unwrap() error { return err.Err }
+
+// ErrorCode is the stable code reported for a failed layout.
+func (err *Error) ErrorCode() string { return "format_failed" }
+
+// Run wipes the cartridge through wiper and then lays it out as requested,
+// recording the layout step in report. It returns the description of the
+// layout, if one was written.
+func Run(ctx context.Context, wiper flash.Wiper, target Target, opts Options, report *Report) (string, error) {
+	report.Reset()
+	if err := wiper.Wipe(ctx, opts.Mode); err != nil {
+		return "", err
+	}
+	if opts.Table == "" {
+		return "", nil
+	}
+	report.begin()
+	detail, err := target.Layout(ctx, opts.Table, opts.filesystem(), opts.Label)
+	if err != nil && ctx.Err() != nil {
+		err = flash.ErrCancelled
+	} else if err != nil {
+		err = &Error{Err: err}
+	}
+	report.end(err)
+	return detail, err
+}
+
+// Report tracks the layout step of the current (or last) wipe for status
+// reporting. The zero value is ready to use.
+type Report struct {
+	mu      sync.Mutex
+	running bool
+	// status and err are the outcome of a failed layout.
+	status string
+	err    string
+}
+
+// Reset forgets the previous run, e.g. when a new flash or wipe starts.
+func (report *Report) Reset() {
+	report.mu.Lock()
+	report.running = false
+	report.status = ""
+	report.err = ""
+	report.mu.Unlock()
+}
+
+// Apply adds the layout step to a flash status. While it runs the status is
+// "formatting"; a failed or cancelled layout turns the (successful) wipe into
+// an "error" or "cancelled" one.
+func (report *Report) Apply(info state.FlashInfo) state.FlashInfo {
+	report.mu.Lock()
+	defer report.mu.Unlock()
+	switch {
+	case report.running:
+		info.Status = "formatting"
+	case report.status != "":
+		info.Status = report.status
+		info.Err = report.err
+	}
+	return info
+}
+
+func (report *Report) begin() {
+	report.mu.Lock()
+	report.running = true
+	report.mu.Unlock()
+}
+
+func (report *Report) end(err error) {
+	report.mu.Lock()
+	report.running = false
+	switch {
+	case errors.Is(err, context.Canceled):
+		report.status = "cancelled"
+		report.err = flash.ErrCancelled.Error()
+	case err != nil:
+		report.status = "error"
+		report.err = err.Error()
+	}
+	report.mu.Unlock()
+}
@@ -5,13 +5,21 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/rook-computer/keymaker/internal/app"
 	"github.com/rook-computer/keymaker/internal/buttons"
 	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/jobs"
+	"github.com/rook-computer/keymaker/internal/library"
+	"github.com/rook-computer/keymaker/internal/provision"
 	"github.com/rook-computer/keymaker/internal/render"
 	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/system"
+	"github.com/rook-computer/keymaker/internal/uploads"
 	"github.com/rook-computer/keymaker/internal/web"
 )
 
@@ -22,6 +30,12 @@ func main() {
 	debug := flag.Bool("debug", false, "enable debug logging to ./keymaker-debug.log")
 	noLogo := flag.Bool("no-logo", false, "disable logo rendering")
 	stdioLog := flag.String("stdio-log", "", "redirect stdout+stderr (including panics) to this file; also configurable via KEYMAKER_STDIO_LOG")
+	flasherKind := flag.String("flasher", "script", "flash implementation: script (flash.sh) or native (in-process writer)")
+	flashTarget := flag.String("flash-target", "", "cartridge device, e.g. /dev/mmcblk1, for the flasher and the device scripts; the native flasher also takes a file (default: auto-detect the cartridge)")
+	imageDir := flag.String("image-dir", "/var/lib/keymaker/images", "directory of the on-device image library")
+	uploadDir := flag.String("upload-dir", "/var/lib/keymaker/uploads", "directory of partial resumable uploads")
+	uploadTTL := flag.Duration("upload-ttl", uploads.DefaultTTL, "how long an idle resumable upload is kept")
+	historyFile := flag.String("history-file", "/var/lib/keymaker/history.jsonl", "log of flashes, dumps, uploads and deletes (JSON Lines)")
 	flag.Parse()
 
 	// Best-effort: redirect all stdout/stderr output (including panic stack traces)
@@ -58,19 +72,68 @@ func main() {
 	// Subsystem stubs (renderer is real to show the local UI)
 	renderer := render.NewFBRenderer()
 	server := web.NewHTTPServer(web.ServerConfig{ListenAddr: ":80"})
-	flasher := flash.NewScriptFlasher()
+	// The scripts and the cartridge detection use the device named by
+	// CARTRIDGE_DEV; a file target only makes sense for the native flasher,
+	// and flashes into it cannot be provisioned (the scripts would find the
+	// cartridge instead).
+	provisionable := true
+	if *flashTarget != "" {
+		device, err := filepath.EvalSymlinks(*flashTarget)
+		if name, ok := strings.CutPrefix(device, "/dev/"); err == nil && ok {
+			_ = os.Setenv(system.CartridgeDevEnv, name)
+		} else if *flasherKind == "native" {
+			provisionable = false
+		} else {
+			fmt.Println("-flash-target must be a device below /dev unless -flasher native is used:", *flashTarget)
+			return
+		}
+	}
+	var flasher flash.Flasher
+	switch *flasherKind {
+	case "script":
+		flasher = flash.NewScriptFlasher()
+	case "native":
+		flasher = flash.NewDeviceFlasher(*flashTarget)
+	default:
+		fmt.Println("unknown flasher:", *flasherKind)
+		return
+	}
 	btns := buttons.NewNoopButtons()
 
 	// App construction
 	a := app.New(store, renderer, server, flasher, btns)
 	a.Logger = logger
+	if provisionable {
+		a.Provision = provision.ScriptTarget{Runner: system.ShellRunner{Logger: logger}}
+	}
 	a.NoLogo = *noLogo
 	a.Debug = *debug
 	server.EjectFunc = a.HandleEject
 	server.FlashFunc = a.HandleFlash
+	server.FlashStatusFunc = a.FlashStatus
+	server.CancelFlashFunc = a.CancelFlash
+	server.CheckFlashFunc = a.CheckFlash
+	server.DumpFunc = a.OpenDump
+	server.HeaderFunc = a.OpenHeader
+	server.WipeFunc = a.HandleWipe
+	server.StartDuplicationFunc = a.StartDuplication
+	server.StopDuplicationFunc = a.StopDuplication
+	server.DuplicationFunc = a.DuplicationReport
+	deps := web.NewDeviceAPIV1Deps(a.Logger)
+	deps.Jobs = jobs.NewManager(ctx)
+	deps.Images = library.New(*imageDir)
+	if err := deps.Images.Check(); err != nil {
+		fmt.Println("image library unusable:", err)
+		logger.Errorf("main", "image library %s unusable: %v", *imageDir, err)
+	}
+	a.Images = deps.Images
+	deps.Uploads = uploads.New(*uploadDir, *uploadTTL)
+	go deps.Uploads.Run(ctx)
+	deps.History = history.New(*historyFile)
+	a.History = deps.History
 	server.Handler = web.NewDefaultMux(server.StaticDir, web.APIV1Config{
-		Handlers: web.APIV1Handlers{EjectFunc: a.HandleEject, FlashFunc: a.HandleFlash},
-		Deps:     web.NewDeviceAPIV1Deps(a.Logger),
+		Handlers: web.APIV1Handlers{EjectFunc: a.HandleEject, FlashFunc: a.HandleFlash, FlashStatusFunc: a.FlashStatus, CancelFlashFunc: a.CancelFlash, CheckFlashFunc: a.CheckFlash, DumpFunc: a.OpenDump, HeaderFunc: a.OpenHeader, WipeFunc: a.HandleWipe, StartDuplicationFunc: a.StartDuplication, StopDuplicationFunc: a.StopDuplication, DuplicationFunc: a.DuplicationReport},
+		Deps:     deps,
 	})
 
 	if err := a.Start(ctx); err != nil {
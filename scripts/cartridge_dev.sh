@@ -0,0 +1,28 @@
+# Cartridge device selection shared by the scripts in this directory, which
+# source it from their own directory:
+#
+#   source "$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/cartridge_dev.sh"
+#
+# Sets root_base to the disk holding the root filesystem (e.g. mmcblk0) and
+# target_dev to the cartridge disk: CARTRIDGE_DEV when set (keymaker passes
+# its -flash-target this way), otherwise the first mmc disk that is not
+# root_base. target_dev is empty when there is none; each script decides how
+# to fail.
+#
+# Environment overrides:
+#   CARTRIDGE_DEV (e.g. mmcblk1)
+
+root_src=$(findmnt -n -o SOURCE / || true)
+root_base="${root_src#/dev/}"
+root_base="${root_base%%p*}"
+
+list_mmc() { lsblk -dn -o NAME,TYPE | awk '$2=="disk"{print $1}' | grep -E '^mmcblk[0-9]$' || true; }
+
+target_dev="${CARTRIDGE_DEV:-}"
+if [[ -z "$target_dev" ]]; then
+  for d in $(list_mmc); do
+    if [[ "$d" != "$root_base" ]] && [[ -b "/dev/$d" ]]; then
+      target_dev="$d"; break
+    fi
+  done
+fi
@@ -14,22 +14,7 @@ while getopts ":f" opt; do
   esac
 done
 
-# Determine target mmc device (not the root one)
-root_src=$(findmnt -n -o SOURCE / || true)
-root_base="${root_src#/dev/}"
-root_base="${root_base%%p*}"
-
-target_dev="${CARTRIDGE_DEV:-}"
-
-list_mmc() { lsblk -dn -o NAME,TYPE | awk '$2=="disk"{print $1}' | grep -E '^mmcblk[0-9]$' || true; }
-
-if [[ -z "$target_dev" ]]; then
-  for d in $(list_mmc); do
-    if [[ "$d" != "$root_base" ]] && [[ -b "/dev/$d" ]]; then
-      target_dev="$d"; break
-    fi
-  done
-fi
+source "$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/cartridge_dev.sh"
 
 [[ -n "$target_dev" ]] || exit 2
 [[ -b "/dev/${target_dev}" ]] || exit 3
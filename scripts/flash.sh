@@ -1,40 +1,58 @@
 #!/usr/bin/env bash
 set -euo pipefail
 
-# Flash a gzipped disk image to the cartridge block device.
+# Flash a disk image to the cartridge block device.
 #
-# Input:  gzipped image on stdin
+# Input:  gzipped image on stdin (default), or a raw image with "raw"
+#         With "part <n>" a raw partition image is written to partition <n>
+#         only; the rest of the card is left alone. The partition must exist
+#         (exit 9) and must not be mounted (exit 10). An unknown mode or a
+#         bad partition number exits 5.
 # Output: none (silent)
 #
 # Usage:
 #   sudo ./flash.sh < image.img.gz
+#   sudo ./flash.sh raw < image.img
+#   sudo ./flash.sh part 1 < boot.img
 #
 # Environment overrides:
 #   CARTRIDGE_DEV (e.g. mmcblk0)
 
 mountpoint="/cartridge"
+mode="${1:-gzip}"
+partition=""
 
-# Determine root base device (to avoid self-destruction)
-root_src=$(findmnt -n -o SOURCE / || true)
-root_base="${root_src#/dev/}"
-root_base="${root_base%%p*}"
+case "$mode" in
+  gzip) decompress() { gunzip -c; } ;;
+  raw) decompress() { cat; } ;;
+  part)
+    decompress() { cat; }
+    partition="${2:-}"
+    [[ "$partition" =~ ^[1-9][0-9]*$ ]] || exit 5
+    ;;
+  *) exit 5 ;;
+esac
 
-# Pick target mmc block device
-list_mmc() { lsblk -dn -o NAME,TYPE | awk '$2=="disk"{print $1}' | grep -E '^mmcblk[0-9]$' || true; }
-
-target_dev="${CARTRIDGE_DEV:-}"
-if [[ -z "$target_dev" ]]; then
-  for d in $(list_mmc); do
-    if [[ "$d" != "$root_base" ]] && [[ -b "/dev/$d" ]]; then
-      target_dev="$d"; break
-    fi
-  done
-fi
+source "$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/cartridge_dev.sh"
 
 [[ -n "$target_dev" ]] || exit 2
 [[ -b "/dev/${target_dev}" ]] || exit 3
 [[ "$target_dev" != "$root_base" ]] || exit 4
 
+# A single partition is only written when nothing uses it.
+if [[ -n "$partition" ]]; then
+  # mmcblk0 -> mmcblk0p1, sda -> sda1
+  part_dev="/dev/${target_dev}${partition}"
+  [[ "$target_dev" =~ [0-9]$ ]] && part_dev="/dev/${target_dev}p${partition}"
+  [[ -b "$part_dev" ]] || exit 9
+  if findmnt -n -S "$part_dev" >/dev/null 2>&1; then
+    exit 10
+  fi
+  decompress | dd of="$part_dev" bs=4M conv=fsync status=none
+  sync
+  exit 0
+fi
+
 # Unmount any mounted partitions for the target device (including /cartridge)
 parts=$(lsblk -rno NAME "/dev/${target_dev}" | tail -n +2 || true)
 if [[ -n "$parts" ]]; then
@@ -51,10 +69,10 @@ if findmnt -n --target "$mountpoint" >/dev/null 2>&1; then
   umount "$mountpoint" || true
 fi
 
-# Stream stdin -> gunzip -> dd to whole device
+# Stream stdin -> (gunzip) -> dd to whole device
 # conv=fsync ensures data is flushed before dd exits.
 # status=none keeps the script silent.
-gunzip -c | dd of="/dev/${target_dev}" bs=4M conv=fsync status=none
+decompress | dd of="/dev/${target_dev}" bs=4M conv=fsync status=none
 
 sync
 
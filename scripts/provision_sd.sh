@@ -0,0 +1,199 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Post-flash provisioning of the cartridge SD card.
+#
+# Modes:
+#   expand
+#     Grow the last partition to the end of the card and, for ext2/3/4,
+#     check and resize its filesystem. Prints a one-line summary.
+#
+#   read <boot|root> <path>
+#     Print a file of the boot partition (first vfat) or the root partition
+#     (largest ext4 holding /etc/fstab). Prints nothing if it does not exist.
+#
+#   write <boot|root> <path> <source> <mode> [owner]
+#     Install the file source as path with the given octal mode. With owner
+#     (a user of the image's /etc/passwd) the file and any parent directories
+#     that had to be created (mode 0700) belong to that user.
+#
+# Usage:
+#   sudo ./provision_sd.sh expand
+#   sudo ./provision_sd.sh read root /etc/hosts
+#   sudo ./provision_sd.sh write root /etc/hostname /tmp/hostname 0644
+#
+# Environment overrides:
+#   CARTRIDGE_DEV (e.g. mmcblk0)
+
+mountpoint="/cartridge"
+
+source "$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/cartridge_dev.sh"
+
+[[ -n "$target_dev" ]] || exit 2
+[[ -b "/dev/${target_dev}" ]] || exit 3
+[[ "$target_dev" != "$root_base" ]] || exit 4
+
+dev="/dev/${target_dev}"
+
+unmount_all() {
+  local parts p mp
+  parts=$(lsblk -rno NAME "$dev" | tail -n +2 || true)
+  if [[ -n "$parts" ]]; then
+    while read -r p; do
+      mp=$(findmnt -n -o TARGET "/dev/${p}" || true)
+      if [[ -n "$mp" ]]; then
+        umount "$mp" || true
+      fi
+    done <<< "$parts"
+  fi
+  if findmnt -n --target "$mountpoint" >/dev/null 2>&1; then
+    umount "$mountpoint" || true
+  fi
+}
+
+expand() {
+  unmount_all
+
+  # The last partition is the one starting last on the card.
+  local last="" last_start=-1 name start
+  while read -r name; do
+    start=$(cat "/sys/class/block/${name}/start")
+    if (( start > last_start )); then
+      last="$name"; last_start="$start"
+    fi
+  done < <(lsblk -rno NAME,TYPE "$dev" | awk '$2=="part"{print $1}')
+  [[ -n "$last" ]] || exit 5
+
+  local number table
+  number=$(cat "/sys/class/block/${last}/partition")
+  table=$(blkid -p -o value -s PTTYPE "$dev" || true)
+  if [[ "$table" == "dos" ]] && (( number > 4 )); then
+    echo "provision: logical partitions cannot be grown" >&2
+    exit 6
+  fi
+  if [[ "$table" == "gpt" ]]; then
+    # Move the backup GPT from the end of the image to the end of the card.
+    sfdisk --relocate gpt-bak-std "$dev" >/dev/null
+  fi
+  echo ", +" | sfdisk --quiet --no-reread --no-tell-kernel -N "$number" "$dev"
+  partx -u "$dev" || blockdev --rereadpt "$dev"
+  udevadm settle || true
+
+  local part="/dev/${last}" size fstype rc
+  size=$(blockdev --getsize64 "$part")
+  fstype=$(blkid -o value -s TYPE "$part" || true)
+  case "$fstype" in
+    ext2|ext3|ext4)
+      # e2fsck exits 1 when it corrected errors, which is fine here.
+      rc=0
+      e2fsck -f -p "$part" >/dev/null 2>&1 || rc=$?
+      (( rc <= 1 )) || { echo "provision: e2fsck failed with exit $rc" >&2; exit 7; }
+      resize2fs "$part" >/dev/null 2>&1
+      echo "grew ${last} to ${size} bytes and resized its ${fstype} filesystem"
+      ;;
+    *)
+      echo "grew ${last} to ${size} bytes; ${fstype:-unknown} filesystem left as is"
+      ;;
+  esac
+}
+
+# find_volume prints the partition device holding the boot or root volume.
+find_volume() {
+  local name size fstype tmpmp
+  case "$1" in
+    boot)
+      name=$(lsblk -rno NAME,FSTYPE "$dev" | awk '$2=="vfat"{print $1; exit}')
+      [[ -n "$name" ]] || return 1
+      echo "/dev/${name}"
+      ;;
+    root)
+      while read -r name size; do
+        tmpmp=$(mktemp -d)
+        mount -o ro "/dev/${name}" "$tmpmp" || { rm -rf "$tmpmp"; continue; }
+        if [[ -f "$tmpmp/etc/fstab" ]]; then
+          umount "$tmpmp"; rm -rf "$tmpmp"
+          echo "/dev/${name}"
+          return 0
+        fi
+        umount "$tmpmp" || true
+        rm -rf "$tmpmp"
+      done < <(lsblk -b -rno NAME,SIZE,FSTYPE "$dev" | awk '$3=="ext4"{print $1" "$2}' | sort -k2,2nr)
+      return 1
+      ;;
+    *)
+      return 1
+      ;;
+  esac
+}
+
+volume_mp=""
+cleanup() {
+  if [[ -n "$volume_mp" ]]; then
+    umount "$volume_mp" || true
+    rm -rf "$volume_mp"
+  fi
+}
+trap cleanup EXIT
+
+mount_volume() {
+  local part
+  part=$(find_volume "$1") || { echo "provision: no $1 partition found" >&2; exit 8; }
+  volume_mp=$(mktemp -d)
+  mount -o rw "$part" "$volume_mp"
+}
+
+# target_path maps path into the mounted volume, refusing anything that
+# resolves outside of it (e.g. through an absolute symlink of the image).
+target_path() {
+  local path="$1" resolved
+  [[ "$path" == /* && "$path" != *..* ]] || { echo "provision: invalid path $path" >&2; exit 9; }
+  resolved=$(realpath -m "${volume_mp}${path}")
+  [[ "$resolved" == "$volume_mp"/* ]] || { echo "provision: $path leaves the partition" >&2; exit 9; }
+  echo "$resolved"
+}
+
+mode="${1:-}"
+case "$mode" in
+  expand)
+    expand
+    ;;
+  read)
+    [[ $# -eq 3 ]] || exit 1
+    mount_volume "$2"
+    file=$(target_path "$3")
+    if [[ -f "$file" ]]; then
+      cat "$file"
+    fi
+    ;;
+  write)
+    [[ $# -eq 5 || $# -eq 6 ]] || exit 1
+    mount_volume "$2"
+    file=$(target_path "$3")
+    owner_args=()
+    if [[ $# -eq 6 ]]; then
+      ids=$(awk -F: -v user="$6" '$1==user{print $3":"$4; exit}' "$volume_mp/etc/passwd")
+      [[ -n "$ids" ]] || { echo "provision: user $6 not found in the image" >&2; exit 10; }
+      owner_args=(-o "${ids%%:*}" -g "${ids##*:}")
+    fi
+    if [[ ! -d "$(dirname "$file")" ]]; then
+      if [[ ${#owner_args[@]} -gt 0 ]]; then
+        install -d -m 0700 "${owner_args[@]}" "$(dirname "$file")"
+      else
+        install -d -m 0755 "$(dirname "$file")"
+      fi
+    fi
+    if [[ "$2" == "boot" ]]; then
+      # vfat has no owners or modes.
+      cp "$4" "$file"
+    else
+      install -m "$5" "${owner_args[@]}" "$4" "$file"
+    fi
+    sync
+    ;;
+  *)
+    echo "Usage: $0 expand | read <boot|root> <path> | write <boot|root> <path> <source> <mode> [owner]" >&2
+    exit 1
+    ;;
+esac
+
+exit 0
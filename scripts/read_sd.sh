@@ -0,0 +1,51 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Read the raw contents of the cartridge block device.
+#
+# Input:  none
+# Output: the first <bytes> bytes of the device on stdout (whole device if omitted)
+#         With <partition>, the first <bytes> bytes of that partition (exit 9
+#         if it does not exist).
+#
+# Usage:
+#   sudo ./read_sd.sh [bytes] > image.img
+#   sudo ./read_sd.sh <bytes> <partition> > partition.img
+#
+# The kernel buffer cache of the device is flushed first, so the data comes
+# from the card itself and not from what was just written.
+#
+# Environment overrides:
+#   CARTRIDGE_DEV (e.g. mmcblk0)
+
+bytes="${1:-}"
+if [[ -n "$bytes" ]] && ! [[ "$bytes" =~ ^[0-9]+$ ]]; then
+  exit 5
+fi
+partition="${2:-}"
+if [[ -n "$partition" ]] && ! [[ "$partition" =~ ^[1-9][0-9]*$ ]]; then
+  exit 5
+fi
+
+source "$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/cartridge_dev.sh"
+
+[[ -n "$target_dev" ]] || exit 2
+[[ -b "/dev/${target_dev}" ]] || exit 3
+
+source_dev="/dev/${target_dev}"
+if [[ -n "$partition" ]]; then
+  # mmcblk0 -> mmcblk0p1, sda -> sda1
+  source_dev="/dev/${target_dev}${partition}"
+  [[ "$target_dev" =~ [0-9]$ ]] && source_dev="/dev/${target_dev}p${partition}"
+  [[ -b "$source_dev" ]] || exit 9
+fi
+
+blockdev --flushbufs "$source_dev" || true
+
+if [[ -n "$bytes" ]]; then
+  dd if="$source_dev" bs=4M count="$bytes" iflag=count_bytes status=none
+else
+  dd if="$source_dev" bs=4M status=none
+fi
+
+exit 0
@@ -0,0 +1,14 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Print the capacity of the cartridge block device in bytes.
+# Silent on failure: exit 2 if no cartridge device is found.
+#
+# Environment overrides:
+#   CARTRIDGE_DEV (e.g. mmcblk0)
+
+source "$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/cartridge_dev.sh"
+
+[[ -n "$target_dev" ]] && [[ -b "/dev/${target_dev}" ]] || exit 2
+
+blockdev --getsize64 "/dev/${target_dev}"
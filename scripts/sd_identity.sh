@@ -0,0 +1,23 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Print the identity of the cartridge SD card from its card registers, one
+# key=value line each: cid, serial, name, manfid, date. Registers the card
+# (or reader) does not expose are left out.
+# Silent on failure: exit 2 if no cartridge device is found.
+#
+# Environment overrides:
+#   CARTRIDGE_DEV (e.g. mmcblk0)
+
+source "$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/cartridge_dev.sh"
+
+[[ -n "$target_dev" ]] && [[ -b "/dev/${target_dev}" ]] || exit 2
+
+regs="/sys/block/${target_dev}/device"
+for key in cid serial name manfid date; do
+  if [[ -r "${regs}/${key}" ]]; then
+    echo "${key}=$(tr -d '\n' < "${regs}/${key}")"
+  fi
+done
+
+exit 0
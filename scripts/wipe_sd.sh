@@ -0,0 +1,115 @@
+#!/usr/bin/env bash
+set -euo pipefail
+
+# Blank the cartridge SD card.
+#
+# Modes:
+#   discard
+#     Discard every block of the card (blkdiscard) in 256 MiB steps. Prints a
+#     "<device>: Discarded <n> bytes from the offset <offset>" line as steps
+#     complete. Exits 6 if the card or reader does not support discard.
+#
+#   layout <mbr|gpt> <fat32|exfat|ext4> [label]
+#     Write a new partition table with a single partition from 1 MiB to the
+#     end of the card and format it. Prints a one-line summary.
+#
+# Zero-filling needs no mode of its own: zeros are streamed into
+# `flash.sh raw`.
+#
+# Usage:
+#   sudo ./wipe_sd.sh discard
+#   sudo ./wipe_sd.sh layout mbr fat32 KEYMAKER
+#
+# Environment overrides:
+#   CARTRIDGE_DEV (e.g. mmcblk0)
+
+mountpoint="/cartridge"
+
+source "$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/cartridge_dev.sh"
+
+[[ -n "$target_dev" ]] || exit 2
+[[ -b "/dev/${target_dev}" ]] || exit 3
+[[ "$target_dev" != "$root_base" ]] || exit 4
+
+dev="/dev/${target_dev}"
+
+unmount_all() {
+  local parts p mp
+  parts=$(lsblk -rno NAME "$dev" | tail -n +2 || true)
+  if [[ -n "$parts" ]]; then
+    while read -r p; do
+      mp=$(findmnt -n -o TARGET "/dev/${p}" || true)
+      if [[ -n "$mp" ]]; then
+        umount "$mp" || true
+      fi
+    done <<< "$parts"
+  fi
+  if findmnt -n --target "$mountpoint" >/dev/null 2>&1; then
+    umount "$mountpoint" || true
+  fi
+}
+
+discard() {
+  unmount_all
+  local out rc=0
+  # The progress lines go to stdout; errors are captured.
+  { out=$(LC_ALL=C blkdiscard -f -v -s 256M "$dev" 2>&1 >&3) || rc=$?; } 3>&1
+  if (( rc != 0 )); then
+    if [[ "$out" == *"not supported"* ]]; then
+      echo "wipe: $out" >&2
+      exit 6
+    fi
+    echo "wipe: $out" >&2
+    exit 7
+  fi
+}
+
+layout() {
+  local table="$1" fs="$2" label="${3:-}" type
+  case "$table:$fs" in
+    mbr:fat32) type="c" ;;
+    mbr:exfat) type="7" ;;
+    mbr:ext4) type="83" ;;
+    gpt:fat32|gpt:exfat) type="EBD0A0A2-B9E5-4433-87C0-68B6B72699C7" ;;
+    gpt:ext4) type="0FC63DAF-8483-4772-8E79-3D69D8477DE4" ;;
+    *) exit 1 ;;
+  esac
+  local label_type="$table"
+  [[ "$table" == "mbr" ]] && label_type="dos"
+
+  unmount_all
+  wipefs -a -q "$dev" || true
+  printf 'label: %s\nstart=2048, type=%s\n' "$label_type" "$type" | sfdisk --quiet --wipe always "$dev"
+  partx -u "$dev" || blockdev --rereadpt "$dev"
+  udevadm settle || true
+
+  local part
+  part=$(lsblk -rno NAME,TYPE "$dev" | awk '$2=="part"{print $1; exit}')
+  [[ -n "$part" ]] || { echo "wipe: the new partition did not appear" >&2; exit 8; }
+  part="/dev/${part}"
+
+  case "$fs" in
+    fat32) mkfs.vfat -F 32 ${label:+-n "$label"} "$part" >/dev/null ;;
+    exfat) mkfs.exfat ${label:+-L "$label"} "$part" >/dev/null ;;
+    ext4) mkfs.ext4 -q -F ${label:+-L "$label"} "$part" ;;
+  esac
+  sync
+  echo "created ${table} partition table with one ${fs} partition of $(blockdev --getsize64 "$part") bytes"
+}
+
+mode="${1:-}"
+case "$mode" in
+  discard)
+    discard
+    ;;
+  layout)
+    [[ $# -eq 3 || $# -eq 4 ]] || exit 1
+    layout "$2" "$3" "${4:-}"
+    ;;
+  *)
+    echo "Usage: $0 discard | layout <mbr|gpt> <fat32|exfat|ext4> [label]" >&2
+    exit 1
+    ;;
+esac
+
+exit 0
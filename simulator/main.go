@@ -53,7 +53,7 @@ func main() {
 	server := web.NewHTTPServer(web.ServerConfig{ListenAddr: *listenAddr, DevMode: *devMode})
 	server.StaticDir = *staticDir
 	server.Handler = web.NewDefaultMux(server.StaticDir, web.APIV1Config{
-		Handlers: web.APIV1Handlers{EjectFunc: control.Eject, FlashFunc: control.Flash},
+		Handlers: web.APIV1Handlers{EjectFunc: control.Eject, FlashFunc: control.Flash, FlashStatusFunc: control.FlashStatus, CancelFlashFunc: control.CancelFlash, DumpFunc: control.Dump, HeaderFunc: control.Header, WipeFunc: control.Wipe, StartDuplicationFunc: control.StartDuplication, StopDuplicationFunc: control.StopDuplication, DuplicationFunc: control.DuplicationReport},
 		Deps:     deps,
 	})
 	registerSimEndpoints(server.Handler, control)
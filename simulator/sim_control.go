@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,8 +14,18 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/rook-computer/keymaker/internal/duplication"
+	"github.com/rook-computer/keymaker/internal/flash"
+	"github.com/rook-computer/keymaker/internal/gamelist"
+	"github.com/rook-computer/keymaker/internal/history"
+	"github.com/rook-computer/keymaker/internal/jobs"
+	"github.com/rook-computer/keymaker/internal/library"
+	"github.com/rook-computer/keymaker/internal/partition"
+	"github.com/rook-computer/keymaker/internal/provision"
 	"github.com/rook-computer/keymaker/internal/state"
+	"github.com/rook-computer/keymaker/internal/uploads"
 	"github.com/rook-computer/keymaker/internal/web"
+	"github.com/rook-computer/keymaker/internal/wipe"
 )
 
 type SimFaults struct {
@@ -30,14 +41,44 @@ type SimControl struct {
 	currentScenario atomic.Value // string
 
 	info   *state.CartridgeInfo
+	jobs   *jobs.Manager
 	faults struct {
 		mu sync.RWMutex
 		v  SimFaults
 	}
 
+	// flasher writes uploaded images to the virtual cartridge device file.
+	flasher *flash.DeviceFlasher
+	// images is the host image library; it lives next to the cartridge root
+	// so scenario resets keep it.
+	images *library.Library
+	// uploads holds resumable uploads, also next to the cartridge root.
+	uploads *uploads.Store
+	// history logs flashes, dumps, uploads and deletes, next to the
+	// cartridge root as well.
+	history *history.Store
+	// provisioning reports the post-flash provisioning of the last flash.
+	provisioning provision.Report
+	// wiping reports the layout step of the last wipe.
+	wiping wipe.Report
+
+	// duplicationStop ends the running duplication loop and waits for it.
+	duplicationMu   sync.Mutex
+	duplicationStop func()
+
 	reinsertSeq int64
 }
 
+// simCartridgeIdentity is the card register set reported for the virtual
+// cartridge.
+var simCartridgeIdentity = state.CartridgeIdentity{
+	CID:            "03534453494d31368001234567015a00",
+	Serial:         "0x01234567",
+	Name:           "SIM16",
+	ManufacturerID: "0x000003",
+	Date:           "10/2025",
+}
+
 func NewSimControl(processCtx context.Context, root, startupScenario string, info *state.CartridgeInfo) *SimControl {
 	if processCtx == nil {
 		processCtx = context.Background()
@@ -45,19 +86,36 @@ func NewSimControl(processCtx context.Context, root, startupScenario string, inf
 	if info == nil {
 		info = state.GetCartridgeInfo()
 	}
-	c := &SimControl{processCtx: processCtx, root: filepath.Clean(root), startupScenario: strings.TrimSpace(startupScenario), info: info}
+	c := &SimControl{processCtx: processCtx, root: filepath.Clean(root), startupScenario: strings.TrimSpace(startupScenario), info: info, jobs: jobs.NewManager(processCtx)}
 	if c.startupScenario == "" {
 		c.startupScenario = "retropie"
 	}
 	c.currentScenario.Store(c.startupScenario)
+	c.flasher = flash.NewDeviceFlasher(c.CartridgeImagePath())
+	c.flasher.BufferSize = 256 * 1024
+	c.images = library.New(c.root + "-images")
+	c.uploads = uploads.New(c.root+"-uploads", uploads.DefaultTTL)
+	go c.uploads.Run(processCtx)
+	c.history = history.New(c.root + "-history.jsonl")
 	return c
 }
 
 func (c *SimControl) Deps() web.APIV1Deps {
+	romsRoot := filepath.Join(c.root, "home/pi/RetroPie/roms")
+	retroPie := web.FileSystemRetroPieStorage{
+		RomsRoot:  romsRoot,
+		BIOSDir:   filepath.Join(c.root, "home/pi/RetroPie/BIOS"),
+		Hashes:    &web.GameHashCache{},
+		Gamelists: &gamelist.Store{Root: c.root, RomsRoot: romsRoot, Home: filepath.Join(c.root, "home/pi")},
+	}
 	return web.APIV1Deps{
 		Cartridge: c.info,
 		Mounter:   SimCartridgeMounter{Control: c},
-		RetroPie:  web.FileSystemRetroPieStorage{RomsRoot: filepath.Join(c.root, "home/pi/RetroPie/roms")},
+		RetroPie:  retroPie,
+		Jobs:      c.jobs,
+		Images:    c.images,
+		Uploads:   c.uploads,
+		History:   c.history,
 	}
 }
 
@@ -70,6 +128,15 @@ func (c *SimControl) ApplyScenario(name string) error {
 	if err := applyScenario(c.processCtx, c.root, name, c.info); err != nil {
 		return err
 	}
+	if c.info.Snapshot().Present {
+		if err := c.ensureVirtualDevice(); err != nil {
+			return err
+		}
+		if capacity, err := flash.DeviceCapacity(c.CartridgeImagePath()); err == nil {
+			c.info.SetCapacity(capacity)
+		}
+		c.info.SetIdentity(simCartridgeIdentity)
+	}
 	c.currentScenario.Store(name)
 	return nil
 }
@@ -132,57 +199,371 @@ func (c *SimControl) Eject(reqCtx context.Context) error {
 	return nil
 }
 
-func (c *SimControl) Flash(ctx context.Context, reader io.Reader) error {
+func (c *SimControl) Flash(ctx context.Context, reader io.Reader, req web.FlashRequest) error {
 	if !c.info.Snapshot().Present {
 		return fmt.Errorf("no cartridge present")
 	}
-
 	faults := c.Faults()
 	if faults.FlashFailAfterBytes < 0 {
 		return fmt.Errorf("simulated flash failure")
 	}
 
+	if err := c.ensureVirtualDevice(); err != nil {
+		return err
+	}
+
 	c.info.SetBusy(true)
 	defer c.info.SetBusy(false)
+	wasIncomplete := c.info.Snapshot().IncompleteImage
+	c.info.SetIncompleteImage(true)
 
-	tmpPath := filepath.Join(c.root, ".sim-flash-"+fmt.Sprint(time.Now().UnixNano())+".img")
-	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	c.provisioning.Reset()
+	c.wiping.Reset()
+	err := c.flasher.Start(ctx, &simUploadReader{reader: reader, failAfter: faults.FlashFailAfterBytes}, req.Options)
 	if err != nil {
+		if !errors.Is(err, context.Canceled) && !c.flasher.Status().Touched {
+			c.info.SetIncompleteImage(wasIncomplete)
+		}
 		return err
 	}
-	defer func() { _ = f.Close(); _ = os.Remove(tmpPath) }()
+	c.info.SetIncompleteImage(false)
+	c.info.SetMounted(false)
+	if req.Provision.Empty() {
+		return nil
+	}
+	return provision.Run(ctx, simProvisionTarget{control: c}, req.Provision, &c.provisioning)
+}
 
-	buf := make([]byte, 256*1024)
-	var total int64
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
+// Wipe blanks the virtual cartridge device file: a discard punches holes
+// into it. The cartridge root is emptied as the card's files are gone.
+func (c *SimControl) Wipe(ctx context.Context, opts wipe.Options) error {
+	if !c.info.Snapshot().Present {
+		return fmt.Errorf("no cartridge present")
+	}
+	if err := c.ensureVirtualDevice(); err != nil {
+		return err
+	}
+
+	c.info.SetBusy(true)
+	defer c.info.SetBusy(false)
+	c.info.SetMounted(false)
+	c.info.SetRetroPie(false, nil, nil)
+	c.info.SetIncompleteImage(true)
+
+	c.provisioning.Reset()
+	detail, err := wipe.Run(ctx, c.flasher, simWipeTarget{control: c}, opts, &c.wiping)
+	if c.flasher.Status().BytesWritten > 0 {
+		if clearErr := clearDir(c.root); clearErr != nil && err == nil {
+			err = clearErr
 		}
-		n, readErr := reader.Read(buf)
-		if n > 0 {
-			if _, err := f.Write(buf[:n]); err != nil {
-				return err
-			}
-			total += int64(n)
-			if faults.FlashFailAfterBytes > 0 && total >= faults.FlashFailAfterBytes {
-				return fmt.Errorf("simulated flash failure after %d bytes", faults.FlashFailAfterBytes)
-			}
-			time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	c.info.SetIncompleteImage(false)
+	if detail != "" {
+		fmt.Fprintln(os.Stderr, "wipe:", detail)
+	}
+	return nil
+}
+
+// simWipeTarget writes the new partition table into the virtual cartridge
+// device file; the filesystem is not created.
+type simWipeTarget struct {
+	control *SimControl
+}
+
+func (t simWipeTarget) Layout(ctx context.Context, table, filesystem, label string) (string, error) {
+	_ = ctx
+	scheme, partType := partition.SchemeMBR, typeMBRFAT32
+	switch table + ":" + filesystem {
+	case "mbr:exfat":
+		partType = typeMBRExFAT
+	case "mbr:ext4":
+		partType = typeMBRLinux
+	case "gpt:fat32", "gpt:exfat":
+		scheme, partType = partition.SchemeGPT, typeGPTBasicData
+	case "gpt:ext4":
+		scheme, partType = partition.SchemeGPT, typeGPTLinux
+	}
+	device, err := os.OpenFile(t.control.CartridgeImagePath(), os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = device.Close() }()
+	info, err := device.Stat()
+	if err != nil {
+		return "", err
+	}
+	created, err := createPartitionTable(device, info.Size(), scheme, partType, label)
+	if err != nil {
+		return "", err
+	}
+	if err := device.Sync(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("created %s partition table with one %s partition of %d bytes (formatting is not simulated)", table, filesystem, created.Size), nil
+}
+
+// clearDir removes the contents of dir, keeping dir itself.
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
 		}
-		if readErr == io.EOF {
-			break
+	}
+	return nil
+}
+
+// CancelFlash aborts a running simulated flash.
+func (c *SimControl) CancelFlash(ctx context.Context) error {
+	_ = ctx
+	return c.flasher.Cancel()
+}
+
+// FlashStatus mirrors flash.Flasher.Status for the simulated flash pipeline.
+func (c *SimControl) FlashStatus() state.FlashInfo {
+	return c.wiping.Apply(c.provisioning.Apply(c.flasher.Status()))
+}
+
+// simProvisionTarget provisions the virtual cartridge: the partition table
+// of the device file is really grown, while files go to the cartridge root
+// (the boot partition being its boot directory).
+type simProvisionTarget struct {
+	control *SimControl
+}
+
+func (t simProvisionTarget) Expand(ctx context.Context) (string, error) {
+	_ = ctx
+	device, err := os.OpenFile(t.control.CartridgeImagePath(), os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = device.Close() }()
+	info, err := device.Stat()
+	if err != nil {
+		return "", err
+	}
+	grown, err := growLastPartition(device, info.Size())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("grew partition %d to %d bytes (filesystem resize is not simulated)", grown.Index, grown.Size), nil
+}
+
+func (t simProvisionTarget) ReadFile(ctx context.Context, volume provision.Volume, path string) ([]byte, error) {
+	_ = ctx
+	data, err := os.ReadFile(t.path(volume, path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (t simProvisionTarget) WriteFile(ctx context.Context, volume provision.Volume, path string, data []byte, mode os.FileMode, owner string) error {
+	_, _ = ctx, owner
+	target := t.path(volume, path)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, data, mode)
+}
+
+func (t simProvisionTarget) path(volume provision.Volume, path string) string {
+	base := t.control.root
+	if volume == provision.Boot {
+		base = filepath.Join(base, "boot")
+	}
+	return filepath.Join(base, filepath.Clean("/"+path))
+}
+
+// CartridgeImagePath is the file backing the virtual cartridge device.
+func (c *SimControl) CartridgeImagePath() string {
+	return c.root + ".img"
+}
+
+// simCartridgeSize is the capacity of a freshly created virtual cartridge.
+const simCartridgeSize = 256 * 1024 * 1024
+
+// ensureVirtualDevice creates the (sparse) virtual cartridge device file.
+func (c *SimControl) ensureVirtualDevice() error {
+	path := c.CartridgeImagePath()
+	if _, err := os.Stat(path); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(simCartridgeSize); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Dump mirrors App.OpenDump against the virtual cartridge device.
+func (c *SimControl) Dump(ctx context.Context) (io.ReadCloser, int64, error) {
+	if !c.info.Snapshot().Present {
+		return nil, 0, fmt.Errorf("no cartridge present")
+	}
+	if err := c.ensureVirtualDevice(); err != nil {
+		return nil, 0, err
+	}
+	c.info.SetBusy(true)
+	mounted := c.info.Snapshot().Mounted
+	c.info.SetMounted(false)
+
+	reader, size, err := c.flasher.OpenRead(ctx)
+	if err != nil {
+		c.info.SetMounted(mounted)
+		c.info.SetBusy(false)
+		return nil, 0, err
+	}
+	return &simDumpReader{ReadCloser: reader, release: func() {
+		c.info.SetMounted(mounted)
+		c.info.SetBusy(false)
+	}}, size, nil
+}
+
+// Header mirrors App.OpenHeader: the start of the virtual device, read
+// without unmounting.
+func (c *SimControl) Header(ctx context.Context) (io.ReadCloser, int64, error) {
+	if !c.info.Snapshot().Present {
+		return nil, 0, fmt.Errorf("no cartridge present")
+	}
+	if err := c.ensureVirtualDevice(); err != nil {
+		return nil, 0, err
+	}
+	reader, size, err := c.flasher.OpenRead(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(reader, partition.HeaderSize), reader}, size, nil
+}
+
+type simDumpReader struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *simDumpReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// simUploadReader throttles the upload like a slow card and injects the
+// configured FlashFailAfterBytes fault (counted on the uploaded bytes).
+type simUploadReader struct {
+	reader    io.Reader
+	failAfter int64
+	total     int64
+}
+
+func (r *simUploadReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.total += int64(n)
+		if r.failAfter > 0 && r.total >= r.failAfter {
+			return n, fmt.Errorf("simulated flash failure after %d bytes", r.failAfter)
 		}
-		if readErr != nil {
-			return readErr
+		time.Sleep(10 * time.Millisecond)
+	}
+	return n, err
+}
+
+// StartDuplication mirrors App.StartDuplication, running the same loop with
+// simSlot for the operator.
+func (c *SimControl) StartDuplication(_ context.Context, imageID string) error {
+	image, err := c.images.Get(imageID)
+	if err != nil {
+		return err
+	}
+	if err := state.GetDuplication().Begin(image.ID, image.Name); err != nil {
+		return err
+	}
+	loopCtx, cancel := context.WithCancel(c.processCtx)
+	done := make(chan struct{})
+	c.duplicationMu.Lock()
+	c.duplicationStop = func() {
+		cancel()
+		<-done
+	}
+	c.duplicationMu.Unlock()
+
+	flashImage := func(ctx context.Context, reader io.Reader, opts flash.Options) error {
+		return c.Flash(ctx, reader, web.FlashRequest{Options: opts})
+	}
+	flashCartridge := duplication.ImageFlash(c.images, imageID, nil, flashImage, c.FlashStatus, c.history)
+	go func() {
+		defer close(done)
+		duplication.Run(loopCtx, simSlot{control: c}, flashCartridge, c.flasher.Status, nil)
+	}()
+	return nil
+}
+
+// simSlot plays the operator swapping cards for duplication.Run: the
+// simulated eject re-inserts a cartridge after 10s.
+type simSlot struct {
+	control *SimControl
+}
+
+func (slot simSlot) Remove(ctx context.Context) bool {
+	for slot.control.info.Snapshot().Present {
+		if err := slot.control.Eject(ctx); err != nil && !sleepContext(ctx, 500*time.Millisecond) {
+			return false
 		}
 	}
+	return ctx.Err() == nil
+}
 
-	c.info.SetMounted(false)
+func (slot simSlot) Insert(ctx context.Context) bool {
+	for !slot.control.info.Snapshot().Present {
+		if !sleepContext(ctx, 200*time.Millisecond) {
+			return false
+		}
+	}
+	return true
+}
+
+// sleepContext waits for delay and reports false when ctx ended first.
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// StopDuplication mirrors App.StopDuplication.
+func (c *SimControl) StopDuplication(ctx context.Context) error {
+	_ = ctx
+	c.duplicationMu.Lock()
+	stop := c.duplicationStop
+	c.duplicationStop = nil
+	c.duplicationMu.Unlock()
+	if stop == nil || !state.GetDuplication().Snapshot().Active {
+		return state.ErrDuplicationNotRunning
+	}
+	stop()
 	return nil
 }
 
+// DuplicationReport mirrors App.DuplicationReport.
+func (c *SimControl) DuplicationReport() state.DuplicationSnapshot {
+	return state.GetDuplication().Snapshot()
+}
+
 type SimCartridgeMounter struct {
 	Control *SimControl
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/rook-computer/keymaker/internal/partition"
+)
+
+// The device changes partition tables with sfdisk (see wipe_sd.sh and
+// provision_sd.sh); the simulator writes the table of its cartridge image
+// file itself.
+
+// partitionDisk is a disk image whose partition table can be rewritten.
+type partitionDisk interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+const (
+	sectorSize       = partition.SectorSize
+	mbrEntriesOffset = 446
+	mbrEntrySize     = 16
+	mbrTypeGPT       = 0xee
+	maxMBRSectors    = 0xffffffff
+	minGPTEntrySize  = 128
+)
+
+// growLastPartition extends the partition that ends last up to the end of a
+// disk of the given size and returns it with its new size. For a GPT the
+// backup header and entries are moved to the new end of the disk. A
+// partition that already reaches the end is returned unchanged. Filesystems
+// are not touched.
+func growLastPartition(disk partitionDisk, diskSize int64) (partition.Partition, error) {
+	header := make([]byte, partition.HeaderSize)
+	if _, err := disk.ReadAt(header, 0); err != nil && !errors.Is(err, io.EOF) {
+		return partition.Partition{}, err
+	}
+	table, err := partition.Parse(header)
+	if err != nil {
+		return partition.Partition{}, err
+	}
+	if len(table.Partitions) == 0 {
+		return partition.Partition{}, errors.New("the partition table is empty")
+	}
+	last := table.Partitions[0]
+	for _, p := range table.Partitions[1:] {
+		if p.End() > last.End() {
+			last = p
+		}
+	}
+	if table.Scheme == partition.SchemeGPT {
+		return growGPT(disk, header, last, diskSize)
+	}
+	return growMBR(disk, header, last, diskSize)
+}
+
+func growMBR(disk partitionDisk, header []byte, last partition.Partition, diskSize int64) (partition.Partition, error) {
+	entry := header[mbrEntriesOffset+(last.Index-1)*mbrEntrySize : mbrEntriesOffset+last.Index*mbrEntrySize]
+	switch entry[4] {
+	case 0x05, 0x0f, 0x85:
+		return partition.Partition{}, errors.New("extended partitions cannot be grown")
+	}
+	sectors := min(diskSize/sectorSize-last.Start/sectorSize, maxMBRSectors)
+	if sectors*sectorSize <= last.Size {
+		return last, nil
+	}
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(sectors))
+	if _, err := disk.WriteAt(header[:sectorSize], 0); err != nil {
+		return partition.Partition{}, err
+	}
+	last.Size = sectors * sectorSize
+	return last, nil
+}
+
+func growGPT(disk partitionDisk, header []byte, last partition.Partition, diskSize int64) (partition.Partition, error) {
+	primary := append([]byte(nil), header[sectorSize:2*sectorSize]...)
+	headerSize := int64(binary.LittleEndian.Uint32(primary[12:16]))
+	entriesLBA := int64(binary.LittleEndian.Uint64(primary[72:80]))
+	entryCount := int64(binary.LittleEndian.Uint32(primary[80:84]))
+	entrySize := int64(binary.LittleEndian.Uint32(primary[84:88]))
+	if headerSize < gptHeaderSize || headerSize > sectorSize {
+		return partition.Partition{}, fmt.Errorf("invalid GPT header size %d", headerSize)
+	}
+	// The entries are rewritten from header, so they must lie in it behind
+	// the GPT header and hold the partition to grow.
+	headerSectors := int64(len(header)) / sectorSize
+	if entriesLBA < 2 || entriesLBA >= headerSectors {
+		return partition.Partition{}, fmt.Errorf("GPT entries at LBA %d outside the first %d sectors", entriesLBA, headerSectors)
+	}
+	if entrySize < minGPTEntrySize || entrySize > sectorSize {
+		return partition.Partition{}, fmt.Errorf("invalid GPT entry size %d", entrySize)
+	}
+	entriesStart := entriesLBA * sectorSize
+	if entryCount < int64(last.Index) || entryCount > (int64(len(header))-entriesStart)/entrySize {
+		return partition.Partition{}, fmt.Errorf("invalid GPT entry count %d", entryCount)
+	}
+	entries := append([]byte(nil), header[entriesStart:entriesStart+entryCount*entrySize]...)
+
+	diskSectors := diskSize / sectorSize
+	entrySectors := (entryCount*entrySize + sectorSize - 1) / sectorSize
+	backupHeaderLBA := diskSectors - 1
+	backupEntriesLBA := backupHeaderLBA - entrySectors
+	lastUsableLBA := backupEntriesLBA - 1
+	lastLBA := last.End()/sectorSize - 1
+	if lastUsableLBA <= lastLBA {
+		return last, nil
+	}
+
+	entry := entries[int64(last.Index-1)*entrySize : int64(last.Index)*entrySize]
+	binary.LittleEndian.PutUint64(entry[40:48], uint64(lastUsableLBA))
+	binary.LittleEndian.PutUint32(primary[88:92], crc32.ChecksumIEEE(entries))
+	binary.LittleEndian.PutUint64(primary[32:40], uint64(backupHeaderLBA))
+	binary.LittleEndian.PutUint64(primary[48:56], uint64(lastUsableLBA))
+	setGPTHeaderCRC(primary, headerSize)
+
+	backup := append([]byte(nil), primary...)
+	binary.LittleEndian.PutUint64(backup[24:32], uint64(backupHeaderLBA))
+	binary.LittleEndian.PutUint64(backup[32:40], 1)
+	binary.LittleEndian.PutUint64(backup[72:80], uint64(backupEntriesLBA))
+	setGPTHeaderCRC(backup, headerSize)
+
+	// The protective MBR covers the whole disk as far as it can.
+	protective := append([]byte(nil), header[:sectorSize]...)
+	for i := 0; i < 4; i++ {
+		if protective[mbrEntriesOffset+i*mbrEntrySize+4] == mbrTypeGPT {
+			sizeField := protective[mbrEntriesOffset+i*mbrEntrySize+12 : mbrEntriesOffset+i*mbrEntrySize+16]
+			binary.LittleEndian.PutUint32(sizeField, uint32(min(diskSectors-1, maxMBRSectors)))
+		}
+	}
+
+	writes := []struct {
+		data   []byte
+		offset int64
+	}{
+		{backup, backupHeaderLBA * sectorSize},
+		{entries, backupEntriesLBA * sectorSize},
+		{entries, entriesStart},
+		{primary, sectorSize},
+		{protective, 0},
+	}
+	for _, write := range writes {
+		if _, err := disk.WriteAt(write.data, write.offset); err != nil {
+			return partition.Partition{}, err
+		}
+	}
+	last.Size = (lastUsableLBA+1)*sectorSize - last.Start
+	return last, nil
+}
+
+func setGPTHeaderCRC(header []byte, headerSize int64) {
+	clear(header[16:20])
+	binary.LittleEndian.PutUint32(header[16:20], crc32.ChecksumIEEE(header[:headerSize]))
+}
+
+// Partition types of the single partition createPartitionTable writes, the
+// ones wipe_sd.sh gives sfdisk.
+const (
+	typeMBRFAT32 = "0x0c"
+	typeMBRExFAT = "0x07"
+	typeMBRLinux = "0x83"
+
+	typeGPTBasicData = "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"
+	typeGPTLinux     = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+)
+
+// partitionAlignment is the start of the partition createPartitionTable
+// writes (1 MiB), which keeps it aligned to the erase blocks of SD cards.
+const partitionAlignment = 1024 * 1024
+
+const (
+	gptEntryCount = 128
+	gptEntrySize  = 128
+	gptHeaderSize = 92
+)
+
+// createPartitionTable writes a new partition table holding a single
+// partition that spans the disk from partitionAlignment to its end. partType
+// is the MBR type ("0x0c") or the GPT type GUID, in the form
+// partition.Parse reports; name is only used by GPT.
+// Any previous table is replaced; the rest of the disk is not touched.
+func createPartitionTable(disk partitionDisk, diskSize int64, scheme partition.Scheme, partType, name string) (partition.Partition, error) {
+	diskSectors := diskSize / sectorSize
+	startLBA := int64(partitionAlignment / sectorSize)
+	switch scheme {
+	case partition.SchemeMBR:
+		if diskSectors <= startLBA {
+			return partition.Partition{}, fmt.Errorf("disk of %d bytes is too small for a partition", diskSize)
+		}
+		return createMBR(disk, diskSectors, startLBA, partType)
+	case partition.SchemeGPT:
+		// The backup entries and header take the last 33 sectors.
+		if diskSectors-33 <= startLBA {
+			return partition.Partition{}, fmt.Errorf("disk of %d bytes is too small for a partition", diskSize)
+		}
+		return createGPT(disk, diskSectors, startLBA, partType, name)
+	default:
+		return partition.Partition{}, fmt.Errorf("unknown partition scheme %q", scheme)
+	}
+}
+
+func createMBR(disk partitionDisk, diskSectors, startLBA int64, partType string) (partition.Partition, error) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(partType), "0x"), 16, 8)
+	if err != nil || value == 0 || value == mbrTypeGPT {
+		return partition.Partition{}, fmt.Errorf("invalid MBR partition type %q", partType)
+	}
+	sectors := min(diskSectors-startLBA, maxMBRSectors)
+
+	mbr := make([]byte, sectorSize)
+	if _, err := rand.Read(mbr[440:444]); err != nil {
+		return partition.Partition{}, err
+	}
+	entry := mbr[mbrEntriesOffset : mbrEntriesOffset+mbrEntrySize]
+	setMBREntry(entry, byte(value), startLBA, sectors)
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if _, err := disk.WriteAt(mbr, 0); err != nil {
+		return partition.Partition{}, err
+	}
+	// Drop a GPT header left behind by a previous table, so the disk is not
+	// mistaken for a GPT disk with a broken protective MBR.
+	if _, err := disk.WriteAt(make([]byte, sectorSize), sectorSize); err != nil {
+		return partition.Partition{}, err
+	}
+	return partition.Partition{Index: 1, Type: fmt.Sprintf("0x%02x", value), Start: startLBA * sectorSize, Size: sectors * sectorSize}, nil
+}
+
+func createGPT(disk partitionDisk, diskSectors, startLBA int64, partType, name string) (partition.Partition, error) {
+	typeGUID, err := parseGUID(partType)
+	if err != nil {
+		return partition.Partition{}, err
+	}
+	diskGUID, partGUID := make([]byte, 16), make([]byte, 16)
+	if err := randomGUID(diskGUID); err != nil {
+		return partition.Partition{}, err
+	}
+	if err := randomGUID(partGUID); err != nil {
+		return partition.Partition{}, err
+	}
+
+	entrySectors := int64(gptEntryCount * gptEntrySize / sectorSize)
+	backupHeaderLBA := diskSectors - 1
+	backupEntriesLBA := backupHeaderLBA - entrySectors
+	lastUsableLBA := backupEntriesLBA - 1
+
+	entries := make([]byte, gptEntryCount*gptEntrySize)
+	entry := entries[:gptEntrySize]
+	copy(entry[0:16], typeGUID)
+	copy(entry[16:32], partGUID)
+	binary.LittleEndian.PutUint64(entry[32:40], uint64(startLBA))
+	binary.LittleEndian.PutUint64(entry[40:48], uint64(lastUsableLBA))
+	for i, unit := range utf16.Encode([]rune(name)) {
+		if i >= 36 {
+			break
+		}
+		binary.LittleEndian.PutUint16(entry[56+2*i:], unit)
+	}
+
+	primary := make([]byte, sectorSize)
+	copy(primary[0:8], "EFI PART")
+	binary.LittleEndian.PutUint32(primary[8:12], 0x00010000)
+	binary.LittleEndian.PutUint32(primary[12:16], gptHeaderSize)
+	binary.LittleEndian.PutUint64(primary[24:32], 1)
+	binary.LittleEndian.PutUint64(primary[32:40], uint64(backupHeaderLBA))
+	binary.LittleEndian.PutUint64(primary[40:48], uint64(2+entrySectors))
+	binary.LittleEndian.PutUint64(primary[48:56], uint64(lastUsableLBA))
+	copy(primary[56:72], diskGUID)
+	binary.LittleEndian.PutUint64(primary[72:80], 2)
+	binary.LittleEndian.PutUint32(primary[80:84], gptEntryCount)
+	binary.LittleEndian.PutUint32(primary[84:88], gptEntrySize)
+	binary.LittleEndian.PutUint32(primary[88:92], crc32.ChecksumIEEE(entries))
+	setGPTHeaderCRC(primary, gptHeaderSize)
+
+	backup := append([]byte(nil), primary...)
+	binary.LittleEndian.PutUint64(backup[24:32], uint64(backupHeaderLBA))
+	binary.LittleEndian.PutUint64(backup[32:40], 1)
+	binary.LittleEndian.PutUint64(backup[72:80], uint64(backupEntriesLBA))
+	setGPTHeaderCRC(backup, gptHeaderSize)
+
+	protective := make([]byte, sectorSize)
+	setMBREntry(protective[mbrEntriesOffset:mbrEntriesOffset+mbrEntrySize], mbrTypeGPT, 1, min(diskSectors-1, maxMBRSectors))
+	protective[510], protective[511] = 0x55, 0xaa
+
+	writes := []struct {
+		data   []byte
+		offset int64
+	}{
+		{backup, backupHeaderLBA * sectorSize},
+		{entries, backupEntriesLBA * sectorSize},
+		{entries, 2 * sectorSize},
+		{primary, sectorSize},
+		{protective, 0},
+	}
+	for _, write := range writes {
+		if _, err := disk.WriteAt(write.data, write.offset); err != nil {
+			return partition.Partition{}, err
+		}
+	}
+	return partition.Partition{
+		Index: 1,
+		Type:  strings.ToUpper(partType),
+		Name:  name,
+		Start: startLBA * sectorSize,
+		Size:  (lastUsableLBA - startLBA + 1) * sectorSize,
+	}, nil
+}
+
+// setMBREntry fills a partition entry. The CHS fields are set to the
+// "use LBA" marker, as for any disk larger than 8 GB.
+func setMBREntry(entry []byte, partType byte, startLBA, sectors int64) {
+	copy(entry[1:4], []byte{0xfe, 0xff, 0xff})
+	entry[4] = partType
+	copy(entry[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[8:12], uint32(startLBA))
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(sectors))
+}
+
+// parseGUID is the inverse of formatGUID.
+func parseGUID(text string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.ReplaceAll(text, "-", ""))
+	if err != nil || len(raw) != 16 || strings.Count(text, "-") != 4 {
+		return nil, fmt.Errorf("invalid GPT partition type %q", text)
+	}
+	// The first three groups are stored little endian.
+	for _, group := range [][2]int{{0, 4}, {4, 6}, {6, 8}} {
+		for i, j := group[0], group[1]-1; i < j; i, j = i+1, j-1 {
+			raw[i], raw[j] = raw[j], raw[i]
+		}
+	}
+	return raw, nil
+}
+
+// randomGUID fills raw with a version 4 GUID in GPT byte order.
+func randomGUID(raw []byte) error {
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	raw[7] = raw[7]&0x0f | 0x40
+	raw[8] = raw[8]&0x3f | 0x80
+	return nil
+}
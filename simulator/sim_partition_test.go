@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rook-computer/keymaker/internal/partition"
+)
+
+const testDiskSize = 8 << 20
+
+// testDisk returns a disk image file of size bytes holding a new table of
+// scheme with one partition that ends at half the disk.
+func testDisk(t *testing.T, scheme partition.Scheme, partType string, size int64) *os.File {
+	t.Helper()
+	disk, err := os.Create(filepath.Join(t.TempDir(), "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = disk.Close() })
+	if _, err := createPartitionTable(disk, size/2, scheme, partType, "data"); err != nil {
+		t.Fatalf("createPartitionTable: %v", err)
+	}
+	if err := disk.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return disk
+}
+
+func readTable(t *testing.T, disk *os.File) *partition.Table {
+	t.Helper()
+	header := make([]byte, partition.HeaderSize)
+	if _, err := disk.ReadAt(header, 0); err != nil {
+		t.Fatal(err)
+	}
+	table, err := partition.Parse(header)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return table
+}
+
+func TestCreatePartitionTable(t *testing.T) {
+	tests := []struct {
+		scheme   partition.Scheme
+		partType string
+		end      int64
+	}{
+		{scheme: partition.SchemeMBR, partType: typeMBRFAT32, end: testDiskSize},
+		{scheme: partition.SchemeMBR, partType: typeMBRLinux, end: testDiskSize},
+		{scheme: partition.SchemeGPT, partType: typeGPTBasicData, end: testDiskSize - 33*sectorSize},
+		{scheme: partition.SchemeGPT, partType: typeGPTLinux, end: testDiskSize - 33*sectorSize},
+	}
+	for _, test := range tests {
+		t.Run(string(test.scheme)+" "+test.partType, func(t *testing.T) {
+			// A table of the other scheme is replaced.
+			other := partition.SchemeGPT
+			otherType := typeGPTLinux
+			if test.scheme == partition.SchemeGPT {
+				other, otherType = partition.SchemeMBR, typeMBRExFAT
+			}
+			disk := testDisk(t, other, otherType, testDiskSize)
+			created, err := createPartitionTable(disk, testDiskSize, test.scheme, test.partType, "KEYMAKER")
+			if err != nil {
+				t.Fatalf("createPartitionTable: %v", err)
+			}
+			table := readTable(t, disk)
+			if table.Scheme != test.scheme || len(table.Partitions) != 1 {
+				t.Fatalf("table: %s with %+v", table.Scheme, table.Partitions)
+			}
+			got := table.Partitions[0]
+			if got.Start != partitionAlignment || got.End() != test.end || got.Type != test.partType {
+				t.Errorf("partition: %+v, want %s from %d to %d", got, test.partType, partitionAlignment, test.end)
+			}
+			if created.Start != got.Start || created.Size != got.Size {
+				t.Errorf("createPartitionTable returned %+v, the table holds %+v", created, got)
+			}
+			if test.scheme == partition.SchemeGPT {
+				backup := make([]byte, 8)
+				if _, err := disk.ReadAt(backup, testDiskSize-sectorSize); err != nil || string(backup) != "EFI PART" {
+					t.Errorf("no backup GPT header in the last sector: %q, %v", backup, err)
+				}
+			}
+		})
+	}
+	if _, err := createPartitionTable(testDisk(t, partition.SchemeMBR, typeMBRFAT32, testDiskSize), partitionAlignment, partition.SchemeMBR, typeMBRFAT32, ""); err == nil {
+		t.Error("createPartitionTable accepted a disk without room for a partition")
+	}
+}
+
+func TestGrowLastPartition(t *testing.T) {
+	tests := []struct {
+		scheme   partition.Scheme
+		partType string
+		// end is where the grown partition ends: the end of the disk, or
+		// the backup GPT entries and header in its last 33 sectors.
+		end int64
+	}{
+		{scheme: partition.SchemeMBR, partType: typeMBRFAT32, end: testDiskSize},
+		{scheme: partition.SchemeGPT, partType: typeGPTLinux, end: testDiskSize - 33*sectorSize},
+	}
+	for _, test := range tests {
+		t.Run(string(test.scheme), func(t *testing.T) {
+			disk := testDisk(t, test.scheme, test.partType, testDiskSize)
+			grown, err := growLastPartition(disk, testDiskSize)
+			if err != nil {
+				t.Fatalf("growLastPartition: %v", err)
+			}
+			if grown.End() != test.end {
+				t.Errorf("grown partition ends at %d, want %d", grown.End(), test.end)
+			}
+			table := readTable(t, disk)
+			if len(table.Partitions) != 1 || table.Partitions[0].End() != test.end {
+				t.Errorf("table after growing: %+v", table.Partitions)
+			}
+
+			again, err := growLastPartition(disk, testDiskSize)
+			if err != nil || again != grown {
+				t.Errorf("growing again: %+v, %v, want it unchanged", again, err)
+			}
+		})
+	}
+}
+
+func TestGrowLastPartitionRejectsBadGPT(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+		value  uint64
+		size   int
+	}{
+		{name: "entries beyond the header", offset: 72, value: 1 << 40, size: 8},
+		{name: "entries over the GPT header", offset: 72, value: 1, size: 8},
+		{name: "entry count overflows", offset: 80, value: 0xffffffff, size: 4},
+		{name: "entry size overflows", offset: 84, value: 0xffffffff, size: 4},
+		{name: "entry size too small", offset: 84, value: 64, size: 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			disk := testDisk(t, partition.SchemeGPT, typeGPTLinux, testDiskSize)
+			field := make([]byte, 8)
+			binary.LittleEndian.PutUint64(field, test.value)
+			if _, err := disk.WriteAt(field[:test.size], int64(sectorSize+test.offset)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := growLastPartition(disk, testDiskSize); err == nil {
+				t.Error("growLastPartition accepted the corrupt GPT header")
+			}
+		})
+	}
+}
@@ -1,5 +1,6 @@
 #!/usr/bin/env python3
 
+import gzip
 import http.client
 import json
 import os
@@ -198,8 +199,19 @@ def main() -> None:
     if delete_resp.get("ok") is not True:
         _fail("DELETE game: expected {ok:true}")
 
+    # flash: unknown formats are rejected before anything is written
+    status, _, body = _request(
+        "POST",
+        base,
+        "/api/v1/flash",
+        body=b"x" * 32,
+        headers={"Content-Type": "application/octet-stream", "Content-Length": "32"},
+    )
+    if status != 415:
+        _fail(f"POST /flash with unknown format: expected 415, got {status}")
+
     # flash: should accept with 202 when Content-Length is present
-    flash_payload = b"x" * 32
+    flash_payload = gzip.compress(b"x" * 32)
     status, _, body = _request(
         "POST",
         base,
@@ -212,6 +224,16 @@ def main() -> None:
     flash_resp = json.loads(body.decode("utf-8"))
     if flash_resp.get("ok") is not True:
         _fail("POST /flash: expected {ok:true}")
+    job_id = flash_resp.get("jobId")
+    if not isinstance(job_id, str) or not job_id:
+        _fail("POST /flash: expected a jobId")
+
+    status, _, body = _request("GET", base, f"/api/v1/jobs/{job_id}")
+    if status != 200:
+        _fail(f"GET /jobs/{job_id}: expected 200, got {status}")
+    job = json.loads(body.decode("utf-8"))
+    if job.get("id") != job_id or job.get("kind") != "flash":
+        _fail(f"GET /jobs/{job_id}: unexpected job {job}")
 
     # flash without Content-Length: should return 411
     status = _request_raw_chunked_status(base, "/api/v1/flash", b"abc")